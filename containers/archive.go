@@ -0,0 +1,259 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// A root filesystem travels as a tar archive: the Alpine minirootfs, `docker export`, and every
+// layer of an image. Unpacking one is where a runtime trusts its input the most, and tar(1)
+// trusts it too much for that. An archive is a list of entries, each with a path, a type, an
+// owner, a mode and for files the content, and any of those can be hostile:
+//
+//	../../etc/cron.d/x      a path that walks out of the target directory
+//	/etc/passwd             an absolute path
+//	lib -> /etc, lib/passwd a symlink first, then a file "inside" it: written through the link,
+//	                        into the host's /etc
+//	lib/x => /etc/shadow    a hard link to a host file, which the container could then read
+//	/dev/sda                a device node, reading it reads the host's disk
+//
+// So every path is cleaned below the target ("/" + path, then cleaned, can't go up), and every
+// directory on the way is resolved like the container would, with resolveInRoot: a symlink to
+// /etc leads to the rootfs's /etc, not the host's. The entry itself is never followed: a symlink
+// already there is replaced, not written through. Hard links point at a path resolved the same
+// way. Device nodes are created only by root, who could create them anyway, and inside the
+// container the devices cgroup decides what may be opened (see devices.go). A rootless unpack
+// skips them, like rootless Docker: mknod() takes CAP_MKNOD on the host.
+
+// unpackResult is what extractTar reports besides errors.
+type unpackResult struct {
+	// SkippedDevices counts the device nodes a rootless unpack can't create
+	SkippedDevices int
+}
+
+// openArchive returns the uncompressed content of a tar archive that may be gzipped, which the
+// first two bytes tell.
+func openArchive(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// extractTar unpacks the tar archive r into the directory dir, which must exist. If r is a layer
+// its whiteouts become overlayfs's, otherwise, for cp, a .wh. file is a file.
+func extractTar(r io.Reader, dir string, layer bool) (unpackResult, error) {
+	var result unpackResult
+	root := os.Geteuid() == 0
+	// The modes and times of directories are set last: a read-only directory would refuse its
+	// entries, and each entry changes the directory's mtime
+	var dirs []unpackedDir
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return result, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			// "./", the rootfs itself
+			continue
+		}
+		target, err := resolveParent(dir, name)
+		if err != nil {
+			return result, err
+		}
+
+		// The markers of deleted files, which become overlayfs's (see overlay.go)
+		if base := path.Base(name); layer && base == whiteoutOpaque {
+			if err := markOpaque(filepath.Dir(target)); err != nil {
+				return result, err
+			}
+			continue
+		} else if layer && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := createWhiteout(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix)); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		// What is in the way goes, unless it's a directory and stays one: a later layer adds
+		// to it
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return result, err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+				return result, err
+			}
+			fi, err := os.Lstat(target)
+			if err != nil {
+				return result, err
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			dirs = append(dirs, unpackedDir{hdr, uint64(st.Dev), st.Ino})
+			continue
+		case tar.TypeReg:
+			if err := writeRegular(target, tr); err != nil {
+				return result, err
+			}
+		case tar.TypeSymlink:
+			// The target can be anything, it is resolved inside the container, or by us in
+			// resolveInRoot
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return result, err
+			}
+		case tar.TypeLink:
+			source, err := resolveParent(dir, path.Clean("/"+hdr.Linkname))
+			if err != nil {
+				return result, err
+			}
+			// Directories can't have more than one name
+			if fi, err := os.Lstat(source); err != nil || fi.IsDir() {
+				return result, fmt.Errorf("%s: hard link to %s, which isn't a file unpacked before it", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Link(source, target); err != nil {
+				return result, err
+			}
+			// A hard link shares the inode, its owner and mode are the other name's
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(syscall.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				mode = syscall.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				mode = syscall.S_IFBLK
+			}
+			if mode != syscall.S_IFIFO && !root {
+				result.SkippedDevices++
+				continue
+			}
+			dev := int((hdr.Devmajor << 8) | (hdr.Devminor & 0xff) | ((hdr.Devminor &^ 0xff) << 12))
+			if err := syscall.Mknod(target, mode|0600, dev); err != nil {
+				return result, fmt.Errorf("mknod %s: %w", hdr.Name, err)
+			}
+		default:
+			// Other types, like GNU sparse files, don't appear in root filesystems
+			continue
+		}
+		if err := applyHeader(target, hdr, root); err != nil {
+			return result, err
+		}
+	}
+
+	// The deepest first: setting the times of a directory before its subdirectories' would
+	// change them again
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		target, err := resolveParent(dir, path.Clean("/"+d.hdr.Name))
+		if err != nil {
+			return result, err
+		}
+		// A later entry may have replaced the directory, with a symlink to a host directory
+		// for example, which chmod and chtimes would follow. Only the directory we made gets
+		// the header, a replacement has its own.
+		fi, err := os.Lstat(target)
+		if err != nil {
+			continue
+		}
+		if st := fi.Sys().(*syscall.Stat_t); !fi.IsDir() || uint64(st.Dev) != d.dev || st.Ino != d.ino {
+			continue
+		}
+		if err := applyHeader(target, d.hdr, root); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// unpackedDir is a directory extractTar made, and which one it is, to find it again for its
+// mode and times.
+type unpackedDir struct {
+	hdr *tar.Header
+	dev uint64
+	ino uint64
+}
+
+// resolveParent returns where the entry name of an archive goes below dir: its directory
+// resolved inside dir, and the name itself, not followed, because the entry replaces it.
+func resolveParent(dir, name string) (string, error) {
+	parent, err := resolveInRoot(dir, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	// A parent might be a file, or a symlink to one
+	if fi, err := os.Stat(parent); err != nil || !fi.IsDir() {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// writeRegular writes the content of a regular file, readable only by us until applyHeader sets
+// the mode.
+func writeRegular(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// applyHeader gives target the owner, mode and modification time of hdr. Only root can give a
+// file away, a rootless unpack owns everything, which is root inside the user namespace.
+func applyHeader(target string, hdr *tar.Header, root bool) error {
+	if root {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// A symlink has no mode of its own, and chmod would follow it. Its time needs utimensat
+	// with AT_SYMLINK_NOFOLLOW, which the syscall package doesn't have: it gets the unpack's.
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// After chown, which clears the setuid and setgid bits. os.FileMode has its own bits for
+	// them, the header's mode has the kernel's.
+	mode := os.FileMode(hdr.Mode & 0777)
+	if hdr.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Every interface sends through a queueing discipline, a qdisc: the kernel hands it the packets
+// to send, the qdisc decides which goes next and when. `tc` (traffic control) configures them.
+// The default just sends everything as fast as it can; tbf, the token bucket filter, sends at a
+// rate. Tokens drip into a bucket at the rate, every byte sent takes one, and a packet that finds
+// too few tokens waits in the queue, or is dropped when the queue is full:
+//
+//	rate   how fast the tokens come, the limit
+//	burst  the size of the bucket: an idle interface may send this much at once
+//	limit  the bytes that may wait for tokens, more are dropped
+//
+// A qdisc only sees what an interface sends, not what it receives. That's why we limit each
+// direction on the end of the veth pair that sends it: what the host end sends arrives in the
+// container (ingress), what the container's eth0 sends leaves it (egress). Kubernetes' bandwidth
+// plugin does the same for ingress; for egress it redirects what the host end receives to an ifb
+// device and limits that one, out of reach of a container with CAP_NET_ADMIN, which could delete
+// the qdisc on its own eth0. Containers don't have CAP_NET_ADMIN here without --cap-add.
+//
+// htb, the hierarchical token bucket, would split a rate into classes, for a share per client or
+// port; one limit per direction is what tbf does alone.
+
+// Attributes of RTM_NEWQDISC, from <linux/rtnetlink.h> and <linux/pkt_sched.h>
+const (
+	tcaKind    = 1 // TCA_KIND: "tbf", "htb", ...
+	tcaOptions = 2 // TCA_OPTIONS: the settings of that kind
+
+	tcaTbfParms  = 1 // TCA_TBF_PARMS, in TCA_OPTIONS: struct tc_tbf_qopt
+	tcaTbfRate64 = 4 // TCA_TBF_RATE64: the rate when it doesn't fit the 32 bits in tc_tbf_qopt
+	tcaTbfBurst  = 6 // TCA_TBF_BURST: the size of the bucket in bytes
+
+	tcHRoot             = 0xffffffff // TC_H_ROOT: the qdisc of the interface itself
+	tcLinklayerEthernet = 1          // TC_LINKLAYER_ETHERNET: the rate counts whole frames
+)
+
+// bandwidthLatency is how long a packet may wait for tokens, which makes up the queue's limit
+// with the burst, like `tc qdisc add ... tbf latency 50ms`.
+const bandwidthLatency = 20 // 1/20 second
+
+// parseBandwidth parses a --network-bandwidth value: RATE for both directions, or ingress=RATE
+// and egress=RATE, separated by commas.
+func parseBandwidth(cfg *containerConfig, v string) error {
+	for _, part := range strings.Split(v, ",") {
+		direction, rateStr, ok := strings.Cut(part, "=")
+		if !ok {
+			direction, rateStr = "", part
+		}
+		rate, err := parseBitRate(rateStr)
+		if err != nil {
+			return err
+		}
+		switch direction {
+		case "ingress":
+			cfg.IngressBandwidth = rate
+		case "egress":
+			cfg.EgressBandwidth = rate
+		case "":
+			cfg.IngressBandwidth, cfg.EgressBandwidth = rate, rate
+		default:
+			return fmt.Errorf("unknown direction %q, expected ingress or egress", direction)
+		}
+	}
+	return nil
+}
+
+// parseBitRate turns rates like tc's "10mbit" into bits per second. The suffixes are powers of
+// 1000, like for network speeds: k, m and g, with an optional "bit". A bare number is bits.
+func parseBitRate(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "bit")
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			multiplier = 1e3
+		case 'm':
+			multiplier = 1e6
+		case 'g':
+			multiplier = 1e9
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, errors.New("expected a rate like 500kbit, 10mbit or 1gbit")
+	}
+	// tbf counts bytes
+	if n*multiplier < 8 {
+		return 0, errors.New("must be at least 8bit, a byte per second")
+	}
+	return n * multiplier, nil
+}
+
+// formatBitRate is the opposite of parseBitRate, for output: 10000000 becomes "10mbit".
+func formatBitRate(rate uint64) string {
+	for _, u := range []struct {
+		suffix string
+		value  uint64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}} {
+		if rate >= u.value && rate%u.value == 0 {
+			return fmt.Sprintf("%d%s", rate/u.value, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dbit", rate)
+}
+
+// limitBandwidth installs the limits of --network-bandwidth on the veth pair of the container
+// whose init is process pid: veth is the host end, eth0 the container's.
+func limitBandwidth(nl *netlinkConn, cfg *containerConfig, veth string, pid int) error {
+	if cfg.IngressBandwidth > 0 {
+		if err := nl.addTBF(veth, cfg.IngressBandwidth); err != nil {
+			return err
+		}
+	}
+	if cfg.EgressBandwidth == 0 {
+		return nil
+	}
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return fmt.Errorf("open network namespace: %w", err)
+	}
+	defer ns.Close()
+	return inNetworkNamespace(ns, func() error {
+		nl, err := openNetlink(syscall.NETLINK_ROUTE)
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		return nl.addTBF("eth0", cfg.EgressBandwidth)
+	})
+}
+
+// addTBF makes a tbf qdisc with rate (bits per second) the root qdisc of interface name, like
+// `tc qdisc replace dev NAME root tbf rate RATE burst BURST latency 50ms`.
+func (c *netlinkConn) addTBF(name string, rate uint64) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	bytesPerSecond := rate / 8
+	// 10ms worth of the rate, but at least a few full frames: a bucket smaller than a packet never
+	// lets it through
+	burst := max(bytesPerSecond/100, 16<<10)
+	limit := min(bytesPerSecond/bandwidthLatency+burst, math.MaxUint32)
+
+	// struct tcmsg: family, padding, ifindex, handle, parent, info. Handle 1:0, the handle of a
+	// root qdisc in `tc qdisc show`.
+	msg := make([]byte, 20)
+	binary.NativeEndian.PutUint32(msg[4:], uint32(link.Index))
+	binary.NativeEndian.PutUint32(msg[8:], 1<<16)
+	binary.NativeEndian.PutUint32(msg[12:], tcHRoot)
+
+	// struct tc_tbf_qopt: the rate and peak rate, each a tc_ratespec (cell_log, linklayer,
+	// overhead, cell_align, mpu, rate), then limit, buffer and mtu. Without a peak rate the mtu
+	// doesn't matter, and TCA_TBF_BURST replaces the buffer, which is in the kernel's time units.
+	// With the link layer set the kernel needs no table of the time each packet size takes.
+	qopt := make([]byte, 36)
+	qopt[1] = tcLinklayerEthernet
+	binary.NativeEndian.PutUint32(qopt[8:], uint32(min(bytesPerSecond, math.MaxUint32)))
+	binary.NativeEndian.PutUint32(qopt[24:], uint32(limit))
+	options := [][]byte{nlAttr(tcaTbfParms, qopt), nlAttr(tcaTbfBurst, nlUint32(uint32(burst)))}
+	if bytesPerSecond > math.MaxUint32 {
+		options = append(options, nlAttr(tcaTbfRate64, binary.NativeEndian.AppendUint64(nil, bytesPerSecond)))
+	}
+
+	err = c.request(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, msg,
+		nlAttr(tcaKind, nlString("tbf")),
+		nlAttr(tcaOptions, options...))
+	if err != nil {
+		return fmt.Errorf("limit %s to %s: %w", name, formatBitRate(rate), err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Images share layers: every image built FROM alpine starts with alpine's layer, the same bytes
+// with the same digest. The blob store keeps each of them once, under its digest, like a
+// registry does and containerd's content store:
+//
+//	/var/lib/mycontainer/images/
+//	  blobs/sha256/<hex>        a config or a layer, as it was downloaded (or imported)
+//	  <image ID>/manifest.json  the manifest of the image: its config and layers, by digest
+//
+// A pull downloads only the layers the store doesn't have yet: "Already exists". Each image
+// names its blobs in its manifest, and a blob is referenced as often as images name it. `rmi`
+// deletes an image, and then the blobs no image references any more. The count isn't kept in a
+// file, it is made by reading the manifests, under the lock of the store: a count in a file can
+// be wrong after a crash, the manifests can't.
+//
+// The name of a blob is the sha256 of its content, which we compute while we write it. So a
+// file in the store always has the content its name says, and a download that doesn't is an
+// error.
+
+// The media types of an image's config and layers
+const (
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// blobRoot is the directory of the blobs.
+func blobRoot() string {
+	return filepath.Join(imageRoot(), "blobs", "sha256")
+}
+
+// blobPath returns the file of the blob with digest. The digest comes from a manifest, which
+// could say anything: only "sha256:" and hex digits make a file name.
+func blobPath(digest string) (string, error) {
+	if !referenceDigest.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(blobRoot(), strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+// hasBlob tells whether the store has the blob with digest.
+func hasBlob(digest string) bool {
+	path, err := blobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// blobWriter writes a blob whose digest is known once it's complete. It goes to a temporary file,
+// and commit renames it to its digest: a blob is in the store complete, or not at all.
+type blobWriter struct {
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+// newBlobWriter starts a blob. The lock of the store must be taken, or it's garbage for rmi.
+func newBlobWriter() (*blobWriter, error) {
+	if err := os.MkdirAll(blobRoot(), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(blobRoot(), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{file: file, hash: sha256.New()}, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// commit puts the blob into the store and returns its digest.
+func (w *blobWriter) commit() (string, error) {
+	digest := "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+	path, _ := blobPath(digest)
+	if err := w.file.Sync(); err != nil {
+		w.discard()
+		return "", err
+	}
+	if err := w.file.Close(); err != nil {
+		w.discard()
+		return "", err
+	}
+	if err := os.Rename(w.file.Name(), path); err != nil {
+		w.discard()
+		return "", err
+	}
+	return digest, nil
+}
+
+// discard throws the blob away.
+func (w *blobWriter) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// writeBlob stores data as a blob and returns its digest.
+func writeBlob(data []byte) (string, error) {
+	w, err := newBlobWriter()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.discard()
+		return "", err
+	}
+	return w.commit()
+}
+
+// openBlob opens the blob with digest for reading.
+func openBlob(digest string) (*os.File, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// partialPrefix starts the names of the downloads an interruption stopped, .partial-<hex> for
+// the blob <hex> (see download.go)
+const partialPrefix = ".partial-"
+
+// resumeBlobWriter goes on with the download of the blob with digest where the last one stopped,
+// or starts it. What it wrote stays for the next one, until commit or discard. The lock of the
+// store must be taken.
+func resumeBlobWriter(digest string) (*blobWriter, error) {
+	if _, err := blobPath(digest); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(blobRoot(), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(blobRoot(), partialPrefix+strings.TrimPrefix(digest, "sha256:")), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// The digest is of all of it: the bytes we have go into the hash first, and the file is
+	// written at its end from then on
+	w := &blobWriter{file: file, hash: sha256.New()}
+	if w.size, err = io.Copy(w.hash, file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// restart throws away what was written, for a download that starts over.
+func (w *blobWriter) restart() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.hash.Reset()
+	w.size = 0
+	return nil
+}
+
+// suspend closes the blob and keeps what was written, for a download that goes on later.
+func (w *blobWriter) suspend() {
+	w.file.Close()
+}
+
+// commitAs puts the blob into the store if it is the blob desc describes, by its size and
+// digest, and throws it away if it isn't.
+func (w *blobWriter) commitAs(desc ociDescriptor) error {
+	if w.size > desc.Size {
+		w.discard()
+		return fmt.Errorf("the content has more than %d bytes", desc.Size)
+	} else if w.size < desc.Size {
+		w.discard()
+		return fmt.Errorf("the content has %d bytes, not %d", w.size, desc.Size)
+	}
+	got := "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+	if got != desc.Digest {
+		w.discard()
+		return fmt.Errorf("the content has the digest %s, not %s", got, desc.Digest)
+	}
+	_, err := w.commit()
+	return err
+}
+
+// readImageManifest reads the manifest of the image with id.
+func readImageManifest(id string) (*ociManifest, error) {
+	data, err := os.ReadFile(filepath.Join(imageDir(id), "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %w", shortID(id), err)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("image %s: %w", shortID(id), err)
+	}
+	return &m, nil
+}
+
+// imageIDs returns the IDs of the images in the store, with a name or without.
+func imageIDs() ([]string, error) {
+	entries, err := os.ReadDir(imageRoot())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		// The image directories are the ones named like a digest, not blobs/ or a pull's
+		if entry.IsDir() && referenceDigest.MatchString("sha256:"+entry.Name()) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// blobRefs counts how many images reference each blob. The lock of the store must be taken.
+func blobRefs() (map[string]int, error) {
+	ids, err := imageIDs()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]int{}
+	for _, id := range ids {
+		m, err := readImageManifest(id)
+		if errors.Is(err, os.ErrNotExist) {
+			// An image from before the blob store, it has its rootfs only
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		refs[m.Config.Digest]++
+		for _, layer := range m.Layers {
+			refs[layer.Digest]++
+		}
+	}
+	return refs, nil
+}
+
+// removeUnreferencedBlobs deletes the blobs no image references, their unpacked layers, and what
+// an interrupted pull left behind, and returns the digests and the bytes of blobs it freed. The
+// lock of the store must be taken.
+func removeUnreferencedBlobs() (removed []string, freed int64, err error) {
+	refs, err := blobRefs()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, dir := range []string{imageRoot(), filepath.Join(imageRoot(), "layers")} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, 0, err
+		}
+		for _, entry := range entries {
+			unreferenced := dir != imageRoot() && refs["sha256:"+entry.Name()] == 0
+			if strings.HasPrefix(entry.Name(), ".tmp-") || unreferenced {
+				if err := removeTree(filepath.Join(dir, entry.Name())); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+	entries, err := os.ReadDir(blobRoot())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range entries {
+		digest := "sha256:" + entry.Name()
+		if refs[digest] > 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return removed, freed, err
+		}
+		if err := os.Remove(filepath.Join(blobRoot(), entry.Name())); err != nil {
+			return removed, freed, err
+		}
+		freed += info.Size()
+		if !strings.HasPrefix(entry.Name(), ".tmp-") && !strings.HasPrefix(entry.Name(), partialPrefix) {
+			removed = append(removed, digest)
+		}
+	}
+	return removed, freed, nil
+}
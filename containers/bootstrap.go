@@ -0,0 +1,247 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A first container needs a root filesystem, and until now the reader had to download the Alpine
+// minirootfs and unpack it by hand (see Readme.md), or know what to pull. `bootstrap` gets one of
+// two small, well-known ones into the image store, checked, with one command:
+//
+//	bootstrap alpine     the minirootfs of an Alpine release, a tarball of 3 MB from Alpine's
+//	                     servers, checked against the sha256 Alpine publishes next to it
+//	bootstrap busybox    the official busybox image of Docker Hub, 2 MB: pull checks its digests
+//
+// Both are pinned versions, not "latest": the same command gets the same files next year, and a
+// checksum means something only for a file that doesn't change. The image gets the version as
+// its tag and latest, so `run alpine /bin/sh` finds it without asking a registry.
+//
+// The sha256 of the minirootfs comes from the same server as the file. That catches a download
+// that broke or was cut short, not a server that lies. Whoever wants more pins it:
+// `bootstrap --sha256 HEX alpine` wants exactly that file, and for busybox the digest of the
+// manifest, like `pull busybox@sha256:HEX`. bootstrap prints the checksum it got, to write down.
+
+// alpineVersion is the Alpine release of `bootstrap alpine`
+const alpineVersion = "3.20.3"
+
+// busyboxVersion is the tag of the busybox image of `bootstrap busybox`
+const busyboxVersion = "1.36.1"
+
+// alpineMirror is where `bootstrap alpine` downloads from, and alpineMirrorEnv the environment
+// variable for another mirror, like one in the classroom
+const (
+	alpineMirror    = "https://dl-cdn.alpinelinux.org/alpine"
+	alpineMirrorEnv = "CONTAINER_ALPINE_MIRROR"
+)
+
+// maxRootfsTarball is what we download at most, a minirootfs is a few MB
+const maxRootfsTarball = 64 << 20
+
+// alpineArchitectures maps our platforms to the names of Alpine's release directories.
+var alpineArchitectures = map[string]string{
+	"linux/amd64":   "x86_64",
+	"linux/arm64":   "aarch64",
+	"linux/arm/v7":  "armv7",
+	"linux/arm/v6":  "armhf",
+	"linux/386":     "x86",
+	"linux/ppc64le": "ppc64le",
+	"linux/s390x":   "s390x",
+	"linux/riscv64": "riscv64",
+}
+
+// bootstrap implements `bootstrap [--sha256 HEX] busybox|alpine [NAME]`.
+func bootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bootstrap [OPTIONS] busybox|alpine [NAME]\n\nDownload a minimal root filesystem into the image store: busybox %s from Docker Hub, or the\nminirootfs of Alpine %s. It is called busybox or alpine, with the version and latest as tags,\nunless NAME is given.\n\nOptions:\n", progName(), busyboxVersion, alpineVersion)
+		fs.PrintDefaults()
+	}
+	want := fs.String("sha256", "", "the checksum the download must have, `HEX`: of the alpine tarball, of the busybox manifest")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		return usageErrorf(fs, "expected busybox or alpine, and maybe a NAME")
+	}
+	*want = strings.TrimPrefix(strings.ToLower(*want), "sha256:")
+	if *want != "" && !referenceDigest.MatchString("sha256:"+*want) {
+		return usageErrorf(fs, "invalid --sha256 %q, expected 64 hex digits", *want)
+	}
+	var names []string
+	switch fs.Arg(0) {
+	case "alpine":
+		names = []string{"alpine:" + alpineVersion, "alpine:latest"}
+	case "busybox":
+		names = []string{"busybox:" + busyboxVersion, "busybox:latest"}
+	default:
+		return usageErrorf(fs, "unknown root filesystem %q, expected busybox or alpine", fs.Arg(0))
+	}
+	if fs.NArg() == 2 {
+		name, err := normalizeImageName(fs.Arg(1))
+		if err != nil {
+			return usageErrorf(fs, "%v", err)
+		}
+		names = []string{name}
+	}
+
+	var id string
+	var err error
+	if fs.Arg(0) == "alpine" {
+		id, err = bootstrapAlpine(*want, names[0])
+	} else {
+		id, err = bootstrapBusybox(*want, names[0])
+	}
+	if err != nil {
+		return err
+	}
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, name := range names[1:] {
+		if err := tagImage(name, id); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Tagged %s\n", strings.Join(names, ", "))
+	fmt.Println("sha256:" + id)
+	return nil
+}
+
+// bootstrapAlpine downloads the minirootfs of alpineVersion for this machine, checks it, and
+// imports it as name. want is the sha256 it must have, if not empty. It returns the image ID.
+func bootstrapAlpine(want, name string) (string, error) {
+	arch, ok := alpineArchitectures[hostPlatform().String()]
+	if !ok {
+		return "", fmt.Errorf("there is no Alpine minirootfs for %s, try bootstrap busybox", hostPlatform())
+	}
+	branch := "v" + alpineVersion[:strings.LastIndex(alpineVersion, ".")]
+	file := fmt.Sprintf("alpine-minirootfs-%s-%s.tar.gz", alpineVersion, arch)
+	url := fmt.Sprintf("%s/%s/releases/%s/%s", strings.TrimSuffix(envOr(alpineMirrorEnv, alpineMirror), "/"), branch, arch, file)
+
+	// Checked before anything is unpacked, so into a file first
+	fmt.Println("Downloading " + url)
+	tmp, err := os.CreateTemp("", "bootstrap-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	body, err := httpGet(url)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, maxRootfsTarball+1))
+	body.Close()
+	if err != nil {
+		return "", fmt.Errorf("download %s: %w", url, err)
+	}
+	if n > maxRootfsTarball {
+		return "", fmt.Errorf("download %s: more than %s, that's no minirootfs", url, formatBytes(maxRootfsTarball))
+	}
+	got := hex.EncodeToString(hash.Sum(nil))
+
+	if want == "" {
+		if want, err = publishedSHA256(url+".sha256", file); err != nil {
+			return "", err
+		}
+	}
+	if got != want {
+		return "", fmt.Errorf("%s has the sha256 %s, not %s: the download is broken, or not the file it should be", file, got, want)
+	}
+	fmt.Printf("Verified sha256:%s (%s)\n", got, formatBytes(n))
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	unlock, err := lockImages()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	id, err := importTarball(tmp, name, "bootstrap alpine "+file, []string{"/bin/sh"})
+	if err != nil {
+		return "", fmt.Errorf("unpack %s: %w", file, err)
+	}
+	return id, nil
+}
+
+// publishedSHA256 reads the checksum of file from the sha256sum output at url.
+func publishedSHA256(url, file string) (string, error) {
+	body, err := httpGet(url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("download %s: %w", url, err)
+	}
+	// "<hex>  alpine-minirootfs-3.20.3-x86_64.tar.gz"
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == file && referenceDigest.MatchString("sha256:"+fields[0]) {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("%s has no sha256 of %s", url, file)
+}
+
+// httpGet starts the download of url. Anything but 200 is an error. Close the body.
+func httpGet(url string) (io.ReadCloser, error) {
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+	}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// bootstrapBusybox pulls the busybox image of busyboxVersion, or the one with the manifest digest
+// want, and calls it name. It returns the image ID.
+func bootstrapBusybox(want, name string) (string, error) {
+	ref, err := parseReference("busybox:" + busyboxVersion)
+	if err != nil {
+		return "", err
+	}
+	if want != "" {
+		ref.Tag, ref.Digest = "", "sha256:"+want
+	}
+	id, err := pullImage(ref, hostPlatform(), nil, os.Stdout)
+	if err != nil {
+		return "", err
+	}
+	if name == ref.String() {
+		return id, nil
+	}
+	unlock, err := lockImages()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return id, tagImage(name, id)
+}
@@ -0,0 +1,841 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// `build` makes an image from a Dockerfile, the way Docker's classic builder did before BuildKit:
+// every instruction starts from the image the one before made, and makes the next.
+//
+//	FROM alpine            the layers and the config of alpine (FROM scratch: none)
+//	RUN apk add curl       a container of the image so far runs the command, and what it
+//	                       changed, the upper/ of its overlay (see overlay.go), is the next layer
+//	COPY app.sh /usr/bin/  files of the build context, packed into the next layer
+//	ENV, CMD, WORKDIR      only the config changes (WORKDIR adds a layer with the directory if
+//	                       the image hasn't got it)
+//
+// That's the whole story of images: a layer is a diff, an image is a stack of them plus a config,
+// a container is the stack with one more, writable layer on top. The image after each step goes
+// into the store without a name, and is printed (" ---> 5d2c4a1b3e7f") like the classic builder
+// did. Only the last one stays once the build is done.
+//
+// upper/ is the diff in overlayfs's format: a deleted file is a whiteout, a character device 0:0,
+// and a directory that replaced one of the layers below is opaque. A layer tar says the same with
+// the .wh. files of the OCI spec. The files the runtime puts into every container, /etc/hostname,
+// /etc/hosts, /etc/resolv.conf and the mount points /proc, /dev and /sys, are left out: Docker
+// mounts them into the container too, and they aren't the command's doing. With --snapshotter vfs
+// the RUN works in a copy of the image instead, and the diff is what the copy has that the layers
+// haven't (see snapshot.go).
+
+// buildRuntimeFiles are the paths of a container's changes that are the runtime's, not the command's
+var buildRuntimeFiles = map[string]bool{
+	"etc/hostname": true, "etc/hosts": true, "etc/resolv.conf": true,
+	"proc": true, "dev": true, "sys": true,
+}
+
+// dockerfileStep is an instruction of a Dockerfile.
+type dockerfileStep struct {
+	Line        int
+	Instruction string
+	// Args is everything after the instruction, Exec the arguments if they were a JSON array,
+	// the exec form: RUN ["apk", "add", "curl"]
+	Args string
+	Exec []string
+}
+
+// rawConfig is a JSON object, an image config or its "config", with the fields we don't know
+// kept the way they were.
+type rawConfig map[string]json.RawMessage
+
+// get reads the field key into v, and leaves v if there is none.
+func (c rawConfig) get(key string, v any) error {
+	if raw, ok := c[key]; ok {
+		return json.Unmarshal(raw, v)
+	}
+	return nil
+}
+
+// set sets the field key to v.
+func (c rawConfig) set(key string, v any) {
+	data, _ := json.Marshal(v)
+	c[key] = data
+}
+
+// builder is the state of a build: the image so far.
+type builder struct {
+	context string
+	config  rawConfig
+	// run is the "config" of config, the defaults for running the image
+	run     rawConfig
+	layers  []ociDescriptor
+	diffIDs []string
+	history []json.RawMessage
+	// id is the image of the last step, created the IDs of the images the build added
+	id      string
+	created []string
+	// snapshotter makes the roots of the RUN containers (see snapshot.go)
+	snapshotter string
+}
+
+// build implements `build [-t NAME] [-f FILE] CONTEXT`.
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s build [OPTIONS] CONTEXT\n\nBuild an image from the Dockerfile in the directory CONTEXT. It knows FROM, RUN, COPY, ENV, CMD and WORKDIR.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var tags stringList
+	fs.Var(&tags, "t", "name the image `NAME[:TAG]` (repeatable)")
+	fs.Var(&tags, "tag", "same as -t")
+	file := fs.String("f", "", "the `Dockerfile` (default CONTEXT/Dockerfile)")
+	fs.StringVar(file, "file", "", "same as -f")
+	snapshotter := fs.String("snapshotter", envOr(snapshotterEnv, defaultSnapshotter), "how the RUN containers get their root: "+snapshotterNames()+" (env "+snapshotterEnv+")")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected CONTEXT, the directory with the files for COPY")
+	}
+	if _, ok := snapshotters[*snapshotter]; !ok {
+		return usageErrorf(fs, "unknown --snapshotter %q, expected %s", *snapshotter, snapshotterNames())
+	}
+	var names []string
+	for _, tag := range tags {
+		name, err := normalizeImageName(tag)
+		if err != nil {
+			return usageErrorf(fs, "invalid -t %q: %v", tag, err)
+		}
+		names = append(names, name)
+	}
+	context, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(context); err != nil || !fi.IsDir() {
+		return fmt.Errorf("the build context %s is no directory", fs.Arg(0))
+	}
+	if *file == "" {
+		*file = filepath.Join(context, "Dockerfile")
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	steps, err := parseDockerfile(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+	if len(steps) == 0 || steps[0].Instruction != "FROM" {
+		return fmt.Errorf("%s: the first instruction must be FROM", *file)
+	}
+
+	b := &builder{context: context, snapshotter: *snapshotter}
+	keep := ""
+	defer func() { b.removeIntermediates(keep) }()
+	for i, step := range steps {
+		fmt.Printf("Step %d/%d : %s %s\n", i+1, len(steps), step.Instruction, step.Args)
+		if err := b.step(step); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", filepath.Base(*file), step.Line, step.Instruction, err)
+		}
+		fmt.Printf(" ---> %s\n", shortID(b.id))
+	}
+
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, name := range names {
+		if err := tagImage(name, b.id); err != nil {
+			return err
+		}
+	}
+	keep = b.id
+	fmt.Printf("Successfully built %s\n", shortID(b.id))
+	for _, name := range names {
+		fmt.Printf("Successfully tagged %s\n", name)
+	}
+	return nil
+}
+
+// parseDockerfile parses the instructions of a Dockerfile. A line that ends with a backslash goes
+// on in the next one, comments start with #.
+func parseDockerfile(data string) ([]dockerfileStep, error) {
+	var steps []dockerfileStep
+	var cont *dockerfileStep
+	for n, line := range strings.Split(data, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || (trimmed == "" && cont == nil) {
+			continue
+		}
+		text, more := strings.CutSuffix(trimmed, "\\")
+		if cont != nil {
+			cont.Args += " " + strings.TrimSpace(text)
+		} else {
+			instruction, args, _ := strings.Cut(text, " ")
+			steps = append(steps, dockerfileStep{Line: n + 1, Instruction: strings.ToUpper(instruction), Args: strings.TrimSpace(args)})
+			cont = &steps[len(steps)-1]
+		}
+		if !more {
+			cont = nil
+		}
+	}
+	for i := range steps {
+		step := &steps[i]
+		step.Args = strings.TrimSpace(step.Args)
+		switch step.Instruction {
+		case "FROM", "RUN", "COPY", "ENV", "CMD", "WORKDIR":
+		default:
+			return nil, fmt.Errorf("line %d: %s is not supported, only FROM, RUN, COPY, ENV, CMD and WORKDIR", step.Line, step.Instruction)
+		}
+		if step.Args == "" {
+			return nil, fmt.Errorf("line %d: %s needs arguments", step.Line, step.Instruction)
+		}
+		// Not JSON is the shell form, like Docker takes it
+		if strings.HasPrefix(step.Args, "[") {
+			var exec []string
+			if json.Unmarshal([]byte(step.Args), &exec) == nil && len(exec) > 0 {
+				step.Exec = exec
+			}
+		}
+	}
+	return steps, nil
+}
+
+// step runs one instruction.
+func (b *builder) step(step dockerfileStep) error {
+	switch step.Instruction {
+	case "FROM":
+		if b.config != nil {
+			return errors.New("there is one FROM only, multi-stage builds are not supported")
+		}
+		return b.from(step.Args)
+	case "ENV":
+		return b.env(step.Args)
+	case "CMD":
+		cmd := step.Exec
+		if cmd == nil {
+			cmd = []string{"/bin/sh", "-c", step.Args}
+		}
+		b.run.set("Cmd", cmd)
+		return b.commit(imageHistory{CreatedBy: "CMD " + formatCommand(cmd)}, nil)
+	case "WORKDIR":
+		return b.workdir(b.expand(step.Args))
+	case "COPY":
+		words := step.Exec
+		if words == nil {
+			words = splitWords(step.Args)
+		}
+		return b.copy(words)
+	case "RUN":
+		return b.runCommand(step)
+	}
+	return nil
+}
+
+// from starts with the image name, or with nothing for scratch.
+func (b *builder) from(args string) error {
+	name := args
+	if strings.ContainsAny(name, " \t") {
+		return errors.New("FROM takes an image only, FROM ... AS for multi-stage builds is not supported")
+	}
+	if name == "scratch" {
+		host := hostPlatform()
+		b.config, b.run = rawConfig{}, rawConfig{}
+		b.config.set("architecture", host.Architecture)
+		if host.Variant != "" {
+			b.config.set("variant", host.Variant)
+		}
+		b.config.set("os", host.OS)
+		return b.commit(imageHistory{}, nil)
+	}
+	id, _, err := findOrPullImage(name, nil)
+	if err != nil {
+		return err
+	}
+	m, err := readImageManifest(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("the image %s is from before the blob store, pull or import it again", name)
+	} else if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(imageDir(id), "config.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &b.config); err != nil {
+		return fmt.Errorf("config of %s: %w", name, err)
+	}
+	b.run = rawConfig{}
+	var rootfs struct {
+		DiffIDs []string `json:"diff_ids"`
+	}
+	if err := errors.Join(b.config.get("config", &b.run), b.config.get("rootfs", &rootfs), b.config.get("history", &b.history)); err != nil {
+		return fmt.Errorf("config of %s: %w", name, err)
+	}
+	// The base image is the image of this step already
+	b.layers, b.diffIDs, b.id = m.Layers, rootfs.DiffIDs, id
+	return nil
+}
+
+// env sets variables, KEY=VALUE ... or the older KEY VALUE.
+func (b *builder) env(args string) error {
+	var pairs [][2]string
+	words := splitWords(args)
+	if !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		pairs = append(pairs, [2]string{key, strings.TrimSpace(value)})
+	} else {
+		for _, word := range words {
+			key, value, ok := strings.Cut(word, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("%q is not KEY=VALUE", word)
+			}
+			pairs = append(pairs, [2]string{key, value})
+		}
+	}
+	var env []string
+	if err := b.run.get("Env", &env); err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		// $OTHER is the value of the variables before, like in Docker
+		entry := pair[0] + "=" + b.expand(pair[1])
+		replaced := false
+		for i, e := range env {
+			if strings.HasPrefix(e, pair[0]+"=") {
+				env[i], replaced = entry, true
+			}
+		}
+		if !replaced {
+			env = append(env, entry)
+		}
+	}
+	b.run.set("Env", env)
+	return b.commit(imageHistory{CreatedBy: "ENV " + args}, nil)
+}
+
+// workdir sets the working directory, and creates it if the image hasn't got it.
+func (b *builder) workdir(dir string) error {
+	dir = b.resolvePath(dir)
+	b.run.set("WorkingDir", dir)
+	missing := b.missingDirs(dir)
+	if len(missing) == 0 {
+		return b.commit(imageHistory{CreatedBy: "WORKDIR " + dir}, nil)
+	}
+	return b.commit(imageHistory{CreatedBy: "WORKDIR " + dir}, func(tw *tar.Writer) error {
+		for _, d := range missing {
+			if err := tw.WriteHeader(buildDirHeader(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// copy copies files of the build context into the image: SRC... DEST.
+func (b *builder) copy(words []string) error {
+	if len(words) < 2 {
+		return errors.New("expected SRC... DEST")
+	}
+	if strings.HasPrefix(words[0], "--") {
+		return fmt.Errorf("%s is not supported", words[0])
+	}
+	dest := b.expand(words[len(words)-1])
+	toDir := strings.HasSuffix(dest, "/") || len(words) > 2
+	dest = b.resolvePath(dest)
+
+	// The sources stay inside the context, like the entries of an archive in their target: the
+	// directories on the way are resolved in it, like cp does, so with link -> /etc, link/shadow
+	// is the context's etc/shadow. The last part is the pattern, matched in that directory.
+	var sources []string
+	for _, src := range words[:len(words)-1] {
+		name := path.Clean("/" + b.expand(src))
+		dir, err := resolveInRoot(b.context, path.Dir(name))
+		if err != nil {
+			return err
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, path.Base(name)))
+		if err != nil {
+			return err
+		}
+		// A pattern in a directory, like */config, is matched by Glob, through the links it
+		// finds: each match's directory is resolved again, and what isn't there goes
+		if strings.ContainsAny(path.Dir(name), `*?[\`) {
+			var inside []string
+			for _, m := range matches {
+				rel, err := filepath.Rel(b.context, m)
+				if err != nil {
+					return err
+				}
+				parent, err := resolveInRoot(b.context, path.Dir("/"+filepath.ToSlash(rel)))
+				if err != nil {
+					return err
+				}
+				m = filepath.Join(parent, filepath.Base(m))
+				if _, err := os.Lstat(m); err == nil && !slices.Contains(inside, m) {
+					inside = append(inside, m)
+				}
+			}
+			matches = inside
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: no such file in the build context", src)
+		}
+		sources = append(sources, matches...)
+	}
+	if len(sources) > 1 {
+		toDir = true
+	}
+	for _, src := range sources {
+		if fi, err := os.Lstat(src); err == nil && fi.IsDir() {
+			toDir = true
+		}
+	}
+
+	parents := b.missingDirs(path.Dir(dest))
+	if toDir {
+		parents = b.missingDirs(dest)
+	}
+	return b.commit(imageHistory{CreatedBy: "COPY " + strings.Join(words, " ")}, func(tw *tar.Writer) error {
+		for _, d := range parents {
+			if err := tw.WriteHeader(buildDirHeader(d)); err != nil {
+				return err
+			}
+		}
+		for _, src := range sources {
+			target := dest
+			if toDir {
+				target = path.Join(dest, filepath.Base(src))
+			}
+			if fi, err := os.Lstat(src); err == nil && fi.IsDir() {
+				// A directory's content goes into DEST, not the directory itself
+				target = dest
+			}
+			if err := writeTreeToTar(tw, src, strings.TrimPrefix(target, "/")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runCommand runs a RUN in a container of the image so far, and makes what it changed a layer.
+func (b *builder) runCommand(step dockerfileStep) error {
+	if len(b.layers) == 0 {
+		return errors.New("the image has no files yet, there is nothing to run: RUN needs a FROM image with a shell, or a COPY first")
+	}
+	args := step.Exec
+	if args == nil {
+		args = []string{"/bin/sh", "-c", step.Args}
+	}
+	// The container of the image so far, with the image's environment and working directory. Its
+	// entrypoint doesn't run the instruction.
+	cfg, err := parseRunFlags("build", []string{"--image", b.id, "--snapshotter", b.snapshotter, args[0]})
+	if err != nil {
+		return err
+	}
+	cfg.Args = args
+	if filepath.IsAbs(args[0]) && !findInLayers(cfg.Layers, args[0]) {
+		return fmt.Errorf("%s not found in the image", args[0])
+	}
+	// Its root isn't in containerDataDir, which goes with the container: we need its changes
+	dir := filepath.Join(filepath.Dir(imageRoot()), "builds", cfg.ID)
+	cfg.Rootfs = filepath.Join(dir, "merged")
+	snapshots := snapshotterOf(cfg)
+	defer snapshots.remove(dir)
+	fmt.Printf(" ---> Running in %s\n", shortID(cfg.ID))
+	var status exitStatus
+	if err := runContainer(cfg, nil, nil); errors.As(err, &status) {
+		return fmt.Errorf("the command %s returned a non-zero code: %d", formatCommand(args), status)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Removing intermediate container %s\n", shortID(cfg.ID))
+	return b.commit(imageHistory{CreatedBy: "RUN " + formatCommand(args)}, func(tw *tar.Writer) error {
+		return snapshots.commit(tw, dir, cfg.Layers)
+	})
+}
+
+// commit makes the image of a step, with a new layer if layer isn't nil: layer writes its tar.
+// step goes into the image's history, unless it says nothing.
+func (b *builder) commit(step imageHistory, layer func(tw *tar.Writer) error) error {
+	// Until the image is in the store its new blobs are referenced by nothing, and rmi would
+	// remove them
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	now := time.Now().UTC()
+	if layer != nil {
+		desc, diffID, err := writeLayer(layer)
+		if err != nil {
+			return err
+		}
+		b.layers = append(b.layers, desc)
+		b.diffIDs = append(b.diffIDs, diffID)
+	}
+	if step != (imageHistory{}) {
+		step.Created, step.EmptyLayer = now, layer == nil
+		entry, _ := json.Marshal(step)
+		b.history = append(b.history, entry)
+	}
+
+	b.config.set("created", now)
+	b.config.set("config", b.run)
+	b.config.set("rootfs", map[string]any{"type": "layers", "diff_ids": append([]string{}, b.diffIDs...)})
+	b.config.set("history", b.history)
+	config, err := json.Marshal(b.config)
+	if err != nil {
+		return err
+	}
+	configDigest := sha256.Sum256(config)
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: "sha256:" + hex.EncodeToString(configDigest[:]), Size: int64(len(config))},
+		Layers:        append([]ociDescriptor{}, b.layers...),
+	})
+	if err != nil {
+		return err
+	}
+	_, existed := os.Stat(imageDir(hex.EncodeToString(configDigest[:])))
+	if b.id, err = addImage("", config, manifest); err != nil {
+		return err
+	}
+	if existed != nil {
+		b.created = append(b.created, b.id)
+	}
+	return nil
+}
+
+// removeIntermediates removes the images the build added, but keep and the ones with a name, and
+// the blobs only they had.
+func (b *builder) removeIntermediates(keep string) {
+	unlock, err := lockImages()
+	if err != nil {
+		fmt.Printf("Warning: could not remove the intermediate images: %v\n", err)
+		return
+	}
+	defer unlock()
+	repos, _ := readRepositories()
+	for _, id := range b.created {
+		named := false
+		for _, other := range repos {
+			named = named || other == id
+		}
+		if id != keep && !named {
+			removeTree(imageDir(id))
+		}
+	}
+	if _, _, err := removeUnreferencedBlobs(); err != nil {
+		fmt.Printf("Warning: could not remove the intermediate images: %v\n", err)
+	}
+}
+
+// writeLayer writes a layer blob, gzipped, with the tar that write writes, and unpacks it. It
+// returns its descriptor and its diff ID, the digest of the tar. The lock of the store must be
+// taken.
+func writeLayer(write func(tw *tar.Writer) error) (ociDescriptor, string, error) {
+	blob, err := newBlobWriter()
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	gz := gzip.NewWriter(blob)
+	diff := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(gz, diff))
+	err = write(tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		blob.discard()
+		return ociDescriptor{}, "", err
+	}
+	desc := ociDescriptor{MediaType: mediaTypeOCILayerGzip, Size: blob.size}
+	if desc.Digest, err = blob.commit(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if !hasLayer(desc.Digest) {
+		if _, err := unpackLayer(desc, "", nil); err != nil {
+			return ociDescriptor{}, "", err
+		}
+	}
+	return desc, "sha256:" + hex.EncodeToString(diff.Sum(nil)), nil
+}
+
+// writeChanges writes the changes of a snapshotter as a layer tar, their files from below root.
+func writeChanges(tw *tar.Writer, root string, entries []diffEntry) error {
+	links := map[uint64]string{}
+	for _, e := range entries {
+		if e.whiteout {
+			hdr := &tar.Header{Name: path.Join(path.Dir(e.path), whiteoutPrefix+path.Base(e.path)), Typeflag: tar.TypeReg, ModTime: e.info.ModTime()}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeFileToTar(tw, filepath.Join(root, e.path), e.path, e.info, links, true); err != nil {
+			return err
+		}
+		if e.opaque {
+			hdr := &tar.Header{Name: path.Join(e.path, whiteoutOpaque), Typeflag: tar.TypeReg, ModTime: e.info.ModTime()}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffEntry is a change of a container's root that goes into the layer: an entry of upper/, or
+// of the copy of the vfs snapshotter.
+type diffEntry struct {
+	path     string
+	info     os.FileInfo
+	whiteout bool
+	opaque   bool
+}
+
+// collectDiff returns the entries of the directory rel of upper that go into the layer, each
+// directory before its entries. A directory that overlayfs only copied up for what's in it goes
+// in only with those.
+func collectDiff(upper, rel string, lowers []string) ([]diffEntry, error) {
+	entries, err := os.ReadDir(filepath.Join(upper, rel))
+	if err != nil {
+		return nil, err
+	}
+	var diff []diffEntry
+	for _, entry := range entries {
+		p := path.Join(rel, entry.Name())
+		if buildRuntimeFiles[p] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(upper, p))
+		if err != nil {
+			return nil, err
+		}
+		if isWhiteout(fi) {
+			diff = append(diff, diffEntry{path: p, info: fi, whiteout: true})
+			continue
+		}
+		if !fi.IsDir() {
+			diff = append(diff, diffEntry{path: p, info: fi})
+			continue
+		}
+		below, err := collectDiff(upper, p, lowers)
+		if err != nil {
+			return nil, err
+		}
+		opaque := isOpaque(filepath.Join(upper, p))
+		lower, _ := lstatInLayers(lowers, p)
+		if lower == nil || !lower.IsDir() || opaque || len(below) > 0 || !sameOwnerAndMode(lower, fi) {
+			diff = append(diff, diffEntry{path: p, info: fi, opaque: opaque})
+			diff = append(diff, below...)
+		}
+	}
+	return diff, nil
+}
+
+// sameOwnerAndMode tells whether two files have the same owner and mode.
+func sameOwnerAndMode(a, b os.FileInfo) bool {
+	sa, oka := a.Sys().(*syscall.Stat_t)
+	sb, okb := b.Sys().(*syscall.Stat_t)
+	return oka && okb && a.Mode() == b.Mode() && sa.Uid == sb.Uid && sa.Gid == sb.Gid
+}
+
+// writeTreeToTar writes the file or directory tree src as name into a layer tar, with the
+// entries of a directory below name.
+func writeTreeToTar(tw *tar.Writer, src, name string) error {
+	links := map[uint64]string{}
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." && d.IsDir() {
+			// The directory itself is name, which missingDirs created if the image hasn't got it
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return writeFileToTar(tw, p, path.Join(name, filepath.ToSlash(rel)), fi, links, false)
+	})
+}
+
+// writeFileToTar writes the file p as name into a layer tar. With keepOwners it has the file's
+// owner, otherwise root's, like the files of COPY: a host user's UID means nothing in the image.
+// A rootless container's files are the user's, which is root in its user namespace, so they are
+// root's either way. links remembers the inodes of files with several names, which are hard
+// links after the first.
+func writeFileToTar(tw *tar.Writer, p, name string, fi os.FileInfo, links map[uint64]string, keepOwners bool) error {
+	if fi.Mode()&os.ModeSocket != 0 {
+		// A socket is of a program that ran, nothing to copy
+		return nil
+	}
+	target := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if target, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Uid, hdr.Gid = 0, 0
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && keepOwners && os.Geteuid() == 0 {
+		hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+	}
+	if ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		if first, seen := links[st.Ino]; seen {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			return tw.WriteHeader(hdr)
+		}
+		links[st.Ino] = name
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// buildDirHeader is the tar header of a directory the build creates.
+func buildDirHeader(dir string) *tar.Header {
+	return &tar.Header{Name: strings.TrimPrefix(dir, "/") + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()}
+}
+
+// missingDirs returns the directories on the way to dir, dir included, that the image hasn't got,
+// the top one first.
+func (b *builder) missingDirs(dir string) []string {
+	var layers []string
+	for _, layer := range b.layers {
+		layers = append(layers, layerDir(layer.Digest))
+	}
+	var missing []string
+	for d := path.Clean(dir); d != "/"; d = path.Dir(d) {
+		if found := findInLayers(layers, d); found {
+			break
+		}
+		missing = append([]string{d}, missing...)
+	}
+	return missing
+}
+
+// resolvePath makes p absolute, relative to the working directory.
+func (b *builder) resolvePath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	workdir := "/"
+	b.run.get("WorkingDir", &workdir)
+	if workdir == "" {
+		workdir = "/"
+	}
+	return path.Join(workdir, p)
+}
+
+// expand replaces $NAME and ${NAME} in s with the variables of ENV.
+func (b *builder) expand(s string) string {
+	var env []string
+	b.run.get("Env", &env)
+	return os.Expand(s, func(name string) string {
+		for _, e := range env {
+			if value, ok := strings.CutPrefix(e, name+"="); ok {
+				return value
+			}
+		}
+		return ""
+	})
+}
+
+// splitWords splits the arguments of ENV and COPY into words like a shell does: at spaces, except
+// in quotes, and a backslash escapes the next character.
+func splitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	inWord, escaped := false, false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// formatCommand is a command for the history and the errors, the way the Dockerfile had it.
+func formatCommand(args []string) string {
+	if len(args) == 3 && args[0] == "/bin/sh" && args[1] == "-c" {
+		return args[0] + " " + args[1] + " " + args[2]
+	}
+	data, _ := json.Marshal(args)
+	return string(data)
+}
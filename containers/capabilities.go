@@ -0,0 +1,240 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capabilityNames lists the Linux capabilities by number, from <linux/capability.h>.
+//
+// Since Linux 2.2 "root" is not one privilege but ~40 separate ones. A root process without
+// CAP_SYS_ADMIN can't mount filesystems or change the hostname, without CAP_NET_ADMIN it can't
+// touch the network configuration, and so on.
+var capabilityNames = []string{
+	"CAP_CHOWN",              // 0
+	"CAP_DAC_OVERRIDE",       // 1
+	"CAP_DAC_READ_SEARCH",    // 2
+	"CAP_FOWNER",             // 3
+	"CAP_FSETID",             // 4
+	"CAP_KILL",               // 5
+	"CAP_SETGID",             // 6
+	"CAP_SETUID",             // 7
+	"CAP_SETPCAP",            // 8
+	"CAP_LINUX_IMMUTABLE",    // 9
+	"CAP_NET_BIND_SERVICE",   // 10
+	"CAP_NET_BROADCAST",      // 11
+	"CAP_NET_ADMIN",          // 12
+	"CAP_NET_RAW",            // 13
+	"CAP_IPC_LOCK",           // 14
+	"CAP_IPC_OWNER",          // 15
+	"CAP_SYS_MODULE",         // 16
+	"CAP_SYS_RAWIO",          // 17
+	"CAP_SYS_CHROOT",         // 18
+	"CAP_SYS_PTRACE",         // 19
+	"CAP_SYS_PACCT",          // 20
+	"CAP_SYS_ADMIN",          // 21
+	"CAP_SYS_BOOT",           // 22
+	"CAP_SYS_NICE",           // 23
+	"CAP_SYS_RESOURCE",       // 24
+	"CAP_SYS_TIME",           // 25
+	"CAP_SYS_TTY_CONFIG",     // 26
+	"CAP_MKNOD",              // 27
+	"CAP_LEASE",              // 28
+	"CAP_AUDIT_WRITE",        // 29
+	"CAP_AUDIT_CONTROL",      // 30
+	"CAP_SETFCAP",            // 31
+	"CAP_MAC_OVERRIDE",       // 32
+	"CAP_MAC_ADMIN",          // 33
+	"CAP_SYSLOG",             // 34
+	"CAP_WAKE_ALARM",         // 35
+	"CAP_BLOCK_SUSPEND",      // 36
+	"CAP_AUDIT_READ",         // 37
+	"CAP_PERFMON",            // 38
+	"CAP_BPF",                // 39
+	"CAP_CHECKPOINT_RESTORE", // 40
+}
+
+// defaultCapabilities is Docker's default allow-list. It is enough for the usual things a root
+// process in an image does (chown files, bind port 80, switch to another user), but notably
+// leaves out CAP_SYS_ADMIN, the "new root" that allows mount(), pivot_root(), setns() and
+// dozens of other operations that lead straight out of a container.
+var defaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// capabilityNumber accepts a name like "SYS_ADMIN", "cap_sys_admin" or "CAP_SYS_ADMIN".
+func capabilityNumber(name string) (int, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	for i, c := range capabilityNames {
+		if c == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseCapabilities applies --cap-add and --cap-drop to the default set, with Docker's rules:
+// "ALL" in --cap-add starts from every capability, "ALL" in --cap-drop starts from none, and the
+// other names are then added or removed. The result is sorted by number.
+func parseCapabilities(add, drop []string) ([]string, error) {
+	set := map[int]bool{}
+	for _, name := range defaultCapabilities {
+		n, _ := capabilityNumber(name)
+		set[n] = true
+	}
+
+	resolve := func(flagName string, names []string, value bool) error {
+		for _, name := range names {
+			if strings.EqualFold(name, "ALL") {
+				continue
+			}
+			n, ok := capabilityNumber(name)
+			if !ok {
+				return fmt.Errorf("invalid --%s: unknown capability %q", flagName, name)
+			}
+			set[n] = value
+		}
+		return nil
+	}
+	if containsFold(drop, "ALL") {
+		set = map[int]bool{}
+	}
+	if containsFold(add, "ALL") {
+		for n := range capabilityNames {
+			set[n] = true
+		}
+	}
+	if err := resolve("cap-drop", drop, false); err != nil {
+		return nil, err
+	}
+	if err := resolve("cap-add", add, true); err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for n, keep := range set {
+		if keep {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	caps := []string{}
+	for _, n := range numbers {
+		caps = append(caps, capabilityNames[n])
+	}
+	return caps, nil
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Constants from <linux/prctl.h> and <linux/capability.h>
+const (
+	prCapbsetDrop          = 24
+	prSetNoNewPrivs        = 38
+	linuxCapabilityVersion = 0x20080522 // _LINUX_CAPABILITY_VERSION_3, capability sets are 2x32 bits
+)
+
+// dropCapabilities limits the capabilities of every program the calling thread executes to keep.
+//
+// A thread has several capability sets. The one that matters here is the *bounding set*: it is
+// the upper limit of what a thread can ever get, and it can only shrink. When root execs a
+// program the kernel hands it every capability in the bounding set (plus the inheritable set), so
+// dropping a capability from the bounding set here removes it from the containerized process.
+//
+// The thread keeps its current (effective) capabilities, but they are not passed on because exec
+// only looks at the bounding and inheritable sets. See startRestricted for why this runs on a
+// thread of its own.
+func dropCapabilities(keep []string) error {
+	keepMask := uint64(0)
+	for _, name := range keep {
+		if n, ok := capabilityNumber(name); ok {
+			keepMask |= 1 << n
+		}
+	}
+
+	// Newer kernels may know capabilities that aren't in our table, those are dropped as well
+	for n := 0; n <= lastCapability(); n++ {
+		if keepMask&(1<<n) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(n), 0); errno != 0 {
+			return fmt.Errorf("drop capability %d from the bounding set: %w", n, errno)
+		}
+	}
+
+	// The inheritable set survives exec too (it is how a capability can be passed to a non-root
+	// program), so limit it to the same capabilities
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %w", errno)
+	}
+	data[0].inheritable &= uint32(keepMask)
+	data[1].inheritable &= uint32(keepMask >> 32)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+	return nil
+}
+
+// setNoNewPrivs sets the no_new_privs bit of the calling thread.
+//
+// Normally exec can *raise* privileges: a setuid-root binary like `sudo` or `su` runs as root no
+// matter who starts it, and a file with capabilities (`setcap cap_net_raw+ep ping`) grants them.
+// With no_new_privs set, exec never grants anything the caller doesn't already have, the setuid
+// bit and file capabilities are simply ignored. A process inside the container that drops to an
+// unprivileged user can't get back to root this way. Like the bounding set, the bit is inherited
+// by all children and can never be cleared.
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("set no_new_privs: %w", errno)
+	}
+	return nil
+}
+
+// lastCapability is the highest capability number the running kernel knows
+func lastCapability() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	return n
+}
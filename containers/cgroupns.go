@@ -0,0 +1,124 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Without a cgroup namespace a container sees the host's cgroup tree: /proc/self/cgroup says
+// /mycontainer/<ID>, which tells it what it runs in, and a cgroup filesystem mounted inside shows
+// all the host's cgroups. A cgroup namespace makes the cgroup a process is in when the namespace
+// is created its root: /proc/self/cgroup says "/", and a cgroup filesystem mounted from inside only
+// shows the container's own subtree. Docker uses one by default on cgroup v2 hosts
+// (--cgroupns=private), systemd inside a container needs it to manage its own cgroups.
+
+// The --cgroupns modes, Docker's names
+const (
+	cgroupnsPrivate = "private"
+	cgroupnsHost    = "host"
+)
+
+// unshareCgroupNamespace gives the child a cgroup namespace rooted at the cgroup it is in, which
+// is why it can't be a clone() flag: the monitor only moves the child into the container's cgroup
+// after it started, and sends the config after that. Namespaces belong to a thread, this one runs
+// on the main thread (main locks the child to it), which /proc/self and the mounts below go by.
+func unshareCgroupNamespace() error {
+	explainBefore("unshare(CLONE_NEWCGROUP)", "Gives the child a cgroup namespace, whose root is the cgroup it is in now, "+
+		"the container's: /proc/self/cgroup says / in the container, and the host's cgroups are out of sight.")
+	err := syscall.Unshare(syscall.CLONE_NEWCGROUP)
+	explainAfter(err, "")
+	if err != nil {
+		return fmt.Errorf("unshare cgroup namespace: %w", err)
+	}
+	return nil
+}
+
+// joinCgroupNamespace moves the calling thread into the cgroup namespace of the main thread, for
+// startRestricted. Its thread doesn't come from the main thread, it would have the host's.
+func joinCgroupNamespace() error {
+	ns, err := os.Open("/proc/self/ns/cgroup")
+	if err != nil {
+		return fmt.Errorf("open cgroup namespace: %w", err)
+	}
+	defer ns.Close()
+	if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWCGROUP, 0); errno != 0 {
+		return fmt.Errorf("join cgroup namespace: %w", errno)
+	}
+	return nil
+}
+
+// mountCgroupfs mounts the container's cgroups on /sys/fs/cgroup below rootfs, read-only like
+// Docker does: the container sees its limits and usage but can't raise them.
+//
+// A v2 host has one tree, a v1 host one per hierarchy. /proc/self/cgroup lists them: "0::/path" is
+// the v2 tree, "4:memory:/path" a v1 hierarchy with the controllers between the colons. On v1 we
+// build the same layout as the host, a tmpfs with one directory per hierarchy.
+func mountCgroupfs(rootfs string) error {
+	root := filepath.Join(rootfs, "sys/fs/cgroup")
+	const flags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	hierarchies, err := readCgroupHierarchies()
+	if err != nil {
+		return err
+	}
+	if len(hierarchies) == 1 && hierarchies[0] == "" {
+		if err := mountFS("cgroup2", root, "cgroup2", flags|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("mount cgroup2: %w", err)
+		}
+		return nil
+	}
+
+	if err := mountFS("tmpfs", root, "tmpfs", flags, "mode=755"); err != nil {
+		return fmt.Errorf("mount tmpfs on /sys/fs/cgroup: %w", err)
+	}
+	for _, controllers := range hierarchies {
+		// The v2 tree of a hybrid host goes where systemd puts it
+		fstype, name := "cgroup2", "unified"
+		if controllers != "" {
+			// A named hierarchy without controllers: systemd's is "name=systemd"
+			fstype, name = "cgroup", strings.TrimPrefix(controllers, "name=")
+		}
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		// The mount options of a v1 cgroup filesystem are the controllers of the hierarchy
+		if err := mountFS("cgroup", dir, fstype, flags|syscall.MS_RDONLY, controllers); err != nil {
+			return fmt.Errorf("mount cgroup %s: %w", name, err)
+		}
+		// Controllers mounted together get a link each, like cpu and cpuacct -> cpu,cpuacct
+		if strings.Contains(controllers, ",") {
+			for _, controller := range strings.Split(controllers, ",") {
+				if err := os.Symlink(name, filepath.Join(root, controller)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return remountReadOnly(root)
+}
+
+// readCgroupHierarchies returns the controllers of every cgroup hierarchy in /proc/self/cgroup,
+// "" for the v2 tree.
+func readCgroupHierarchies() ([]string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var hierarchies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line in /proc/self/cgroup: %q", scanner.Text())
+		}
+		hierarchies = append(hierarchies, fields[1])
+	}
+	return hierarchies, scanner.Err()
+}
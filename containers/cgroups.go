@@ -0,0 +1,324 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// cgroupRoot is where the kernel's cgroup filesystem is mounted
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupParent groups all our containers. Every container gets a cgroup below it named after
+	// its ID (like /sys/fs/cgroup/docker/<id>), so two containers never share limits.
+	cgroupParent = "mycontainer"
+
+	// cpuPeriod is the CFS scheduling period in microseconds (100ms, the kernel default).
+	// A CPU limit is expressed as "quota microseconds of CPU time per period".
+	cpuPeriod = 100000
+)
+
+// cgroupV1Controllers lists the v1 hierarchies the container joins. In v1 every controller is a
+// separate tree (/sys/fs/cgroup/memory/..., /sys/fs/cgroup/cpu/...), so we need one directory per
+// controller. v2 has a single unified tree where one directory covers all controllers.
+var cgroupV1Controllers = []string{"memory", "cpu", "cpuacct", "pids", "blkio", "cpuset", "freezer", "devices", "hugetlb"}
+
+// cgroupV1Hierarchies returns the controllers of cgroupV1Controllers the host has a hierarchy for.
+// Kernels are built with different controllers, hugetlb for one is often left out, and
+// /sys/fs/cgroup is a tmpfs we would happily create plain directories in.
+func cgroupV1Hierarchies() []string {
+	var controllers []string
+	for _, controller := range cgroupV1Controllers {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, controller, "cgroup.procs")); err == nil {
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers
+}
+
+// setupCgroups creates the container's cgroup, applies the limits from cfg and moves pid into it.
+//
+// The parent does this for the child: the child is still blocked waiting for its config, so it
+// is inside the cgroup before it runs anything. Every process it starts inherits the membership.
+//
+// The limits are best effort, but the device rules are not: without them the container may open
+// and create every device node of the host, the disks included. An error there stops the container.
+func setupCgroups(cfg *containerConfig, pid int) error {
+	// Try cgroups v2 first (unified hierarchy), then fall back to v1
+	if cgroupV2() {
+		return cgroupsV2(cfg, pid)
+	}
+	return cgroupsV1(cfg, pid)
+}
+
+// removeCgroups deletes the container's cgroup directories once the container has exited.
+// Without it every run leaves a stale cgroup behind, still carrying the limits of that run.
+func removeCgroups(id string) {
+	dirs := []string{cgroupPath("", id)}
+	if !cgroupV2() {
+		dirs = dirs[:0]
+		for _, controller := range cgroupV1Hierarchies() {
+			dirs = append(dirs, cgroupPath(controller, id))
+		}
+	}
+
+	for _, dir := range dirs {
+		// A cgroup can only be removed with rmdir (not rm -r, the control files can't be deleted)
+		// and only when it has no processes left. When the container's PID 1 exits the kernel kills
+		// the rest of the PID namespace, but they leave the cgroup asynchronously, so retry briefly.
+		var err error
+		for i := 0; i < 100; i++ {
+			if err = syscall.Rmdir(dir); err != syscall.EBUSY {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil && err != syscall.ENOENT {
+			slog.Warn("could not remove cgroup", "dir", dir, "err", err)
+		} else {
+			slog.Debug("removed cgroup", "dir", dir)
+		}
+	}
+}
+
+// joinCgroups moves pid into the cgroup of container id.
+func joinCgroups(id string, pid int) error {
+	if cgroupV2() {
+		return writeCgroupFileErr(cgroupPath("", id), "cgroup.procs", strconv.Itoa(pid))
+	}
+	for _, controller := range cgroupV1Hierarchies() {
+		if err := writeCgroupFileErr(cgroupPath(controller, id), "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgroupV2 reports whether the host uses the unified (v2) hierarchy.
+// Only v2 has cgroup.controllers in the root of the cgroup filesystem.
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// cgroupPath returns the cgroup directory of container id. The controller is only used for v1,
+// where every controller has its own tree; pass "" for v2.
+func cgroupPath(controller, id string) string {
+	if cgroupV2() {
+		return filepath.Join(cgroupRoot, cgroupParent, id)
+	}
+	return filepath.Join(cgroupRoot, controller, cgroupParent, id)
+}
+
+func cgroupsV2(cfg *containerConfig, pid int) error {
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	os.Mkdir(parent, 0755)
+
+	// In v2 a controller is only usable in a child cgroup after its parent enables it in
+	// cgroup.subtree_control, at every level. systemd usually did that for the root already, so a
+	// failure there is fine. (This is also why `mycontainer` itself must never hold processes:
+	// a v2 cgroup with controllers enabled for its children can't have processes of its own.)
+	controllers := []byte("+memory +cpu +pids +io +cpuset")
+	os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), controllers, 0700)
+	writeCgroupFile(parent, "cgroup.subtree_control", string(controllers), "controllers for containers")
+
+	path := cgroupPath("", cfg.ID)
+	os.Mkdir(path, 0755)
+
+	// Limit memory (cgroups v2 uses memory.max)
+	if cfg.Memory > 0 {
+		writeCgroupFile(path, "memory.max", strconv.FormatInt(cfg.Memory, 10), "memory limit")
+	}
+
+	// Limit swap. memory.max only counts RAM: once it is reached the kernel swaps the container's
+	// pages out instead of OOM-killing it, so without a swap limit the process keeps growing.
+	// v2 limits swap on its own (memory.swap.max), while --memory-swap is RAM+swap like in Docker.
+	switch {
+	case cfg.MemorySwap == -1:
+		writeCgroupFile(path, "memory.swap.max", "max", "swap limit")
+	case cfg.MemorySwap > 0:
+		writeCgroupFile(path, "memory.swap.max", strconv.FormatInt(cfg.MemorySwap-cfg.Memory, 10), "swap limit")
+	}
+
+	// Limit CPU (cgroups v2 uses cpu.max = "<quota> <period>")
+	// e.g. "50000 100000" lets the container run 50ms out of every 100ms: half a CPU
+	if cfg.CPUs > 0 {
+		writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", cpuQuota(cfg.CPUs), cpuPeriod), "CPU limit")
+	}
+
+	// Limit the number of processes (same file name in v1 and v2). fork() and clone() fail with
+	// EAGAIN once the cgroup holds pids.max tasks, which stops a fork bomb from taking the host down.
+	if cfg.PidsLimit > 0 {
+		writeCgroupFile(path, "pids.max", strconv.FormatInt(cfg.PidsLimit, 10), "process limit")
+	}
+
+	// Throttle block devices (cgroups v2 uses io.max with one "MAJ:MIN key=value" line per device).
+	// Keys that are left out keep their value, so read and write limits can be written separately.
+	for _, limit := range cfg.DeviceReadBps {
+		writeCgroupFile(path, "io.max", fmt.Sprintf("%s rbps=%d", limit.device(), limit.Rate), "read limit for "+limit.Path)
+	}
+	for _, limit := range cfg.DeviceWriteBps {
+		writeCgroupFile(path, "io.max", fmt.Sprintf("%s wbps=%d", limit.device(), limit.Rate), "write limit for "+limit.Path)
+	}
+
+	// Pin the container to CPUs and memory nodes. An empty value in v2 means "same as the parent".
+	if cfg.CpusetCpus != "" {
+		writeCgroupFile(path, "cpuset.cpus", cfg.CpusetCpus, "cpuset CPUs")
+	}
+	if cfg.CpusetMems != "" {
+		writeCgroupFile(path, "cpuset.mems", cfg.CpusetMems, "cpuset memory nodes")
+	}
+
+	// Huge pages, one limit per page size. hugetlb is enabled on its own, and only when needed:
+	// one controller the kernel doesn't have fails the whole write to cgroup.subtree_control.
+	if len(cfg.HugetlbLimits) > 0 {
+		os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+hugetlb"), 0700)
+		writeCgroupFile(parent, "cgroup.subtree_control", "+hugetlb", "hugetlb controller for containers")
+		applyHugetlbLimits(path, "max", cfg.HugetlbLimits)
+	}
+
+	// Restrict access to device nodes with an eBPF program (v2 has no devices.allow file)
+	if err := applyDeviceRulesV2(path, defaultDeviceRules); err != nil {
+		return fmt.Errorf("set device rules: %w", err)
+	}
+
+	// Add the container process to cgroup. Outside of it the device rules don't apply either.
+	if err := writeCgroupFileErr(path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return fmt.Errorf("move the container into its cgroup: %w", err)
+	}
+	return nil
+}
+
+func cgroupsV1(cfg *containerConfig, pid int) error {
+	path := func(controller string) string {
+		return cgroupPath(controller, cfg.ID)
+	}
+	controllers := cgroupV1Hierarchies()
+	for _, controller := range controllers {
+		os.MkdirAll(path(controller), 0755)
+	}
+
+	// Limit memory (cgroups v1 uses memory.limit_in_bytes)
+	if cfg.Memory > 0 {
+		writeCgroupFile(path("memory"), "memory.limit_in_bytes", strconv.FormatInt(cfg.Memory, 10), "memory limit")
+	}
+
+	// Limit RAM+swap (cgroups v1 uses memory.memsw.limit_in_bytes, which counts both together).
+	// It must be written after memory.limit_in_bytes, the kernel rejects memsw < memory.
+	// The file only exists when the kernel does swap accounting (swapaccount=1).
+	if cfg.MemorySwap != 0 {
+		writeCgroupFile(path("memory"), "memory.memsw.limit_in_bytes", strconv.FormatInt(cfg.MemorySwap, 10), "swap limit")
+	}
+
+	// Limit CPU (cgroups v1 splits cpu.max into two files). The period has to be set first,
+	// the kernel rejects a quota that doesn't make sense for the current period.
+	if cfg.CPUs > 0 {
+		writeCgroupFile(path("cpu"), "cpu.cfs_period_us", strconv.Itoa(cpuPeriod), "CPU period")
+		writeCgroupFile(path("cpu"), "cpu.cfs_quota_us", strconv.FormatInt(cpuQuota(cfg.CPUs), 10), "CPU limit")
+	}
+
+	// Limit the number of processes
+	if cfg.PidsLimit > 0 {
+		writeCgroupFile(path("pids"), "pids.max", strconv.FormatInt(cfg.PidsLimit, 10), "process limit")
+	}
+
+	// Throttle block devices (cgroups v1 has one file per direction). Note that v1 can only
+	// throttle I/O that goes straight to the device, like `dd oflag=direct`: buffered writes are
+	// flushed later by kernel threads outside the container's cgroup. v2 fixed that.
+	for _, limit := range cfg.DeviceReadBps {
+		writeCgroupFile(path("blkio"), "blkio.throttle.read_bps_device", fmt.Sprintf("%s %d", limit.device(), limit.Rate), "read limit for "+limit.Path)
+	}
+	for _, limit := range cfg.DeviceWriteBps {
+		writeCgroupFile(path("blkio"), "blkio.throttle.write_bps_device", fmt.Sprintf("%s %d", limit.device(), limit.Rate), "write limit for "+limit.Path)
+	}
+
+	// Pin the container to CPUs and memory nodes. v1 gotcha: a new cpuset cgroup starts with EMPTY
+	// cpuset.cpus and cpuset.mems, and the kernel refuses to add a process until both are set.
+	// That applies to our `mycontainer` parent too. When the user didn't ask for pinning we copy
+	// the values of the root cpuset.
+	rootCpus := readCgroupFile(filepath.Join(cgroupRoot, "cpuset"), "cpuset.cpus")
+	rootMems := readCgroupFile(filepath.Join(cgroupRoot, "cpuset"), "cpuset.mems")
+	parent := filepath.Dir(path("cpuset"))
+	if readCgroupFile(parent, "cpuset.cpus") == "" {
+		writeCgroupFile(parent, "cpuset.cpus", rootCpus, "cpuset CPUs")
+	}
+	if readCgroupFile(parent, "cpuset.mems") == "" {
+		writeCgroupFile(parent, "cpuset.mems", rootMems, "cpuset memory nodes")
+	}
+	cpus, mems := cfg.CpusetCpus, cfg.CpusetMems
+	if cpus == "" {
+		cpus = rootCpus
+	}
+	if mems == "" {
+		mems = rootMems
+	}
+	writeCgroupFile(path("cpuset"), "cpuset.cpus", cpus, "cpuset CPUs")
+	writeCgroupFile(path("cpuset"), "cpuset.mems", mems, "cpuset memory nodes")
+
+	// Restrict access to device nodes. Without the devices hierarchy there is nowhere to.
+	if !slices.Contains(controllers, "devices") {
+		return errors.New("set device rules: the host has no devices cgroup hierarchy")
+	}
+	if err := applyDeviceRulesV1(path("devices"), defaultDeviceRules); err != nil {
+		return fmt.Errorf("set device rules: %w", err)
+	}
+
+	// Huge pages, one limit per page size
+	if len(cfg.HugetlbLimits) > 0 {
+		applyHugetlbLimits(path("hugetlb"), "limit_in_bytes", cfg.HugetlbLimits)
+	}
+
+	// Add the container process to the cgroup of every controller. Only the devices cgroup must
+	// take it, the others merely don't limit it otherwise.
+	for _, controller := range controllers {
+		if controller == "devices" {
+			if err := writeCgroupFileErr(path(controller), "cgroup.procs", strconv.Itoa(pid)); err != nil {
+				return fmt.Errorf("move the container into its devices cgroup: %w", err)
+			}
+			continue
+		}
+		writeCgroupFile(path(controller), "cgroup.procs", strconv.Itoa(pid), "process to "+controller+" cgroup")
+	}
+	return nil
+}
+
+// cpuQuota converts a number of CPUs (1.5 = one and a half cores) into a CFS quota per cpuPeriod.
+func cpuQuota(cpus float64) int64 {
+	return int64(cpus * cpuPeriod)
+}
+
+// readCgroupFile returns the trimmed content of a cgroup file, or "" if it can't be read.
+func readCgroupFile(dir, file string) string {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeCgroupFile writes one cgroup setting. Limits are best effort in this demo: a missing
+// controller only prints a warning instead of stopping the container.
+func writeCgroupFile(dir, file, value, what string) {
+	if err := writeCgroupFileErr(dir, file, value); err != nil {
+		slog.Warn("could not set "+what, "dir", dir, "file", file, "err", err)
+	}
+}
+
+// writeCgroupFileErr is writeCgroupFile for callers that need to handle the error themselves.
+func writeCgroupFileErr(dir, file, value string) error {
+	path := filepath.Join(dir, file)
+	slog.Debug("write cgroup file", "path", path, "value", value)
+	explainBefore(fmt.Sprintf("write(%q, %q)", path, value), cgroupFileWhy(file))
+	err := os.WriteFile(path, []byte(value), 0700)
+	explainAfter(err, "")
+	return err
+}
@@ -0,0 +1,382 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Kubernetes doesn't connect pods itself, and neither does its container runtime (containerd,
+// CRI-O). They leave it to a CNI plugin (Container Network Interface), a program they run for
+// every pod: Flannel, Calico, Cilium, or the bridge plugin of the CNI project, which does what
+// setupNetwork does. The protocol between runtime and plugin is small:
+//
+//	CNI_COMMAND=ADD            connect the namespace, DEL disconnects it, CHECK verifies it
+//	CNI_CONTAINERID=1a2b...    whose network it is
+//	CNI_NETNS=/var/run/netns/x the network namespace, a path: the pod's pause container holds it
+//	CNI_IFNAME=eth0            the interface to create in it
+//	stdin                      the network's configuration, JSON from /etc/cni/net.d
+//	stdout                     the result, JSON: interfaces, addresses, routes, DNS; or an error
+//
+// This binary is such a plugin too. Run without arguments and with CNI_COMMAND set, it is a
+// bridge plugin instead of the container tool, with the netlink code of our bridge network. It
+// can't be a program of its own in cni/: without a Go module every file is package main, and
+// nothing could share that code. A runtime looks the plugin up by the "type" of the
+// configuration in CNI_PATH, so it is installed under that name:
+//
+//	install -m 755 container /opt/cni/bin/mycontainer-bridge
+//	install -m 644 cni/10-mycontainer.conf /etc/cni/net.d/
+//
+// Where the bridge plugin hands the addresses to another plugin named in the configuration's
+// "ipam", usually host-local, ours hands them out itself, like ipam.go for the containers.
+
+// cniVersion is the version of the spec our results follow, the others are the ones we read
+const cniVersion = "1.0.0"
+
+var cniSupportedVersions = []string{"0.4.0", cniVersion}
+
+// cniDir holds the address files of each network, by name. In /run like ipamDir: after a reboot
+// the network namespaces are gone, and their addresses free.
+const cniDir = "/run/mycontainer/cni"
+
+// The error codes of the spec we use. Every plugin has the codes from 100 on for its own errors.
+const (
+	cniErrIncompatibleVersion = 1
+	cniErrInvalidEnv          = 4
+	cniErrDecode              = 6
+	cniErrInvalidConfig       = 7
+	cniErrPlugin              = 100
+)
+
+// cniError is what a plugin prints instead of a result, exiting with 1.
+type cniError struct {
+	Version string `json:"cniVersion"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+}
+
+func (e *cniError) Error() string {
+	return e.Msg
+}
+
+// cniErrorf returns a cniError with code.
+func cniErrorf(code int, format string, args ...any) error {
+	return &cniError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// cniNetConf is the configuration of a network, in /etc/cni/net.d:
+//
+//	{"cniVersion": "1.0.0", "name": "mynet", "type": "mycontainer-bridge",
+//	 "bridge": "cni0", "subnet": "10.88.0.0/16", "ipMasq": true}
+type cniNetConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// The bridge the namespaces are attached to, created by the first ADD
+	Bridge string `json:"bridge"`
+	Subnet string `json:"subnet"`
+	// Masquerade the packets that leave the subnet, like our bridge network does
+	IPMasq bool   `json:"ipMasq"`
+	DNS    cniDNS `json:"dns"`
+	// CHECK and DEL get the result of ADD in here
+	PrevResult *cniResult `json:"prevResult,omitempty"`
+}
+
+// cniResult is what ADD prints.
+type cniResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []cniInterface `json:"interfaces,omitempty"`
+	IPs        []cniIP        `json:"ips,omitempty"`
+	Routes     []cniRoute     `json:"routes,omitempty"`
+	DNS        cniDNS         `json:"dns"`
+}
+
+// cniInterface is an interface ADD created or used. Sandbox is the network namespace, for the
+// ones in the container.
+type cniInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// cniIP is an address, on the interface with that index in Interfaces. Version 0.4.0 of the spec
+// also wants "4" or "6" in Version.
+type cniIP struct {
+	Version   string `json:"version,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+// cniRoute is a route in the container.
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// cniDNS is what the runtime should put into the container's resolv.conf. The plugin only passes
+// it on from the configuration, it writes no files.
+type cniDNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// cniArgs are the CNI_ variables of a call.
+type cniArgs struct {
+	containerID, netns, ifname string
+}
+
+// owner is who an address and the masquerade rule belong to: one container may be in a network
+// with several interfaces.
+func (a cniArgs) owner() string {
+	return a.containerID + "/" + a.ifname
+}
+
+// cniMain runs the plugin, and returns its exit code.
+func cniMain() int {
+	conf, result, err := cniCommand(os.Getenv("CNI_COMMAND"), os.Stdin)
+	if err != nil {
+		var e *cniError
+		if !errors.As(err, &e) {
+			e = &cniError{Code: cniErrPlugin, Msg: err.Error()}
+		}
+		e.Version = cniVersion
+		if conf != nil && conf.CNIVersion != "" {
+			e.Version = conf.CNIVersion
+		}
+		json.NewEncoder(os.Stdout).Encode(e)
+		return 1
+	}
+	if result != nil {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+	return 0
+}
+
+// cniCommand runs command, with the configuration on stdin. It returns the configuration as far
+// as it got, for the version of the error.
+func cniCommand(command string, stdin io.Reader) (*cniNetConf, any, error) {
+	if command == "VERSION" {
+		return nil, map[string]any{"cniVersion": cniVersion, "supportedVersions": cniSupportedVersions}, nil
+	}
+	var conf cniNetConf
+	if err := json.NewDecoder(stdin).Decode(&conf); err != nil {
+		return nil, nil, cniErrorf(cniErrDecode, "decode the network configuration: %v", err)
+	}
+	if !slices.Contains(cniSupportedVersions, conf.CNIVersion) {
+		return &conf, nil, cniErrorf(cniErrIncompatibleVersion, "cniVersion %q is not supported, only %s", conf.CNIVersion, strings.Join(cniSupportedVersions, ", "))
+	}
+	if conf.Name == "" || strings.ContainsAny(conf.Name, "/\x00") || conf.Name == "." || conf.Name == ".." {
+		return &conf, nil, cniErrorf(cniErrInvalidConfig, "invalid network name %q", conf.Name)
+	}
+	if conf.Bridge == "" {
+		conf.Bridge = "cni0"
+	}
+	subnet, err := parseSubnet(conf.Subnet)
+	if err != nil {
+		return &conf, nil, cniErrorf(cniErrInvalidConfig, "invalid subnet %q: %v", conf.Subnet, err)
+	}
+	args := cniArgs{os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_NETNS"), os.Getenv("CNI_IFNAME")}
+	if args.containerID == "" {
+		return &conf, nil, cniErrorf(cniErrInvalidEnv, "CNI_CONTAINERID is not set")
+	}
+	if len(args.ifname) == 0 || len(args.ifname) > 15 || strings.ContainsAny(args.ifname, "/ ") {
+		return &conf, nil, cniErrorf(cniErrInvalidEnv, "invalid CNI_IFNAME %q", args.ifname)
+	}
+	// Only DEL may come after the namespace is gone
+	if args.netns == "" && command != "DEL" {
+		return &conf, nil, cniErrorf(cniErrInvalidEnv, "CNI_NETNS is not set")
+	}
+
+	switch command {
+	case "ADD":
+		result, err := cniAdd(&conf, subnet, args)
+		return &conf, result, err
+	case "DEL":
+		return &conf, nil, cniDel(&conf, args)
+	case "CHECK":
+		return &conf, nil, cniCheck(&conf, args)
+	}
+	return &conf, nil, cniErrorf(cniErrInvalidEnv, "unknown CNI_COMMAND %q", command)
+}
+
+// cniVethName is the host end of the veth pair of an interface in a container. A runtime's
+// container IDs needn't be hex or long, so it is a hash of them instead of a short ID.
+func cniVethName(args cniArgs) string {
+	sum := sha256.Sum256([]byte(args.owner()))
+	return "veth" + hex.EncodeToString(sum[:])[:8]
+}
+
+// cniAdd connects the network namespace to the bridge, like setupNetwork a container.
+func cniAdd(conf *cniNetConf, subnet *net.IPNet, args cniArgs) (result *cniResult, err error) {
+	ns, err := os.Open(args.netns)
+	if err != nil {
+		return nil, fmt.Errorf("open network namespace: %w", err)
+	}
+	defer ns.Close()
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Close()
+
+	if err := nl.createBridge(conf.Bridge); err != nil {
+		return nil, err
+	}
+	if err := nl.setLinkUp(conf.Bridge); err != nil {
+		return nil, err
+	}
+	gateway := &net.IPNet{IP: subnetGateway(subnet), Mask: subnet.Mask}
+	if err := nl.addAddress(conf.Bridge, gateway); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, err
+	}
+	if err := enableIPForwarding(); err != nil {
+		return nil, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+
+	// The address is taken until DEL: we can't tell whether a namespace is still in use
+	dir := filepath.Join(cniDir, conf.Name)
+	ip, err := allocateAddress(dir, args.owner(), subnet, func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	// A failed ADD leaves nothing behind, the runtime doesn't always call DEL then. But a second
+	// ADD for the same interface fails on the veth pair, which is the first one's.
+	veth := cniVethName(args)
+	created := false
+	defer func() {
+		if err != nil {
+			os.Remove(filepath.Join(dir, ip.String()))
+			if created {
+				nl.deleteLink(veth)
+			}
+		}
+	}()
+	if err := nl.createVeth(veth, args.ifname, netnsFd(ns)); err != nil {
+		return nil, err
+	}
+	created = true
+	if err := nl.setLinkMaster(veth, conf.Bridge); err != nil {
+		return nil, err
+	}
+	if err := nl.setLinkUp(veth); err != nil {
+		return nil, err
+	}
+	address := &net.IPNet{IP: ip, Mask: subnet.Mask}
+	var mac string
+	err = inNetworkNamespace(ns, func() error {
+		if err := configureInterface(args.ifname, address, gateway.IP); err != nil {
+			return err
+		}
+		link, err := net.InterfaceByName(args.ifname)
+		if err != nil {
+			return err
+		}
+		mac = link.HardwareAddr.String()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conf.IPMasq {
+		if err := addMasquerade(args.owner(), ip, conf.Bridge); err != nil {
+			return nil, fmt.Errorf("add masquerade rule: %w", err)
+		}
+	}
+
+	result = &cniResult{CNIVersion: conf.CNIVersion, DNS: conf.DNS}
+	for _, name := range []string{conf.Bridge, veth} {
+		link, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		result.Interfaces = append(result.Interfaces, cniInterface{Name: name, Mac: link.HardwareAddr.String()})
+	}
+	result.Interfaces = append(result.Interfaces, cniInterface{Name: args.ifname, Mac: mac, Sandbox: args.netns})
+	container := len(result.Interfaces) - 1
+	result.IPs = []cniIP{{Address: address.String(), Gateway: gateway.IP.String(), Interface: &container}}
+	if conf.CNIVersion == "0.4.0" {
+		result.IPs[0].Version = "4"
+	}
+	result.Routes = []cniRoute{{Dst: "0.0.0.0/0", GW: gateway.IP.String()}}
+	return result, nil
+}
+
+// cniDel undoes cniAdd. The runtime may call it more than once, or for an ADD that failed, or
+// after the namespace is gone: what isn't there anymore is fine.
+func cniDel(conf *cniNetConf, args cniArgs) error {
+	if err := releaseAddress(filepath.Join(cniDir, conf.Name), args.owner()); err != nil {
+		return err
+	}
+	if err := removeRules(args.owner()); err != nil {
+		return fmt.Errorf("remove the nftables rules: %w", err)
+	}
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	// The other end goes with it
+	return nl.deleteLink(cniVethName(args))
+}
+
+// cniCheck verifies that what ADD set up, the result it returned, is still there. Runtimes call it
+// now and then, to see whether a container's network broke.
+func cniCheck(conf *cniNetConf, args cniArgs) error {
+	if conf.PrevResult == nil || len(conf.PrevResult.IPs) == 0 {
+		return cniErrorf(cniErrInvalidConfig, "CHECK needs the prevResult of ADD")
+	}
+	address := conf.PrevResult.IPs[0].Address
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return cniErrorf(cniErrInvalidConfig, "invalid address %q in prevResult", address)
+	}
+
+	owner, err := os.ReadFile(filepath.Join(cniDir, conf.Name, ip.String()))
+	if err != nil || strings.TrimSpace(string(owner)) != args.owner() {
+		return fmt.Errorf("address %s is not allocated to %s", ip, args.owner())
+	}
+	veth := cniVethName(args)
+	master, err := os.Readlink(filepath.Join("/sys/class/net", veth, "master"))
+	if err != nil || filepath.Base(master) != conf.Bridge {
+		return fmt.Errorf("%s is not attached to %s", veth, conf.Bridge)
+	}
+
+	ns, err := os.Open(args.netns)
+	if err != nil {
+		return fmt.Errorf("open network namespace: %w", err)
+	}
+	defer ns.Close()
+	return inNetworkNamespace(ns, func() error {
+		link, err := net.InterfaceByName(args.ifname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args.ifname, err)
+		}
+		if link.Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", args.ifname)
+		}
+		addrs, err := link.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if a.String() == address {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s doesn't have address %s", args.ifname, address)
+	})
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// `commit` makes an image of a container: its image, with the container's changes as one more
+// layer. The changes are the upper/ of its overlay (see overlay.go), so that is all there is to
+// it, the same diff a RUN of `build` makes a layer of (see build.go):
+//
+//	run -d alpine sh -c 'apk add curl; sleep 1d'    the container installs curl into upper/
+//	commit 5d2c4a1b3e7f alpine-curl                 the image alpine + upper/
+//
+// docker commit also keeps the container's settings: the image's command is the container's,
+// and so are the environment and the working directory. A container that ran `touch /x` makes
+// an image that runs `touch /x`, unless --change in Docker says otherwise; `build` is the way to
+// make images on purpose, commit the way to save what someone did in a container.
+//
+// A running container keeps writing while we read upper/. Like docker commit, we pause it for
+// that with the freezer (see freezer.go), unless --pause=false. Rootless there are no cgroups to
+// freeze with.
+
+// commit implements `commit [OPTIONS] CONTAINER [IMAGE]`.
+func commit(args []string) error {
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s commit [OPTIONS] CONTAINER [IMAGE]\n\nCreate an image from the changes of a container of an image.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	message := fs.String("m", "", "the commit `MESSAGE`, in the image's history")
+	fs.StringVar(message, "message", "", "same as -m")
+	author := fs.String("a", "", "the `AUTHOR` of the image, like \"Jane Doe <jane@example.com>\"")
+	fs.StringVar(author, "author", "", "same as -a")
+	pauseFlag := fs.Bool("p", true, "pause a running container while its changes are read")
+	fs.BoolVar(pauseFlag, "pause", true, "same as -p")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usageErrorf(fs, "expected CONTAINER and optionally IMAGE")
+	}
+	name := ""
+	if fs.NArg() == 2 {
+		var err error
+		if name, err = normalizeImageName(fs.Arg(1)); err != nil {
+			return usageErrorf(fs, "invalid image name %q: %v", fs.Arg(1), err)
+		}
+	}
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfig(s.ID)
+	if err != nil {
+		return err
+	}
+	if cfg.ImageID == "" {
+		return fmt.Errorf("container %s runs on the directory %s, not on an image: there are no changes to commit, the directory has them", shortID(s.ID), cfg.Rootfs)
+	}
+
+	if *pauseFlag && s.currentStatus() == statusRunning {
+		if os.Geteuid() != 0 {
+			fmt.Println("Rootless mode: not pausing the container, there is no freezer cgroup")
+		} else {
+			thaw, err := pauseWhile(s.ID)
+			if err != nil {
+				return err
+			}
+			defer thaw()
+		}
+	}
+
+	b := &builder{}
+	if err := b.from(cfg.ImageID); err != nil {
+		return fmt.Errorf("the image of container %s: %w", shortID(s.ID), err)
+	}
+	// The container's settings: the image's entrypoint stays, the command is the rest
+	var entrypoint []string
+	b.run.get("Entrypoint", &entrypoint)
+	cmd := cfg.Args
+	if len(entrypoint) > 0 && len(cmd) >= len(entrypoint) && slices.Equal(cmd[:len(entrypoint)], entrypoint) {
+		cmd = cmd[len(entrypoint):]
+	}
+	b.run.set("Cmd", cmd)
+	// HOSTNAME is the container's, not the image's
+	b.run.set("Env", slices.DeleteFunc(slices.Clone(cfg.Env), func(e string) bool { return strings.HasPrefix(e, "HOSTNAME=") }))
+	b.run.set("WorkingDir", cfg.Workdir)
+	if *author != "" {
+		b.config.set("author", *author)
+	}
+
+	step := imageHistory{CreatedBy: formatCommand(cfg.Args), Author: *author, Comment: *message}
+	if err := b.commit(step, func(tw *tar.Writer) error {
+		return snapshotterOf(cfg).commit(tw, filepath.Dir(cfg.Rootfs), cfg.Layers)
+	}); err != nil {
+		return err
+	}
+	if name != "" {
+		unlock, err := lockImages()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := tagImage(name, b.id); err != nil {
+			return err
+		}
+	}
+	fmt.Println("sha256:" + b.id)
+	return nil
+}
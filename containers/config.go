@@ -0,0 +1,1154 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errUsage is returned for command-line mistakes. The flag package has already printed the
+// problem together with the usage text, so main only has to pick the exit code.
+var errUsage = errors.New("bad usage")
+
+// containerConfig holds everything the parent knows about the container it is about to create.
+// The parent fills it from the command line and hands it to the child as JSON (see sendConfig).
+type containerConfig struct {
+	// ID identifies this container, it is generated for every run
+	ID string `json:"id"`
+	// Args is the command (and its arguments) to execute inside the container
+	Args []string `json:"args"`
+	// Rootfs is the absolute path of the directory that becomes `/` inside the container
+	Rootfs string `json:"rootfs"`
+	// Image is the --image the rootfs belongs to, as given, and ImageID its ID (see images.go)
+	Image   string `json:"image,omitempty"`
+	ImageID string `json:"imageID,omitempty"`
+	// Layers are the image's unpacked layers, the lowest first. The rootfs is their overlay with
+	// the container's own upper directory (see overlay.go), or a copy of them.
+	Layers []string `json:"layers,omitempty"`
+	// Snapshotter makes the rootfs from the layers, overlayfs or vfs (see snapshot.go). Empty is
+	// overlayfs, for the containers from before there was a choice.
+	Snapshotter string `json:"snapshotter,omitempty"`
+	// Hostname is set in the container's UTS namespace and written to /etc/hostname
+	Hostname string `json:"hostname"`
+	// Workdir is the working directory of the containerized process, inside the rootfs
+	Workdir string `json:"workdir"`
+	// ReadOnly mounts the rootfs read-only, the tmpfs mounts stay writable
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Tmpfs are the tmpfs filesystems mounted in the container (/tmp, /run, /dev/shm and --tmpfs)
+	Tmpfs []tmpfsMount `json:"tmpfs"`
+	// Volumes are bind-mounted from the host into the container
+	Volumes []volumeMount `json:"volumes,omitempty"`
+	// MaskedPaths are hidden in the container, ReadonlyPaths made read-only (see protectProcPaths)
+	MaskedPaths   []string `json:"maskedPaths"`
+	ReadonlyPaths []string `json:"readonlyPaths"`
+	// RootfsPropagation is the mount propagation of the container's mount tree, e.g. "rprivate"
+	RootfsPropagation string `json:"rootfsPropagation"`
+	// Tty gives the command a pseudo terminal as stdin, stdout and stderr (-t)
+	Tty bool `json:"tty,omitempty"`
+	// Detach runs the container in the background (-d)
+	Detach bool `json:"detach,omitempty"`
+	// Trace prints the system calls of the command and what it starts on its stderr (--trace, see
+	// trace.go)
+	Trace bool `json:"trace,omitempty"`
+	// CreateOnly sets the container up and waits for `start` before the command runs (create)
+	CreateOnly bool `json:"createOnly,omitempty"`
+	// Restart says when the monitor of a background container starts it again (--restart)
+	Restart restartPolicy `json:"restart,omitzero"`
+	// Log says how large the log of a background container grows (--log-opt, see logs.go)
+	Log logOptions `json:"log,omitzero"`
+	// Health is the health check of the container, nil for none (--health-cmd, --health-tcp,
+	// --health-http, see health.go)
+	Health *healthCheck `json:"health,omitempty"`
+	// Hooks are run on the host when the container starts and stops (--hooks)
+	Hooks containerHooks `json:"hooks,omitzero"`
+	// TimeNamespace gives the command a time namespace of its own, whose clocks are TimeOffsets
+	// ahead of the host's (--boottime-offset, --monotonic-offset)
+	TimeNamespace bool        `json:"timeNamespace,omitempty"`
+	TimeOffsets   timeOffsets `json:"timeOffsets,omitzero"`
+	// Cgroupns is private for a cgroup namespace of the container's own, host to share the
+	// host's (--cgroupns)
+	Cgroupns string `json:"cgroupns"`
+	// Network is how the container is connected: bridge for a veth pair on our bridge, macvlan
+	// for an interface of its own on a host network, host for the host's network namespace,
+	// container for the one of container NetworkContainer, none for nothing but its own loopback
+	// device (--network)
+	Network          string `json:"network"`
+	NetworkContainer string `json:"networkContainer,omitempty"`
+	// Subnet is the bridge network the container gets an address in (--subnet). IPAddress is that
+	// address with the subnet's prefix length, like 172.29.0.2/16, and Gateway the bridge's, the
+	// container's default route. The monitor fills them in, they are the same after a restart.
+	Subnet    string `json:"subnet,omitempty"`
+	IPAddress string `json:"ipAddress,omitempty"`
+	Gateway   string `json:"gateway,omitempty"`
+	// IPv6 gives a bridge container an IPv6 address too, in Subnet6 (--ipv6, --subnet6).
+	// IPAddress6 and Gateway6 are like IPAddress and Gateway.
+	IPv6       bool   `json:"ipv6,omitempty"`
+	Subnet6    string `json:"subnet6,omitempty"`
+	IPAddress6 string `json:"ipAddress6,omitempty"`
+	Gateway6   string `json:"gateway6,omitempty"`
+	// MacvlanParent is the host interface of a macvlan network (--network macvlan=PARENT). The
+	// address is static, IPAddress and Gateway come from --ip and --gateway, or with DHCP from the
+	// parent's network at every start.
+	MacvlanParent string `json:"macvlanParent,omitempty"`
+	DHCP          bool   `json:"dhcp,omitempty"`
+	// Slirp4netns is set while slirp4netns connects the bridge network of a rootless container
+	// instead, in user mode (see slirp.go)
+	Slirp4netns bool `json:"slirp4netns,omitempty"`
+	// PortProxy is set while the child connects to its ports for the monitor, for the proxy of a
+	// rootless container and its health checks (see ports.go)
+	PortProxy bool `json:"portProxy,omitempty"`
+	// Nameservers are the DNS servers that come with the network, from the DHCP lease or
+	// slirp4netns. Without any the container gets the host's.
+	Nameservers []string `json:"nameservers,omitempty"`
+	// EmbeddedDNS is the address of the DNS server on the bridge while the monitor runs one (see
+	// dns.go). It is the only nameserver then, it passes the rest on to DNS or the host's.
+	EmbeddedDNS string `json:"embeddedDNS,omitempty"`
+	// Ports are the container ports published on the host (-p)
+	Ports []portMapping `json:"ports,omitempty"`
+	// IngressBandwidth and EgressBandwidth limit the traffic into and out of the container, in
+	// bits per second, 0 for no limit (--network-bandwidth, see bandwidth.go)
+	IngressBandwidth uint64 `json:"ingressBandwidth,omitempty"`
+	EgressBandwidth  uint64 `json:"egressBandwidth,omitempty"`
+	// DNS, DNSSearch and DNSOptions replace the nameservers, search domains and options of the
+	// host's resolv.conf (--dns, --dns-search, --dns-option). ResolvConf is the file the monitor
+	// wrote from it, the child mounts it on /etc/resolv.conf.
+	DNS        []string `json:"dns,omitempty"`
+	DNSSearch  []string `json:"dnsSearch,omitempty"`
+	DNSOptions []string `json:"dnsOptions,omitempty"`
+	ResolvConf string   `json:"resolvConf,omitempty"`
+	// ExtraHosts are the NAME:IP entries for /etc/hosts (--add-host), HostsFile is the file the
+	// monitor wrote with them, the child mounts it on /etc/hosts
+	ExtraHosts []string `json:"extraHosts,omitempty"`
+	HostsFile  string   `json:"hostsFile,omitempty"`
+	// Labels tag the container for us and whoever manages it, e.g. to find it with
+	// `ps --filter label=app=web` (--label). The runtime itself gives them no meaning.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Bundle is the OCI bundle the container was created from (--bundle). Annotations are the
+	// annotations of its config.json (or --annotation), hooks get them in the OCI state.
+	Bundle      string            `json:"bundle,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Env is the complete environment of the containerized process (KEY=VALUE entries)
+	Env []string `json:"env"`
+	// Memory is the cgroup memory limit in bytes, 0 means unlimited
+	Memory int64 `json:"memory"`
+	// MemorySwap is the limit for memory plus swap in bytes: 0 keeps the kernel default,
+	// -1 allows unlimited swap and a value equal to Memory disables swap
+	MemorySwap int64 `json:"memorySwap,omitempty"`
+	// CPUs is the number of CPUs the container may use (0.5 = half a core), 0 means unlimited
+	CPUs float64 `json:"cpus"`
+	// PidsLimit is the maximum number of processes in the container, 0 means unlimited
+	PidsLimit int64 `json:"pidsLimit"`
+	// OOMScoreAdj makes the processes of the container likelier (up to 1000) or less likely (down
+	// to -1000) to be picked by the OOM killer, nil keeps ours (--oom-score-adj)
+	OOMScoreAdj *int `json:"oomScoreAdj,omitempty"`
+	// HugetlbLimits limit the huge pages of each size in the container's cgroup (--hugetlb-limit)
+	HugetlbLimits []hugetlbLimit `json:"hugetlbLimits,omitempty"`
+	// Rlimits are the per-process limits of the containerized process (--ulimit)
+	Rlimits []rlimit `json:"rlimits,omitempty"`
+	// CpusetCpus and CpusetMems pin the container to CPUs and NUMA memory nodes ("0-2,4" syntax)
+	CpusetCpus string `json:"cpusetCpus,omitempty"`
+	CpusetMems string `json:"cpusetMems,omitempty"`
+	// DeviceReadBps and DeviceWriteBps throttle block devices to a number of bytes per second
+	DeviceReadBps  []deviceRate `json:"deviceReadBps,omitempty"`
+	DeviceWriteBps []deviceRate `json:"deviceWriteBps,omitempty"`
+	// Capabilities are the capabilities the containerized process keeps, e.g. "CAP_CHOWN"
+	Capabilities []string `json:"capabilities"`
+	// Seccomp is the syscall filter of the containerized process, nil means unconfined
+	Seccomp *seccompProfile `json:"seccomp,omitempty"`
+	// NoNewPrivileges stops setuid binaries and file capabilities from granting privileges
+	NoNewPrivileges bool `json:"noNewPrivileges"`
+	// AppArmorProfile and SELinuxLabel confine the containerized process with an LSM policy
+	AppArmorProfile string `json:"apparmorProfile,omitempty"`
+	SELinuxLabel    string `json:"selinuxLabel,omitempty"`
+}
+
+// deviceRate is a per-device I/O limit. cgroups identify block devices by their major:minor
+// numbers, not by path, so we resolve the path once in the parent.
+type deviceRate struct {
+	Path  string `json:"path"`
+	Major uint32 `json:"major"`
+	Minor uint32 `json:"minor"`
+	Rate  int64  `json:"rate"`
+}
+
+// device returns the "MAJ:MIN" form the cgroup files expect
+func (d deviceRate) device() string {
+	return fmt.Sprintf("%d:%d", d.Major, d.Minor)
+}
+
+// defaultPath is the PATH every container starts with, the same one Docker uses
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// stringList is a flag.Value for options that may be repeated, e.g. `--env A=1 --env B=2`
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// rootfsEnv overrides the default rootfs, handy when every demo run uses the same directory
+const rootfsEnv = "CONTAINER_ROOTFS"
+
+// parseRunFlags parses `run [OPTIONS] [IMAGE] [COMMAND [ARG...]]`, or the same for `create`.
+//
+// Flag parsing stops at the first non-flag argument, so everything from COMMAND on belongs to the
+// containerized process: `run --memory 50m /bin/sh -c "ls -l"` passes "-c" and "ls -l" to sh.
+// Without IMAGE (see isImageArg) the rootfs is the --rootfs directory, and COMMAND is required.
+func parseRunFlags(name string, args []string) (*containerConfig, error) {
+	cfg := &containerConfig{ID: newContainerID(), MaskedPaths: maskedPaths, ReadonlyPaths: readonlyPaths}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [OPTIONS] [IMAGE] [COMMAND [ARG...]]\n\nOptions:\n", progName(), name)
+		fs.PrintDefaults()
+	}
+
+	var bundle, platform string
+	fs.StringVar(&bundle, "b", "", "run the OCI bundle in this directory: everything but -d, --restart, --label, --trace, --log-opt and the health check comes from its config.json")
+	fs.StringVar(&bundle, "bundle", "", "same as -b")
+	fs.StringVar(&cfg.Rootfs, "rootfs", envOr(rootfsEnv, "/rootfs"), "directory to use as the container's root filesystem (env "+rootfsEnv+")")
+	fs.StringVar(&cfg.Image, "image", "", "run an image of the image store instead of the --rootfs directory, see pull and import")
+	fs.StringVar(&cfg.Snapshotter, "snapshotter", envOr(snapshotterEnv, defaultSnapshotter), "how the rootfs of an image is made: "+snapshotterNames()+" (env "+snapshotterEnv+")")
+	fs.StringVar(&platform, "platform", "", "the platform of the image, OS/ARCH[/VARIANT] like linux/arm64: pulled if the store's is another one")
+	fs.StringVar(&cfg.Hostname, "hostname", "container", "hostname inside the container")
+	fs.StringVar(&cfg.Workdir, "workdir", "/", "working directory inside the container (absolute path)")
+	fs.BoolVar(&cfg.Tty, "t", false, "allocate a pseudo terminal, for interactive programs like shells")
+	fs.BoolVar(&cfg.Tty, "tty", false, "same as -t")
+	fs.BoolVar(&cfg.Trace, "trace", false, "print the system calls of the command and the processes it starts on its stderr, like strace")
+	fs.BoolVar(&cfg.Detach, "d", false, "run the container in the background and print its ID")
+	fs.BoolVar(&cfg.Detach, "detach", false, "same as -d")
+	fs.StringVar(&cfg.Network, "network", networkBridge, "network: bridge (a veth pair on the "+bridgeName+" bridge), macvlan=PARENT (an interface on the network of host interface PARENT), host (the host's network), container:ID (the network of container ID) or none")
+	fs.StringVar(&cfg.Subnet, "subnet", envOr(subnetEnv, defaultSubnet), "IPv4 network of the bridge the container gets an address in (env "+subnetEnv+")")
+	fs.BoolVar(&cfg.IPv6, "ipv6", false, "give the container an IPv6 address on the bridge too, from --subnet6")
+	fs.StringVar(&cfg.Subnet6, "subnet6", envOr(subnet6Env, defaultSubnet6), "IPv6 network of the bridge with --ipv6 (env "+subnet6Env+")")
+	ip := fs.String("ip", "", "static address of a macvlan container with its prefix length, e.g. 192.168.1.50/24, instead of DHCP")
+	gateway := fs.String("gateway", "", "default route of a macvlan container with --ip")
+	var publish stringList
+	fs.Var(&publish, "p", "publish a container port on the host: [HOSTIP:]HOSTPORT:CONTAINERPORT[/udp], e.g. 8080:80 (repeatable)")
+	fs.Var(&publish, "publish", "same as -p")
+	var bandwidth stringList
+	fs.Var(&bandwidth, "network-bandwidth", "limit the container's traffic on the bridge: RATE for both directions, or ingress=RATE,egress=RATE, e.g. 10mbit (repeatable)")
+	var dns, dnsSearch, dnsOptions stringList
+	fs.Var(&dns, "dns", "DNS server for the container's resolv.conf, instead of the host's (repeatable)")
+	fs.Var(&dnsSearch, "dns-search", "search domain for the container's resolv.conf, instead of the host's (repeatable)")
+	fs.Var(&dnsOptions, "dns-option", "resolver option for the container's resolv.conf, e.g. ndots:2, instead of the host's (repeatable)")
+	var addHosts stringList
+	fs.Var(&addHosts, "add-host", "add NAME:IP to the container's /etc/hosts, host-gateway for the bridge's address (repeatable)")
+	fs.StringVar(&cfg.Cgroupns, "cgroupns", cgroupnsPrivate, "cgroup namespace: private (the container's cgroup is its /) or host")
+	boottimeOffset := fs.String("boottime-offset", "", "give the container a time namespace whose boot time (uptime) is ahead by this much, e.g. 10d or -2h")
+	monotonicOffset := fs.String("monotonic-offset", "", "give the container a time namespace whose monotonic clock is ahead by this much, e.g. 1h")
+	var labels, annotations stringList
+	fs.Var(&labels, "l", "set a label on the container: KEY=VALUE, or KEY for an empty value (repeatable)")
+	fs.Var(&labels, "label", "same as -l")
+	fs.Var(&annotations, "annotation", "set an OCI annotation, passed to hooks: KEY=VALUE (repeatable)")
+	restart := fs.String("restart", restartNo, "restart policy of a container started with -d: no, on-failure[:MAX] or always")
+	var logOpts stringList
+	fs.Var(&logOpts, "log-opt", fmt.Sprintf("rotate the log of a container started with -d: max-size=SIZE (default %s, 0 for no limit), max-file=N (default %d) or compress=true (repeatable)", formatBytes(defaultLogMaxSize), defaultLogMaxFile))
+	healthExec := fs.String("health-cmd", "", "check the health of the container with a command, run in it with /bin/sh -c: healthy when it exits 0")
+	healthTCPPort := fs.String("health-tcp", "", "check the health of the container by connecting to this `PORT` of it")
+	healthHTTPGet := fs.String("health-http", "", "check the health of the container with a GET of `PORT[/PATH]`: healthy with a status from 200 to 399")
+	healthInterval := fs.Duration("health-interval", 30*time.Second, "time between two health checks")
+	healthTimeout := fs.Duration("health-timeout", 30*time.Second, "time after which a health check failed")
+	healthRetries := fs.Int("health-retries", 3, "health checks that fail in a row before the container is unhealthy")
+	hooksFile := fs.String("hooks", "", "JSON file with OCI hooks (prestart, poststart, poststop) to run on the host")
+	fs.BoolVar(&cfg.ReadOnly, "read-only", false, "mount the container's root filesystem read-only (/tmp and /run stay writable)")
+	var volumes, tmpfs stringList
+	fs.Var(&volumes, "v", "bind-mount a host path: /host/path:/container/path[:ro] (repeatable)")
+	fs.Var(&volumes, "volume", "same as -v")
+	fs.StringVar(&cfg.RootfsPropagation, "rootfs-propagation", "rprivate", "mount propagation of the container's mounts: rprivate, rslave or rshared")
+	fs.Var(&tmpfs, "tmpfs", "mount a tmpfs, e.g. /tmp:size=64m or /cache:size=10m,noexec (repeatable)")
+	var envs, envFiles stringList
+	fs.Var(&envs, "env", "set an environment variable KEY=VALUE, or KEY to copy it from the host (repeatable)")
+	fs.Var(&envFiles, "env-file", "read environment variables from a file of KEY=VALUE lines (repeatable)")
+	memory := fs.String("memory", "100m", "memory limit (e.g. 512k, 100m, 1g), 0 for no limit")
+	memorySwap := fs.String("memory-swap", "", "limit for memory plus swap (e.g. 200m), equal to --memory disables swap, -1 = unlimited swap")
+	fs.Int64Var(&cfg.PidsLimit, "pids-limit", 0, "maximum number of processes in the container (0 or -1 = no limit)")
+	var hugetlbLimits stringList
+	fs.Var(&hugetlbLimits, "hugetlb-limit", "limit the huge pages of one size: PAGESIZE:LIMIT, e.g. 2MB:64MB (repeatable)")
+	oomScoreAdj := fs.String("oom-score-adj", "", "make the OOM killer likelier (up to 1000) or less likely (down to -1000) to pick the container's processes")
+	var ulimits stringList
+	fs.Var(&ulimits, "ulimit", "set a per-process limit: NAME=SOFT[:HARD], e.g. nofile=1024:2048 or core=0 (repeatable)")
+	fs.StringVar(&cfg.CpusetCpus, "cpuset-cpus", "", "CPUs the container may run on, e.g. 0-2,4")
+	fs.StringVar(&cfg.CpusetMems, "cpuset-mems", "", "NUMA memory nodes the container may allocate from, e.g. 0")
+	var readBps, writeBps stringList
+	fs.Var(&readBps, "device-read-bps", "limit read rate from a block device, e.g. /dev/sda:1m (repeatable)")
+	fs.Var(&writeBps, "device-write-bps", "limit write rate to a block device, e.g. /dev/sda:1m (repeatable)")
+	fs.Float64Var(&cfg.CPUs, "cpus", 0, "number of CPUs the container may use, e.g. 0.5 or 1.5 (0 = no limit)")
+	var capAdd, capDrop stringList
+	fs.Var(&capAdd, "cap-add", "add a Linux capability, e.g. SYS_ADMIN, or ALL (repeatable)")
+	fs.Var(&capDrop, "cap-drop", "drop a Linux capability, e.g. NET_RAW, or ALL (repeatable)")
+	var securityOpts stringList
+	fs.Var(&securityOpts, "security-opt", "security option: seccomp=PROFILE.json|unconfined, no-new-privileges=false, apparmor=PROFILE, label=type:TYPE (repeatable)")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, errUsage
+	}
+
+	// A created container waits in the background, like one started with -d
+	if name == "create" {
+		cfg.Detach, cfg.CreateOnly = true, true
+	}
+
+	var err error
+	if cfg.Restart, err = parseRestartPolicy(*restart); err != nil {
+		return nil, usageErrorf(fs, "invalid --restart %q: %v", *restart, err)
+	}
+	// In the foreground Ctrl-C would only end the current run, so only the monitor restarts
+	if cfg.Restart.Name != restartNo && !cfg.Detach {
+		return nil, usageErrorf(fs, "--restart needs -d")
+	}
+	if cfg.Trace {
+		if err := checkTrace(); err != nil {
+			return nil, usageErrorf(fs, "%v", err)
+		}
+	}
+	if cfg.Log, err = parseLogOptions(logOpts); err != nil {
+		return nil, usageErrorf(fs, "invalid --log-opt: %v", err)
+	}
+	// Only a background container has a log
+	if len(logOpts) > 0 && !cfg.Detach {
+		return nil, usageErrorf(fs, "--log-opt needs -d")
+	}
+	if cfg.Health, err = parseHealthCheck(*healthExec, *healthTCPPort, *healthHTTPGet, *healthInterval, *healthTimeout, *healthRetries); err != nil {
+		return nil, usageErrorf(fs, "%v", err)
+	}
+
+	if cfg.Labels, err = parseKeyValues(labels); err != nil {
+		return nil, usageErrorf(fs, "invalid --label: %v", err)
+	}
+
+	if bundle != "" {
+		var others []string
+		fs.Visit(func(f *flag.Flag) {
+			if !slices.Contains([]string{"b", "bundle", "d", "detach", "restart", "l", "label", "trace", "log-opt"}, f.Name) && !strings.HasPrefix(f.Name, "health-") {
+				others = append(others, "--"+f.Name)
+			}
+		})
+		if len(others) > 0 {
+			return nil, usageErrorf(fs, "--bundle takes the settings from config.json, it can't be combined with %s", strings.Join(others, ", "))
+		}
+		if fs.NArg() > 0 {
+			return nil, usageErrorf(fs, "--bundle takes the command from config.json, unexpected argument %q", fs.Arg(0))
+		}
+		if err := loadBundle(cfg, bundle); err != nil {
+			return nil, err
+		}
+		if cfg.Tty && cfg.Detach {
+			return nil, usageErrorf(fs, "process.terminal in config.json needs the terminal, it can't be combined with -d or create")
+		}
+		return cfg, nil
+	}
+
+	// Nobody would be there to type into the terminal or see what it shows
+	if cfg.Tty && cfg.Detach {
+		return nil, usageErrorf(fs, "-t needs the terminal, it can't be combined with -d or create")
+	}
+
+	if cfg.Annotations, err = parseKeyValues(annotations); err != nil {
+		return nil, usageErrorf(fs, "invalid --annotation: %v", err)
+	}
+
+	if mode, parent, ok := strings.Cut(cfg.Network, "="); ok && mode == networkMacvlan {
+		if _, err := net.InterfaceByName(parent); err != nil {
+			return nil, usageErrorf(fs, "invalid --network %q: no host interface %q", cfg.Network, parent)
+		}
+		cfg.Network, cfg.MacvlanParent = networkMacvlan, parent
+	} else if mode, id, ok := strings.Cut(cfg.Network, ":"); ok && mode == networkContainer {
+		// Like exec: joining the namespaces of a rootless container takes its user namespace too
+		if os.Geteuid() != 0 {
+			return nil, usageErrorf(fs, "--network container:ID needs root")
+		}
+		other, err := findContainer(id)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --network %q: %v", cfg.Network, err)
+		}
+		cfg.Network, cfg.NetworkContainer = networkContainer, other.ID
+	} else if cfg.Network == networkMacvlan {
+		return nil, usageErrorf(fs, "invalid --network %q: expected macvlan=PARENT, e.g. macvlan=eth0", cfg.Network)
+	} else if cfg.Network != networkBridge && cfg.Network != networkHost && cfg.Network != networkNone {
+		return nil, usageErrorf(fs, "invalid --network %q: expected bridge, macvlan=PARENT, host, container:ID or none", cfg.Network)
+	}
+	if *ip != "" {
+		if cfg.Network != networkMacvlan {
+			return nil, usageErrorf(fs, "--ip needs --network macvlan=PARENT")
+		}
+		addr, subnet, err := net.ParseCIDR(*ip)
+		if err != nil || addr.To4() == nil {
+			return nil, usageErrorf(fs, "invalid --ip %q: expected an IPv4 address with its prefix length, e.g. 192.168.1.50/24", *ip)
+		}
+		cfg.IPAddress = (&net.IPNet{IP: addr, Mask: subnet.Mask}).String()
+		if *gateway != "" {
+			gw := net.ParseIP(*gateway)
+			// The route to the gateway comes with the address
+			if gw == nil || !subnet.Contains(gw) {
+				return nil, usageErrorf(fs, "invalid --gateway %q: not an address in %s", *gateway, subnet)
+			}
+			cfg.Gateway = gw.String()
+		}
+	} else if *gateway != "" {
+		return nil, usageErrorf(fs, "--gateway needs --ip")
+	}
+	cfg.DHCP = cfg.Network == networkMacvlan && cfg.IPAddress == ""
+	if cfg.Network != networkBridge {
+		cfg.Subnet = ""
+	} else if _, err := parseSubnet(cfg.Subnet); err != nil {
+		return nil, usageErrorf(fs, "invalid --subnet %q: %v", cfg.Subnet, err)
+	}
+	if cfg.IPv6 && cfg.Network != networkBridge {
+		return nil, usageErrorf(fs, "--ipv6 needs --network bridge")
+	}
+	if !cfg.IPv6 {
+		cfg.Subnet6 = ""
+	} else if _, err := parseSubnet6(cfg.Subnet6); err != nil {
+		return nil, usageErrorf(fs, "invalid --subnet6 %q: %v", cfg.Subnet6, err)
+	}
+	for _, v := range publish {
+		p, err := parsePublish(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --publish %q: %v", v, err)
+		}
+		cfg.Ports = append(cfg.Ports, p)
+	}
+	// Without a bridge there is nothing to forward to
+	if len(cfg.Ports) > 0 && cfg.Network == networkHost {
+		return nil, usageErrorf(fs, "--publish has no use with --network host: the container's ports are the host's")
+	}
+	if len(cfg.Ports) > 0 && cfg.Network != networkBridge {
+		return nil, usageErrorf(fs, "--publish needs --network bridge")
+	}
+	for _, v := range bandwidth {
+		if err := parseBandwidth(cfg, v); err != nil {
+			return nil, usageErrorf(fs, "invalid --network-bandwidth %q: %v", v, err)
+		}
+	}
+	// The limits are qdiscs on the ends of the veth pair, which a rootless container doesn't have
+	if len(bandwidth) > 0 && (cfg.Network != networkBridge || os.Geteuid() != 0) {
+		return nil, usageErrorf(fs, "--network-bandwidth needs --network bridge and root")
+	}
+	for _, v := range dns {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, usageErrorf(fs, "invalid --dns %q: not an IP address", v)
+		}
+		cfg.DNS = append(cfg.DNS, ip.String())
+	}
+	cfg.DNSSearch, cfg.DNSOptions = dnsSearch, dnsOptions
+	for _, v := range addHosts {
+		entry, err := parseAddHost(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --add-host %q: %v", v, err)
+		}
+		if strings.HasSuffix(entry, ":"+hostGateway) && cfg.Network != networkBridge {
+			return nil, usageErrorf(fs, "--add-host %s needs --network bridge", v)
+		}
+		cfg.ExtraHosts = append(cfg.ExtraHosts, entry)
+	}
+	// The container shares the other one's resolv.conf and hosts, like in Docker
+	if cfg.Network == networkContainer && len(cfg.DNS)+len(cfg.DNSSearch)+len(cfg.DNSOptions)+len(cfg.ExtraHosts) > 0 {
+		return nil, usageErrorf(fs, "--dns, --dns-search, --dns-option and --add-host can't be combined with --network container:ID, the files are the other container's")
+	}
+
+	if cfg.Cgroupns != cgroupnsPrivate && cfg.Cgroupns != cgroupnsHost {
+		return nil, usageErrorf(fs, "invalid --cgroupns %q: expected private or host", cfg.Cgroupns)
+	}
+
+	// Either offset asks for a time namespace, the other clock then keeps the host's time
+	if *boottimeOffset != "" {
+		if cfg.TimeOffsets.Boottime, err = parseTimeOffset(*boottimeOffset); err != nil {
+			return nil, usageErrorf(fs, "invalid --boottime-offset %q: %v", *boottimeOffset, err)
+		}
+		cfg.TimeNamespace = true
+	}
+	if *monotonicOffset != "" {
+		if cfg.TimeOffsets.Monotonic, err = parseTimeOffset(*monotonicOffset); err != nil {
+			return nil, usageErrorf(fs, "invalid --monotonic-offset %q: %v", *monotonicOffset, err)
+		}
+		cfg.TimeNamespace = true
+	}
+
+	if *hooksFile != "" {
+		if cfg.Hooks, err = loadHooks(*hooksFile); err != nil {
+			return nil, usageErrorf(fs, "invalid --hooks: %v", err)
+		}
+	}
+
+	if cfg.Memory, err = parseBytes(*memory); err != nil {
+		return nil, usageErrorf(fs, "invalid --memory value %q: %v", *memory, err)
+	}
+
+	if err := validateHostname(cfg.Hostname); err != nil {
+		return nil, usageErrorf(fs, "invalid --hostname %q: %v", cfg.Hostname, err)
+	}
+
+	if *memorySwap != "" {
+		if cfg.MemorySwap, err = parseMemorySwap(*memorySwap, cfg.Memory); err != nil {
+			return nil, usageErrorf(fs, "invalid --memory-swap value %q: %v", *memorySwap, err)
+		}
+	}
+
+	// The kernel needs a quota of at least 1ms per period
+	if cfg.CPUs != 0 && cpuQuota(cfg.CPUs) < 1000 {
+		return nil, usageErrorf(fs, "invalid --cpus %v: must be 0 or at least 0.01", cfg.CPUs)
+	}
+
+	// Docker accepts -1 for "unlimited" too
+	if cfg.PidsLimit < -1 {
+		return nil, usageErrorf(fs, "invalid --pids-limit %d", cfg.PidsLimit)
+	}
+
+	for _, v := range hugetlbLimits {
+		l, err := parseHugetlbLimit(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --hugetlb-limit %q: %v", v, err)
+		}
+		cfg.HugetlbLimits = append(cfg.HugetlbLimits, l)
+	}
+
+	if *oomScoreAdj != "" {
+		adj, err := strconv.Atoi(*oomScoreAdj)
+		if err != nil || adj < -1000 || adj > 1000 {
+			return nil, usageErrorf(fs, "invalid --oom-score-adj %q: expected a number from -1000 to 1000", *oomScoreAdj)
+		}
+		cfg.OOMScoreAdj = &adj
+	}
+
+	for _, v := range ulimits {
+		l, err := parseUlimit(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --ulimit %q: %v", v, err)
+		}
+		// A second --ulimit for the same resource replaces the first
+		cfg.Rlimits = slices.DeleteFunc(cfg.Rlimits, func(other rlimit) bool { return other.Type == l.Type })
+		cfg.Rlimits = append(cfg.Rlimits, l)
+	}
+
+	if err := validateCPUList(cfg.CpusetCpus); err != nil {
+		return nil, usageErrorf(fs, "invalid --cpuset-cpus %q: %v", cfg.CpusetCpus, err)
+	}
+	if err := validateCPUList(cfg.CpusetMems); err != nil {
+		return nil, usageErrorf(fs, "invalid --cpuset-mems %q: %v", cfg.CpusetMems, err)
+	}
+
+	for _, v := range readBps {
+		limit, err := parseDeviceRate(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --device-read-bps %q: %v", v, err)
+		}
+		cfg.DeviceReadBps = append(cfg.DeviceReadBps, limit)
+	}
+	for _, v := range writeBps {
+		limit, err := parseDeviceRate(v)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid --device-write-bps %q: %v", v, err)
+		}
+		cfg.DeviceWriteBps = append(cfg.DeviceWriteBps, limit)
+	}
+
+	if cfg.Capabilities, err = parseCapabilities(capAdd, capDrop); err != nil {
+		return nil, usageErrorf(fs, "%v", err)
+	}
+
+	// Needs the final capabilities: the default profile allows more syscalls with --cap-add
+	if err := parseSecurityOpts(cfg, securityOpts); err != nil {
+		return nil, usageErrorf(fs, "%v", err)
+	}
+
+	for _, spec := range volumes {
+		v, err := parseVolume(spec)
+		if err != nil {
+			return nil, usageErrorf(fs, "invalid volume %q: %v", spec, err)
+		}
+		cfg.Volumes = append(cfg.Volumes, v)
+	}
+	if _, ok := propagationFlags[cfg.RootfsPropagation]; !ok {
+		return nil, usageErrorf(fs, "invalid --rootfs-propagation %q", cfg.RootfsPropagation)
+	}
+	// Like Docker: a volume can only pass mounts on if the tree it sits in does
+	for _, v := range cfg.Volumes {
+		switch {
+		case strings.HasSuffix(v.Propagation, "shared"):
+			cfg.RootfsPropagation = "rshared"
+		case strings.HasSuffix(v.Propagation, "slave") && cfg.RootfsPropagation != "rshared":
+			cfg.RootfsPropagation = "rslave"
+		}
+	}
+	if cfg.Tmpfs, err = buildTmpfs(tmpfs, cfg.Volumes); err != nil {
+		return nil, usageErrorf(fs, "%v", err)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if _, ok := snapshotters[cfg.Snapshotter]; !ok {
+		return nil, usageErrorf(fs, "unknown --snapshotter %q, expected %s", cfg.Snapshotter, snapshotterNames())
+	}
+	cfg.Args = fs.Args()
+	// A rootfs of your own, with --rootfs or its environment variable, has the commands
+	rootfsGiven := explicit["rootfs"] || os.Getenv(rootfsEnv) != ""
+	if cfg.Image == "" && !explicit["rootfs"] && len(cfg.Args) > 0 && isImageArg(cfg.Args[0], cfg.Rootfs, rootfsGiven) {
+		// `run alpine /bin/sh`: the first argument is the image
+		cfg.Image, cfg.Args = cfg.Args[0], cfg.Args[1:]
+	}
+	if cfg.Image != "" && explicit["rootfs"] {
+		return nil, usageErrorf(fs, "--image and --rootfs both name the root filesystem, use one")
+	}
+	var want *ociPlatform
+	if platform != "" {
+		if cfg.Image == "" {
+			return nil, usageErrorf(fs, "--platform is the platform of an image, there is none")
+		}
+		p, err := parsePlatform(platform)
+		if err != nil {
+			return nil, usageErrorf(fs, "%v", err)
+		}
+		want = &p
+	}
+	if cfg.Image == "" {
+		if explicit["snapshotter"] {
+			return nil, usageErrorf(fs, "--snapshotter makes the rootfs of an image, there is none")
+		}
+		cfg.Snapshotter = ""
+		if len(cfg.Args) == 0 {
+			return nil, usageErrorf(fs, "missing COMMAND")
+		}
+	}
+	if !filepath.IsAbs(cfg.Workdir) {
+		return nil, usageErrorf(fs, "invalid --workdir %q: must be an absolute path", cfg.Workdir)
+	}
+	// The env files are read once, and checked along with --env before the image comes into it
+	var userEnv []string
+	for _, file := range envFiles {
+		lines, err := readEnvFile(file)
+		if err != nil {
+			return nil, usageErrorf(fs, "%v", err)
+		}
+		userEnv = append(userEnv, lines...)
+	}
+	userEnv = append(userEnv, envs...)
+	if _, err := buildEnv(cfg.Hostname, nil, userEnv); err != nil {
+		return nil, usageErrorf(fs, "%v", err)
+	}
+
+	// Every option is fine, only now the image may have to come from the network
+	var image *imageConfig
+	if cfg.Image != "" {
+		if cfg.ImageID, image, err = findOrPullImage(cfg.Image, want); err != nil {
+			return nil, err
+		}
+		if cfg.Layers, err = imageLayers(cfg.ImageID); err != nil {
+			return nil, err
+		}
+		cfg.Rootfs = filepath.Join(containerDataDir(cfg.ID), "merged")
+		// The defaults of the image, Docker's way: the arguments go after the entrypoint, and
+		// replace the command
+		if len(cfg.Args) == 0 {
+			cfg.Args = image.Config.Cmd
+		}
+		cfg.Args = append(slices.Clone(image.Config.Entrypoint), cfg.Args...)
+		if len(cfg.Args) == 0 {
+			return nil, usageErrorf(fs, "missing COMMAND, the image %s has none", cfg.Image)
+		}
+		if !explicit["workdir"] && image.Config.WorkingDir != "" {
+			cfg.Workdir = image.Config.WorkingDir
+			if !filepath.IsAbs(cfg.Workdir) {
+				return nil, fmt.Errorf("image %s has an invalid working directory %q: must be an absolute path", cfg.Image, cfg.Workdir)
+			}
+		}
+	}
+	cfg.Workdir = filepath.Clean(cfg.Workdir)
+
+	var imageEnv []string
+	if image != nil {
+		imageEnv = image.Config.Env
+	}
+	if cfg.Env, err = buildEnv(cfg.Hostname, imageEnv, userEnv); err != nil {
+		return nil, err
+	}
+
+	// Check the rootfs now: once we are inside the new namespaces a mistake here only shows up as
+	// an obscure mount or exec error. An image's rootfs is only there once the child mounted it.
+	if len(cfg.Layers) > 0 {
+		if filepath.IsAbs(cfg.Args[0]) && !findInLayers(cfg.Layers, cfg.Args[0]) {
+			return nil, fmt.Errorf("%s not found in image %s", cfg.Args[0], cfg.Image)
+		}
+	} else if cfg.Rootfs, err = validateRootfs(cfg.Rootfs, cfg.Args[0]); err != nil {
+		return nil, err
+	} else if !strings.Contains(cfg.Args[0], "/") && !commandInContainer(cfg, cfg.Args[0]) {
+		// Like `lss` for ls: not an image either, with a rootfs of its own
+		return nil, fmt.Errorf("%s: command not found in rootfs %s", cfg.Args[0], cfg.Rootfs)
+	}
+	return cfg, nil
+}
+
+// isImageArg tells whether the first argument of run is an image, like alpine in `run alpine
+// /bin/sh`, or the command, like wget in `run wget -qO- example.com`. A bare name could be both.
+// It's an image if the store has it, and the command if the rootfs has it. Otherwise, without a
+// rootfs of your own, `run alpine` pulls alpine. With one only a name that can't be a command is
+// pulled, one with a tag, a digest or a registry: `run lss` is a typo, not docker.io/library/lss.
+// An absolute path is always the command.
+func isImageArg(arg, rootfs string, rootfsGiven bool) bool {
+	if filepath.IsAbs(arg) {
+		return false
+	}
+	ref, err := parseReference(arg)
+	if err != nil {
+		return false
+	}
+	if _, _, err := findImage(arg); err == nil {
+		return true
+	}
+	if commandInRootfs(rootfs, arg, defaultPath) {
+		return false
+	}
+	return !rootfsGiven || strings.ContainsAny(arg, ":@") || ref.Registry != dockerHub
+}
+
+// commandInRootfs tells whether rootfs has command in one of the directories of path, a PATH.
+func commandInRootfs(rootfs, command, path string) bool {
+	for _, dir := range filepath.SplitList(path) {
+		if _, err := os.Lstat(filepath.Join(rootfs, dir, command)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// commandInContainer tells whether the container of cfg will find command in its PATH: in its
+// rootfs, or in a volume mounted on one of the directories.
+func commandInContainer(cfg *containerConfig, command string) bool {
+	for _, dir := range filepath.SplitList(envPath(cfg.Env)) {
+		root, sub := cfg.Rootfs, dir
+		// The last volume on dir or above it is what the container sees there
+		for _, v := range cfg.Volumes {
+			if rel, err := filepath.Rel(v.Destination, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				root, sub = v.Source, rel
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(root, sub, command)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// envPath is the PATH of the environment env.
+func envPath(env []string) string {
+	path := defaultPath
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = value
+		}
+	}
+	return path
+}
+
+// validateRootfs makes sure dir looks like a root filesystem we can pivot into and returns its absolute path.
+func validateRootfs(dir, command string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("rootfs %s: %w", dir, err)
+	}
+	hint := "run an image, like `" + progName() + " run alpine /bin/sh`, see Readme.md for how to download the Alpine minirootfs, or point --rootfs/" + rootfsEnv + " at another directory"
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("rootfs %s does not exist (%s)", abs, hint)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("rootfs %s is not a directory", abs)
+	}
+	if abs == "/" {
+		return "", errors.New("rootfs can't be the host's / (pivot_root needs a different directory)")
+	}
+
+	// We mount a fresh procfs on <rootfs>/proc and a tmpfs on <rootfs>/dev, and a rootless
+	// container can't create the directories
+	for _, dir := range []string{"proc", "dev"} {
+		if info, err := os.Stat(filepath.Join(abs, dir)); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("rootfs %s has no /%s directory, is it a root filesystem? (%s)", abs, dir, hint)
+		}
+	}
+
+	// An absolute command is looked up inside the rootfs, not on the host. Lstat, because
+	// /bin/sh is often a symlink (e.g. to /bin/busybox) that only resolves inside the container.
+	if filepath.IsAbs(command) {
+		if _, err := os.Lstat(filepath.Join(abs, command)); err != nil {
+			return "", fmt.Errorf("%s not found in rootfs %s", command, abs)
+		}
+	}
+	return abs, nil
+}
+
+// parseMemorySwap parses --memory-swap, which only makes sense together with a memory limit.
+func parseMemorySwap(v string, memory int64) (int64, error) {
+	if memory == 0 {
+		return 0, errors.New("requires --memory")
+	}
+	if v == "-1" {
+		return -1, nil
+	}
+	swap, err := parseBytes(v)
+	if err != nil {
+		return 0, err
+	}
+	if swap < memory {
+		return 0, errors.New("must be at least as large as --memory, it counts memory plus swap")
+	}
+	return swap, nil
+}
+
+// parseSecurityOpts applies the --security-opt KEY=VALUE options, Docker's syntax.
+func parseSecurityOpts(cfg *containerConfig, opts []string) error {
+	cfg.Seccomp = defaultSeccompProfile()
+	cfg.NoNewPrivileges = true
+	var labelParts []string
+	for _, opt := range opts {
+		key, value, hasValue := strings.Cut(opt, "=")
+		switch key {
+		case "seccomp":
+			if value == "unconfined" {
+				cfg.Seccomp = nil
+				continue
+			}
+			profile, err := loadSeccompProfile(value, cfg.Capabilities)
+			if err != nil {
+				return fmt.Errorf("invalid --security-opt %s: %v", opt, err)
+			}
+			cfg.Seccomp = profile
+		case "no-new-privileges":
+			// Docker's default is off, ours is on; `no-new-privileges=false` shows the difference
+			if !hasValue {
+				value = "true"
+			}
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid --security-opt %s: expected true or false", opt)
+			}
+			cfg.NoNewPrivileges = enabled
+		case "apparmor":
+			if value == "unconfined" {
+				cfg.AppArmorProfile = ""
+				continue
+			}
+			if err := validateAppArmorProfile(value); err != nil {
+				return fmt.Errorf("invalid --security-opt %s: %v", opt, err)
+			}
+			cfg.AppArmorProfile = value
+		case "label":
+			// label=disable runs without a label, the parts of several label= options add up
+			if value == "disable" {
+				labelParts = nil
+				continue
+			}
+			labelParts = append(labelParts, value)
+		default:
+			return fmt.Errorf("invalid --security-opt %q: unknown option", opt)
+		}
+	}
+
+	if len(labelParts) > 0 {
+		label, err := parseSELinuxLabel(labelParts)
+		if err != nil {
+			return fmt.Errorf("invalid --security-opt label: %v", err)
+		}
+		cfg.SELinuxLabel = label
+	}
+	return nil
+}
+
+// buildTmpfs combines the default tmpfs mounts with --tmpfs. A --tmpfs for a default path
+// replaces it, other paths are mounted in addition. A volume on a default path replaces it too.
+func buildTmpfs(specs []string, volumes []volumeMount) ([]tmpfsMount, error) {
+	var mounts []tmpfsMount
+	for _, d := range defaultTmpfs {
+		if !slices.ContainsFunc(volumes, func(v volumeMount) bool { return v.Destination == d.Path }) {
+			mounts = append(mounts, d)
+		}
+	}
+	for _, spec := range specs {
+		m, err := parseTmpfs(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --tmpfs %q: %v", spec, err)
+		}
+		i := slices.IndexFunc(mounts, func(d tmpfsMount) bool { return d.Path == m.Path })
+		if i >= 0 {
+			mounts[i] = m
+		} else {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts, nil
+}
+
+// validateHostname applies the RFC 1123 rules: letters, digits, '-' and '.', at most 64 bytes
+// (HOST_NAME_MAX, the kernel rejects anything longer with EINVAL).
+func validateHostname(name string) error {
+	if name == "" || len(name) > 64 {
+		return errors.New("must be 1 to 64 characters long")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("labels must not be empty or start/end with '-'")
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("character %q is not allowed", r)
+			}
+		}
+	}
+	return nil
+}
+
+// buildEnv assembles the container environment.
+//
+// The host environment is NOT inherited: your shell's $HOME, $SSH_AUTH_SOCK or $AWS_* variables have
+// no business inside the container, and a run should behave the same no matter who starts it.
+// Later entries win: envs override the image's environment, and that the defaults, most images
+// set their own PATH. parseRunFlags passes the lines of the --env-file files first and --env
+// after them, so --env overrides --env-file.
+func buildEnv(hostname string, imageEnv, envs []string) ([]string, error) {
+	entries := append([]string{"PATH=" + defaultPath, "HOSTNAME=" + hostname}, imageEnv...)
+	entries = append(entries, envs...)
+
+	// Resolve each entry and keep only the last value of every key, in first-seen order
+	var env []string
+	index := map[string]int{}
+	for _, entry := range entries {
+		key, value, hasValue := strings.Cut(entry, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid environment variable %q", entry)
+		}
+		if !hasValue {
+			// Docker semantics: a bare KEY copies the host's value, or is dropped when unset
+			var ok bool
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		if i, ok := index[key]; ok {
+			env[i] = key + "=" + value
+			continue
+		}
+		index[key] = len(env)
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// readEnvFile reads KEY=VALUE lines. Blank lines and lines starting with # are ignored,
+// and values are taken literally (no quote removal or variable expansion, like docker).
+func readEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("env file: %w", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimLeft(strings.TrimSuffix(line, "\r"), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// validateCPUList checks the kernel's list format: comma separated numbers and ranges like "0-3,8".
+// Whether the CPUs/nodes exist is checked by the kernel when we write the cgroup file.
+func validateCPUList(list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%q is not a number or range", part)
+		}
+		if isRange {
+			last, err := strconv.ParseUint(hi, 10, 16)
+			if err != nil || last < first {
+				return fmt.Errorf("%q is not a valid range", part)
+			}
+		}
+	}
+	return nil
+}
+
+// parseDeviceRate parses PATH:RATE, e.g. "/dev/sda:10m", and looks up the device numbers.
+func parseDeviceRate(v string) (deviceRate, error) {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return deviceRate{}, errors.New("expected DEVICE:RATE")
+	}
+	path, rateStr := v[:i], v[i+1:]
+
+	rate, err := parseBytes(rateStr)
+	if err != nil {
+		return deviceRate{}, err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return deviceRate{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return deviceRate{}, fmt.Errorf("%s is not a block device", path)
+	}
+	major, minor := splitDev(st.Rdev)
+	return deviceRate{Path: path, Major: major, Minor: minor, Rate: rate}, nil
+}
+
+// parseKeyValues turns KEY=VALUE entries (--label, --annotation) into a map. A KEY without "="
+// gets an empty value, like in Docker. Later entries win.
+func parseKeyValues(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, entry := range entries {
+		key, value, _ := strings.Cut(entry, "=")
+		if key == "" {
+			return nil, fmt.Errorf("%q has no key", entry)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// newContainerID returns a random 64 character hex ID, the same format Docker uses.
+// Like Docker we print only the first 12 characters (see shortID), which is plenty to be unique.
+// Plenty is not always: an ID whose short form another container has already is drawn again, so
+// every short ID printed can be used as a prefix. So is one whose short form is all digits, like
+// Docker does, it would look like a PID or a number to whoever reads it.
+func newContainerID() string {
+	b := make([]byte, 32)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic(err) // crypto/rand never fails on Linux
+		}
+		id := hex.EncodeToString(b)
+		if strings.Trim(shortID(id), "0123456789") != "" && !shortIDTaken(shortID(id)) {
+			return id
+		}
+	}
+}
+
+// shortIDTaken reports whether the ID of an existing container starts with short.
+func shortIDTaken(short string) bool {
+	for _, s := range listStates() {
+		if strings.HasPrefix(s.ID, short) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortID is the abbreviated ID shown to users
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// envOr returns the value of the environment variable key, or fallback when it is unset or empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// usageErrorf prints a problem found after flag parsing the same way the flag package does.
+func usageErrorf(fs *flag.FlagSet, format string, a ...any) error {
+	fmt.Fprintf(fs.Output(), format+"\n", a...)
+	fs.Usage()
+	return errUsage
+}
+
+// parseBytes turns docker-style sizes like "100m" or "1g" into bytes.
+// Suffixes are powers of 1024: b, k, m, g (case-insensitive), also as kb, mb and gb like the
+// kernel writes huge page sizes. A bare number is bytes.
+func parseBytes(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n := len(s); n > 1 && s[n-1] == 'b' && strings.ContainsRune("kmg", rune(s[n-2])) {
+		s = s[:n-1]
+	}
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if strings.ContainsRune("bkmg", rune(s[n-1])) {
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("expected a number with an optional b, k, m or g suffix")
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n * multiplier, nil
+}
+
+// formatBytes is the opposite of parseBytes, for output: 104857600 becomes "100.0MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// sendConfig writes the config to the child over the pipe it inherited as file descriptor 3.
+//
+// runc does the same: `runc init` reads its configuration from an inherited pipe
+// (_LIBCONTAINER_INITPIPE) instead of command-line arguments. The child also can't continue until
+// the config arrives, which gives the parent a natural point to finish any setup first.
+func sendConfig(pipe *os.File, cfg *containerConfig) error {
+	defer pipe.Close()
+	return json.NewEncoder(pipe).Encode(cfg)
+}
+
+// receiveConfig is the child side of sendConfig.
+func receiveConfig() (*containerConfig, error) {
+	pipe := os.NewFile(3, "config-pipe")
+	defer pipe.Close()
+
+	var cfg containerConfig
+	if err := json.NewDecoder(pipe).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("read config from parent: %w", err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,403 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A digest says the image is the one asked for (see pull.go), not that the one asked for is any
+// good: whoever can push to the repository can move a tag to an image of their own. A signature
+// says who vouches for a digest. `pull --verify` checks the signatures of cosign, Sigstore's tool,
+// which keeps them in the registry next to the image, as an image of their own whose tag is the
+// digest of the signed manifest:
+//
+//	ghcr.io/org/app:v2                       the index, sha256:5d2c4a1b...
+//	ghcr.io/org/app:sha256-5d2c4a1b....sig   its signatures, a manifest with a layer each
+//
+// The layer is the signed "payload", a JSON document with the digest that is signed, and the
+// signature is in an annotation of the layer:
+//
+//	{"critical": {"identity": {"docker-reference": "ghcr.io/org/app"},
+//	              "image": {"docker-manifest-digest": "sha256:5d2c4a1b..."},
+//	              "type": "cosign container image signature"}, "optional": null}
+//
+// A pull with --verify fails unless a signature of the digest it got is valid, before it
+// downloads any layer. There are two ways to say whose signature is valid:
+//
+//   - With a key: `cosign generate-key-pair` makes one, `cosign sign --key cosign.key IMAGE`
+//     signs, and `pull --verify --key cosign.pub IMAGE` checks with the public key.
+//   - Keyless: `cosign sign IMAGE` logs in with OpenID Connect, to GitHub, Google or Microsoft, or
+//     in CI as the workflow, and Sigstore's certificate authority Fulcio certifies a key made for
+//     this one signature for the identity of the login, for 10 minutes. The transparency log Rekor
+//     records the signature, and signs the time it did: the certificate was valid then. We check
+//     that the certificate is Fulcio's, that Rekor's entry is the signature, and that it is the
+//     identity of --certificate-identity, by the OIDC issuer of --certificate-oidc-issuer: any login
+//     gets a certificate, the identity says whose.
+//
+// Fulcio's certificates and Rekor's key come from Sigstore's "trust root", which cosign updates
+// with TUF. We don't, we read them from the files cosign reads instead when it's told to, in
+// SIGSTORE_ROOT_FILE and SIGSTORE_REKOR_PUBLIC_KEY. We also don't check the certificate's SCT,
+// the receipt of the certificate transparency log of Fulcio, and don't ask Rekor online: the
+// entry of the signature has to be in the "bundle" cosign attaches to it.
+
+// The annotations of a cosign signature layer
+const (
+	mediaTypeCosignPayload      = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignAnnotationSignature   = "dev.cosignproject.cosign/signature"
+	cosignAnnotationCertificate = "dev.sigstore.cosign/certificate"
+	cosignAnnotationChain       = "dev.sigstore.cosign/chain"
+	cosignAnnotationBundle      = "dev.sigstore.cosign/bundle"
+	cosignPayloadType           = "cosign container image signature"
+)
+
+// The OIDC issuer of a Fulcio certificate is in an extension: the old one has the URL as is, the
+// new one as an ASN.1 UTF8String.
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// signaturePolicy is whose signatures pull --verify accepts: the holder of key, or keyless the
+// identity certified by a root for a login at issuer.
+type signaturePolicy struct {
+	key     crypto.PublicKey
+	keyFile string
+
+	identity, issuer string
+	roots, chain     *x509.CertPool
+	rekorKey         crypto.PublicKey
+}
+
+// newSignaturePolicy makes the policy of pull --verify: with keyFile, signatures of its key,
+// otherwise keyless ones of identity and issuer.
+func newSignaturePolicy(keyFile, identity, issuer string) (*signaturePolicy, error) {
+	if keyFile != "" {
+		key, err := readPublicKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &signaturePolicy{key: key, keyFile: keyFile}, nil
+	}
+	if identity == "" || issuer == "" {
+		return nil, errors.New("--verify without --key needs --certificate-identity and --certificate-oidc-issuer: whose keyless signature to accept")
+	}
+	p := &signaturePolicy{identity: identity, issuer: issuer, roots: x509.NewCertPool(), chain: x509.NewCertPool()}
+	rootFile, rekorFile := os.Getenv("SIGSTORE_ROOT_FILE"), os.Getenv("SIGSTORE_REKOR_PUBLIC_KEY")
+	if rootFile == "" || rekorFile == "" {
+		return nil, errors.New("keyless verification needs Fulcio's certificates in $SIGSTORE_ROOT_FILE and Rekor's public key in $SIGSTORE_REKOR_PUBLIC_KEY")
+	}
+	data, err := os.ReadFile(rootFile)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates: %v", rootFile, err)
+	}
+	// The file has the root and the intermediate certificates
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			p.roots.AddCert(cert)
+		} else {
+			p.chain.AddCert(cert)
+		}
+	}
+	if p.rekorKey, err = readPublicKey(rekorFile); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// verifySignatures checks that the image with the manifest digest has a signature policy
+// accepts, and says whose it is on out.
+func verifySignatures(c *registryClient, digest string, policy *signaturePolicy, out io.Writer) error {
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	m, _, err := c.manifest(tag)
+	if err != nil {
+		return fmt.Errorf("%s has no cosign signature: %w", c.ref, err)
+	}
+	var problems []error
+	for _, layer := range m.Layers {
+		if layer.MediaType != mediaTypeCosignPayload {
+			continue
+		}
+		signer, err := verifySignature(c, layer, digest, policy)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("signature %s: %w", shortID(strings.TrimPrefix(layer.Digest, "sha256:")), err))
+			continue
+		}
+		fmt.Fprintf(out, "Verified signature of %s by %s\n", digest, signer)
+		return nil
+	}
+	if len(problems) == 0 {
+		return fmt.Errorf("%s: %s has no cosign signatures", c.ref, tag)
+	}
+	return fmt.Errorf("%s: no valid signature of %s: %w", c.ref, digest, errors.Join(problems...))
+}
+
+// verifySignature checks one signature layer of cosign, and returns who signed.
+func verifySignature(c *registryClient, layer ociDescriptor, digest string, policy *signaturePolicy) (string, error) {
+	body, err := c.blob(layer.Digest)
+	if err != nil {
+		return "", err
+	}
+	payload, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	body.Close()
+	if err == nil {
+		err = verifyContent(payload, layer)
+	}
+	if err != nil {
+		return "", fmt.Errorf("payload: %w", err)
+	}
+	// What is signed has to be the digest we pulled, a signature of another image doesn't count
+	var doc struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return "", fmt.Errorf("payload: %w", err)
+	}
+	if doc.Critical.Type != cosignPayloadType {
+		return "", fmt.Errorf("payload of type %q, not a %s", doc.Critical.Type, cosignPayloadType)
+	}
+	if doc.Critical.Image.DockerManifestDigest != digest {
+		return "", fmt.Errorf("signs %s, not %s", doc.Critical.Image.DockerManifestDigest, digest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignAnnotationSignature])
+	if err != nil || len(signature) == 0 {
+		return "", fmt.Errorf("no signature in the annotation %s", cosignAnnotationSignature)
+	}
+
+	if policy.key != nil {
+		if err := verifyWithKey(policy.key, payload, signature); err != nil {
+			return "", err
+		}
+		return "the key " + policy.keyFile, nil
+	}
+	cert, err := parseCertificate(layer.Annotations[cosignAnnotationCertificate])
+	if err != nil {
+		return "", fmt.Errorf("keyless: the certificate in %s: %w", cosignAnnotationCertificate, err)
+	}
+	// When Rekor logged the signature, which it signed: the certificate was valid for 10 minutes
+	logged, err := verifyRekorBundle(layer.Annotations[cosignAnnotationBundle], payload, signature, cert, policy.rekorKey)
+	if err != nil {
+		return "", fmt.Errorf("keyless: %w", err)
+	}
+	intermediates := policy.chain.Clone()
+	if chain, err := parseCertificates([]byte(layer.Annotations[cosignAnnotationChain])); err == nil {
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         policy.roots,
+		Intermediates: intermediates,
+		CurrentTime:   logged,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return "", fmt.Errorf("keyless: the certificate isn't valid: %w", err)
+	}
+	identities := cert.EmailAddresses
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	if !slices.Contains(identities, policy.identity) {
+		return "", fmt.Errorf("keyless: the certificate is for %s, not %s", strings.Join(identities, ", "), policy.identity)
+	}
+	if issuer := certificateIssuer(cert); issuer != policy.issuer {
+		return "", fmt.Errorf("keyless: %s logged in at %q, not %s", policy.identity, issuer, policy.issuer)
+	}
+	if err := verifyWithKey(cert.PublicKey, payload, signature); err != nil {
+		return "", fmt.Errorf("keyless: %w", err)
+	}
+	return fmt.Sprintf("%s (logged in at %s, signed %s)", policy.identity, policy.issuer, logged.UTC().Format(time.RFC3339)), nil
+}
+
+// verifyRekorBundle checks the Rekor entry cosign attached to a keyless signature: that Rekor
+// signed it with key, and that it is the entry of this signature of payload by cert. It returns
+// when Rekor logged it.
+func verifyRekorBundle(annotation string, payload, signature []byte, cert *x509.Certificate, key crypto.PublicKey) (time.Time, error) {
+	if annotation == "" {
+		return time.Time{}, fmt.Errorf("no Rekor bundle in the annotation %s: we don't look the signature up in Rekor", cosignAnnotationBundle)
+	}
+	var bundle struct {
+		SignedEntryTimestamp []byte
+		// The fields in the order of canonical JSON (RFC 8785), which is what Rekor signed
+		Payload struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogID          string `json:"logID"`
+			LogIndex       int64  `json:"logIndex"`
+		}
+	}
+	if err := json.Unmarshal([]byte(annotation), &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("the Rekor bundle: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if logID := sha256.Sum256(der); bundle.Payload.LogID != hex.EncodeToString(logID[:]) {
+		return time.Time{}, fmt.Errorf("the Rekor bundle is of another log, %s", bundle.Payload.LogID)
+	}
+	signed, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifyWithKey(key, signed, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("the Rekor bundle: %w", err)
+	}
+
+	// The entry: the hash of the payload, the signature, and the certificate it was made with
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the Rekor entry: %w", err)
+	}
+	var entry struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("the Rekor entry: %w", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("a Rekor entry of kind %q, not hashedrekord", entry.Kind)
+	}
+	hash := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) {
+		return time.Time{}, errors.New("the Rekor entry is of another payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, signature) {
+		return time.Time{}, errors.New("the Rekor entry is of another signature")
+	}
+	if logged, err := parseCertificate(string(entry.Spec.Signature.PublicKey.Content)); err != nil || !logged.Equal(cert) {
+		return time.Time{}, errors.New("the Rekor entry is of another certificate")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifyWithKey checks the signature of message by key, of the kinds cosign makes: ECDSA, ed25519
+// or RSA, over the sha256 of message.
+func verifyWithKey(key crypto.PublicKey, message, signature []byte) error {
+	digest := sha256.Sum256(message)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return errors.New("invalid signature")
+}
+
+// certificateIssuer returns the OIDC issuer a Fulcio certificate was given for.
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuerV2) {
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuer) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// readPublicKey reads a PEM public key, like the cosign.pub of `cosign generate-key-pair`.
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM public key", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return key, nil
+}
+
+// parseCertificate parses the one PEM certificate in s.
+func parseCertificate(s string) (*x509.Certificate, error) {
+	certs, err := parseCertificates([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) != 1 {
+		return nil, fmt.Errorf("%d certificates, not one", len(certs))
+	}
+	return certs[0], nil
+}
+
+// parseCertificates parses the PEM certificates in data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -0,0 +1,236 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// `cp` copies files between the host and a container, like `docker cp`:
+//
+//	cp ./app.conf 5d2c4a1b3e7f:/etc/app/      into the container
+//	cp 5d2c4a1b3e7f:/var/log/app.log .        out of it
+//
+// The container's files are somewhere the host can reach: a running container's root is
+// /proc/PID/root, the root its processes see, with their mounts (volumes and tmpfs included).
+// A stopped container of an image has its overlay mounted for the copy, on the host, unless its
+// root is a vfs copy (see snapshot.go); one on a --rootfs directory has the directory.
+//
+// The paths are the container's, and so are its symlinks: a /etc/app -> /tmp/app in the
+// container leads to the container's /tmp/app, not the host's. We resolve every path with
+// resolveInRoot, like the mounts of the child (see mounts.go), and write with extractTar, which
+// won't write through a symlink either (see archive.go): the copy travels as a tar archive, like
+// between docker cp and dockerd. And the container's processes mustn't swap a directory for a
+// symlink between our check and our write, which is what CVE-2018-15664 did to docker cp: so a
+// running container is paused while we copy, like Docker does since. Rootless there is no freezer.
+//
+// Files copied into a container are root's, files copied out are the user's who ran cp.
+
+// cp implements `cp [OPTIONS] CONTAINER:SRC DEST` and `cp [OPTIONS] SRC CONTAINER:DEST`.
+func cp(args []string) error {
+	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %[1]s cp [OPTIONS] CONTAINER:SRC DEST\n       %[1]s cp [OPTIONS] SRC CONTAINER:DEST\n\nCopy files or directories between a container and the host. SRC/. copies the content of the directory SRC.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	follow := fs.Bool("L", false, "follow SRC if it is a symlink, instead of copying the symlink")
+	fs.BoolVar(follow, "follow-link", false, "same as -L")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 2 {
+		return usageErrorf(fs, "expected SRC and DEST")
+	}
+	srcContainer, src := splitContainerPath(fs.Arg(0))
+	destContainer, dest := splitContainerPath(fs.Arg(1))
+	if (srcContainer == "") == (destContainer == "") {
+		return usageErrorf(fs, "one of SRC and DEST must be CONTAINER:PATH, the other a path of the host (./a:b for a file with a colon)")
+	}
+	// The host's paths are relative to the current directory, and the root of the host is /.
+	// Not cleaned: a trailing / or /. says what to copy.
+	hostPath := &dest
+	if destContainer != "" {
+		hostPath = &src
+	}
+	if !filepath.IsAbs(*hostPath) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*hostPath = wd + "/" + *hostPath
+	}
+
+	root, done, err := containerRoot(srcContainer + destContainer)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if srcContainer != "" {
+		return copyFiles(root, src, "/", dest, *follow)
+	}
+	return copyFiles("/", src, root, dest, *follow)
+}
+
+// splitContainerPath splits CONTAINER:PATH. A path that has a "/" before the colon, like ./a:b,
+// is the host's.
+func splitContainerPath(arg string) (container, p string) {
+	container, p, ok := strings.Cut(arg, ":")
+	if !ok || container == "" || strings.Contains(container, "/") {
+		return "", arg
+	}
+	return container, p
+}
+
+// containerRoot returns where the host finds the root of the container with ID prefix, for cp.
+// done undoes what it took: a pause, a mount.
+func containerRoot(prefix string) (root string, done func(), err error) {
+	found, err := findContainer(prefix)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg, err := readConfig(found.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	// rm waits for the lock, and the monitor with a restart
+	s, unlock, err := lockContainerState(found.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if s.alive() {
+		unlock()
+		root = fmt.Sprintf("/proc/%d/root", s.Pid)
+		if os.Geteuid() != 0 {
+			fmt.Fprintln(os.Stderr, "Rootless mode: not pausing the container, there is no freezer cgroup")
+			return root, func() {}, nil
+		}
+		thaw, err := pauseWhile(s.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		return root, thaw, nil
+	}
+	if !s.stopped() {
+		unlock()
+		return "", nil, fmt.Errorf("container %s is %s, try again", shortID(s.ID), s.currentStatus())
+	}
+	if cfg.ImageID == "" {
+		return cfg.Rootfs, unlock, nil
+	}
+	// The overlay the child mounted went with its mount namespace, a vfs copy is still there
+	if os.Geteuid() != 0 && len(snapshotterOf(cfg).mounts(filepath.Dir(cfg.Rootfs), cfg.Layers)) > 0 {
+		unlock()
+		return "", nil, fmt.Errorf("container %s isn't running: mounting its overlay takes root, copy while it runs", shortID(s.ID))
+	}
+	mounted, err := mountSnapshot(cfg)
+	if err != nil {
+		if mounted {
+			syscall.Unmount(cfg.Rootfs, 0)
+		}
+		unlock()
+		return "", nil, err
+	}
+	return cfg.Rootfs, func() {
+		if !mounted {
+			unlock()
+			return
+		}
+		if err := syscall.Unmount(cfg.Rootfs, 0); err != nil {
+			slog.Warn("could not unmount", "path", cfg.Rootfs, "err", err)
+		}
+		unlock()
+	}, nil
+}
+
+// copyFiles copies the path src below srcRoot to dest below destRoot, the way docker cp does:
+//
+//	SRC a file         DEST a directory: into it; DEST missing: the copy is DEST
+//	SRC a directory    DEST a directory: into it; DEST missing: created as the copy
+//	SRC/.              the content of SRC, into the directory DEST
+func copyFiles(srcRoot, src, destRoot, dest string, follow bool) error {
+	content := strings.HasSuffix(src, "/.")
+	srcName := path.Clean("/" + src)
+	// The symlink SRC is copied, not what it points to, unless -L or a trailing slash says so
+	from, err := resolveInRoot(srcRoot, srcName)
+	if err != nil {
+		return err
+	}
+	if !follow && !content && !strings.HasSuffix(src, "/") && srcName != "/" {
+		parent, err := resolveInRoot(srcRoot, path.Dir(srcName))
+		if err != nil {
+			return err
+		}
+		from = filepath.Join(parent, path.Base(srcName))
+	}
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return fmt.Errorf("no such file or directory: %s", src)
+	}
+	if content && !fi.IsDir() {
+		return fmt.Errorf("%s is no directory", strings.TrimSuffix(src, "/."))
+	}
+
+	// Where the copy goes, by its path below destRoot
+	target := path.Clean("/" + dest)
+	resolved, err := resolveInRoot(destRoot, target)
+	if err != nil {
+		return err
+	}
+	if dfi, err := os.Stat(resolved); err == nil && dfi.IsDir() {
+		if !content {
+			target = path.Join(target, path.Base(srcName))
+		}
+	} else if err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("cannot copy the directory %s onto the file %s", src, dest)
+		}
+	} else {
+		if strings.HasSuffix(dest, "/") && !fi.IsDir() {
+			return fmt.Errorf("no such directory: %s", dest)
+		}
+		parent, err := resolveInRoot(destRoot, path.Dir(target))
+		if err != nil {
+			return err
+		}
+		if pfi, err := os.Stat(parent); err != nil || !pfi.IsDir() {
+			return fmt.Errorf("no such directory: %s", path.Dir(target))
+		}
+	}
+	// extractTar replaces what is in the way, Docker refuses to replace a directory with a file
+	if parent, err := resolveInRoot(destRoot, path.Dir(target)); err == nil {
+		if tfi, err := os.Lstat(filepath.Join(parent, path.Base(target))); err == nil && tfi.IsDir() && !fi.IsDir() {
+			return fmt.Errorf("cannot overwrite the directory %s with the file %s", target, src)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		name := strings.TrimPrefix(target, "/")
+		err := writeFileToTar(tw, from, name, fi, map[uint64]string{}, false)
+		if err == nil && fi.IsDir() {
+			err = writeTreeToTar(tw, from, name)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err = extractTar(pr, destRoot, false)
+	// The writer may still be at the end of the archive, which extractTar didn't wait for
+	pr.Close()
+	return err
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Private images need a login, and so does more than Docker Hub's anonymous rate limit. We don't
+// have a `login` command, we use the one of Docker: `docker login ghcr.io` keeps the credentials
+// in ~/.docker/config.json ($DOCKER_CONFIG/config.json), in one of three ways:
+//
+//	{
+//	  "auths": {"ghcr.io": {"auth": "<base64 of user:password>"}},
+//	  "credsStore": "desktop",
+//	  "credHelpers": {"123456789.dkr.ecr.eu-west-1.amazonaws.com": "ecr-login"}
+//	}
+//
+// "auths" has them in the file, only base64 encoded. With a credential helper the file only
+// names the program, docker-credential-desktop or docker-credential-ecr-login, which keeps them
+// in the system's keychain or makes them up on the spot: `echo ghcr.io | docker-credential-desktop
+// get` prints {"Username": ..., "Secret": ...}. credHelpers names one per registry, credsStore one
+// for all others.
+//
+// Docker Hub's entry is called "https://index.docker.io/v1/", the address of its old API.
+
+// dockerHubAuthKey is the name of Docker Hub's credentials in config.json
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the part of ~/.docker/config.json with the credentials.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerConfigPath is where Docker keeps its configuration.
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// authHost is the registry host that a key of "auths" or "credHelpers" names: keys can be URLs,
+// like Docker Hub's.
+func authHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	switch key {
+	case "index.docker.io", dockerHubHost:
+		return dockerHub
+	}
+	return key
+}
+
+// registryCredentials returns the user name and password for registry from the Docker config,
+// or empty ones if it has none.
+func registryCredentials(registry string) (user, password string, err error) {
+	path := dockerConfigPath()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, helper := range config.CredHelpers {
+		if authHost(key) == registry {
+			return credentialHelper(helper, registry)
+		}
+	}
+	for key, auth := range config.Auths {
+		if authHost(key) != registry {
+			continue
+		}
+		if auth.Auth == "" {
+			// An entry without credentials, they are in the credsStore
+			if auth.Username != "" {
+				return auth.Username, auth.Password, nil
+			}
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: the auth of %s: %w", path, key, err)
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", "", fmt.Errorf("%s: the auth of %s isn't user:password", path, key)
+		}
+		return user, password, nil
+	}
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, registry)
+	}
+	return "", "", nil
+}
+
+// credentialHelper asks the program docker-credential-NAME for the credentials of registry.
+func credentialHelper(name, registry string) (user, password string, err error) {
+	server := registry
+	if registry == dockerHub {
+		server = dockerHubAuthKey
+	}
+	program := "docker-credential-" + name
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// It says so on stdout when it has none, that's not an error: we pull anonymously
+		if strings.Contains(string(out), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("%s: %w %s", program, err, strings.TrimSpace(string(out)+stderr.String()))
+	}
+	var answer struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &answer); err != nil {
+		return "", "", fmt.Errorf("%s: %w", program, err)
+	}
+	// "<token>" means the secret is an identity token, for OAuth2 token services: we'd need
+	// the refresh flow for it
+	if answer.Username == "<token>" {
+		return "", "", fmt.Errorf("%s: identity tokens are not supported, log in with a password or access token", program)
+	}
+	return answer.Username, answer.Secret, nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// readyFd is where the monitor finds the pipe it reports the start of the container on (3 is
+// the config pipe, like in the child).
+const readyFd = 4
+
+// runDetached implements `run -d`: the container runs in the background and we only print its ID.
+//
+// Someone still has to wait for the container, forward signals to it and remove its cgroup when
+// it exits. Docker leaves a small containerd-shim process behind per container for that, podman
+// uses conmon. Our "monitor" is ourselves once more: runDetached starts `/proc/self/exe monitor`
+// in a session of its own, gives it the config, and the monitor does what a foreground `run`
+// does. We wait until it reports that the container runs, then exit.
+func runDetached(cfg *containerConfig) error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+	configReader, configWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create config pipe: %w", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create ready pipe: %w", err)
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command("/proc/self/exe", "monitor")
+	// Nothing of ours: the terminal may be closed long before the container exits
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+	cmd.ExtraFiles = []*os.File{configReader, readyWriter}
+	// setsid(): a new session without a controlling terminal. When the terminal is closed, the
+	// kernel sends SIGHUP to its session, which no longer includes the monitor and the container.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// Its spans are part of ours (see otel.go)
+	if parent := traceparent(); parent != "" {
+		cmd.Env = append(os.Environ(), traceparentEnv+"="+parent)
+	}
+	err = cmd.Start()
+	configReader.Close()
+	readyWriter.Close()
+	if err != nil {
+		configWriter.Close()
+		return fmt.Errorf("start monitor: %w", err)
+	}
+
+	if err := sendConfig(configWriter, cfg); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("send config to monitor: %w", err)
+	}
+	// One line: "ok", or the error that stopped the container from starting
+	line, err := bufio.NewReader(readyReader).ReadString('\n')
+	if err != nil {
+		cmd.Wait()
+		return errors.New("container monitor exited before the container started")
+	}
+	if line = strings.TrimSpace(line); line != "ok" {
+		cmd.Wait()
+		return errors.New(line)
+	}
+
+	// We don't wait for the monitor, when we exit it is re-parented to init
+	cmd.Process.Release()
+	fmt.Println(cfg.ID)
+	return nil
+}
+
+// monitor is the process runDetached leaves behind. It runs the container like a foreground
+// `run`, restarts it according to its restart policy and records its exit code in the state file.
+func monitor() error {
+	// Inherited file descriptors are not close-on-exec, the container must not get this one
+	syscall.CloseOnExec(readyFd)
+	ready := os.NewFile(readyFd, "ready-pipe")
+
+	notified := false
+	started := func() {
+		fmt.Fprintln(ready, "ok")
+		ready.Close()
+		notified = true
+	}
+	cfg, err := receiveConfig()
+	if err == nil {
+		logToStateDir(cfg.ID)
+		err = superviseContainer(cfg, started)
+	}
+	if !notified {
+		fmt.Fprintln(ready, err)
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// device is a device node that every container gets in its /dev.
+type device struct {
+	Path         string
+	Major, Minor uint32
+}
+
+// defaultDevices are the character devices nearly every program expects. Most images ship an
+// empty /dev, so without these even `cmd > /dev/null` fails.
+var defaultDevices = []device{
+	{"/dev/null", 1, 3},
+	{"/dev/zero", 1, 5},
+	{"/dev/full", 1, 7},
+	{"/dev/random", 1, 8},
+	{"/dev/urandom", 1, 9},
+	{"/dev/tty", 5, 0},
+}
+
+// deviceRule allows access to a range of devices in the devices cgroup. A Major/Minor of -1
+// matches any number, Access is a combination of r(ead), w(rite) and m(knod).
+type deviceRule struct {
+	Type         byte // 'c' (character) or 'b' (block)
+	Major, Minor int64
+	Access       string
+}
+
+// defaultDeviceRules is Docker's default allow-list. Everything else is denied, so even a root
+// process with CAP_MKNOD can't create /dev/sda inside the container and read the host's disk:
+// it may create the node (m), but opening it fails with EPERM.
+var defaultDeviceRules = []deviceRule{
+	{'c', -1, -1, "m"},    // mknod any character device
+	{'b', -1, -1, "m"},    // mknod any block device
+	{'c', 1, 3, "rwm"},    // /dev/null
+	{'c', 1, 5, "rwm"},    // /dev/zero
+	{'c', 1, 7, "rwm"},    // /dev/full
+	{'c', 1, 8, "rwm"},    // /dev/random
+	{'c', 1, 9, "rwm"},    // /dev/urandom
+	{'c', 5, 0, "rwm"},    // /dev/tty
+	{'c', 5, 2, "rwm"},    // /dev/ptmx, the pseudo terminal multiplexer
+	{'c', 136, -1, "rwm"}, // /dev/pts/*, pseudo terminals
+}
+
+// String returns the rule in the format of the v1 devices.allow file, e.g. "c 1:3 rwm"
+func (r deviceRule) String() string {
+	num := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, num(r.Major), num(r.Minor), r.Access)
+}
+
+// setupDev gives the container a fresh /dev, before pivot_root.
+//
+// Like runc we don't use the /dev that comes with the rootfs: we mount a small tmpfs over it and
+// create exactly the nodes we want. A rootless container may not call mknod() at all (a user
+// namespace can't grant access to devices), so there we bind-mount the host's nodes instead.
+func setupDev(rootfs string) error {
+	dev := filepath.Join(rootfs, "dev")
+	if err := mountFS("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("mount tmpfs on /dev: %w", err)
+	}
+
+	// The umask would otherwise strip the permission bits we ask mknod() for
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
+
+	for _, d := range defaultDevices {
+		path := filepath.Join(rootfs, d.Path)
+		err := syscall.Mknod(path, syscall.S_IFCHR|0666, int(mkdev(d.Major, d.Minor)))
+		if errors.Is(err, syscall.EPERM) {
+			err = bindDevice(d.Path, path)
+		}
+		if err != nil {
+			return fmt.Errorf("create %s: %w", d.Path, err)
+		}
+	}
+
+	// The usual symlinks into /proc, e.g. `bash` uses /dev/fd for process substitution
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+		"ptmx":   "pts/ptmx",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return fmt.Errorf("create /dev/%s: %w", name, err)
+		}
+	}
+
+	// Mount points for the pseudo terminal and shared memory filesystems
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.Mkdir(filepath.Join(dev, dir), 0755); err != nil {
+			return fmt.Errorf("create /dev/%s: %w", dir, err)
+		}
+	}
+
+	// A devpts of our own for terminals (see setupConsole). `newinstance` keeps the host's pts
+	// numbers and terminals out of the container, /dev/ptmx (linked to pts/ptmx) creates new ones.
+	pts := filepath.Join(dev, "pts")
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	err := mountFS("devpts", pts, "devpts", flags, "newinstance,ptmxmode=0666,mode=0620,gid=5")
+	if errors.Is(err, syscall.EINVAL) {
+		// gid 5 (tty) doesn't exist in a rootless container, only our own GID is mapped
+		err = mountFS("devpts", pts, "devpts", flags, "newinstance,ptmxmode=0666,mode=0620")
+	}
+	if err != nil {
+		return fmt.Errorf("mount devpts: %w", err)
+	}
+	return nil
+}
+
+// bindDevice makes the host's device node hostPath visible at target by bind-mounting it over
+// an empty file.
+func bindDevice(hostPath, target string) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return mountFS(hostPath, target, "", syscall.MS_BIND, "")
+}
+
+// mkdev encodes device numbers into a dev_t, the makedev() macro from glibc
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
+// splitDev decodes the kernel's dev_t encoding (the major()/minor() macros from glibc)
+func splitDev(dev uint64) (major, minor uint32) {
+	major = uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor = uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
+
+// applyDeviceRulesV1 configures the v1 devices controller: deny everything, then allow the rules.
+func applyDeviceRulesV1(dir string, rules []deviceRule) error {
+	if err := writeCgroupFileErr(dir, "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := writeCgroupFileErr(dir, "devices.allow", rule.String()); err != nil {
+			return fmt.Errorf("device rule %s: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+// applyDeviceRulesV2 enforces the rules on a v2 cgroup.
+//
+// cgroups v2 has no devices.allow file anymore. Instead the kernel runs an eBPF program of type
+// BPF_PROG_TYPE_CGROUP_DEVICE on every open()/mknod() of a device node by a process in the
+// cgroup. The program returns 1 to allow and 0 to deny. runc and systemd generate such a program
+// from the rules; we assemble it by hand below, so no eBPF library or C compiler is needed.
+func applyDeviceRulesV2(dir string, rules []deviceRule) error {
+	insns := deviceFilterProgram(rules)
+	progFD, errno := loadDeviceFilter(insns, nil)
+	if errno != 0 {
+		// Load it again with a log buffer: the verifier explains why it rejected the program
+		logBuf := make([]byte, 1<<16)
+		loadDeviceFilter(insns, logBuf)
+		return fmt.Errorf("load device filter: %w (verifier: %s)", errno, cString(logBuf))
+	}
+	defer syscall.Close(int(progFD))
+
+	cgroupFD, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(cgroupFD)
+
+	// union bpf_attr for BPF_PROG_ATTACH. Once attached the cgroup holds its own reference to the
+	// program, so it stays active after we close our file descriptors.
+	attachAttr := struct {
+		targetFD    uint32
+		attachBPFFD uint32
+		attachType  uint32
+		attachFlags uint32
+	}{
+		targetFD:    uint32(cgroupFD),
+		attachBPFFD: uint32(progFD),
+		attachType:  bpfCgroupDevice,
+	}
+	if _, _, errno := syscall.Syscall(sysBPF, bpfProgAttach, uintptr(unsafe.Pointer(&attachAttr)), unsafe.Sizeof(attachAttr)); errno != 0 {
+		return fmt.Errorf("attach device filter: %w", errno)
+	}
+	return nil
+}
+
+// loadDeviceFilter loads the program into the kernel and returns its file descriptor. With a
+// logBuf the verifier writes its log there (and fails with ENOSPC if the log doesn't fit).
+func loadDeviceFilter(insns []bpfInsn, logBuf []byte) (uintptr, syscall.Errno) {
+	return loadBPFProgram(bpfProgTypeCgroupDevice, "container_dev", "Apache-2.0", insns, logBuf)
+}
+
+// loadBPFProgram loads a program of progType, called name, like loadDeviceFilter. The license
+// decides which helpers it may call: some are only for GPL programs.
+func loadBPFProgram(progType uint32, name, licenseName string, insns []bpfInsn, logBuf []byte) (uintptr, syscall.Errno) {
+	license := []byte(licenseName + "\x00")
+
+	// union bpf_attr for BPF_PROG_LOAD (only the fields we use, the rest must be zero)
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+		progName    [16]byte
+	}{
+		progType: progType,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	if len(logBuf) > 0 {
+		attr.logLevel = 1
+		attr.logSize = uint32(len(logBuf))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+	}
+	copy(attr.progName[:], name)
+
+	fd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	// The kernel only knows these buffers by address, keep them alive until the call returned
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	return fd, errno
+}
+
+// Constants from <linux/bpf.h>
+const (
+	bpfProgLoad   = 5
+	bpfProgAttach = 8
+
+	bpfProgTypeCgroupDevice = 15
+	bpfCgroupDevice         = 6
+
+	// struct bpf_cgroup_dev_ctx { u32 access_type; u32 major; u32 minor; }
+	// access_type is (access << 16) | type
+	bpfDevcgDevBlock = 1
+	bpfDevcgDevChar  = 2
+	bpfDevcgAccMknod = 1
+	bpfDevcgAccRead  = 2
+	bpfDevcgAccWrite = 4
+	bpfCtxAccessType = 0
+	bpfCtxMajor      = 4
+	bpfCtxMinor      = 8
+)
+
+// bpfInsn is one eBPF instruction (struct bpf_insn): an opcode, two 4-bit registers packed into
+// one byte, a 16-bit offset (used by memory accesses and jumps) and a 32-bit immediate.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes we need, see Documentation/bpf/instruction-set.rst
+const (
+	bpfLdxMemW   = 0x61 // dst = *(u32 *)(src + off)
+	bpfAlu32AndK = 0x54 // dst &= imm (32 bit)
+	bpfAlu32RshK = 0x74 // dst >>= imm (32 bit)
+	bpfAlu64MovK = 0xb7 // dst = imm
+	bpfAlu64MovX = 0xbf // dst = src
+	bpfJmpJneK   = 0x55 // if dst != imm: pc += off
+	bpfExit      = 0x95 // return r0
+)
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// deviceFilterProgram compiles the rules into an allow-list program:
+//
+//	r2 = ctx->access_type & 0xffff   // device type
+//	r3 = ctx->access_type >> 16      // requested access
+//	r4 = ctx->major
+//	r5 = ctx->minor
+//	for every rule:
+//	    if r2 != rule.type: next rule
+//	    if r3 & ^rule.access != 0: next rule
+//	    if rule.major != * && r4 != rule.major: next rule
+//	    if rule.minor != * && r5 != rule.minor: next rule
+//	    return 1
+//	return 0
+func deviceFilterProgram(rules []deviceRule) []bpfInsn {
+	const r0, r1, r2, r3, r4, r5, r6 = 0, 1, 2, 3, 4, 5, 6
+	prog := []bpfInsn{
+		insn(bpfLdxMemW, r2, r1, bpfCtxAccessType, 0),
+		insn(bpfAlu32AndK, r2, 0, 0, 0xffff),
+		insn(bpfLdxMemW, r3, r1, bpfCtxAccessType, 0),
+		insn(bpfAlu32RshK, r3, 0, 0, 16),
+		insn(bpfLdxMemW, r4, r1, bpfCtxMajor, 0),
+		insn(bpfLdxMemW, r5, r1, bpfCtxMinor, 0),
+	}
+
+	for _, rule := range rules {
+		devType := int32(bpfDevcgDevChar)
+		if rule.Type == 'b' {
+			devType = bpfDevcgDevBlock
+		}
+		var access int32
+		for _, a := range rule.Access {
+			switch a {
+			case 'r':
+				access |= bpfDevcgAccRead
+			case 'w':
+				access |= bpfDevcgAccWrite
+			case 'm':
+				access |= bpfDevcgAccMknod
+			}
+		}
+
+		block := []bpfInsn{
+			insn(bpfJmpJneK, r2, 0, 0, devType),
+			// r6 = requested access bits that the rule does NOT allow
+			insn(bpfAlu64MovX, r6, r3, 0, 0),
+			insn(bpfAlu32AndK, r6, 0, 0, ^access),
+			insn(bpfJmpJneK, r6, 0, 0, 0),
+		}
+		if rule.Major >= 0 {
+			block = append(block, insn(bpfJmpJneK, r4, 0, 0, int32(rule.Major)))
+		}
+		if rule.Minor >= 0 {
+			block = append(block, insn(bpfJmpJneK, r5, 0, 0, int32(rule.Minor)))
+		}
+		block = append(block, insn(bpfAlu64MovK, r0, 0, 0, 1), insn(bpfExit, 0, 0, 0, 0))
+
+		// Every failed check skips the rest of this rule's block. Jump offsets are relative to
+		// the next instruction.
+		for i := range block {
+			if block[i].code == bpfJmpJneK {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+
+	return append(prog, insn(bpfAlu64MovK, r0, 0, 0, 0), insn(bpfExit, 0, 0, 0, 0))
+}
+
+// cString converts a NUL terminated C string in buf to a Go string
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
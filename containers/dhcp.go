@@ -0,0 +1,260 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+)
+
+// A DHCP client, just enough for a macvlan container (see macvlan.go). A machine without an
+// address asks the network for one in four broadcasts, each a UDP message from port 68 to 67
+// (RFC 2131):
+//
+//	client                       server
+//	DISCOVER  "anyone?"     ──▶
+//	                        ◀──  OFFER    "192.168.1.50, router 192.168.1.1, for 24 hours"
+//	REQUEST   "I take it"   ──▶
+//	                        ◀──  ACK      "it's yours"
+//
+// The address is only lent, the lease: halfway through, the client asks for it again with one
+// more REQUEST. The monitor does all this for the container, from a socket in its network
+// namespace, and keeps renewing while it runs.
+
+// The ports of DHCP, from its predecessor BOOTP
+const (
+	dhcpClientPort = 68
+	dhcpServerPort = 67
+)
+
+// The message types, option 53
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+)
+
+// The options we send or read. Each is a code, a length and the data.
+const (
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptDNS         = 6
+	dhcpOptHostname    = 12
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptParameters  = 55
+	dhcpOptEnd         = 255
+)
+
+// dhcpMagic starts the options, after the fixed 236 bytes of a BOOTP message
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// dhcpLease is the address a DHCP client got, on its socket.
+type dhcpLease struct {
+	conn     net.PacketConn
+	mac      net.HardwareAddr
+	hostname string
+	done     chan struct{}
+
+	// What the server's ACK said
+	address     *net.IPNet
+	router      net.IP
+	nameservers []string
+	duration    time.Duration
+}
+
+// newDHCPLease returns the client for the interface with address mac, which conn is bound to. It
+// has no address yet, obtain asks for one.
+func newDHCPLease(conn net.PacketConn, mac net.HardwareAddr, hostname string) *dhcpLease {
+	return &dhcpLease{conn: conn, mac: mac, hostname: hostname, done: make(chan struct{})}
+}
+
+// obtain gets an address from the network's DHCP server, previous if it still has that one free.
+func (l *dhcpLease) obtain(previous net.IP) error {
+	xid := rand.Uint32()
+	var options [][]byte
+	if previous != nil {
+		options = append(options, dhcpOption(dhcpOptRequestedIP, previous.To4()...))
+	}
+	offered, offer, err := l.exchange(l.message(dhcpDiscover, xid, nil, options...), xid, dhcpOffer)
+	if err != nil {
+		return err
+	}
+	// Several servers may offer, the REQUEST names the one we take, in a broadcast the others
+	// see too
+	offered, ack, err := l.exchange(l.message(dhcpRequest, xid, nil,
+		dhcpOption(dhcpOptRequestedIP, offered...),
+		dhcpOption(dhcpOptServerID, offer[dhcpOptServerID]...)), xid, dhcpAck)
+	if err != nil {
+		return err
+	}
+	l.accept(offered, ack)
+	return nil
+}
+
+// keepRenewing asks for the address again each time half of the lease is over, until close. A
+// lease without a time never ends.
+func (l *dhcpLease) keepRenewing() {
+	for l.duration > 0 {
+		select {
+		case <-l.done:
+			return
+		case <-time.After(l.duration / 2):
+		}
+		// With our address in it, the server knows which lease this is about
+		xid := rand.Uint32()
+		yiaddr, ack, err := l.exchange(l.message(dhcpRequest, xid, l.address.IP), xid, dhcpAck)
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		if err != nil {
+			// Once more after the next half then, the lease may run out before that
+			slog.Warn("could not renew the DHCP lease", "address", l.address.IP, "err", err)
+			continue
+		}
+		if !yiaddr.Equal(l.address.IP) {
+			slog.Warn("the DHCP server renewed the lease with another address, keeping ours", "address", l.address.IP, "offered", yiaddr)
+		}
+		l.duration = leaseDuration(ack)
+	}
+}
+
+// close stops renewing. The lease runs out on the server, the interface is gone by then anyway.
+func (l *dhcpLease) close() {
+	close(l.done)
+	l.conn.Close()
+}
+
+// accept takes the address and options of an ACK.
+func (l *dhcpLease) accept(yiaddr net.IP, options map[byte][]byte) {
+	mask := net.IPMask(options[dhcpOptSubnetMask])
+	if len(mask) != net.IPv4len {
+		mask = yiaddr.DefaultMask()
+	}
+	l.address = &net.IPNet{IP: yiaddr, Mask: mask}
+	// The first router of the list, and the DNS servers in its order
+	if router := options[dhcpOptRouter]; len(router) >= net.IPv4len {
+		l.router = net.IP(router[:net.IPv4len])
+	}
+	for dns := options[dhcpOptDNS]; len(dns) >= net.IPv4len; dns = dns[net.IPv4len:] {
+		l.nameservers = append(l.nameservers, net.IP(dns[:net.IPv4len]).String())
+	}
+	l.duration = leaseDuration(options)
+}
+
+// leaseDuration is how long a lease lasts, 0 for ever.
+func leaseDuration(options map[byte][]byte) time.Duration {
+	v := options[dhcpOptLeaseTime]
+	if len(v) != 4 || binary.BigEndian.Uint32(v) == 0xffffffff {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+}
+
+// message encodes a DHCP message of type typ in transaction xid. ciaddr is the address we have,
+// nil before the ACK.
+func (l *dhcpLease) message(typ byte, xid uint32, ciaddr net.IP, options ...[]byte) []byte {
+	msg := make([]byte, 236)
+	msg[0] = 1 // BOOTREQUEST
+	msg[1] = 1 // Ethernet
+	msg[2] = 6 // the length of its addresses
+	binary.BigEndian.PutUint32(msg[4:], xid)
+	// We can't receive an answer to an address we don't have: the broadcast flag asks the server
+	// to broadcast it
+	if ciaddr == nil {
+		binary.BigEndian.PutUint16(msg[10:], 0x8000)
+	} else {
+		copy(msg[12:16], ciaddr.To4())
+	}
+	copy(msg[28:], l.mac)
+	msg = append(msg, dhcpMagic...)
+	msg = append(msg, dhcpOption(dhcpOptMessageType, typ)...)
+	msg = append(msg, dhcpOption(dhcpOptHostname, []byte(l.hostname)...)...)
+	msg = append(msg, dhcpOption(dhcpOptParameters, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptLeaseTime)...)
+	for _, o := range options {
+		msg = append(msg, o...)
+	}
+	msg = append(msg, dhcpOptEnd)
+	// The minimum size of a BOOTP message, some servers insist on it
+	for len(msg) < 300 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// dhcpOption encodes an option.
+func dhcpOption(code byte, data ...byte) []byte {
+	return append([]byte{code, byte(len(data))}, data...)
+}
+
+// exchange broadcasts msg until the answer of type want arrives, and returns the address in it
+// (yiaddr) and its options. UDP may lose either, every try waits twice as long.
+func (l *dhcpLease) exchange(msg []byte, xid uint32, want byte) (net.IP, map[byte][]byte, error) {
+	server := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+	buf := make([]byte, 1500)
+	for timeout := time.Second; timeout <= 8*time.Second; timeout *= 2 {
+		if _, err := l.conn.WriteTo(msg, server); err != nil {
+			return nil, nil, err
+		}
+		l.conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, _, err := l.conn.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+			// Everyone's answers are broadcast, ours are the ones for our transaction and address
+			yiaddr, options, ok := parseDHCP(buf[:n], xid, l.mac)
+			if !ok {
+				continue
+			}
+			switch options[dhcpOptMessageType][0] {
+			case want:
+				return yiaddr, options, nil
+			case dhcpNak:
+				return nil, nil, errors.New("the DHCP server refused the address")
+			}
+		}
+	}
+	return nil, nil, errors.New("no answer from a DHCP server")
+}
+
+// parseDHCP decodes a server's answer, if it is one to transaction xid of the client with mac.
+func parseDHCP(b []byte, xid uint32, mac net.HardwareAddr) (net.IP, map[byte][]byte, bool) {
+	if len(b) < 240 || b[0] != 2 /* BOOTREPLY */ || binary.BigEndian.Uint32(b[4:]) != xid ||
+		!bytes.Equal(b[28:34], mac) || !bytes.Equal(b[236:240], dhcpMagic) {
+		return nil, nil, false
+	}
+	// The values below point into b, the buffer of the next message
+	b = bytes.Clone(b)
+	options := map[byte][]byte{}
+	for rest := b[240:]; len(rest) > 0 && rest[0] != dhcpOptEnd; {
+		// Option 0 is padding, without a length
+		if rest[0] == 0 {
+			rest = rest[1:]
+			continue
+		}
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			break
+		}
+		options[rest[0]] = rest[2 : 2+rest[1]]
+		rest = rest[2+rest[1]:]
+	}
+	if len(options[dhcpOptMessageType]) != 1 {
+		return nil, nil, false
+	}
+	return net.IP(b[16:20]), options, true
+}
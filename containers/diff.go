@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+// diff implements `diff CONTAINER`: what the container changed in its image, like `docker diff`.
+//
+// That's the upper/ of its overlay (see overlay.go), the only directory the container writes, or
+// with --snapshotter vfs what its copy of the layers has that they haven't (see snapshot.go):
+//
+//	A /srv/app/new    added, the layers haven't got it
+//	C /srv/app        changed: copied up and written to, or a directory with changes in it
+//	D /bin/rm         deleted, a whiteout hides the layers' file
+//
+// A file the container only read is still in the layers, and isn't listed. A directory that was
+// removed and created again is opaque: it is C, its entries are A, and the entries of the layers
+// it hides aren't listed one by one.
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff CONTAINER\n\nList the files a container of an image added (A), changed (C) and deleted (D).\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected CONTAINER")
+	}
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfig(s.ID)
+	if err != nil {
+		return err
+	}
+	if cfg.ImageID == "" {
+		return fmt.Errorf("container %s runs on the directory %s, not on an image: it changes the directory itself", shortID(s.ID), cfg.Rootfs)
+	}
+	entries, err := snapshotterOf(cfg).changes(filepath.Dir(cfg.Rootfs), cfg.Layers)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		kind := "C"
+		if e.whiteout {
+			kind = "D"
+		} else if lower, _ := lstatInLayers(cfg.Layers, e.path); lower == nil {
+			kind = "A"
+		}
+		fmt.Printf("%s /%s\n", kind, e.path)
+	}
+	return nil
+}
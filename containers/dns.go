@@ -0,0 +1,323 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// On a user-defined network Docker containers find each other by name: `ping db` works, because
+// the resolv.conf points at a DNS server of Docker's own that knows the containers, and asks the
+// real servers for everything else. We have one too, on the bridge's address, where all bridge
+// containers reach it:
+//
+//	web ──"db?"──▶ 172.29.0.1:53 ──▶ the states of the running containers: db is 172.29.0.3
+//	web ──"example.com?"──▶ 172.29.0.1:53 ──▶ the host's nameservers, or the container's --dns
+//
+// A container is found by its hostname, its short ID, and each of its labels as VALUE.KEY: all
+// containers with --label app=web are web.app, a Kubernetes service selecting pods by label in
+// one line. Several containers with the same name all get their address in the answer, the
+// resolver takes the first, and the next query has them in another order: DNS round robin.
+//
+// There is no daemon to run the server. Every monitor of a bridge container runs one, all of them
+// on the same address and port with SO_REUSEPORT: the kernel hands each query to one of them,
+// and they all give the same answer, from the same state files. It ends with the last container.
+
+// dnsPort is the port of DNS, for UDP and TCP
+const dnsPort = 53
+
+// soReusePort is SO_REUSEPORT, which the syscall package lacks
+const soReusePort = 15
+
+// dnsTTL is how long the answers about containers may be cached, in seconds: containers come
+// and go, and their addresses with them
+const dnsTTL = 5
+
+// dnsTimeout is how long we wait for an answer from upstream, and for a TCP client to ask
+const dnsTimeout = 3 * time.Second
+
+// The DNS record types and answers we know, from RFC 1035 and RFC 3596
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeServFail = 2
+)
+
+// dnsServer is the DNS server of a monitor.
+type dnsServer struct {
+	// address is where it listens, the bridge's address in subnet, whose containers it knows
+	address string
+	subnet  *net.IPNet
+	udp     net.PacketConn
+	tcp     net.Listener
+}
+
+// startDNS starts the DNS server of the bridge container cfg, on its gateway, once setupNetwork
+// gave it an address. close it when the container exits.
+func startDNS(cfg *containerConfig) (*dnsServer, error) {
+	_, subnet, err := net.ParseCIDR(cfg.IPAddress)
+	if err != nil {
+		return nil, err
+	}
+	s := &dnsServer{address: cfg.Gateway, subnet: subnet}
+	// The kernel shares the port between sockets with SO_REUSEPORT of the same user, root
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	address := net.JoinHostPort(s.address, strconv.Itoa(dnsPort))
+	if s.udp, err = lc.ListenPacket(context.Background(), "udp4", address); err != nil {
+		return nil, err
+	}
+	// Answers that don't fit a UDP message come over TCP, the resolver asks again there
+	if s.tcp, err = lc.Listen(context.Background(), "tcp4", address); err != nil {
+		s.udp.Close()
+		return nil, err
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s, nil
+}
+
+// close stops the server. The other monitors' servers answer the queries from now on.
+func (s *dnsServer) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+// serveUDP answers the queries that come over UDP, one message each.
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := s.answer("udp", query, from.(*net.UDPAddr).IP); reply != nil {
+				s.udp.WriteTo(reply, from)
+			}
+		}()
+	}
+}
+
+// serveTCP answers the queries that come over TCP, where each message has its length in front.
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTimeout))
+				query, err := readDNSMessage(conn)
+				if err != nil {
+					return
+				}
+				reply := s.answer("tcp", query, conn.RemoteAddr().(*net.TCPAddr).IP)
+				if reply == nil || writeDNSMessage(conn, reply) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the reply to query from the container with address from: the containers that
+// have the name, or what upstream says. Nothing for what isn't a query.
+func (s *dnsServer) answer(network string, query []byte, from net.IP) []byte {
+	name, qtype, end, ok := parseDNSQuery(query)
+	if !ok {
+		return nil
+	}
+	if ips, found := s.lookup(name, qtype); found {
+		return dnsReply(query[:end], 0, ips)
+	}
+	reply, err := forwardDNS(network, query, s.upstreams(from))
+	if err != nil {
+		return dnsReply(query[:end], dnsRcodeServFail, nil)
+	}
+	return reply
+}
+
+// lookup returns the addresses of the running containers on our subnet named name, for a query
+// of qtype. found is false if there are none: the name is upstream's then. A name without
+// addresses of the type, like AAAA without --ipv6, is found but has no answers.
+func (s *dnsServer) lookup(name string, qtype uint16) (ips []net.IP, found bool) {
+	name = strings.TrimSuffix(name, ".")
+	for _, st := range listStates() {
+		ip := net.ParseIP(st.IPAddress)
+		// macvlan containers have addresses too, but not on the bridge
+		if ip == nil || !s.subnet.Contains(ip) || !st.alive() || !dnsNameMatches(st, name) {
+			continue
+		}
+		found = true
+		switch qtype {
+		case dnsTypeA:
+			ips = append(ips, ip.To4())
+		case dnsTypeAAAA:
+			if ip6 := net.ParseIP(st.IPAddress6); ip6 != nil {
+				ips = append(ips, ip6)
+			}
+		}
+	}
+	// listStates has the newest first, a different order each time spreads the clients over the
+	// containers
+	if len(ips) > 1 {
+		k := int(time.Now().UnixNano() % int64(len(ips)))
+		ips = append(ips[k:], ips[:k]...)
+	}
+	return ips, found
+}
+
+// dnsNameMatches reports whether container st goes by name. DNS names are case-insensitive.
+func dnsNameMatches(st *containerState, name string) bool {
+	if strings.EqualFold(st.Hostname, name) || strings.EqualFold(shortID(st.ID), name) {
+		return true
+	}
+	for key, value := range st.Labels {
+		if value != "" && strings.EqualFold(value+"."+key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreams are the servers that get the queries of the container with address from that aren't
+// about containers: its --dns servers, or the host's. The monitor runs on the host, so they may
+// be on its loopback device, like systemd-resolved's.
+func (s *dnsServer) upstreams(from net.IP) []string {
+	for _, st := range listStates() {
+		if st.IPAddress != from.String() {
+			continue
+		}
+		if cfg, err := readConfig(st.ID); err == nil && len(cfg.DNS) > 0 {
+			return cfg.DNS
+		}
+		break
+	}
+	if host, err := readHostResolvConf(true, true); err == nil && len(host.nameservers) > 0 {
+		return host.nameservers
+	}
+	return defaultNameservers
+}
+
+// forwardDNS asks the servers for the answer to query, one after the other, over network.
+func forwardDNS(network string, query []byte, servers []string) ([]byte, error) {
+	err := errors.New("no nameservers")
+	for _, server := range servers {
+		var conn net.Conn
+		conn, err = net.DialTimeout(network, net.JoinHostPort(server, strconv.Itoa(dnsPort)), dnsTimeout)
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		var reply []byte
+		if network == "tcp" {
+			if err = writeDNSMessage(conn, query); err == nil {
+				reply, err = readDNSMessage(conn)
+			}
+		} else if _, err = conn.Write(query); err == nil {
+			buf := make([]byte, 65535)
+			var n int
+			n, err = conn.Read(buf)
+			reply = buf[:n]
+		}
+		conn.Close()
+		// The answer belongs to the query with the same ID
+		if err == nil && len(reply) >= 12 && binary.BigEndian.Uint16(reply) == binary.BigEndian.Uint16(query) {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+// parseDNSQuery returns the name and type of a standard query with one question, and where the
+// question ends. A message is a 12 byte header (ID, flags, the number of questions, answers and
+// other records), then the question: the name as labels, each a length byte and that many
+// characters, ending with the empty label, then the type and class:
+//
+//	ID  flags  1 0 0 0  | 2 d b 0 | 0 1 (A) | 0 1 (IN)
+func parseDNSQuery(msg []byte) (name string, qtype uint16, end int, ok bool) {
+	// QR 0 for a query, opcode 0 for a standard one
+	if len(msg) < 12 || msg[2]&0xf8 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, 0, false
+	}
+	var labels []string
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		// Only answers compress names, with pointers whose first two bits are set
+		n := int(msg[i])
+		if n > 63 || i+1+n > len(msg) {
+			return "", 0, 0, false
+		}
+		labels = append(labels, string(msg[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+5 > len(msg) || binary.BigEndian.Uint16(msg[i+3:]) != dnsClassIN {
+		return "", 0, 0, false
+	}
+	return strings.Join(labels, "."), binary.BigEndian.Uint16(msg[i+1:]), i + 5, true
+}
+
+// dnsReply builds the reply to question, the query up to the end of its question, with rcode
+// and a record for each of ips.
+func dnsReply(question []byte, rcode byte, ips []net.IP) []byte {
+	reply := append([]byte(nil), question...)
+	// QR (a reply), the opcode and RD (recursion desired) of the query, AA (we know the names),
+	// RA (we recurse)
+	reply[2] = 0x80 | question[2]&0x79 | 0x04
+	reply[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(ips)))
+	// No authority or additional records, whatever the query had there
+	binary.BigEndian.PutUint32(reply[8:], 0)
+	for _, ip := range ips {
+		qtype := uint16(dnsTypeAAAA)
+		if ip.To4() != nil {
+			qtype, ip = dnsTypeA, ip.To4()
+		}
+		// The name is a pointer to the one in the question, at offset 12
+		reply = binary.BigEndian.AppendUint16(reply, 0xc000|12)
+		reply = binary.BigEndian.AppendUint16(reply, qtype)
+		reply = binary.BigEndian.AppendUint16(reply, dnsClassIN)
+		reply = binary.BigEndian.AppendUint32(reply, dnsTTL)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(ip)))
+		reply = append(reply, ip...)
+	}
+	return reply
+}
+
+// readDNSMessage reads a message from a TCP connection, with its length in front.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeDNSMessage writes a message to a TCP connection, with its length in front.
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
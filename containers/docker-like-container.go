@@ -5,33 +5,149 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // This function runs in the PARENT namespace
-func run() {
-	// os.Args[2:] contains the command to run inside the container (e.g., "/bin/bash")
+func run(args []string) error {
+	// The root of the trace of the container, with OTEL_EXPORTER_OTLP_ENDPOINT (see otel.go)
+	root := startSpan(progName() + " run")
+	// args holds the options and the command to run inside the container (e.g., "--memory 50m /bin/bash")
+	cfg, err := parseRunFlags("run", args)
+	if err != nil {
+		root.end(err)
+		return err
+	}
+	root.set("container.id", cfg.ID)
+	if cfg.Detach {
+		err = runDetached(cfg)
+	} else {
+		err = runContainer(cfg, nil, nil)
+	}
+	root.end(err)
+	return err
+}
+
+// runContainer starts the container described by cfg and waits until it exits. prev is the state
+// of the previous run when the container is restarted (see superviseContainer). started, if not
+// nil, is called once the container runs.
+func runContainer(cfg *containerConfig, prev *containerState, started func()) (err error) {
+	// cfg.Args contains the command to run inside the container (e.g., "/bin/bash")
 	// os.Getpid() returns the process ID as seen from the HOST namespace
 	//
 	// In the parent, this will be something like PID 12345
 	// In the child (with CLONE_NEWPID), this will be PID 1
-	fmt.Printf("Running %v as PID %d\n", os.Args[2:], os.Getpid())
+	slog.Info("running a container", "args", cfg.Args, "pid", os.Getpid(), "id", shortID(cfg.ID))
+	// Everything up to the prestart hooks, that is the container without its command. Ended on
+	// the ways out before as well, with the error they return (see span.end).
+	creating := startSpan("create", "container.id", cfg.ID)
+	defer func() { creating.end(err) }()
 
 	// Create the command that will run in new namespaces
 	//
 	// `/proc/self/exe`: Special symlink that points to the currently running executable which allows the program to re-execute itself
 	// `/proc/self/`: is a special directory in Linux that always points to the current process
 	// `exe`: is a symlink to the actual executable binary
-	cmd := exec.Command("/proc/self/exe", append([]string{"child"}, os.Args[2:]...)...)
+	//
+	// The command is repeated on the child's command line only so it shows up nicely in `ps`;
+	// the child takes everything it needs from the config it receives on the pipe below.
+	cmd := exec.Command("/proc/self/exe", append([]string{"child"}, cfg.Args...)...)
 
 	// Redirect stdin, stdout, and stderr to the parent's standard streams. This what makes the container interactive
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
+	// A detached container has no terminal to write to, its output goes to its log instead
+	var logStdout, logStderr *os.File
+	var waitLogs func()
+	if cfg.Detach {
+		var err error
+		if logStdout, logStderr, waitLogs, err = startLogging(cfg.ID, cfg.Log); err != nil {
+			return err
+		}
+		cmd.Stdout, cmd.Stderr = logStdout, logStderr
+	}
+
+	// The config pipe: the read end becomes file descriptor 3 in the child (0-2 are stdio)
+	configReader, configWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create config pipe: %w", err)
+	}
+	cmd.ExtraFiles = []*os.File{configReader}
+
+	// With -t the child sends us the master side of its terminal over this socket (file descriptor 4)
+	var consoleSocket, consoleChild *os.File
+	if cfg.Tty {
+		if consoleSocket, consoleChild, err = newConsoleSocket(); err != nil {
+			return err
+		}
+		defer consoleSocket.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, consoleChild)
+	}
+
+	// A created container waits on the FIFO for `start` (file descriptor 4 as well, there's no -t)
+	if cfg.CreateOnly {
+		fifo, err := openExecFifo(cfg.ID)
+		if err != nil {
+			return err
+		}
+		defer fifo.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, fifo)
+	}
+
+	// The published ports are ours before the container starts, or it doesn't (see ports.go)
+	proxy, err := listenPorts(cfg.Ports)
+	if err != nil {
+		return err
+	}
+	defer proxy.close()
+	// A rootless container's proxy and health checks connect through the child, over this socket
+	// (file descriptor 5)
+	var proxySocket, proxyChild *os.File
+	cfg.PortProxy = (len(cfg.Ports) > 0 || cfg.Health.dials()) && os.Geteuid() != 0
+	if cfg.PortProxy {
+		if proxySocket, proxyChild, err = newPortProxySocket(); err != nil {
+			return err
+		}
+		defer proxySocket.Close()
+		for len(cmd.ExtraFiles) < portProxyFd-3 {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, proxyChild)
+	}
+
+	// --network container:ID joins the other container's network namespace (see network.go)
+	var netns *os.File
+	if cfg.Network == networkContainer {
+		if netns, err = openContainerNetwork(cfg); err != nil {
+			return err
+		}
+		defer netns.Close()
+	}
+
+	// The root of an image is made here, where `create` waits for it: a vfs copy takes a while, and
+	// until it's there the container has no root for cp (see snapshot.go). The child only mounts.
+	if len(cfg.Layers) > 0 {
+		rootfs := startSpan("rootfs", "layers", strconv.Itoa(len(cfg.Layers)))
+		err := snapshotterOf(cfg).prepare(filepath.Dir(cfg.Rootfs), cfg.Layers)
+		rootfs.end(err)
+		if err != nil {
+			return err
+		}
+	}
+
 	// flags to create new namespaces
 	// These flags are passed to the Linux clone() syscall. Each flag creates a NEW namespace for the child process
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -42,103 +158,828 @@ func run() {
 			syscall.CLONE_NEWPID |
 			// Creates a new namespace. Child has its own mount table, isolated from parent(host).
 			syscall.CLONE_NEWNS |
-			// Creates a new network namespace. The child process has its own network stack. (You have to use veth to connect to the parent's network)
+			// Creates a new network namespace. The child process has its own network stack. (setupNetwork connects it to the host with a veth pair, unless --network host leaves it out)
 			syscall.CLONE_NEWNET |
 			// Creates a new IPC namespace(Inter-Process Communication) objects. The child process has its own IPC objects, isolated from parent(host).
 			syscall.CLONE_NEWIPC,
-		// Unshareflags: applied AFTER the process is created but BEFORE exec.
-		// `CLONE_NEWNS`: ensures mount changes don't propagate to the parent(host).
-		Unshareflags: syscall.CLONE_NEWNS,
+		// No `Unshareflags: CLONE_NEWNS` here: that would make Go remount everything private before
+		// exec, and the mounts could never receive events from the host again. The child sets the
+		// propagation itself (see setRootPropagation) before it mounts anything.
+	}
+	// --network host: the one namespace the container shares with the host. With --network
+	// container:ID the child gets the other container's instead, below.
+	if cfg.Network == networkHost || cfg.Network == networkContainer {
+		cmd.SysProcAttr.Cloneflags &^= syscall.CLONE_NEWNET
+	}
+
+	// The child enters its time namespace by itself, see enterTimeNamespace
+	if cfg.TimeNamespace {
+		cmd.Env = append(os.Environ(), timeOffsetsEnv+"="+cfg.TimeOffsets.encode())
+	}
+
+	// Without root we can still build a container: a user namespace makes us root *inside* it
+	if os.Geteuid() != 0 {
+		rootless(cmd.SysProcAttr)
+	}
+
+	// A new process starts in the namespaces of the thread that forks it, like after setns() in exec
+	start := cmd.Start
+	if netns != nil {
+		start = func() error {
+			return startRestricted(cmd, func() error { return joinNetworkNamespace(netns) })
+		}
+	}
+	slog.Debug("starting the child in new namespaces", "cloneflags", fmt.Sprintf("%#x", cmd.SysProcAttr.Cloneflags))
+	explainClone(cmd.SysProcAttr.Cloneflags)
+	clone := startSpan("clone", "cloneflags", fmt.Sprintf("%#x", cmd.SysProcAttr.Cloneflags))
+	err = start()
+	clone.end(err)
+	if err != nil {
+		explainAfter(err, "")
+		configWriter.Close()
+		configReader.Close()
+		return fmt.Errorf("start container: %w", err)
+	}
+	explainResult(fmt.Sprintf("%d, the PID of the child on the host: in its PID namespace it is 1", cmd.Process.Pid))
+	// The child has its own copy of the read end (and of the console socket) now
+	configReader.Close()
+	if consoleChild != nil {
+		consoleChild.Close()
+	}
+	if proxyChild != nil {
+		proxyChild.Close()
+	}
+	if cfg.Detach {
+		// Only the container may hold the write ends, the log ends when the last of them is closed
+		logStdout.Close()
+		logStderr.Close()
+	}
+	// Deferred first so it runs last, on every way out from here on: after the cgroup is gone
+	defer func() {
+		if err := runHooks("poststop", cfg.Hooks.Poststop, newOCIState(cfg, cmd.Process.Pid, "stopped")); err != nil {
+			slog.Warn("hook failed", "err", err)
+		}
+	}()
+	// From here on Ctrl-C & co. are for the container, we stay to clean up after it
+	stopSignals := forwardSignals(cmd.Process, forwardedSignals...)
+	defer stopSignals()
+
+	// Setup cgroup for resource limits. The cgroup files belong to the real root user, so an
+	// unprivileged (rootless) container can't write them without a delegated cgroup v2 subtree.
+	var oom *oomWatcher
+	if os.Geteuid() != 0 {
+		slog.Info("rootless mode: skipping cgroup limits")
+	} else {
+		cgroups := startSpan("cgroup-setup")
+		err := setupCgroups(cfg, cmd.Process.Pid)
+		// Runs on every way out of run() below, including the error paths, and this one
+		defer removeCgroups(cfg.ID)
+		if err != nil {
+			cgroups.end(err)
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+
+		// Deferred calls run last-in first-out: the watcher stops before the cgroup goes away
+		oom = watchOOM(cfg.ID)
+		defer oom.stop()
+		cgroups.end(nil)
+	}
+
+	// The bridge, the veth pair and a macvlan are host interfaces, creating them takes root on
+	// the host
+	cfg.EmbeddedDNS = ""
+	network := startSpan("network-setup", "network", cfg.Network)
+	defer func() { network.end(err) }()
+	if cfg.Network == networkBridge || cfg.Network == networkMacvlan {
+		// A rootless bridge network is slirp4netns's, if it is installed (see slirp.go)
+		slirpPath, slirpErr := exec.LookPath(slirpBinary)
+		if os.Geteuid() != 0 && cfg.Network == networkBridge && slirpErr == nil {
+			slog.Info("rootless mode: connecting the network with " + slirpBinary + ", published ports go through a proxy")
+			s, err := startSlirp(cfg, slirpPath, cmd.Process.Pid)
+			if err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return err
+			}
+			defer s.stop()
+		} else if os.Geteuid() != 0 {
+			slog.Info("rootless mode: skipping the network, the container has no interfaces but lo: published ports go through a proxy, install " + slirpBinary + " for more")
+			// It may have had slirp4netns at the last start
+			cfg.IPAddress, cfg.Gateway, cfg.Slirp4netns, cfg.Nameservers = "", "", false, nil
+			cfg.IPAddress6, cfg.Gateway6 = "", ""
+		} else if cfg.Network == networkBridge {
+			// The DNAT rules of the published ports are only there while the container runs
+			if len(cfg.Ports) > 0 {
+				defer func() {
+					if err := removeRules(cfg.ID, nftPrerouting, nftOutput); err != nil {
+						slog.Warn("could not remove the port rules", "err", err)
+					}
+				}()
+			}
+			if err := setupNetwork(cfg, cmd.Process.Pid); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return err
+			}
+			// The containers find each other by name (see dns.go)
+			if dns, err := startDNS(cfg); err != nil {
+				slog.Warn("could not start the DNS server, containers can't resolve each other's names", "err", err)
+			} else {
+				defer dns.close()
+				cfg.EmbeddedDNS = dns.address
+			}
+		} else {
+			lease, err := setupMacvlan(cfg, cmd.Process.Pid)
+			if err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return err
+			}
+			if lease != nil {
+				defer lease.close()
+			}
+		}
+	}
+	// With a network the container needs its DNS servers too, and every container its own name.
+	// A bundle brings its own files, if it wants any.
+	if cfg.IPAddress != "" || (cfg.Network == networkHost && cfg.Bundle == "") {
+		if err := writeResolvConf(cfg); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+	if cfg.Bundle == "" && cfg.Network != networkContainer {
+		if err := writeHosts(cfg); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+	network.end(nil)
+
+	// The proxy and the health checks can connect now: to the container's address, through the
+	// child, or without an address in its network namespace
+	dial := dialContainerAddress(cfg)
+	if proxySocket != nil {
+		if dial, err = proxy.dialThroughChild(proxySocket); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	} else if cfg.IPAddress == "" {
+		dial = dialInNetworkNamespace(cmd.Process.Pid)
+	}
+	if len(proxy.listeners) > 0 {
+		proxy.serve(dial)
+	}
+
+	// Tell the other commands about the container (see state.go)
+	state := &containerState{
+		ID:         cfg.ID,
+		Pid:        cmd.Process.Pid,
+		MonitorPid: os.Getpid(),
+		Status:     statusRunning,
+		Args:       cfg.Args,
+		Rootfs:     cfg.Rootfs,
+		Detached:   cfg.Detach,
+		Labels:     cfg.Labels,
+		Hostname:   cfg.Hostname,
+		Created:    time.Now(),
+		IPAddress:  strings.Split(cfg.IPAddress, "/")[0],
+		IPAddress6: strings.Split(cfg.IPAddress6, "/")[0],
+		Ports:      cfg.Ports,
+	}
+	state.Started = state.Created
+	if cfg.CreateOnly {
+		state.Status = statusCreated
+	}
+	if prev != nil {
+		state.Created, state.RestartCount = prev.Created, prev.RestartCount
+	}
+	if os.Geteuid() == 0 {
+		state.Cgroup = "/" + cgroupParent + "/" + cfg.ID
+	}
+	// Only fails if the child is already gone, the state then just never matches a process
+	state.PidStartTime, _ = processStartTime(cmd.Process.Pid)
+	state.MonitorStartTime, _ = processStartTime(os.Getpid())
+	err = writeState(state)
+	if err == nil {
+		err = writeConfig(cfg)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if prev == nil {
+		recordEvent(cfg.ID, eventCreate)
+	}
+	if !cfg.CreateOnly {
+		addCounter(counterStarts, 1)
+		recordEvent(cfg.ID, eventStart)
+	}
+	if !cfg.Detach {
+		// A container in the foreground is gone with the command that ran it
+		defer removeState(cfg.ID)
+	}
+	// Every way out from here on is the exit of the container, err is its exit code
+	died := func(err error) error {
+		// The notification of an OOM kill that ended the container may still be on its way, its
+		// oom event comes first
+		if oom != nil {
+			oom.check()
+		}
+		recordEvent(cfg.ID, eventDie, "exitCode", strconv.Itoa(errorExitCode(err)))
+		return err
+	}
+	// From here on `start` may change the state too, so the exit goes into what is there now
+	recordExit := func(err error) error {
+		return updateState(cfg.ID, func(s *containerState) error {
+			s.Status, s.Finished, s.ExitCode = statusExited, time.Now(), errorExitCode(err)
+			return nil
+		})
+	}
+	// The other commands know the container now, if it can't start it has exited
+	abort := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		died(err)
+		recordExit(err)
+		return err
 	}
 
-	if err := cmd.Run(); err != nil {
-		panic(err)
+	// The namespaces exist and the child waits for its config: a prestart hook can still prepare
+	// them before the command runs, e.g. move a network interface into /proc/<pid>/ns/net
+	if err := runHooks("prestart", cfg.Hooks.Prestart, newOCIState(cfg, cmd.Process.Pid, "created")); err != nil {
+		return abort(err)
+	}
+	// With run the child goes on to its command once it has its config, a created one sets
+	// itself up and waits for `start`
+	var startup *span
+	if !cfg.CreateOnly {
+		creating.end(nil)
+		startup = startSpan("start", "container.id", cfg.ID)
+		defer func() { startup.end(err) }()
+	}
+	if err := sendConfig(configWriter, cfg); err != nil {
+		return abort(fmt.Errorf("send config to container: %w", err))
+	}
+	// A failing poststart hook can't undo the start anymore. A created container hasn't started
+	// yet, `start` runs them.
+	if !cfg.CreateOnly {
+		if err := runHooks("poststart", cfg.Hooks.Poststart, newOCIState(cfg, cmd.Process.Pid, "running")); err != nil {
+			slog.Warn("hook failed", "err", err)
+		}
+	}
+	creating.end(nil)
+	startup.end(nil)
+	if started != nil {
+		started()
+	}
+	// The collector has the start of the container now, not only once it has exited
+	flushSpans()
+	if cfg.Health != nil {
+		stopHealthChecks := startHealthChecks(cfg.ID, cfg.Health, dial)
+		defer stopHealthChecks()
+	}
+
+	if cfg.Detach {
+		// Nobody is waiting for our exit code, so keep it in the state for later
+		err := died(waitExit(cmd))
+		waitLogs()
+		// After the event: `stop` waits for the exit, its stop comes after the die
+		if err := recordExit(err); err != nil {
+			slog.Warn("could not record the exit", "err", err)
+		}
+		return err
+	}
+
+	if cfg.Tty {
+		master, err := receiveConsole(consoleSocket)
+		if err != nil {
+			// The child failed during its setup, its error says more than ours
+			if waitErr := died(waitExit(cmd)); waitErr != nil {
+				return waitErr
+			}
+			return err
+		}
+		defer master.Close()
+		// Only when we were started from a terminal; with `echo ls | container run -t` there's none
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			defer restore()
+		}
+		stopResize := forwardWindowSize(master)
+		defer stopResize()
+		output := proxyConsole(master)
+		err = waitExit(cmd)
+		// Print everything the container wrote before it exited
+		<-output
+		return died(err)
 	}
+	return died(waitExit(cmd))
 }
 
-func child() {
-	fmt.Printf("Running %v as PID %d\n", os.Args[2:], os.Getpid())
+func child() error {
+	if offsets, ok := os.LookupEnv(timeOffsetsEnv); ok {
+		return enterTimeNamespace(offsets)
+	}
+	cfg, err := receiveConfig()
+	if err != nil {
+		return err
+	}
+	slog.Info("running the command", "args", cfg.Args, "pid", os.Getpid())
+
+	// The monitor has moved us into the container's cgroup by now, it becomes our cgroup root
+	if cfg.Cgroupns == cgroupnsPrivate {
+		if err := unshareCgroupNamespace(); err != nil {
+			return err
+		}
+	}
 
-	// Setup cgroup for memory limit
-	cgroups()
+	// The lo of the host, or of the container whose network this is, is up and not ours to touch
+	if cfg.Network != networkHost && cfg.Network != networkContainer {
+		if err := setupLoopback(); err != nil {
+			return err
+		}
+	}
+	// The monitor has plugged in eth0 as well, it only needs its address
+	if cfg.IPAddress != "" {
+		if err := configureNetwork(cfg); err != nil {
+			return err
+		}
+	}
+	// Without an address the host can reach, the monitor's proxy and health checks need us to
+	// connect to our ports (see ports.go)
+	if cfg.PortProxy {
+		if err := servePortProxy(); err != nil {
+			return err
+		}
+	}
 
 	// Change hostname (proving UTS namespace isolation)
-	if err := syscall.Sethostname([]byte("container")); err != nil {
-		panic(err)
+	slog.Debug("sethostname", "hostname", cfg.Hostname)
+	explainBefore(fmt.Sprintf("sethostname(%q)", cfg.Hostname), "Sets the hostname of the UTS namespace the child is in. "+
+		"The host's stays what it was, that's what CLONE_NEWUTS was for.")
+	err = syscall.Sethostname([]byte(cfg.Hostname))
+	explainAfter(err, fmt.Sprintf("the hostname in here is %q", cfg.Hostname))
+	if err != nil {
+		return fmt.Errorf("set hostname: %w", err)
+	}
+
+	// Decide first whether our mounts may propagate to and from the host
+	if err := setRootPropagation(cfg.Rootfs, cfg.RootfsPropagation); err != nil {
+		return err
+	}
+	// An image's rootfs is the overlay of its layers, which only we see, or a copy of them (see
+	// snapshot.go)
+	if len(cfg.Layers) > 0 {
+		if _, err := mountSnapshot(cfg); err != nil {
+			return err
+		}
+	}
+
+	// Mount proc filesystem inside the new root BEFORE pivoting. Inside a user namespace the kernel
+	// only allows a new proc mount while a fully visible proc is still mounted in the namespace,
+	// and the host's /proc disappears together with the old root.
+	if err := mountFS("proc", filepath.Join(cfg.Rootfs, "proc"), "proc", 0, ""); err != nil {
+		return fmt.Errorf("mount proc: %w", err)
+	}
+
+	// sysfs too, and with a cgroup namespace the container's cgroups in it
+	if err := mountSysfs(cfg.Rootfs); err != nil {
+		return err
+	}
+	if cfg.Cgroupns == cgroupnsPrivate {
+		if err := mountCgroupfs(cfg.Rootfs); err != nil {
+			return err
+		}
 	}
 
-	// Change root filesystem (pivot_root would be more correct)
-	if err := syscall.Chroot("/rootfs"); err != nil {
-		panic(err)
+	// Populate /dev (also before pivoting: rootless containers bind-mount the host's device nodes)
+	if err := setupDev(cfg.Rootfs); err != nil {
+		return err
 	}
-	if err := os.Chdir("/"); err != nil {
-		panic(err)
+
+	// /tmp, /run, /dev/shm and the --tmpfs mounts, then the volumes (which may be inside a tmpfs)
+	if err := mountTmpfs(cfg.Rootfs, cfg.Tmpfs); err != nil {
+		return err
+	}
+	// The monitor's resolv.conf and hosts go first, a volume on the same path is mounted over them
+	mountNetworkFiles(cfg)
+	if err := mountVolumes(cfg.Rootfs, cfg.Volumes); err != nil {
+		return err
+	}
+
+	// Change root filesystem with pivot_root (this is what runc does instead of chroot)
+	slog.Debug("pivot_root", "root", cfg.Rootfs)
+	if err := pivotRoot(cfg.Rootfs); err != nil {
+		return err
+	}
+
+	// Hide /proc/kcore & co. and make /proc/sys read-only
+	if err := protectProcPaths(cfg.MaskedPaths, cfg.ReadonlyPaths); err != nil {
+		return err
 	}
 
-	// Mount proc filesystem
-	if err := syscall.Mount("proc", "proc", "proc", 0, ""); err != nil {
-		panic(err)
+	// sethostname() only changes the kernel's view. Tools like `hostname -f` and many init
+	// scripts read /etc/hostname instead, so keep the file in sync with the UTS namespace.
+	if err := os.WriteFile("/etc/hostname", []byte(cfg.Hostname+"\n"), 0644); err != nil {
+		slog.Warn("could not write /etc/hostname", "err", err)
 	}
 
-	// Execute the actual command
-	cmd := exec.Command(os.Args[2], os.Args[3:]...)
+	// Last change to the rootfs itself, everything above still needed to write to it
+	if cfg.ReadOnly {
+		if err := remountReadOnly("/"); err != nil {
+			return err
+		}
+	}
+
+	// pivotRoot left us in `/`. The path is resolved *after* the pivot, so it is looked up in the
+	// container's filesystem and can't point at a host directory.
+	if err := os.Chdir(cfg.Workdir); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("workdir %s does not exist in the container", cfg.Workdir)
+		}
+		return fmt.Errorf("workdir %s: %w", cfg.Workdir, err)
+	}
+
+	// The command inherits it, and the OOM killer only looks at processes: the Go runtime of the
+	// child is the command after the exec
+	if cfg.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(0, *cfg.OOMScoreAdj); err != nil {
+			return err
+		}
+	}
+
+	// Execute the actual command.
+	// exec.Command looks the command up in OUR $PATH, so switch to the container's PATH first
+	for _, kv := range cfg.Env {
+		if path, ok := strings.CutPrefix(kv, "PATH="); ok {
+			os.Setenv("PATH", path)
+		}
+	}
+	cmd := exec.Command(cfg.Args[0], cfg.Args[1:]...)
+	// Only the variables from the config, nothing inherited from the host
+	cmd.Env = cfg.Env
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if cfg.Tty {
+		tty, err := setupConsole()
+		if err != nil {
+			return err
+		}
+		defer tty.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		// A controlling terminal belongs to a session: setsid() starts a new one with the command
+		// as its leader, then TIOCSCTTY makes the terminal on fd 0 the session's terminal. That's
+		// what lets Ctrl-C reach the shell and job control (Ctrl-Z, fg) work.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	}
 
-	if err := cmd.Run(); err != nil {
-		panic(err)
+	// Last step before exec: everything above needed the full root privileges, the command doesn't
+	restrict := func() error {
+		if cfg.Cgroupns == cgroupnsPrivate {
+			if err := joinCgroupNamespace(); err != nil {
+				return err
+			}
+		}
+		// Raising a hard limit needs CAP_SYS_RESOURCE, and the limits count for us too from here
+		// on, so as late as possible but before the capabilities go
+		if err := setRlimits(0, cfg.Rlimits); err != nil {
+			return err
+		}
+		if err := dropCapabilities(cfg.Capabilities); err != nil {
+			return err
+		}
+		if err := applyLSMLabels(cfg.AppArmorProfile, cfg.SELinuxLabel); err != nil {
+			return err
+		}
+		if cfg.NoNewPrivileges {
+			if err := setNoNewPrivs(); err != nil {
+				return err
+			}
+		}
+		// The filter goes last, a custom profile may well block the syscalls used above
+		if cfg.Seccomp == nil {
+			return nil
+		}
+		return installSeccomp(cfg.Seccomp, cfg.Capabilities)
+	}
+	// Everything is ready, a created container waits for `start` here
+	if cfg.CreateOnly {
+		if err := awaitStart(); err != nil {
+			return err
+		}
+	}
+	explainBefore(fmt.Sprintf("clone() and execve(%q, [%s])", cfg.Args[0], quoteArgs(cfg.Args)),
+		"Starts the command, as a child of this process: we stay PID 1, the init of the container that passes on "+
+			"signals and reaps orphans. The new process drops the capabilities, sets the limits and installs the "+
+			"seccomp filter before execve() replaces this program with the command.")
+	var status syscall.WaitStatus
+	if cfg.Trace {
+		// The tracer waits for everything in the container, see trace.go
+		var stopSignals func()
+		status, err = startTraced(cmd, restrict, func(pid int) {
+			explainResult(fmt.Sprintf("%d, the PID of the command in the container", pid))
+			stopSignals = forwardSignals(cmd.Process, initForwardedSignals...)
+		})
+		if stopSignals != nil {
+			stopSignals()
+		}
+		if err != nil && stopSignals == nil {
+			explainAfter(err, "")
+			return startError(err)
+		}
+	} else {
+		if err := startRestricted(cmd, restrict); err != nil {
+			explainAfter(err, "")
+			return startError(err)
+		}
+		explainResult(fmt.Sprintf("%d, the PID of the command in the container", cmd.Process.Pid))
+		stopSignals := forwardSignals(cmd.Process, initForwardedSignals...)
+		// Not cmd.Wait(): as the container's init we also have to reap processes that aren't ours
+		status, err = reapUntil(cmd.Process.Pid)
+		stopSignals()
+	}
+	if err != nil {
+		return err
 	}
 
-	// Cleanup
-	if err := syscall.Unmount("proc", 0); err != nil {
-		panic(err)
+	// Cleanup. MNT_DETACH takes the masks and read-only mounts on top of /proc along.
+	if err := syscall.Unmount("/proc", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount proc: %w", err)
+	}
+	// Our exit code is the command's, the parent passes it on
+	if code := exitCode(status); code != 0 {
+		return exitStatus(code)
 	}
+	return nil
 }
 
-func cgroups() {
-	// Try cgroups v2 first (unified hierarchy), then fall back to v1
-	cgroupV2Path := "/sys/fs/cgroup/mycontainer"
-	cgroupV1Path := "/sys/fs/cgroup/memory/mycontainer"
+// rootless adds a user namespace to the clone flags and maps our unprivileged host user to root in it.
+//
+// A user namespace starts with no mappings: every UID is "nobody" until someone writes
+// /proc/<pid>/uid_map and /proc/<pid>/gid_map. That has to happen from the parent after clone() but
+// before the child execs, which is exactly what Go's os/exec does for us when the mappings are set:
+//  1. clone() the child with CLONE_NEWUSER; the child blocks on an internal pipe
+//  2. the parent writes "0 <our uid> 1" to uid_map
+//  3. the parent writes "deny" to setgroups (required before an unprivileged gid_map write)
+//  4. the parent writes "0 <our gid> 1" to gid_map, then unblocks the child
+//  5. the child execs as UID 0 with a full capability set, but only over namespaces it owns
+func rootless(attr *syscall.SysProcAttr) {
+	// The user namespace is created first, so every other namespace in Cloneflags is owned by it
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
 
-	// Check if cgroups v2 is available
-	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
-		// cgroups v2
-		os.Mkdir(cgroupV2Path, 0755)
+	// Map container root (0) to our own UID/GID. Size 1: an unprivileged user may only map itself.
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
 
-		// Limit memory to 100MB (cgroups v2 uses memory.max)
-		if err := os.WriteFile(cgroupV2Path+"/memory.max", []byte("100000000"), 0700); err != nil {
-			fmt.Printf("Warning: could not set memory limit: %v\n", err)
-		}
+	// false makes Go write "deny" to /proc/<pid>/setgroups. Otherwise the container could drop
+	// supplementary groups and gain access to files that are blocked by a "negative" group permission.
+	attr.GidMappingsEnableSetgroups = false
+}
 
-		// Add current process to cgroup
-		if err := os.WriteFile(cgroupV2Path+"/cgroup.procs", []byte(fmt.Sprintf("%d", os.Getpid())), 0700); err != nil {
-			fmt.Printf("Warning: could not add process to cgroup: %v\n", err)
+// startRestricted starts cmd from a thread of its own that calls restrict first.
+//
+// Capabilities and seccomp filters belong to a *thread*, not to the whole process, and the Go
+// scheduler moves goroutines between threads as it likes. So we lock a goroutine to its thread,
+// restrict only that thread and fork the command from it: the command inherits the restrictions,
+// while the rest of the child keeps its privileges for the cleanup. The thread is never unlocked,
+// which makes the Go runtime throw it away when the goroutine returns.
+func startRestricted(cmd *exec.Cmd, restrict func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := restrict(); err != nil {
+			errc <- err
+			return
 		}
-	} else {
-		// cgroups v1
-		os.Mkdir(cgroupV1Path, 0755)
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
 
-		// Limit memory to 100MB (cgroups v1 uses memory.limit_in_bytes)
-		if err := os.WriteFile(cgroupV1Path+"/memory.limit_in_bytes", []byte("100000000"), 0700); err != nil {
-			fmt.Printf("Warning: could not set memory limit: %v\n", err)
-		}
+// pivotRoot swaps the root mount of our mount namespace for newRoot.
+//
+// Unlike chroot, which only changes the path lookup start point of one process, pivot_root moves
+// the whole mount namespace onto the new root. Once the old root is unmounted there is no path
+// left that leads back to the host filesystem, so the classic chroot escape no longer works.
+func pivotRoot(newRoot string) error {
+	// pivot_root requires new_root to be a mount point. Bind-mounting the directory onto itself
+	// turns a plain directory like /rootfs into a mount point without changing its contents.
+	// `MS_REC` also brings along any mounts that already exist below it.
+	if err := mountFS(newRoot, newRoot, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %w", newRoot, err)
+	}
 
-		// Add current process to cgroup
-		if err := os.WriteFile(cgroupV1Path+"/cgroup.procs", []byte(fmt.Sprintf("%d", os.Getpid())), 0700); err != nil {
-			fmt.Printf("Warning: could not add process to cgroup: %v\n", err)
-		}
+	// pivot_root normally needs a directory under the new root to park the old root in, but a
+	// rootless container usually can't create one in a rootfs owned by the real root user.
+	// runc's trick: step into the new root and pass "." for both. The old root is then stacked on
+	// top of the new one at the same place, ready to be unmounted.
+	if err := os.Chdir(newRoot); err != nil {
+		return fmt.Errorf("chdir %s: %w", newRoot, err)
 	}
+
+	// After this call `/` is newRoot (with the host's root mounted over it).
+	// This only works because setRootPropagation made sure our root isn't a shared mount;
+	// pivot_root refuses to run when it is, since the change would leak to the host.
+	explainBefore(`pivot_root(".", ".")`, "Makes "+newRoot+", the directory we are in, the root of the mount namespace. "+
+		"The host's root is stacked on top of it, at the same place, until we unmount it.")
+	err := syscall.PivotRoot(".", ".")
+	explainAfter(err, `"/" is `+newRoot+" now")
+	if err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+
+	// Lazily detach the old root. `MNT_DETACH` removes it from the mount tree right away even if
+	// something still holds a reference, so the host filesystem disappears from the container.
+	explainBefore(`umount2(".", MNT_DETACH)`, "Unmounts the host's root, right away even if something still uses it. "+
+		"After this no path in the container leads to the host's files, unlike after a chroot.")
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	explainAfter(err, "")
+	if err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	return os.Chdir("/")
 }
 
 // Main function - this runs in the parent namespace
 func main() {
+	// A runtime runs a CNI plugin without arguments, see cni.go
+	if len(os.Args) == 1 && os.Getenv("CNI_COMMAND") != "" {
+		os.Exit(cniMain())
+	}
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n\n", progName(), err)
+		usage()
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	// The commands find their arguments in os.Args, after the options of the runtime
+	os.Args = append(os.Args[:1], args...)
+
+	// The child may have to set up a time namespace, and that only works from the main thread
+	if os.Args[1] == "child" {
+		runtime.LockOSThread()
+	}
+
 	switch os.Args[1] {
 	case "run":
-		run() // Initial invocation by the user (parent process)
+		err = run(os.Args[2:]) // Initial invocation by the user (parent process)
+	case "create":
+		err = create(os.Args[2:])
+	case "start":
+		err = start(os.Args[2:])
+	case "state":
+		err = printState(os.Args[2:])
 	case "child":
-		child() //Re-execution of itself in new namespaces (child process)
+		err = child() //Re-execution of itself in new namespaces (child process)
+	case "monitor":
+		err = monitor() // Stays behind to look after a container started with `run -d`
+	case "ps":
+		err = ps(os.Args[2:])
+	case "exec":
+		err = execInContainer(os.Args[2:])
+	case "stop":
+		err = stop(os.Args[2:])
+	case "kill":
+		err = kill(os.Args[2:])
+	case "rm", "delete":
+		err = rm(os.Args[2:])
+	case "inspect":
+		err = inspect(os.Args[2:])
+	case "network":
+		err = networkCommand(os.Args[2:])
+	case "import":
+		err = importImage(os.Args[2:])
+	case "bootstrap":
+		err = bootstrap(os.Args[2:])
+	case "pull":
+		err = pull(os.Args[2:])
+	case "build":
+		err = build(os.Args[2:])
+	case "commit":
+		err = commit(os.Args[2:])
+	case "diff":
+		err = diff(os.Args[2:])
+	case "cp":
+		err = cp(os.Args[2:])
+	case "images":
+		err = listImages(os.Args[2:])
+	case "tag":
+		err = tagCommand(os.Args[2:])
+	case "rmi":
+		err = rmi(os.Args[2:])
+	case "image":
+		err = imageCommand(os.Args[2:])
+	case "system":
+		err = systemCommand(os.Args[2:])
+	case "logs":
+		err = logs(os.Args[2:])
+	case "wait":
+		err = waitContainers(os.Args[2:])
+	case "stats":
+		err = stats(os.Args[2:])
+	case "metrics":
+		err = metricsCommand(os.Args[2:])
+	case "events":
+		err = eventsCommand(os.Args[2:])
+	case "top":
+		err = top(os.Args[2:])
+	case "observe":
+		err = observe(os.Args[2:])
+	case "pause":
+		err = pause(os.Args[2:])
+	case "unpause":
+		err = unpause(os.Args[2:])
+	case "help", "-h", "--help":
+		usage()
+		return
 	default:
-		panic("bad command")
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", progName(), os.Args[1])
+		usage()
+		os.Exit(2)
 	}
+	// os.Exit doesn't run deferred calls
+	flushSpans()
+
+	var status exitStatus
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		// `run -h` printed the help on request, that's not a failure
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case errors.As(err, &status):
+		// The container already had its say on stderr
+		os.Exit(int(status))
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progName(), err)
+		os.Exit(1)
+	}
+}
+
+// usage prints the list of commands
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [OPTIONS] COMMAND [ARG...]
+
+Options:
+  --log-level LEVEL    What the runtime logs: debug, info, warn or error (env %s, default info)
+  --log-format FORMAT  How: text or json (env %s, default text)
+  --explain            Explain every system call that makes a container, before and after it (env %s=1)
+
+Commands:
+  run        Run a command in a new container
+  create     Set up a new container, its command runs after start
+  start      Run the command of created containers
+  state      Show the OCI state of a container as JSON
+  ps         List containers
+  exec       Run a command in a running container
+  stop       Stop running containers gracefully
+  kill       Send a signal to running containers
+  rm         Remove stopped containers (alias: delete)
+  inspect    Show details of containers as JSON
+  network    Show the network of the containers as JSON (network inspect)
+  import     Create an image from a root filesystem tarball
+  bootstrap  Download a minimal root filesystem: busybox or alpine
+  pull       Download an image from a registry
+  build      Build an image from a Dockerfile
+  commit     Create an image from the changes of a container
+  diff       List the files a container added, changed and deleted
+  cp         Copy files between a container and the host
+  images     List the images of the store
+  tag        Give an image another name
+  rmi        Remove images, and the layers no other image uses
+  image      Work with images: image load, image ls, image prune, image save, image sbom, image tag
+  system     Clean up: system prune
+  logs       Show the output of a container started with -d
+  wait       Wait until containers stop and print their exit codes
+  stats      Show live resource usage of containers
+  metrics    Serve the resource usage of containers for Prometheus
+  events     Show what happened to containers: created, started, died...
+  top        List the processes of a container, with their host PIDs
+  observe    Watch the programs and system calls of a container with eBPF
+  pause      Freeze all processes of containers
+  unpause    Thaw paused containers
+
+Run '%s COMMAND -h' for the options of a command. Run without arguments and with CNI_COMMAND
+set, it is a CNI bridge plugin instead: install it as /opt/cni/bin/mycontainer-bridge (see cni/).
+`, progName(), logLevelEnv, logFormatEnv, explainEnv, progName())
+}
+
+// progName is the name the user invoked us with, for messages
+func progName() string {
+	return filepath.Base(os.Args[0])
 }
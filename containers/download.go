@@ -0,0 +1,311 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A classroom pulls the same image on thirty laptops over one Wi-Fi, and an image is tens or
+// hundreds of megabytes in a few layers. Like dockerd, pull doesn't fetch them one after the other:
+//
+//   - maxConcurrentDownloads layers download at the same time, and each is unpacked as soon as
+//     it's complete: a layer is a directory of its own (see images.go), their order doesn't
+//     matter until the overlay stacks them.
+//
+//   - Every layer has a line with its progress. On a terminal it's a bar, redrawn in place:
+//
+//     a1b2c3d4e5f6: Downloading [=========>                    ]  9.8MiB/29.1MiB
+//     5d2c4a1b3e7f: Waiting
+//
+//     Into a file or a pipe only what happened is written, a line each.
+//
+//   - A download writes into .partial-<hex> in the blob store (see blobs.go). When the connection
+//     breaks, it asks for the rest with a Range request (see registry.go), after a pause, a few
+//     times. The next pull after a Ctrl-C goes on where the last one stopped too: "Resuming at
+//     12.0MiB". A registry that can't send a range sends all of the blob, which starts over.
+//
+// The digest is of the whole blob, so a resumed download is checked like any other. One whose
+// first part went bad, say on a disk that filled up, fails the check: it is thrown away and
+// downloaded from the start once more. `image prune` removes what interrupted pulls left.
+
+// maxConcurrentDownloads is how many layers download at the same time, dockerd's default of
+// --max-concurrent-downloads
+const maxConcurrentDownloads = 3
+
+// downloadAttempts is how often a download tries before it gives up
+const downloadAttempts = 5
+
+// errDownloadStopped stops the downloads when another one failed
+var errDownloadStopped = errors.New("stopped, another layer failed")
+
+// pullLayers downloads and unpacks the layers the store hasn't got, with the diff IDs of the
+// config, and returns the number of device nodes the unpacking skipped. The lock of the store
+// must be taken.
+func pullLayers(c *registryClient, layers []ociDescriptor, diffIDs []string, out io.Writer) (int, error) {
+	// A layer twice in an image, like an empty one, is fetched once
+	var jobs []int
+	first := map[string]int{}
+	for i, layer := range layers {
+		if j, ok := first[layer.Digest]; ok {
+			if diffIDs[i] != diffIDs[j] {
+				return 0, fmt.Errorf("layer %s: the config says the diff IDs %s and %s for it", layer.Digest, diffIDs[j], diffIDs[i])
+			}
+			continue
+		}
+		first[layer.Digest] = i
+		jobs = append(jobs, i)
+	}
+	names := make([]string, len(jobs))
+	for k, i := range jobs {
+		names[k] = shortID(strings.TrimPrefix(layers[i].Digest, "sha256:"))
+	}
+	progress := newPullProgress(out, names)
+
+	var (
+		mu       sync.Mutex
+		skipped  int
+		firstErr error
+		failed   atomic.Bool
+		wg       sync.WaitGroup
+	)
+	next := make(chan int)
+	for range min(maxConcurrentDownloads, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				layer := layers[jobs[k]]
+				n, err := pullLayer(c, layer, diffIDs[jobs[k]], progress.lines[k], &failed)
+				mu.Lock()
+				skipped += n
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("layer %s: %w", layer.Digest, err)
+					failed.Store(true)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	// In the order of the image, the lowest layer first
+	for k := range jobs {
+		if failed.Load() {
+			break
+		}
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+	return skipped, firstErr
+}
+
+// pullLayer downloads the blob of layer unless the store has it, and unpacks it unless the store
+// has it unpacked. It returns the device nodes the unpacking skipped.
+func pullLayer(c *registryClient, layer ociDescriptor, diffID string, line *progressLine, stop *atomic.Bool) (int, error) {
+	if hasBlob(layer.Digest) {
+		line.set("Already exists")
+	} else if err := downloadBlob(c, layer, line, stop); err != nil {
+		return 0, err
+	} else {
+		line.set(fmt.Sprintf("Download complete (%s)", formatBytes(layer.Size)))
+	}
+	if hasLayer(layer.Digest) {
+		// Unpacked for another image, whose config may have said another diff ID
+		return 0, verifyDiffID(layer, diffID)
+	}
+	result, err := unpackLayer(layer, diffID, func(done int64) { line.bar("Extracting", done, layer.Size) })
+	if err != nil {
+		return 0, err
+	}
+	line.set("Pull complete")
+	return result.SkippedDevices, nil
+}
+
+// downloadBlob downloads the blob desc describes into the blob store, and goes on with what an
+// earlier download left of it.
+func downloadBlob(c *registryClient, desc ociDescriptor, line *progressLine, stop *atomic.Bool) error {
+	w, err := resumeBlobWriter(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if w.size > 0 && w.size < desc.Size {
+		line.set("Resuming at " + formatBytes(w.size))
+	}
+	for attempt := 1; ; attempt++ {
+		resumed := w.size > 0
+		retry, err := fetchBlob(c, desc, w, line, stop)
+		if err == nil {
+			if err = w.commitAs(desc); err == nil || !resumed || attempt == downloadAttempts {
+				return err
+			}
+			// What an earlier download left may have been wrong, commitAs threw it away
+			line.set(fmt.Sprintf("%v, downloading all of it again", err))
+			if w, err = resumeBlobWriter(desc.Digest); err != nil {
+				return err
+			}
+			continue
+		}
+		if stop.Load() || attempt == downloadAttempts {
+			w.suspend()
+			return err
+		}
+		if !retry {
+			if !resumed {
+				w.discard()
+				return err
+			}
+			// Like 416 Range Not Satisfiable: the partial blob isn't one the registry knows
+			if err := w.restart(); err != nil {
+				w.discard()
+				return err
+			}
+		}
+		wait := time.Duration(attempt) * time.Second
+		line.set(fmt.Sprintf("Retrying in %s: %v", wait, err))
+		time.Sleep(wait)
+	}
+}
+
+// fetchBlob downloads what w hasn't got of the blob desc describes. retry tells whether an error
+// is of the connection, which another attempt can overcome, rather than the registry's answer.
+func fetchBlob(c *registryClient, desc ociDescriptor, w *blobWriter, line *progressLine, stop *atomic.Bool) (retry bool, err error) {
+	if w.size > desc.Size {
+		// commitAs won't take it either, and a Range can't be after the end
+		if err := w.restart(); err != nil {
+			return false, err
+		}
+	}
+	if w.size == desc.Size {
+		return false, nil
+	}
+	body, resumed, err := c.blobFrom(desc.Digest, w.size)
+	if err != nil {
+		var urlErr *url.Error
+		return errors.As(err, &urlErr), err
+	}
+	defer body.Close()
+	if !resumed && w.size > 0 {
+		line.set("The registry can't resume downloads, starting over")
+		if err := w.restart(); err != nil {
+			return false, err
+		}
+	}
+	// A byte more than the manifest says is enough to tell it's wrong: a server that never stops
+	// sending doesn't fill the disk
+	r := &progressReader{r: io.LimitReader(body, desc.Size+1-w.size), done: w.size, stop: stop, report: func(done int64) {
+		line.bar("Downloading", done, desc.Size)
+	}}
+	if _, err := io.Copy(w, r); err != nil {
+		// Not if writing failed, the disk won't be less full in a second
+		return r.broken, err
+	}
+	return false, nil
+}
+
+// progressReader reports how many bytes were read from r, and stops reading when stop is set.
+// broken tells whether reading from r failed.
+type progressReader struct {
+	r      io.Reader
+	done   int64
+	stop   *atomic.Bool
+	broken bool
+	report func(done int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if p.stop != nil && p.stop.Load() {
+		return 0, errDownloadStopped
+	}
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	p.report(p.done)
+	p.broken = err != nil && err != io.EOF
+	return n, err
+}
+
+// pullProgress shows a line per layer of a pull, see above.
+type pullProgress struct {
+	mu    sync.Mutex
+	out   io.Writer
+	tty   bool
+	width int
+	lines []*progressLine
+}
+
+// progressLine is the line of one layer.
+type progressLine struct {
+	p      *pullProgress
+	index  int
+	name   string
+	status string
+	drawn  time.Time
+}
+
+// newPullProgress starts the lines of the layers names on out.
+func newPullProgress(out io.Writer, names []string) *pullProgress {
+	p := &pullProgress{out: out}
+	if f, ok := out.(*os.File); ok && isTerminal(f) {
+		p.tty, p.width = true, terminalWidth(f)
+	}
+	for i, name := range names {
+		p.lines = append(p.lines, &progressLine{p: p, index: i, name: name, status: "Waiting"})
+		if p.tty {
+			fmt.Fprintf(out, "%s: Waiting\n", name)
+		}
+	}
+	return p
+}
+
+// set shows that status is the news of the layer.
+func (l *progressLine) set(status string) {
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	l.status = status
+	if !l.p.tty {
+		fmt.Fprintf(l.p.out, "%s: %s\n", l.name, status)
+		return
+	}
+	l.p.draw(l)
+}
+
+// bar shows how far action is, at done of total bytes. Only on a terminal, and ten times a
+// second at most.
+func (l *progressLine) bar(action string, done, total int64) {
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	if !l.p.tty || (time.Since(l.drawn) < 100*time.Millisecond && done < total) {
+		return
+	}
+	const width = 30
+	filled := width
+	if total > 0 && done < total {
+		filled = int(done * width / total)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	l.status = fmt.Sprintf("%-11s [%s] %7s/%s", action, bar, formatBytes(done), formatBytes(total))
+	l.p.draw(l)
+}
+
+// draw writes the line l again. The cursor is below the last line, where it goes back to.
+func (p *pullProgress) draw(l *progressLine) {
+	text := l.name + ": " + l.status
+	// A line that wraps would push the others up
+	if len(text) > p.width-1 {
+		text = text[:p.width-1]
+	}
+	up := len(p.lines) - l.index
+	// Up to the line, erase it, write it, and down again
+	fmt.Fprintf(p.out, "\x1b[%dA\r\x1b[2K%s\r\x1b[%dB", up, text, up)
+	l.drawn = time.Now()
+}
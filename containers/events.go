@@ -0,0 +1,343 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// `events` tells what happened to the containers, like `docker events`. A program that wants to
+// react to a container, say start it again somewhere else when it died, needn't poll ps:
+//
+//	2026-10-14T09:12:03.512204106Z container create 1f9fc284afae... (image=alpine)
+//	2026-10-14T09:12:03.514092771Z container start 1f9fc284afae... (image=alpine)
+//	2026-10-14T09:12:05.033876211Z container die 1f9fc284afae... (exitCode=0, image=alpine)
+//	2026-10-14T09:12:05.040110054Z container remove 1f9fc284afae... (image=alpine)
+//
+// dockerd keeps the last events in memory and sends them to whoever asks. Here every `run`,
+// monitor, `stop` and `rm` is a process of its own, so they append their events to events.jsonl
+// next to the states, a line of JSON each: the shape of Docker's events, for the scripts that
+// read `docker events --format '{{json .}}'`. Like counters.json (see metrics.go) it is in /run
+// and starts empty after a reboot. When it has grown to maxEventLog, the events before go to
+// events.jsonl.1, and the ones before those are dropped.
+//
+//	create   run or create made the container
+//	start    it runs: run, start, or a restart of the restart policy (see restart.go)
+//	kill     kill sent it a signal
+//	oom      the kernel OOM-killed one of its processes (see oom.go)
+//	die      its init exited, with the exit code
+//	stop     stop ended it
+//	remove   rm removed it, or it ran in the foreground and is gone with its run
+//	health_status
+//	         its health check made it healthy or unhealthy (see health.go)
+//
+// `events --follow` keeps reading like `tail -f`. Docker calls remove destroy, and has the new
+// health in the action: health_status: healthy.
+
+// The actions of the events
+const (
+	eventCreate = "create"
+	eventStart  = "start"
+	eventKill   = "kill"
+	eventOOM    = "oom"
+	eventDie    = "die"
+	eventStop   = "stop"
+	eventRemove = "remove"
+	// eventHealthStatus is a change of the health of a container (see health.go)
+	eventHealthStatus = "health_status"
+)
+
+// eventActions lists the actions, for the usage and --filter
+var eventActions = []string{eventCreate, eventStart, eventKill, eventOOM, eventDie, eventStop, eventRemove, eventHealthStatus}
+
+// maxEventLog is how large events.jsonl grows before it's rotated
+const maxEventLog = 1 << 20
+
+// event is a line of events.jsonl, with the field names of Docker's events API.
+type event struct {
+	Type   string     `json:"Type"`
+	Action string     `json:"Action"`
+	Actor  eventActor `json:"Actor"`
+	// The seconds since 1970, and the same in nanoseconds
+	Time     int64 `json:"time"`
+	TimeNano int64 `json:"timeNano"`
+}
+
+// eventActor is what the event happened to: the container, with its image and labels and what
+// else the action has to say.
+type eventActor struct {
+	ID         string            `json:"ID"`
+	Attributes map[string]string `json:"Attributes,omitempty"`
+}
+
+// eventsPath is the event log, next to the directories of the states.
+func eventsPath() string {
+	return filepath.Join(filepath.Dir(stateRoot()), "events.jsonl")
+}
+
+// recordEvent appends that action happened to container id to the event log. attributes are
+// more of them, name and value after each other. It reads the config of the container for its
+// image and labels, so a remove must be recorded while it's still there. Like a counter, an event
+// that can't be written isn't worth failing a container for.
+func recordEvent(id, action string, attributes ...string) {
+	e := event{Type: "container", Action: action, Actor: eventActor{ID: id, Attributes: map[string]string{}}}
+	if cfg, err := readConfig(id); err == nil {
+		for key, value := range cfg.Labels {
+			e.Actor.Attributes[key] = value
+		}
+		if cfg.Image != "" {
+			e.Actor.Attributes["image"] = cfg.Image
+		}
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		e.Actor.Attributes[attributes[i]] = attributes[i+1]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(eventsPath()), 0700); err != nil {
+		return
+	}
+	// Under the lock, so two events don't both rotate, and the time is in the order of the lines
+	unlock, err := lockPath(eventsPath() + ".lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+	now := time.Now()
+	e.Time, e.TimeNano = now.Unix(), now.UnixNano()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if fi, err := os.Stat(eventsPath()); err == nil && fi.Size()+int64(len(line)) > maxEventLog {
+		os.Rename(eventsPath(), eventsPath()+".1")
+	}
+	file, err := os.OpenFile(eventsPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	// One write: who follows the log reads whole lines
+	file.Write(append(line, '\n'))
+}
+
+// eventsCommand implements `events [OPTIONS]`.
+func eventsCommand(args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s events [OPTIONS]\n\nShow what happened to containers: %s.\n\nOptions:\n", progName(), strings.Join(eventActions, ", "))
+		fs.PrintDefaults()
+	}
+	follow := fs.Bool("follow", false, "keep printing events as they happen, until Ctrl-C")
+	since := fs.String("since", "", "only show events since `TIME`: a duration like 10m, or a time like 2026-10-14T09:00:00Z")
+	format := fs.String("format", "text", "the format: text, or json for a line of Docker's JSON per event")
+	var filters stringList
+	fs.Var(&filters, "f", "only show events that match: container=ID, event=ACTION, image=IMAGE, label=KEY or label=KEY=VALUE (repeatable)")
+	fs.Var(&filters, "filter", "same as -f")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "unexpected argument %q", fs.Arg(0))
+	}
+	if *format != "text" && *format != "json" {
+		return usageErrorf(fs, "unknown --format %q, expected text or json", *format)
+	}
+	filter, err := parseEventFilters(filters)
+	if err != nil {
+		return usageErrorf(fs, "invalid --filter: %v", err)
+	}
+	if *since != "" {
+		if filter.since, err = parseSince(*since); err != nil {
+			return usageErrorf(fs, "invalid --since: %v", err)
+		}
+	}
+
+	show := func(line string) {
+		var e event
+		if err := json.Unmarshal([]byte(line), &e); err != nil || !filter.match(e) {
+			return
+		}
+		if *format == "json" {
+			fmt.Print(line)
+			return
+		}
+		fmt.Println(formatEvent(e))
+	}
+	// What was rotated away first, it's older
+	if data, err := os.ReadFile(eventsPath() + ".1"); err == nil {
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if strings.HasSuffix(line, "\n") {
+				show(line)
+			}
+		}
+	}
+	file, err := os.Open(eventsPath())
+	if errors.Is(err, os.ErrNotExist) && *follow {
+		// Nothing happened yet, wait for the first event
+		for ; errors.Is(err, os.ErrNotExist); file, err = os.Open(eventsPath()) {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	reader := bufio.NewReader(file)
+	var partial string
+	for next := false; ; {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == nil {
+			show(partial)
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if !*follow {
+			return nil
+		}
+		if next {
+			// Nobody writes into the old one any more, we read the last of it
+			if newer, err := os.Open(eventsPath()); err == nil {
+				file.Close()
+				file, partial = newer, ""
+				reader.Reset(file)
+			}
+			next = false
+			continue
+		}
+		time.Sleep(200 * time.Millisecond)
+		// Rotated: this file is events.jsonl.1 now. Read what is left in it, then the new one.
+		next = rotated(file, eventsPath())
+	}
+}
+
+// rotated tells whether there's another file at path by now than file, the one opened there
+// before: a log rotated it away.
+func rotated(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	a, b := opened.Sys().(*syscall.Stat_t), current.Sys().(*syscall.Stat_t)
+	return a.Dev != b.Dev || a.Ino != b.Ino
+}
+
+// formatEvent prints e the way `docker events` does: the time, the type, the action, the ID, and
+// the attributes sorted.
+func formatEvent(e event) string {
+	var attributes []string
+	for key, value := range e.Actor.Attributes {
+		attributes = append(attributes, key+"="+value)
+	}
+	slices.Sort(attributes)
+	text := fmt.Sprintf("%s %s %s %s", time.Unix(0, e.TimeNano).UTC().Format(time.RFC3339Nano), e.Type, e.Action, e.Actor.ID)
+	if len(attributes) > 0 {
+		text += " (" + strings.Join(attributes, ", ") + ")"
+	}
+	return text
+}
+
+// parseSince parses the TIME of --since: a duration before now, a time in RFC 3339, or seconds
+// since 1970 like Docker takes it too.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration like 10m nor a time like 2026-10-14T09:00:00Z", s)
+}
+
+// eventFilter is what `events --filter` asks for. Like in Docker an event must match one of the
+// values given for each key, and have every label.
+type eventFilter struct {
+	containers, actions, images []string
+	// labels maps a label to its value, nil when any value will do
+	labels map[string]*string
+	since  time.Time
+}
+
+// parseEventFilters parses the --filter entries of events.
+func parseEventFilters(entries []string) (eventFilter, error) {
+	f := eventFilter{labels: map[string]*string{}}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || value == "" {
+			return f, fmt.Errorf("%q is not NAME=VALUE", entry)
+		}
+		switch name {
+		case "container":
+			f.containers = append(f.containers, value)
+		case "event":
+			if !slices.Contains(eventActions, value) {
+				return f, fmt.Errorf("unknown event %q, expected one of %s", value, strings.Join(eventActions, ", "))
+			}
+			f.actions = append(f.actions, value)
+		case "image":
+			f.images = append(f.images, value)
+		case "label":
+			if key, labelValue, hasValue := strings.Cut(value, "="); hasValue {
+				f.labels[key] = &labelValue
+			} else {
+				f.labels[key] = nil
+			}
+		default:
+			return f, fmt.Errorf("unknown filter %q, expected container, event, image or label", name)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether e passes f.
+func (f eventFilter) match(e event) bool {
+	if !f.since.IsZero() && e.TimeNano < f.since.UnixNano() {
+		return false
+	}
+	// An ID or the start of one, like the other commands take it
+	if len(f.containers) > 0 && !slices.ContainsFunc(f.containers, func(prefix string) bool { return strings.HasPrefix(e.Actor.ID, prefix) }) {
+		return false
+	}
+	if len(f.actions) > 0 && !slices.Contains(f.actions, e.Action) {
+		return false
+	}
+	if len(f.images) > 0 && !slices.Contains(f.images, e.Actor.Attributes["image"]) {
+		return false
+	}
+	for key, want := range f.labels {
+		value, ok := e.Actor.Attributes[key]
+		if !ok || (want != nil && value != *want) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+// Command hugepages maps huge pages and touches them one by one, to show the hugetlb limit of a
+// container (--hugetlb-limit). The rootfs has no compiler, so build it static and copy it in:
+//
+//	CGO_ENABLED=0 GOOS=linux go build -o /rootfs/usr/local/bin/hugepages examples/hugepages/main.go
+//
+// Usage: hugepages [MB], 128 by default. The pages are the default huge page size, the
+// Hugepagesize of /proc/meminfo, 2MB on x86 and most arm64 kernels.
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"syscall"
+)
+
+const hugePageSize = 2 << 20
+
+func main() {
+	mb := 128
+	if len(os.Args) > 1 {
+		n, err := strconv.Atoi(os.Args[1])
+		if err != nil || n <= 0 || n%(hugePageSize>>20) != 0 {
+			fmt.Fprintf(os.Stderr, "usage: hugepages [MB], a multiple of %dMB\n", hugePageSize>>20)
+			os.Exit(2)
+		}
+		mb = n
+	}
+	size := mb << 20
+
+	// MAP_HUGETLB takes the pages from the pool in /proc/sys/vm/nr_hugepages. The kernel reserves
+	// them right here, which the reservation limit (hugetlb.2MB.rsvd.*) can refuse with ENOMEM,
+	// as can an empty pool.
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_HUGETLB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mmap %dMB of huge pages: %v\n", mb, err)
+		os.Exit(1)
+	}
+	fmt.Printf("mapped %dMB of huge pages\n", mb)
+
+	// The usage limit (hugetlb.2MB.max, limit_in_bytes on v1) only counts a page once it is
+	// touched, and a page fault has no error to return: the kernel sends SIGBUS. Go turns that
+	// into a panic we can recover from.
+	debug.SetPanicOnFault(true)
+	touched := 0
+	defer func() {
+		if recover() != nil {
+			fmt.Fprintf(os.Stderr, "SIGBUS after %dMB: the container's huge page limit is used up\n", touched>>20)
+			os.Exit(1)
+		}
+	}()
+	for ; touched < size; touched += hugePageSize {
+		mem[touched] = 1
+	}
+	fmt.Printf("touched all %dMB\n", mb)
+}
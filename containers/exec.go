@@ -0,0 +1,218 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// execNamespaces are the namespaces exec joins, in order. The mount namespace comes last: once we
+// are in it, the host's /proc (and the files of the other namespaces) are out of sight. With
+// --cgroupns host the cgroup namespace of the init is the host's, and with --network host its
+// network namespace: joining them changes nothing.
+var execNamespaces = []string{"ipc", "uts", "net", "pid", "cgroup", "mnt"}
+
+// execInContainer implements `exec [OPTIONS] CONTAINER COMMAND [ARG...]`, like `docker exec`.
+//
+// There is nothing like "a container" the kernel could start a process in. A container is a set
+// of namespaces, a cgroup and some restrictions, and that's what a new process has to get:
+//  1. setns() into each namespace of the container's init, found in /proc/<pid>/ns/*
+//  2. fork the command, it starts inside those namespaces
+//  3. move it into the container's cgroup
+//  4. drop the same capabilities, and apply the same seccomp filter and LSM labels, as for the
+//     command of `run`
+func execInContainer(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exec [OPTIONS] CONTAINER COMMAND [ARG...]\n\nRun a command in a running container.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var tty bool
+	fs.BoolVar(&tty, "t", false, "allocate a pseudo terminal")
+	fs.BoolVar(&tty, "tty", false, "same as -t")
+	var envs stringList
+	fs.Var(&envs, "e", "set an environment variable KEY=VALUE, or KEY to copy it from the host (repeatable)")
+	fs.Var(&envs, "env", "same as -e")
+	var workdir string
+	fs.StringVar(&workdir, "w", "", "working directory inside the container (default: the one of the container)")
+	fs.StringVar(&workdir, "workdir", "", "same as -w")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < 2 {
+		return usageErrorf(fs, "missing CONTAINER or COMMAND")
+	}
+
+	// A process can only join a user namespace while it is single-threaded, and a Go program
+	// never is: the runtime starts several threads before main(). runc gets around this with C
+	// code that runs before the Go runtime starts (nsexec.c), this demo doesn't.
+	if os.Geteuid() != 0 {
+		return errors.New("exec needs root: a Go program can't join the user namespace of a rootless container")
+	}
+
+	// Locked till the namespaces are open, so `rm` and the monitor leave the container alone
+	state, unlock, err := lockContainerState(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if state.currentStatus() != statusRunning {
+		return fmt.Errorf("container %s is not running", shortID(state.ID))
+	}
+	cfg, err := readConfig(state.ID)
+	if err != nil {
+		return err
+	}
+	env, err := buildEnv(cfg.Hostname, nil, append(cfg.Env, envs...))
+	if err != nil {
+		return usageErrorf(fs, "%v", err)
+	}
+	if workdir == "" {
+		workdir = cfg.Workdir
+	}
+	// setns() into a time namespace refuses a process with more than one thread, which a Go
+	// program always has. nsenter, in C, can do it: nsenter -t PID -T
+	if cfg.TimeNamespace {
+		slog.Warn("exec can't join the time namespace, the command sees the host's clocks", "id", shortID(state.ID))
+	}
+
+	// Open all namespace files first, they're in the host's /proc
+	var namespaces []*os.File
+	for _, ns := range execNamespaces {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", state.Pid, ns))
+		if err != nil {
+			return fmt.Errorf("open %s namespace: %w", ns, err)
+		}
+		defer f.Close()
+		namespaces = append(namespaces, f)
+	}
+	// The files hold on to the namespaces now, even if the container exits. Still the same
+	// process means they are the container's.
+	if !state.alive() {
+		return fmt.Errorf("container %s is not running", shortID(state.ID))
+	}
+	unlock()
+
+	// The command is looked up in the container's PATH, like in the child
+	for _, kv := range env {
+		if path, ok := strings.CutPrefix(kv, "PATH="); ok {
+			os.Setenv("PATH", path)
+		}
+	}
+
+	// Set on ourselves, so the command inherits it without a gap. It applies to us as well, which
+	// does no harm: all we do is wait for the command.
+	if cfg.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(0, *cfg.OOMScoreAdj); err != nil {
+			return err
+		}
+	}
+
+	var cmd *exec.Cmd
+	var master *os.File
+	errc := make(chan error, 1)
+	go func() {
+		// Namespaces belong to a thread, like the restrictions in startRestricted, and so does
+		// everything after setns(): the path lookup, /dev/ptmx and the fork all have to happen on
+		// this thread. It is never unlocked, the Go runtime throws it away afterwards.
+		runtime.LockOSThread()
+		errc <- func() error {
+			// The threads of a process share one root and working directory (CLONE_FS), and the
+			// kernel doesn't let a thread that shares them join a mount namespace. Unsharing
+			// gives this thread a copy of its own first.
+			if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+				return fmt.Errorf("unshare CLONE_FS: %w", err)
+			}
+			for i, f := range namespaces {
+				// setns() into the PID namespace only applies to children: the command becomes a
+				// process of the container, we stay where we are
+				if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), 0, 0); errno != 0 {
+					return fmt.Errorf("join %s namespace: %w", execNamespaces[i], errno)
+				}
+			}
+			// setns() into a mount namespace also moved our root to the container's `/`
+
+			cmd = exec.Command(fs.Arg(1), fs.Args()[2:]...)
+			cmd.Env = env
+			cmd.Dir = workdir
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if tty {
+				var slave *os.File
+				var err error
+				if master, slave, err = openPTY(); err != nil {
+					return err
+				}
+				defer slave.Close()
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+			}
+
+			if err := dropCapabilities(cfg.Capabilities); err != nil {
+				return err
+			}
+			if err := applyLSMLabels(cfg.AppArmorProfile, cfg.SELinuxLabel); err != nil {
+				return err
+			}
+			if cfg.NoNewPrivileges {
+				if err := setNoNewPrivs(); err != nil {
+					return err
+				}
+			}
+			if cfg.Seccomp != nil {
+				if err := installSeccomp(cfg.Seccomp, cfg.Capabilities); err != nil {
+					return err
+				}
+			}
+			return cmd.Start()
+		}()
+	}()
+	if err := <-errc; err != nil {
+		if master != nil {
+			master.Close()
+		}
+		return startError(err)
+	}
+
+	// The command runs outside the cgroup, and with our rlimits, for the moment it takes to get
+	// here. runc closes that gap by moving itself into the cgroup and setting the limits before it
+	// forks. We can't: lower limits would hold for us as well.
+	if err := setRlimits(cmd.Process.Pid, cfg.Rlimits); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if state.Cgroup != "" {
+		if err := joinCgroups(state.ID, cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("join cgroup: %w", err)
+		}
+	}
+
+	stopSignals := forwardSignals(cmd.Process, forwardedSignals...)
+	defer stopSignals()
+	if tty {
+		defer master.Close()
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			defer restore()
+		}
+		stopResize := forwardWindowSize(master)
+		defer stopResize()
+		output := proxyConsole(master)
+		err := waitExit(cmd)
+		<-output
+		return err
+	}
+	return waitExit(cmd)
+}
@@ -0,0 +1,242 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// `--explain`, before the command, makes the demo its own tutorial: every system call that makes
+// the container is printed before it's made, with what it does and why we need it, and after
+// with what it returned, like strace would show it:
+//
+//	→ child: sethostname("container")
+//	  Sets the hostname of the UTS namespace the child is in. The host's stays what it was, that's
+//	  what CLONE_NEWUTS was for.
+//	← child: 0, the hostname in here is "container"
+//
+// Which process makes the call is in front of it: run (or the monitor of -d) clones the child,
+// writes its cgroup files and sets up its network, the child mounts its filesystems and pivots
+// into its root. Like the log options (see logging.go), --explain passes on to them in the
+// environment. It's on stderr, and with -d in monitor.log and the container's log.
+
+// explainEnv is the environment variable of --explain
+const explainEnv = "CONTAINER_EXPLAIN"
+
+// explaining tells whether --explain is on.
+func explaining() bool {
+	return os.Getenv(explainEnv) == "1"
+}
+
+// explainWidth is where the explanations wrap
+const explainWidth = 100
+
+// explainBefore prints call, a system call about to be made, and why: what it does, and what
+// for. Only with --explain.
+func explainBefore(call, why string) {
+	if !explaining() {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "→ %s: %s\n", os.Args[1], call)
+	for _, line := range wrapText(why, explainWidth-2) {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+}
+
+// explainAfter prints what the call explainBefore announced returned: 0 and what changed, or -1
+// and the error, like strace.
+func explainAfter(err error, effect string) {
+	if !explaining() {
+		return
+	}
+	result := "0"
+	if err != nil {
+		result = "-1 " + err.Error()
+	} else if effect != "" {
+		result += ", " + effect
+	}
+	explainResult(result)
+}
+
+// explainResult prints what a call returned, when that's more than 0.
+func explainResult(result string) {
+	if explaining() {
+		fmt.Fprintf(os.Stderr, "← %s: %s\n", os.Args[1], result)
+	}
+}
+
+// wrapText breaks text into lines of at most width, between words.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// quoteArgs writes args the way strace does, quoted and between commas.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// cloneFlags are the namespace flags of clone(), with what each one gives the child.
+var cloneFlags = []struct {
+	flag       uintptr
+	name, what string
+}{
+	{syscall.CLONE_NEWUSER, "CLONE_NEWUSER", "a user namespace, in which our user is root and nobody else exists"},
+	{syscall.CLONE_NEWUTS, "CLONE_NEWUTS", "a hostname of its own"},
+	{syscall.CLONE_NEWPID, "CLONE_NEWPID", "PIDs of its own, starting with it as PID 1"},
+	{syscall.CLONE_NEWNS, "CLONE_NEWNS", "a copy of our mount table, which it changes without the host seeing it"},
+	{syscall.CLONE_NEWNET, "CLONE_NEWNET", "a network stack of its own, with nothing but a lo that is down"},
+	{syscall.CLONE_NEWIPC, "CLONE_NEWIPC", "System V IPC objects and POSIX message queues of its own"},
+}
+
+// explainClone explains the clone() that starts the child with flags.
+func explainClone(flags uintptr) {
+	if !explaining() {
+		return
+	}
+	var names, gets []string
+	for _, f := range cloneFlags {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			gets = append(gets, f.what+" ("+f.name+")")
+		}
+	}
+	explainBefore(fmt.Sprintf("clone(%s)", strings.Join(names, "|")),
+		"Starts the child, this program again as /proc/self/exe child, in new namespaces. It gets "+
+			strings.Join(gets, ", ")+". Everything else it shares with the host until it changes it.")
+}
+
+// mountFlagNames are the MS_ flags of mount(), for printing a call.
+var mountFlagNames = []struct {
+	flag uintptr
+	name string
+}{
+	{syscall.MS_RDONLY, "MS_RDONLY"}, {syscall.MS_NOSUID, "MS_NOSUID"}, {syscall.MS_NODEV, "MS_NODEV"},
+	{syscall.MS_NOEXEC, "MS_NOEXEC"}, {syscall.MS_REMOUNT, "MS_REMOUNT"}, {syscall.MS_BIND, "MS_BIND"},
+	{syscall.MS_MOVE, "MS_MOVE"}, {syscall.MS_REC, "MS_REC"}, {syscall.MS_UNBINDABLE, "MS_UNBINDABLE"},
+	{syscall.MS_PRIVATE, "MS_PRIVATE"}, {syscall.MS_SLAVE, "MS_SLAVE"}, {syscall.MS_SHARED, "MS_SHARED"},
+	{syscall.MS_NOATIME, "MS_NOATIME"}, {syscall.MS_RELATIME, "MS_RELATIME"}, {syscall.MS_STRICTATIME, "MS_STRICTATIME"},
+}
+
+// mountFS is syscall.Mount, explained with --explain.
+func mountFS(source, target, fstype string, flags uintptr, data string) error {
+	if !explaining() {
+		return syscall.Mount(source, target, fstype, flags, data)
+	}
+	var names []string
+	rest := flags
+	for _, f := range mountFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			rest &^= f.flag
+		}
+	}
+	if rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", rest))
+	} else if len(names) == 0 {
+		names = append(names, "0")
+	}
+	explainBefore(fmt.Sprintf("mount(%q, %q, %q, %s, %q)", source, target, fstype, strings.Join(names, "|"), data),
+		mountWhy(source, target, fstype, flags))
+	err := syscall.Mount(source, target, fstype, flags, data)
+	explainAfter(err, "")
+	return err
+}
+
+// mountWhy says what a mount does.
+func mountWhy(source, target, fstype string, flags uintptr) string {
+	switch {
+	case flags&syscall.MS_REMOUNT != 0 && flags&syscall.MS_RDONLY != 0:
+		return "Makes the mount at " + target + " read-only: the files stay, nobody in the container can change them."
+	case flags&syscall.MS_REMOUNT != 0:
+		return "Changes the flags of the mount at " + target + ", its files stay the same."
+	case flags&(syscall.MS_PRIVATE|syscall.MS_SLAVE|syscall.MS_SHARED) != 0 && source == "":
+		return "Sets the propagation of " + target + ": whether mounts made below it show up in the other " +
+			"mount namespaces, and theirs here. private is neither way, slave only from the host to the " +
+			"container, shared both ways."
+	case flags&syscall.MS_BIND != 0 && source == "/dev/null":
+		return "Hides " + target + ": /dev/null on top of it, reading it gives nothing."
+	case flags&syscall.MS_BIND != 0 && source == target:
+		return "Binds " + target + " onto itself. Nothing changes in it, but now it's a mount point of its own, " +
+			"which pivot_root and a later read-only remount need."
+	case flags&syscall.MS_BIND != 0:
+		return "A bind mount: " + source + " of the host shows at " + target + " as well, the same files, no copy. " +
+			"Writes in the container are writes on the host."
+	}
+	switch fstype {
+	case "proc":
+		return "A new procfs. It shows the processes of the PID namespace of whoever mounts it, only the " +
+			"container's: ps in the container reads /proc."
+	case "sysfs":
+		return "sysfs, the kernel's objects: devices, drivers, and in /sys/class/net the interfaces of the " +
+			"network namespace that mounts it."
+	case "tmpfs":
+		return "A tmpfs at " + target + ": a filesystem in memory, empty at the start and gone with the container."
+	case "devpts":
+		return "A devpts of the container's own (newinstance): its pseudo terminals, numbered from /dev/pts/0, " +
+			"without the host's."
+	case "overlay":
+		return "The overlay of the image's layers: the lowerdirs stay read-only, what the container changes goes " +
+			"into upperdir, and merged shows them as one tree, the container's root."
+	case "cgroup", "cgroup2":
+		return "The cgroup filesystem. In a cgroup namespace its root is the container's cgroup, the host's " +
+			"cgroups aren't in it."
+	}
+	return "Mounts a " + fstype + " filesystem from " + source + " at " + target + "."
+}
+
+// cgroupFileWhy says what writing a cgroup file does, file being its name.
+func cgroupFileWhy(file string) string {
+	switch {
+	case file == "cgroup.procs":
+		return "Moves the process into the cgroup. From now on its limits apply to it and to every process it starts, " +
+			"children stay in the cgroup of their parent."
+	case file == "cgroup.subtree_control":
+		return "Enables controllers for the cgroups below this one: in v2 a cgroup can only use a controller its parent passes on."
+	case file == "memory.max" || file == "memory.limit_in_bytes":
+		return "The memory limit. When the cgroup reaches it the kernel reclaims its pages first, and OOM-kills one of its processes when that fails."
+	case file == "memory.swap.max" || file == "memory.memsw.limit_in_bytes":
+		return "How much of the cgroup's memory may be swapped out (v2), or memory and swap together (v1)."
+	case file == "cpu.max":
+		return "The CPU quota: QUOTA PERIOD in microseconds. The cgroup runs QUOTA of every PERIOD, on all CPUs together, and waits for the next one after."
+	case file == "cpu.cfs_quota_us" || file == "cpu.cfs_period_us":
+		return "The CPU quota in v1, the microseconds the cgroup may run in every period."
+	case file == "pids.max":
+		return "The most processes and threads the cgroup may have, fork() fails beyond it: a fork bomb stops there."
+	case file == "cpuset.cpus":
+		return "The CPUs the processes of the cgroup may run on."
+	case file == "cpuset.mems":
+		return "The memory nodes the processes of the cgroup may allocate on."
+	case file == "io.max" || strings.HasPrefix(file, "blkio.throttle."):
+		return "A limit of the bytes per second the cgroup reads from or writes to a block device."
+	case file == "devices.allow" || file == "devices.deny":
+		return "Which device nodes the cgroup may open (v1). a is all of them, c and b the character and block devices MAJOR:MINOR."
+	case strings.HasPrefix(file, "hugetlb."):
+		return "A limit of the huge pages of one size the cgroup may use."
+	case file == "cgroup.freeze" || file == "freezer.state":
+		return "Freezes or thaws the cgroup: the kernel stops scheduling its processes, or goes on."
+	}
+	return "A setting of the cgroup, see Documentation/admin-guide/cgroup-v2.rst of the kernel."
+}
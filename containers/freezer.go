@@ -0,0 +1,103 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// pause implements `pause CONTAINER...`, unpause implements `unpause CONTAINER...`.
+//
+// This is all `docker pause` does: it asks the cgroup freezer to stop scheduling every process in
+// the container's cgroup. The processes are not signalled and can't notice or block it (unlike
+// SIGSTOP, which a process can observe through its parent); they simply get no CPU time until
+// they are thawed. Their memory, open files and connections stay as they are.
+func pause(args []string) error {
+	return freezeContainers("pause", args, true)
+}
+
+func unpause(args []string) error {
+	return freezeContainers("unpause", args, false)
+}
+
+func freezeContainers(command string, args []string, freeze bool) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s CONTAINER...\n", progName(), command)
+		return errUsage
+	}
+	ids, err := resolveContainers(args)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := setFrozen(id, freeze); err != nil {
+			return fmt.Errorf("%s %s: %w", command, shortID(id), err)
+		}
+		fmt.Println(shortID(id))
+	}
+	return nil
+}
+
+// setFrozen freezes or thaws the container's cgroup and waits until the kernel is done. Freezing
+// is asynchronous: every task has to reach a safe point in the kernel first.
+func setFrozen(id string, freeze bool) error {
+	var file, value string
+	var done func() bool
+
+	if cgroupV2() {
+		// v2: write 1 or 0 to cgroup.freeze; cgroup.events reports "frozen 1" once it took effect
+		dir := cgroupPath("", id)
+		file, value = "cgroup.freeze", "0"
+		if freeze {
+			value = "1"
+		}
+		done = func() bool {
+			return strings.Contains(readCgroupFile(dir, "cgroup.events"), "frozen "+value)
+		}
+	} else {
+		// v1: the freezer controller has freezer.state, which goes THAWED -> FREEZING -> FROZEN
+		dir := cgroupPath("freezer", id)
+		file, value = "freezer.state", "THAWED"
+		if freeze {
+			value = "FROZEN"
+		}
+		done = func() bool {
+			return readCgroupFile(dir, "freezer.state") == value
+		}
+	}
+
+	dir := cgroupPath("freezer", id)
+	if err := writeCgroupFileErr(dir, file, value); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if done() {
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for %s to become %s", file, value)
+}
+
+// pauseWhile freezes the container id for a command that reads or writes its files, like commit
+// and cp, so its processes can't change them halfway through. thaw thaws it again, unless it was
+// paused before.
+func pauseWhile(id string) (thaw func(), err error) {
+	if frozen(id) {
+		return func() {}, nil
+	}
+	if err := setFrozen(id, true); err != nil {
+		return nil, fmt.Errorf("pause %s: %w", shortID(id), err)
+	}
+	return func() { setFrozen(id, false) }, nil
+}
+
+// frozen tells whether the container's cgroup is frozen, by pause.
+func frozen(id string) bool {
+	if cgroupV2() {
+		return strings.Contains(readCgroupFile(cgroupPath("", id), "cgroup.events"), "frozen 1")
+	}
+	return readCgroupFile(cgroupPath("freezer", id), "freezer.state") == "FROZEN"
+}
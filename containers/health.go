@@ -0,0 +1,368 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A container that runs isn't necessarily one that works: the server in it may hang, or still
+// load its data. A health check asks it, every --health-interval, one of three ways:
+//
+//	--health-cmd CMD     runs /bin/sh -c CMD in the container like exec, healthy when it exits 0
+//	--health-tcp PORT    connects to the port, healthy when something accepts
+//	--health-http PORT[/PATH]
+//	                     GETs http://localhost:PORT/PATH, healthy with a status from 200 to 399
+//
+// A check that takes longer than --health-timeout failed. The container starts "starting",
+// becomes "healthy" with the first check that passes, and "unhealthy" after --health-retries
+// checks that failed in a row; one that passes makes it healthy again. The status is in the state,
+// ps shows it after the uptime (Up 5 minutes (healthy)) and inspect with the last checks:
+//
+//	"health": {
+//	  "status": "healthy",
+//	  "failingStreak": 0,
+//	  "log": [{"start": "...", "end": "...", "exitCode": 0, "output": "HTTP/1.1 200 OK"}]
+//	}
+//
+// Docker has --health-cmd only, and the image's HEALTHCHECK. The three kinds are Kubernetes'
+// probes: exec, tcpSocket and httpGet. The kubelet also just runs them, and what it does with the
+// result is what makes them liveness or readiness probes: it restarts a container that fails its
+// liveness probe, and sends no traffic to one that isn't ready yet. Here an unhealthy container
+// keeps running, the status is for whoever watches it, with ps or the health_status event (see
+// events.go).
+//
+// The process that waits for the container, run or the monitor of -d, runs the checks. Like the
+// proxy of the published ports (see ports.go) it connects to the container's address, or without
+// one from inside its network namespace to 127.0.0.1; for a rootless container the child
+// connects. --health-cmd uses exec, which needs root.
+
+// The statuses of a health check, the words Docker uses
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// The kinds of health check
+const (
+	healthCmd  = "cmd"
+	healthTCP  = "tcp"
+	healthHTTP = "http"
+)
+
+// healthLogSize is how many checks the state keeps, and healthOutputLimit how much of the output
+// of one, like Docker
+const (
+	healthLogSize     = 5
+	healthOutputLimit = 4096
+)
+
+// healthCheck is the health check of a container.
+type healthCheck struct {
+	// Type is cmd, tcp or http, with Command to run or the Port (and Path) to connect to
+	Type    string `json:"type"`
+	Command string `json:"command,omitempty"`
+	Port    uint16 `json:"port,omitempty"`
+	Path    string `json:"path,omitempty"`
+	// Interval is the time between two checks, and the time to the first one
+	Interval time.Duration `json:"interval"`
+	Timeout  time.Duration `json:"timeout"`
+	// Retries is how many checks must fail in a row for the container to be unhealthy
+	Retries int `json:"retries"`
+}
+
+// healthState is how healthy a container is, in its state.
+type healthState struct {
+	Status string `json:"status"`
+	// FailingStreak counts the checks that failed since the last one that passed
+	FailingStreak int            `json:"failingStreak"`
+	Log           []healthResult `json:"log,omitempty"`
+}
+
+// healthResult is one check.
+type healthResult struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// ExitCode is 0 for a check that passed, 1 for one that failed and -1 for one that timed out
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output"`
+}
+
+// parseHealthCheck makes the health check of the --health options, nil without one of
+// --health-cmd, --health-tcp and --health-http.
+func parseHealthCheck(command, tcp, httpGet string, interval, timeout time.Duration, retries int) (*healthCheck, error) {
+	h := &healthCheck{Interval: interval, Timeout: timeout, Retries: retries}
+	var kinds []string
+	if command != "" {
+		h.Type, h.Command = healthCmd, command
+		kinds = append(kinds, "--health-cmd")
+	}
+	if tcp != "" {
+		port, err := parsePort(tcp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --health-tcp %q: %v", tcp, err)
+		}
+		h.Type, h.Port = healthTCP, port
+		kinds = append(kinds, "--health-tcp")
+	}
+	if httpGet != "" {
+		portText, path, _ := strings.Cut(httpGet, "/")
+		port, err := parsePort(portText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --health-http %q: %v, expected PORT[/PATH] like 8080/healthz", httpGet, err)
+		}
+		h.Type, h.Port, h.Path = healthHTTP, port, "/"+path
+		kinds = append(kinds, "--health-http")
+	}
+	switch {
+	case len(kinds) == 0:
+		return nil, nil
+	case len(kinds) > 1:
+		return nil, fmt.Errorf("%s can't be combined, a container has one health check", strings.Join(kinds, " and "))
+	case interval <= 0:
+		return nil, fmt.Errorf("invalid --health-interval %v", interval)
+	case timeout <= 0:
+		return nil, fmt.Errorf("invalid --health-timeout %v", timeout)
+	case retries < 1:
+		return nil, fmt.Errorf("invalid --health-retries %d, expected at least 1", retries)
+	}
+	// Like exec, see there
+	if h.Type == healthCmd && os.Geteuid() != 0 {
+		return nil, errors.New("--health-cmd runs the command like exec, which needs root")
+	}
+	return h, nil
+}
+
+// parsePort parses a TCP port number.
+func parsePort(v string) (uint16, error) {
+	n, err := strconv.ParseUint(v, 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port %q", v)
+	}
+	return uint16(n), nil
+}
+
+// dials tells whether the health check connects to the container. Nil is no health check.
+func (h *healthCheck) dials() bool {
+	return h != nil && (h.Type == healthTCP || h.Type == healthHTTP)
+}
+
+// startHealthChecks checks the health of container id every interval of h, until the
+// returned function is called. dial connects to a port of the container.
+func startHealthChecks(id string, h *healthCheck, dial func(port uint16) (net.Conn, error)) (stop func()) {
+	setHealth(id, func(health *healthState) { *health = healthState{Status: healthStarting} })
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			// A created container waits for start, its command doesn't run yet
+			if s, err := readState(id); err != nil || s.Status != statusRunning {
+				continue
+			}
+			result := h.check(id, dial)
+			var changed string
+			setHealth(id, func(health *healthState) {
+				before := health.Status
+				health.Log = append(health.Log, result)
+				health.Log = health.Log[max(0, len(health.Log)-healthLogSize):]
+				if result.ExitCode == 0 {
+					health.Status, health.FailingStreak = healthHealthy, 0
+				} else if health.FailingStreak++; health.FailingStreak >= h.Retries {
+					health.Status = healthUnhealthy
+				}
+				if health.Status != before {
+					changed = health.Status
+				}
+			})
+			if changed != "" {
+				slog.Info("health status changed", "id", shortID(id), "status", changed, "output", result.Output)
+				recordEvent(id, eventHealthStatus, "healthStatus", changed)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// setHealth changes the health in the state of container id, while it runs: a check that ends
+// after the container leaves its state alone.
+func setHealth(id string, update func(health *healthState)) {
+	updateState(id, func(s *containerState) error {
+		if s.Status != statusRunning && s.Status != statusCreated {
+			return errNotRunning
+		}
+		if s.Health == nil {
+			s.Health = &healthState{Status: healthStarting}
+		}
+		update(s.Health)
+		return nil
+	})
+}
+
+// errNotRunning tells updateState to leave the state of a container that exited alone
+var errNotRunning = errors.New("not running")
+
+// check runs the health check once.
+func (h *healthCheck) check(id string, dial func(port uint16) (net.Conn, error)) healthResult {
+	result := healthResult{Start: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	var output string
+	var err error
+	switch h.Type {
+	case healthCmd:
+		output, err = h.checkCommand(ctx, id)
+	case healthTCP:
+		var conn net.Conn
+		if conn, err = dialContext(ctx, dial, h.Port); err == nil {
+			conn.Close()
+			output = fmt.Sprintf("connected to port %d", h.Port)
+		}
+	case healthHTTP:
+		output, err = h.checkHTTP(ctx, dial)
+	}
+	result.End = time.Now()
+	switch {
+	case ctx.Err() != nil:
+		result.ExitCode, output = -1, fmt.Sprintf("health check exceeded timeout (%v)", h.Timeout)
+	case err != nil:
+		result.ExitCode = 1
+		output = strings.TrimSpace(output + "\n" + err.Error())
+	}
+	if len(output) > healthOutputLimit {
+		output = output[:healthOutputLimit]
+	}
+	result.Output = output
+	return result
+}
+
+// checkCommand runs the command of --health-cmd in the container, with exec.
+func (h *healthCheck) checkCommand(ctx context.Context, id string) (string, error) {
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", "exec", id, "/bin/sh", "-c", h.Command)
+	// exec passes SIGTERM on to the command, SIGKILL would only end exec
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = time.Second
+	// Not another story of every system call in the monitor's log
+	cmd.Env = slices.DeleteFunc(os.Environ(), func(kv string) bool { return strings.HasPrefix(kv, explainEnv+"=") })
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("exit status %d", exitErr.ExitCode())
+	}
+	return strings.TrimSpace(output.String()), err
+}
+
+// checkHTTP sends the GET of --health-http. Kubernetes takes what a redirect says as its answer
+// too, without following it.
+func (h *healthCheck) checkHTTP(ctx context.Context, dial func(port uint16) (net.Conn, error)) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       func(ctx context.Context, _, _ string) (net.Conn, error) { return dialContext(ctx, dial, h.Port) },
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d%s", h.Port, h.Path), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	output := response.Proto + " " + response.Status
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return output, errors.New("the status isn't 2xx or 3xx")
+	}
+	return output, nil
+}
+
+// dialContext is dial, given up when ctx is done.
+func dialContext(ctx context.Context, dial func(port uint16) (net.Conn, error), port uint16) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := dial(port)
+		result <- dialed{conn, err}
+	}()
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// The connection still comes, nobody wants it anymore
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialInNetworkNamespace returns the dial function of a container without an address of its own:
+// it connects to 127.0.0.1 from inside the network namespace of process pid.
+func dialInNetworkNamespace(pid int) func(port uint16) (net.Conn, error) {
+	return func(port uint16) (net.Conn, error) {
+		type dialed struct {
+			conn net.Conn
+			err  error
+		}
+		result := make(chan dialed, 1)
+		go func() {
+			// A socket is made in the network namespace of its thread, and stays there. The thread
+			// is never unlocked: the Go runtime throws it away, with the namespace, when we return.
+			runtime.LockOSThread()
+			ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+			if err != nil {
+				result <- dialed{nil, err}
+				return
+			}
+			defer ns.Close()
+			if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+				result <- dialed{nil, fmt.Errorf("join network namespace: %w", errno)}
+				return
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), 5*time.Second)
+			result <- dialed{conn, err}
+		}()
+		r := <-result
+		return r.conn, r.err
+	}
+}
+
+// healthSuffix is what ps shows of the health of s after its uptime, like Docker.
+func healthSuffix(s *containerState) string {
+	switch {
+	case s.Health == nil:
+		return ""
+	case s.Health.Status == healthStarting:
+		return " (health: starting)"
+	}
+	return " (" + s.Health.Status + ")"
+}
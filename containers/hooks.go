@@ -0,0 +1,149 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ociVersion is the version of the OCI runtime spec whose formats we use
+const ociVersion = "1.0.2"
+
+// containerHooks are programs the runtime runs on the host at points of the container's life, the
+// "hooks" of an OCI config.json. This is how runc & co. let others plug in without knowing about
+// them: Docker sets up networking for runc through a prestart hook, the NVIDIA container toolkit
+// mounts the GPU drivers into the container from one.
+type containerHooks struct {
+	// Prestart hooks run once the container's namespaces exist, before its command runs
+	Prestart []hook `json:"prestart,omitempty"`
+	// Poststart hooks run after the container started
+	Poststart []hook `json:"poststart,omitempty"`
+	// Poststop hooks run after the container stopped and its cgroup is gone
+	Poststop []hook `json:"poststop,omitempty"`
+}
+
+// hook is one program to run.
+type hook struct {
+	// Path is the absolute path of the program on the host
+	Path string `json:"path"`
+	// Args are its arguments including argv[0], like for execv(); empty means just Path
+	Args []string `json:"args,omitempty"`
+	// Env is its complete environment, it inherits nothing
+	Env []string `json:"env,omitempty"`
+	// Timeout is how many seconds it may run before it is killed, 0 means no limit
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ociState is the state of a container in the format of the OCI runtime spec. Every hook gets it
+// on stdin, that's how it learns which container it is run for and where to find it: a network
+// hook joins /proc/<pid>/ns/net.
+type ociState struct {
+	OCIVersion string `json:"ociVersion"`
+	ID         string `json:"id"`
+	// Status is creating, created, running or stopped
+	Status string `json:"status"`
+	Pid    int    `json:"pid,omitempty"`
+	// Bundle is the directory with the container's config.json
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// newOCIState describes container cfg, whose init is pid, to a hook.
+func newOCIState(cfg *containerConfig, pid int, status string) ociState {
+	// Without --bundle the closest thing is the state directory, it has our config.json
+	bundle := cfg.Bundle
+	if bundle == "" {
+		bundle = stateDir(cfg.ID)
+	}
+	return ociState{OCIVersion: ociVersion, ID: cfg.ID, Status: status, Pid: pid, Bundle: bundle, Annotations: cfg.Annotations}
+}
+
+// loadHooks reads --hooks: a JSON file with the "hooks" object of an OCI config.json.
+func loadHooks(path string) (containerHooks, error) {
+	var hooks containerHooks
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return hooks, err
+	}
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return hooks, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, list := range [][]hook{hooks.Prestart, hooks.Poststart, hooks.Poststop} {
+		for _, h := range list {
+			if err := h.validate(); err != nil {
+				return hooks, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// validate checks h before the container depends on it.
+func (h hook) validate() error {
+	// The spec requires an absolute path: hooks run from the runtime, whose PATH is anybody's guess
+	if !filepath.IsAbs(h.Path) {
+		return fmt.Errorf("hook path %q must be absolute", h.Path)
+	}
+	if _, err := os.Stat(h.Path); err != nil {
+		return fmt.Errorf("hook: %w", err)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("hook %s: timeout must be positive", h.Path)
+	}
+	return nil
+}
+
+// runHooks runs the hooks of one lifecycle point one after another and stops at the first one
+// that fails.
+func runHooks(name string, hooks []hook, state ociState) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	stdin, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	running := startSpan(name+" hooks", "hooks", strconv.Itoa(len(hooks)))
+	for _, h := range hooks {
+		if err := h.run(stdin); err != nil {
+			err = fmt.Errorf("%s hook %s: %w", name, h.Path, err)
+			running.end(err)
+			return err
+		}
+	}
+	running.end(nil)
+	return nil
+}
+
+// run starts h with stdin and waits until it exits, or until its timeout has passed.
+func (h hook) run(stdin []byte) error {
+	ctx := context.Background()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Timeout)*time.Second)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	// A nil Env would hand over ours
+	cmd.Env = append([]string{}, h.Env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("killed after %ds", h.Timeout)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// /etc/hosts maps names to addresses before DNS is asked, and the container's own name is in no
+// DNS: without an entry `ping $(hostname)` fails, and sudo complains it can't resolve the host.
+// Docker writes one for every container like the resolv.conf, and so do we:
+//
+//	127.0.0.1	localhost
+//	::1	localhost ip6-localhost ip6-loopback
+//	...
+//	192.168.1.10	db          <- --add-host db:192.168.1.10
+//	172.29.0.2	container   <- the hostname and address on the bridge
+//	fd00:29::2	container   <- and with --ipv6 the IPv6 one
+
+// hostGateway in --add-host stands for the bridge's address, the host as the container sees it:
+// --add-host host.docker.internal:host-gateway
+const hostGateway = "host-gateway"
+
+// parseAddHost parses an --add-host value, NAME:IP or NAME=IP like in Docker. The IP may contain
+// colons, the name can't.
+func parseAddHost(v string) (string, error) {
+	i := strings.IndexAny(v, ":=")
+	if i <= 0 {
+		return "", errors.New("expected NAME:IP")
+	}
+	name, ip := v[:i], v[i+1:]
+	if err := validateHostname(name); err != nil {
+		return "", err
+	}
+	if ip != hostGateway {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return "", fmt.Errorf("%q is not an IP address", ip)
+		}
+		ip = parsed.String()
+	}
+	return name + ":" + ip, nil
+}
+
+// writeHosts writes the hosts file of the container into its state directory and sets
+// cfg.HostsFile to it.
+func writeHosts(cfg *containerConfig) error {
+	var buf bytes.Buffer
+	ownAddress := strings.Split(cfg.IPAddress, "/")[0]
+	if ownAddress == "" {
+		// No address of its own, its name is at least itself
+		fmt.Fprintf(&buf, "127.0.0.1\tlocalhost %s\n", cfg.Hostname)
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+	}
+	buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n" +
+		"fe00::0\tip6-localnet\n" +
+		"ff00::0\tip6-mcastprefix\n" +
+		"ff02::1\tip6-allnodes\n" +
+		"ff02::2\tip6-allrouters\n")
+	for _, entry := range cfg.ExtraHosts {
+		name, ip, _ := strings.Cut(entry, ":")
+		if ip == hostGateway {
+			if cfg.Gateway == "" {
+				slog.Warn("--add-host: the container has no gateway, leaving it out", "host", entry)
+				continue
+			}
+			ip = cfg.Gateway
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, name)
+	}
+	if ownAddress != "" {
+		fmt.Fprintf(&buf, "%s\t%s\n", ownAddress, cfg.Hostname)
+	}
+	if ownAddress6, _, _ := strings.Cut(cfg.IPAddress6, "/"); ownAddress6 != "" {
+		fmt.Fprintf(&buf, "%s\t%s\n", ownAddress6, cfg.Hostname)
+	}
+
+	path := filepath.Join(stateDir(cfg.ID), "hosts")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write hosts: %w", err)
+	}
+	cfg.HostsFile = path
+	return nil
+}
+
+// mountNetworkFiles bind-mounts the resolv.conf and hosts the monitor wrote, in the child. Like
+// /etc/hostname they're nice to have: a rootless container can't create the files in a rootfs
+// that doesn't have them, and runs without.
+func mountNetworkFiles(cfg *containerConfig) {
+	for _, v := range []volumeMount{
+		{Source: cfg.ResolvConf, Destination: "/etc/resolv.conf"},
+		{Source: cfg.HostsFile, Destination: "/etc/hosts"},
+	} {
+		if v.Source == "" {
+			continue
+		}
+		if err := mountVolumes(cfg.Rootfs, []volumeMount{v}); err != nil {
+			slog.Warn("could not mount", "destination", v.Destination, "err", err)
+		}
+	}
+}
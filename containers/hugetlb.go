@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Huge pages are pages of 2MB or 1GB instead of 4KB: one TLB entry covers 512 (or 262144) times
+// as much memory, which databases and DPDK-style network stacks rely on. They come from a pool the
+// admin reserves up front (/proc/sys/vm/nr_hugepages), and a process asks for them explicitly
+// with mmap(MAP_HUGETLB) or a file on hugetlbfs. They don't count against the memory limit, so the
+// hugetlb controller has limits of its own, one per page size:
+//   - "hugetlb.2MB.max" (v2) or "hugetlb.2MB.limit_in_bytes" (v1) counts the pages in use. Going
+//     over it happens when a page is first touched, the kernel can only answer with SIGBUS.
+//   - "hugetlb.2MB.rsvd.max" (v2) or "hugetlb.2MB.rsvd.limit_in_bytes" (v1), Linux 5.7+, counts
+//     the pages reserved by mmap(). Going over it makes mmap() fail with ENOMEM, which a program
+//     can handle. Like runc we set both.
+
+// hugetlbLimit limits the huge pages of one size the container may use.
+type hugetlbLimit struct {
+	// PageSize is the kernel's name for the size, e.g. "2MB", "1GB"
+	PageSize string `json:"pageSize"`
+	Limit    int64  `json:"limit"`
+}
+
+// parseHugetlbLimit parses --hugetlb-limit SIZE:LIMIT, e.g. 2MB:64MB.
+func parseHugetlbLimit(v string) (hugetlbLimit, error) {
+	size, limit, ok := strings.Cut(v, ":")
+	if !ok {
+		return hugetlbLimit{}, errors.New("expected PAGESIZE:LIMIT, e.g. 2MB:64MB")
+	}
+	bytes, err := parseBytes(size)
+	if err != nil {
+		return hugetlbLimit{}, fmt.Errorf("invalid page size %q: %v", size, err)
+	}
+	l := hugetlbLimit{PageSize: hugePageSizeName(bytes)}
+	// The kernel has a directory per page size the CPU supports
+	if _, err := os.Stat(fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", bytes>>10)); err != nil {
+		return l, fmt.Errorf("this host has no %s huge pages (see /sys/kernel/mm/hugepages)", l.PageSize)
+	}
+	if l.Limit, err = parseBytes(limit); err != nil {
+		return l, fmt.Errorf("invalid limit %q: %v", limit, err)
+	}
+	// The kernel would round it down, a limit of half a page is no page at all
+	if l.Limit%bytes != 0 {
+		return l, fmt.Errorf("limit %s is not a multiple of the page size", limit)
+	}
+	return l, nil
+}
+
+// hugePageSizeName returns the name the hugetlb files use for a page size: 2097152 is "2MB".
+func hugePageSizeName(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%dGB", bytes>>30)
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%dMB", bytes>>20)
+	default:
+		return fmt.Sprintf("%dKB", bytes>>10)
+	}
+}
+
+// applyHugetlbLimits writes limits to the hugetlb cgroup dir, whose files all start with
+// "hugetlb.<size>." and end in suffix: "max" on v2, "limit_in_bytes" on v1.
+func applyHugetlbLimits(dir, suffix string, limits []hugetlbLimit) {
+	for _, l := range limits {
+		value := strconv.FormatInt(l.Limit, 10)
+		writeCgroupFile(dir, "hugetlb."+l.PageSize+"."+suffix, value, l.PageSize+" huge page limit")
+		// Older kernels don't have the reservation limit, the one above still holds
+		rsvd := "hugetlb." + l.PageSize + ".rsvd." + suffix
+		if _, err := os.Stat(filepath.Join(dir, rsvd)); err == nil {
+			writeCgroupFile(dir, rsvd, value, l.PageSize+" huge page reservation limit")
+		}
+	}
+}
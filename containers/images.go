@@ -0,0 +1,764 @@
+//go:build linux
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// An image is a root filesystem with a name and a little metadata, and until now ours was a
+// directory the user unpacked by hand into /rootfs. The image store keeps them for us, like
+// Docker's /var/lib/docker. Unlike the state of the containers, images outlive a reboot, so the
+// store isn't in /run:
+//
+//	/var/lib/mycontainer/images/
+//	  repositories.json          the names: {"alpine:latest": "<image ID>"}
+//	  lock                       taken while the store changes
+//	  <image ID>/config.json     the image's configuration, in the format of the OCI image spec
+//	  <image ID>/manifest.json   its manifest, which names the config and the layers in blobs/
+//	  <image ID>/repodigests.json  for a pulled image, what its names pointed at in the registries
+//	  blobs/sha256/              the configs and layers, once each (see blobs.go)
+//	  layers/<digest>/           every layer unpacked, once, for the overlays (see overlay.go)
+//
+// The image's configuration says how to run it (command, environment, working directory), and
+// in "rootfs.diff_ids" which layers it is made of: the sha256 of each uncompressed layer tar.
+// The image ID is the sha256 of that configuration: the same configuration, layers included,
+// always gets the same ID, and is stored once. Docker's image IDs are made the same way.
+//
+// `images` lists them, with what those files say.
+//
+// `import` puts a tarball of a root filesystem into the store, as an image of one layer, like
+// `docker import`, and `pull` an image of a registry (see pull.go). `run --image NAME` runs it,
+// or `run NAME`.
+
+// errNoSuchImage is the error of findImage for a name the store doesn't have
+var errNoSuchImage = errors.New("no such image")
+
+// imageConfig is the image configuration of the OCI image spec, with the fields we use.
+type imageConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	Variant      string    `json:"variant,omitempty"`
+	OS           string    `json:"os"`
+	// Config are the defaults for running the image
+	Config struct {
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []imageHistory `json:"history,omitempty"`
+}
+
+// platform is the platform the image was built for.
+func (c *imageConfig) platform() ociPlatform {
+	return ociPlatform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+}
+
+// imageHistory says what made a layer, `docker history` shows it.
+type imageHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// Author and Comment are commit's -a and -m
+	Author  string `json:"author,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// EmptyLayer is set for a step that changed the config only, like ENV: the other entries
+	// are the layers, in their order
+	EmptyLayer bool `json:"empty_layer,omitempty"`
+}
+
+// imageRoot is the directory of the image store, in the user's data directory when rootless.
+func imageRoot() string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/mycontainer/images"
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "mycontainer", "images")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "share", "mycontainer", "images")
+}
+
+// imageDir is the directory of the image with id.
+func imageDir(id string) string {
+	return filepath.Join(imageRoot(), id)
+}
+
+// lockImages takes the lock of the image store, for changes of more than one file.
+func lockImages() (unlock func(), err error) {
+	if err := os.MkdirAll(imageRoot(), 0700); err != nil {
+		return nil, err
+	}
+	return lockPath(filepath.Join(imageRoot(), "lock"))
+}
+
+// readRepositories returns the names of the images and their IDs.
+func readRepositories() (map[string]string, error) {
+	repos := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(imageRoot(), "repositories.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return repos, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &repos); err != nil {
+		return nil, fmt.Errorf("repositories.json: %w", err)
+	}
+	return repos, nil
+}
+
+// writeRepositories replaces the names of the images, under the lock of the store.
+func writeRepositories(repos map[string]string) error {
+	data, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(imageRoot(), "repositories.json"), append(data, '\n'))
+}
+
+// findImage returns the ID and configuration of the image called name, or whose ID starts with
+// it, see lookupImage.
+func findImage(name string) (string, *imageConfig, error) {
+	repos, err := readRepositories()
+	if err != nil {
+		return "", nil, err
+	}
+	id, _, err := lookupImage(repos, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if id == "" {
+		return "", nil, fmt.Errorf("%w: %s, see `%s pull` and `%s import`", errNoSuchImage, name, progName(), progName())
+	}
+	config, err := readImageConfig(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, config, nil
+}
+
+// lookupImage returns the ID of the image name stands for, or "" if there is none, and byName,
+// its name in repos if name is one. name is
+//
+//	a name of repos         alpine, alpine:3.19, ghcr.io/org/app@sha256:...
+//	a repository digest     alpine@sha256:..., the digest a pull of another name got (see addRepoDigest)
+//	a prefix of the ID      3f57d9401f8d, sha256:3f57d9401f8d, like `docker run 3f57d9401f8d`
+func lookupImage(repos map[string]string, name string) (id, byName string, err error) {
+	if ref, err := parseReference(name); err == nil {
+		if id := repos[ref.String()]; id != "" {
+			return id, ref.String(), nil
+		}
+		if ref.Digest != "" {
+			if id, err := findRepoDigest(ref.repository() + "@" + ref.Digest); err != nil || id != "" {
+				return id, "", err
+			}
+		}
+	}
+	// Of an image with a name or without
+	if prefix := strings.TrimPrefix(name, "sha256:"); len(prefix) >= 4 {
+		ids, err := imageIDs()
+		if err != nil {
+			return "", "", err
+		}
+		for _, other := range ids {
+			if strings.HasPrefix(other, prefix) {
+				return other, "", nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// readImageConfig reads the configuration of the image with id.
+func readImageConfig(id string) (*imageConfig, error) {
+	data, err := os.ReadFile(filepath.Join(imageDir(id), "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %w", shortID(id), err)
+	}
+	var config imageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("image %s: %w", shortID(id), err)
+	}
+	return &config, nil
+}
+
+// addImage puts the image with the configuration config and the manifest into the store, and
+// calls it name, unless that's empty. config are the bytes of config.json as they are: the ID is their sha256, and
+// for a pulled image that's the digest of its config blob. The layers of the manifest must be in
+// the store. It returns the ID. The lock of the store must be taken.
+func addImage(name string, config, manifest []byte) (string, error) {
+	digest, err := writeBlob(config)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimPrefix(digest, "sha256:")
+	if _, err := os.Stat(imageDir(id)); err != nil {
+		// Written next to it, and renamed into place when it's complete
+		tmp, err := os.MkdirTemp(imageRoot(), ".tmp-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		if err := os.WriteFile(filepath.Join(tmp, "config.json"), config, 0600); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "manifest.json"), manifest, 0600); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, imageDir(id)); err != nil {
+			return "", err
+		}
+	}
+	if name == "" {
+		return id, nil
+	}
+	return id, tagImage(name, id)
+}
+
+// layerDir is the directory a layer is unpacked in, named after the digest of its blob.
+func layerDir(digest string) string {
+	return filepath.Join(imageRoot(), "layers", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// hasLayer tells whether the layer with digest is unpacked.
+func hasLayer(digest string) bool {
+	_, err := os.Stat(layerDir(digest))
+	return err == nil
+}
+
+// newLayerDir creates a directory to unpack a layer in, in the store's directory because rename()
+// doesn't move across filesystems. commitLayer renames it into place.
+func newLayerDir() (string, error) {
+	root := filepath.Join(imageRoot(), "layers")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(root, ".tmp-")
+}
+
+// commitLayer moves the layer unpacked in dir into place as the layer with digest, unless it is
+// unpacked already.
+func commitLayer(dir, digest string) error {
+	if hasLayer(digest) {
+		return removeTree(dir)
+	}
+	// MkdirTemp made it 0700, a layer's / has the mode of the container's
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(dir, layerDir(digest))
+}
+
+// imageLayers returns the unpacked layers of the image with id, the lowest first.
+func imageLayers(id string) ([]string, error) {
+	m, err := readImageManifest(id)
+	if errors.Is(err, os.ErrNotExist) {
+		// An image from before the layers were kept apart, it has its rootfs/ as its one layer
+		return []string{filepath.Join(imageDir(id), "rootfs")}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, layer := range m.Layers {
+		if !hasLayer(layer.Digest) {
+			return nil, fmt.Errorf("image %s: layer %s is missing, pull it again", shortID(id), layer.Digest)
+		}
+		layers = append(layers, layerDir(layer.Digest))
+	}
+	return layers, nil
+}
+
+// removeTree removes a directory tree that may have read-only directories in it, like an
+// unpacked layer: only root may remove the entries of a directory without write permission.
+func removeTree(path string) error {
+	filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// tagImage gives the image with id the name. The lock of the store must be taken.
+func tagImage(name, id string) error {
+	repos, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	// The image that had the name before keeps its files, without a name
+	repos[name] = id
+	return writeRepositories(repos)
+}
+
+// tagCommand implements `tag SOURCE TARGET`: the image SOURCE, by name, digest or ID, gets the
+// name TARGET too, like `docker tag`.
+func tagCommand(args []string) error {
+	fs := flag.NewFlagSet("tag", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tag SOURCE TARGET\n\nGive the image SOURCE, by name or ID, the name TARGET too, like localhost:5000/app:v1.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 2 {
+		return usageErrorf(fs, "expected SOURCE and TARGET")
+	}
+	target, err := parseReference(fs.Arg(1))
+	if err != nil {
+		return usageErrorf(fs, "%v", err)
+	}
+	// It would say that other content is this image
+	if target.Digest != "" {
+		return usageErrorf(fs, "%s: a digest can't be a name, it is the content's", fs.Arg(1))
+	}
+
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	id, _, err := findImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return tagImage(target.String(), id)
+}
+
+// readRepoDigests returns the repository digests of the image with id, like
+// "alpine@sha256:...", the digest each repository had for it when it was pulled.
+func readRepoDigests(id string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(imageDir(id), "repodigests.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var digests []string
+	if err := json.Unmarshal(data, &digests); err != nil {
+		return nil, fmt.Errorf("image %s: repodigests.json: %w", shortID(id), err)
+	}
+	return digests, nil
+}
+
+// addRepoDigest notes that in repository, the image with id is digest: the digest of the
+// manifest the pull got for its name, for most images the index. It replaces the digest the
+// repository had before. The lock of the store must be taken.
+func addRepoDigest(id, repository, digest string) error {
+	digests, err := readRepoDigests(id)
+	if err != nil {
+		return err
+	}
+	digests = slices.DeleteFunc(digests, func(d string) bool {
+		return strings.HasPrefix(d, repository+"@")
+	})
+	digests = append(digests, repository+"@"+digest)
+	slices.Sort(digests)
+	data, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(imageDir(id), "repodigests.json"), append(data, '\n'))
+}
+
+// findRepoDigest returns the ID of the image with the repository digest, or "" if no pull got it.
+func findRepoDigest(repoDigest string) (string, error) {
+	ids, err := imageIDs()
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		digests, err := readRepoDigests(id)
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(digests, repoDigest) {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// importImage implements `import TARBALL NAME`: the archive, "-" for the standard input, becomes
+// the image NAME.
+func importImage(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import TARBALL NAME\n\nCreate an image from a root filesystem tarball (gzipped or not, - for stdin).\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 2 {
+		return usageErrorf(fs, "expected TARBALL and NAME")
+	}
+	name, err := normalizeImageName(fs.Arg(1))
+	if err != nil {
+		return usageErrorf(fs, "%v", err)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	id, err := importTarball(in, name, "import "+filepath.Base(fs.Arg(0)), nil)
+	if err != nil {
+		return fmt.Errorf("unpack %s: %w", fs.Arg(0), err)
+	}
+	fmt.Println("sha256:" + id)
+	return nil
+}
+
+// importTarball makes the root filesystem tarball in an image of one layer called name, with
+// the default command cmd, and returns its ID. createdBy is for its history. The lock of the
+// store must be taken.
+func importTarball(in io.Reader, name, createdBy string, cmd []string) (string, error) {
+	unpacked, err := newLayerDir()
+	if err != nil {
+		return "", err
+	}
+	defer removeTree(unpacked)
+	// The tarball as it is becomes the layer's blob, while we unpack it
+	blob, err := newBlobWriter()
+	if err != nil {
+		return "", err
+	}
+	raw := io.TeeReader(in, blob)
+	archive, err := openArchive(raw)
+	if err != nil {
+		blob.discard()
+		return "", err
+	}
+	// The diff ID is the digest of the uncompressed tar, all of it: tar stops reading at the end
+	// marker, the padding after it counts too, and the blob is all of the file
+	hash := sha256.New()
+	tee := io.TeeReader(archive, hash)
+	result, err := extractTar(tee, unpacked, true)
+	if err == nil {
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, raw)
+	}
+	if err != nil {
+		blob.discard()
+		return "", err
+	}
+	layer := ociDescriptor{MediaType: mediaTypeOCILayer, Size: blob.size}
+	if _, ok := archive.(*gzip.Reader); ok {
+		layer.MediaType = mediaTypeOCILayerGzip
+	}
+	if layer.Digest, err = blob.commit(); err != nil {
+		return "", err
+	}
+	if err := commitLayer(unpacked, layer.Digest); err != nil {
+		return "", err
+	}
+	if result.SkippedDevices > 0 {
+		fmt.Printf("Warning: skipped %d device nodes, creating them takes root (the container gets its own /dev)\n", result.SkippedDevices)
+	}
+
+	host := hostPlatform()
+	config := &imageConfig{Created: time.Now().UTC(), Architecture: host.Architecture, Variant: host.Variant, OS: host.OS}
+	config.Config.Cmd = cmd
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{"sha256:" + hex.EncodeToString(hash.Sum(nil))}
+	config.History = []imageHistory{{Created: config.Created, CreatedBy: createdBy}}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	configDigest := sha256.Sum256(data)
+	manifest, err := json.MarshalIndent(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: "sha256:" + hex.EncodeToString(configDigest[:]), Size: int64(len(data))},
+		Layers:        []ociDescriptor{layer},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return addImage(name, data, manifest)
+}
+
+// rmi implements `rmi IMAGE...`: it removes the names, the images that have no name left, and
+// then the blobs no image references.
+func rmi(args []string) error {
+	fs := flag.NewFlagSet("rmi", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rmi IMAGE...\n\nRemove images, by name or ID, and the layers no other image uses.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing IMAGE")
+	}
+
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, arg := range fs.Args() {
+		if err := removeImage(arg); err != nil {
+			return err
+		}
+	}
+	removed, freed, err := removeUnreferencedBlobs()
+	for _, digest := range removed {
+		fmt.Println("Deleted blob: " + digest)
+	}
+	if freed > 0 {
+		fmt.Printf("Freed %s of blobs\n", formatBytes(freed))
+	}
+	return err
+}
+
+// removeImage removes the name, or all names of the image with an ID that starts with it or with
+// the repository digest (see lookupImage), and the image when it has no name left. The lock of
+// the store must be taken.
+func removeImage(name string) error {
+	repos, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	id, byName, err := lookupImage(repos, name)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("%w: %s", errNoSuchImage, name)
+	}
+
+	var names []string
+	for other, otherID := range repos {
+		if otherID == id && other != byName {
+			names = append(names, other)
+		}
+	}
+	if byName == "" || len(names) == 0 {
+		// The image goes, unless a container runs in its rootfs
+		for _, st := range listStates() {
+			if cfg, err := readConfig(st.ID); err == nil && cfg.ImageID == id {
+				return fmt.Errorf("image %s is used by container %s, remove the container first", name, shortID(st.ID))
+			}
+		}
+	}
+	if byName != "" {
+		names = []string{byName}
+	}
+	slices.Sort(names)
+	for _, other := range names {
+		delete(repos, other)
+		fmt.Println("Untagged: " + other)
+	}
+	if err := writeRepositories(repos); err != nil {
+		return err
+	}
+	for _, otherID := range repos {
+		if otherID == id {
+			// It has another name
+			return nil
+		}
+	}
+	if err := removeTree(imageDir(id)); err != nil {
+		return err
+	}
+	fmt.Println("Deleted: sha256:" + id)
+	return nil
+}
+
+// imageRow is a line of `images`, of an image with one of its names.
+type imageRow struct {
+	repository, tag, digest, id string
+	created                     time.Time
+	size                        int64
+}
+
+// listImages implements `images [OPTIONS] [REPOSITORY[:TAG]]`: the images of the store, a line
+// for every name, and one for an image without a name, the newest first like `docker images`.
+func listImages(args []string) error {
+	fs := flag.NewFlagSet("images", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s images [OPTIONS] [REPOSITORY[:TAG]]\n\nList the images of the store, or those of a repository.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	quiet := fs.Bool("q", false, "only print the image IDs")
+	noTrunc := fs.Bool("no-trunc", false, "print the IDs and digests in full")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 1 {
+		return usageErrorf(fs, "unexpected argument %q", fs.Arg(1))
+	}
+	// alpine is every tag of alpine, alpine:3.19 one of them, alpine@sha256:... the ones with that
+	// digest
+	var want imageReference
+	wantTag := false
+	if fs.NArg() == 1 {
+		arg := fs.Arg(0)
+		ref, err := parseReference(arg)
+		if err != nil {
+			return usageErrorf(fs, "%v", err)
+		}
+		want = ref
+		wantTag = strings.LastIndex(arg, ":") > strings.LastIndex(arg, "/")
+	}
+
+	repos, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	ids, err := imageIDs()
+	if err != nil {
+		return err
+	}
+	names := map[string][]string{}
+	for name, id := range repos {
+		names[id] = append(names[id], name)
+	}
+	var rows []imageRow
+	for _, id := range ids {
+		config, err := readImageConfig(id)
+		if err != nil {
+			return err
+		}
+		digests, err := readRepoDigests(id)
+		if err != nil {
+			return err
+		}
+		row := imageRow{repository: "<none>", tag: "<none>", digest: "<none>", id: id, created: config.Created, size: imageSize(id)}
+		if len(names[id]) == 0 {
+			if fs.NArg() == 0 {
+				rows = append(rows, row)
+			}
+			continue
+		}
+		for _, name := range names[id] {
+			ref, err := parseReference(name)
+			if err != nil {
+				return fmt.Errorf("repositories.json: %w", err)
+			}
+			named := row
+			named.repository = ref.repository()
+			// A name with a digest was pulled by it, and has no tag
+			if ref.Tag != "" {
+				named.tag = ref.Tag
+			}
+			if ref.Digest != "" {
+				named.digest = ref.Digest
+			} else {
+				for _, d := range digests {
+					if repository, digest, _ := strings.Cut(d, "@"); repository == named.repository {
+						named.digest = digest
+					}
+				}
+			}
+			if fs.NArg() == 1 {
+				if named.repository != want.repository() || (want.Digest != "" && named.digest != want.Digest) ||
+					(want.Digest == "" && wantTag && named.tag != want.Tag) {
+					continue
+				}
+			}
+			rows = append(rows, named)
+		}
+	}
+	slices.SortFunc(rows, func(a, b imageRow) int {
+		if c := b.created.Compare(a.created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.repository+":"+a.tag, b.repository+":"+b.tag)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	if *quiet {
+		// An image with several names once
+		seen := map[string]bool{}
+		for _, row := range rows {
+			if !seen[row.id] {
+				seen[row.id] = true
+				fmt.Fprintln(tw, shortImageID(row.id, *noTrunc))
+			}
+		}
+		return tw.Flush()
+	}
+	fmt.Fprintln(tw, "REPOSITORY\tTAG\tDIGEST\tIMAGE ID\tCREATED\tSIZE")
+	for _, row := range rows {
+		digest := row.digest
+		if hex, ok := strings.CutPrefix(digest, "sha256:"); ok && !*noTrunc {
+			digest = "sha256:" + shortID(hex)
+		}
+		// An image made from a tarball without a date, or with the date of 1970, like Nix's
+		created := "N/A"
+		if row.created.Year() > 1970 {
+			created = humanDuration(time.Since(row.created)) + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", row.repository, row.tag, digest, shortImageID(row.id, *noTrunc), created, formatBytes(row.size))
+	}
+	return tw.Flush()
+}
+
+// shortImageID is id the way `images` prints it, 12 digits unless noTrunc.
+func shortImageID(id string, noTrunc bool) string {
+	if noTrunc {
+		return "sha256:" + id
+	}
+	return shortID(id)
+}
+
+// imageSize is the size of the image with id, its blobs as its manifest says: what a pull
+// downloads, the layers compressed. Unpacked they take more. An image from before the blob store
+// has its rootfs/ instead.
+func imageSize(id string) int64 {
+	m, err := readImageManifest(id)
+	if err != nil {
+		return diskUsage(filepath.Join(imageDir(id), "rootfs"))
+	}
+	size := m.Config.Size
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size
+}
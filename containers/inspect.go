@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// containerInspect is what `inspect` prints for a container: its state and config, plus what the
+// kernel says about it right now.
+type containerInspect struct {
+	*containerState
+	Config *containerConfig `json:"config,omitempty"`
+	// Seccomp summarizes the filter, the profile itself is too long to be useful here
+	Seccomp string `json:"seccomp"`
+	// Namespaces maps each namespace type to its inode number. Two processes are in the same
+	// namespace exactly when the numbers match, compare them with `ls -l /proc/self/ns`.
+	Namespaces map[string]uint64 `json:"namespaces,omitempty"`
+	// CgroupPaths are the cgroup directories, CgroupLimits the limit files in them
+	CgroupPaths  []string          `json:"cgroupPaths,omitempty"`
+	CgroupLimits map[string]string `json:"cgroupLimits,omitempty"`
+	// Mounts is the mount table inside the container
+	Mounts []mountInfo `json:"mounts,omitempty"`
+	// Interfaces are the network interfaces of the container's network namespace
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+// cgroupLimitFiles are the limit files inspect shows, as controller/file (v1) and file (v2)
+var cgroupLimitFiles = struct{ v1, v2 []string }{
+	v1: []string{"memory/memory.limit_in_bytes", "memory/memory.memsw.limit_in_bytes", "cpu/cpu.cfs_quota_us",
+		"cpu/cpu.cfs_period_us", "pids/pids.max", "cpuset/cpuset.cpus", "cpuset/cpuset.mems",
+		"blkio/blkio.throttle.read_bps_device", "blkio/blkio.throttle.write_bps_device"},
+	v2: []string{"memory.max", "memory.swap.max", "cpu.max", "pids.max", "cpuset.cpus", "cpuset.mems", "io.max"},
+}
+
+// inspect implements `inspect CONTAINER...`: a JSON array with one object per container, like
+// `docker inspect`.
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect CONTAINER...\n\nShow everything known about containers, as JSON.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+
+	var result []containerInspect
+	for _, arg := range fs.Args() {
+		s, err := findContainer(arg)
+		if err != nil {
+			return err
+		}
+		result = append(result, inspectContainer(s))
+	}
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// inspectContainer collects the details of container s. Everything that comes from /proc is only
+// available while the container runs.
+func inspectContainer(s *containerState) containerInspect {
+	state := *s
+	state.Status = s.currentStatus()
+	info := containerInspect{containerState: &state}
+	info.Seccomp = "unconfined"
+	if cfg, err := readConfig(s.ID); err == nil {
+		if cfg.Seccomp != nil {
+			info.Seccomp = fmt.Sprintf("%d rules, default action %s", len(cfg.Seccomp.Syscalls), cfg.Seccomp.DefaultAction)
+			cfg.Seccomp = nil
+		}
+		info.Config = cfg
+	}
+
+	if state.Status != statusRunning {
+		return info
+	}
+	pid := fmt.Sprint(s.Pid)
+
+	// Every /proc/PID/ns/* file is a handle for a namespace; its inode number identifies it
+	entries, _ := os.ReadDir(filepath.Join("/proc", pid, "ns"))
+	for _, entry := range entries {
+		var st syscall.Stat_t
+		if syscall.Stat(filepath.Join("/proc", pid, "ns", entry.Name()), &st) == nil {
+			if info.Namespaces == nil {
+				info.Namespaces = map[string]uint64{}
+			}
+			info.Namespaces[entry.Name()] = st.Ino
+		}
+	}
+
+	if s.Cgroup != "" {
+		info.CgroupLimits = map[string]string{}
+		if cgroupV2() {
+			dir := cgroupPath("", s.ID)
+			info.CgroupPaths = []string{dir}
+			for _, file := range cgroupLimitFiles.v2 {
+				info.CgroupLimits[file] = readCgroupFile(dir, file)
+			}
+		} else {
+			for _, controller := range cgroupV1Hierarchies() {
+				info.CgroupPaths = append(info.CgroupPaths, cgroupPath(controller, s.ID))
+			}
+			for _, file := range cgroupLimitFiles.v1 {
+				controller, name, _ := strings.Cut(file, "/")
+				info.CgroupLimits[name] = readCgroupFile(cgroupPath(controller, s.ID), name)
+			}
+		}
+	}
+
+	info.Mounts, _ = readMountInfo(pid)
+
+	// /proc/PID/net/dev lists the interfaces of the network namespace process PID is in:
+	// two header lines, then "  eth0: 1234 ..." per interface
+	if data, err := os.ReadFile(filepath.Join("/proc", pid, "net", "dev")); err == nil {
+		lines := strings.Split(string(data), "\n")
+		for _, line := range lines[min(2, len(lines)):] {
+			if name, _, ok := strings.Cut(line, ":"); ok {
+				info.Interfaces = append(info.Interfaces, strings.TrimSpace(name))
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IPAM (IP address management) hands out the addresses of the bridge network. Like the
+// host-local plugin of CNI, which Kubernetes uses for the same job, it keeps one file per address
+// in use, named after the address and holding the ID of the container that has it:
+//
+//	/run/mycontainer/networks/172.29.0.2   1a2b3c4d...
+//	/run/mycontainer/networks/fd00:29::2   1a2b3c4d...    with --ipv6
+//
+// A new container takes the lowest address without a file. The files outlive a crashed monitor,
+// so an address whose container has no state anymore counts as free.
+
+// ipamDir holds the address files. Only root has a bridge network, so there's no rootless one.
+const ipamDir = "/run/mycontainer/networks"
+
+// defaultSubnet is the bridge network unless --subnet or subnetEnv says otherwise. Docker takes
+// 172.17.0.0/16 for docker0, this one leaves that alone.
+const defaultSubnet = "172.29.0.0/16"
+
+// subnetEnv is the environment variable for the default of --subnet
+const subnetEnv = "CONTAINER_SUBNET"
+
+// defaultSubnet6 is the IPv6 network of the bridge with --ipv6, unless --subnet6 or subnet6Env
+// says otherwise. Like the private IPv4 networks, a unique local address (ULA, fc00::/7) isn't
+// routed on the internet: fd, then 40 bits that should be random, so that two networks that get
+// connected one day don't clash, and 16 bits for the subnet.
+const defaultSubnet6 = "fd00:29::/64"
+
+// subnet6Env is the environment variable for the default of --subnet6
+const subnet6Env = "CONTAINER_SUBNET6"
+
+// parseSubnet parses --subnet, an IPv4 network in CIDR notation like 172.29.0.0/16. It needs room
+// for the gateway and at least one container.
+func parseSubnet(v string) (*net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, errors.New("only IPv4 subnets are supported")
+	}
+	if !ip.Equal(subnet.IP) {
+		return nil, fmt.Errorf("%s is an address in %s, not the network", ip, subnet)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 30 {
+		return nil, errors.New("the subnet is too small, it needs at least 4 addresses (/30)")
+	}
+	return subnet, nil
+}
+
+// parseSubnet6 parses --subnet6, an IPv6 network in CIDR notation like fd00:29::/64.
+func parseSubnet6(v string) (*net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, errors.New("not an IPv6 subnet")
+	}
+	if !ip.Equal(subnet.IP) {
+		return nil, fmt.Errorf("%s is an address in %s, not the network", ip, subnet)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 126 {
+		return nil, errors.New("the subnet is too small, it needs at least 4 addresses (/126)")
+	}
+	return subnet, nil
+}
+
+// subnetGateway is the bridge's address in subnet, its first one: 172.29.0.1, or fd00:29::1.
+func subnetGateway(subnet *net.IPNet) net.IP {
+	return ipAdd(subnet.IP, 1)
+}
+
+// ipAdd returns ip + n, for an IPv4 or IPv6 address. n goes into the last 8 bytes of an IPv6
+// address, the host part of a network address is all zeros there.
+func ipAdd(ip net.IP, n uint32) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.AppendUint32(nil, binary.BigEndian.Uint32(ip4)+n)
+	}
+	return binary.BigEndian.AppendUint64(bytes.Clone(ip.To16()[:8]), binary.BigEndian.Uint64(ip.To16()[8:])+uint64(n))
+}
+
+// allocateIP returns a free address in subnet for container id and marks it as taken.
+func allocateIP(id string, subnet *net.IPNet) (net.IP, error) {
+	// The address counts as taken while the state directory exists. writeState creates it a
+	// moment later anyway, until then another container would take the address back.
+	if err := os.MkdirAll(stateDir(id), 0700); err != nil {
+		return nil, err
+	}
+	return allocateAddress(ipamDir, id, subnet, func(owner string) bool {
+		_, err := os.Stat(stateDir(owner))
+		return err == nil
+	})
+}
+
+// allocateAddress returns a free address in subnet for id, with a file in dir. An address whose
+// file names an owner that isn't inUse anymore counts as free.
+func allocateAddress(dir, id string, subnet *net.IPNet, inUse func(owner string) bool) (net.IP, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Two containers starting at the same time see the same free address, one at a time does
+	unlock, err := lockPath(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", dir, err)
+	}
+	defer unlock()
+
+	// An IPv6 subnet has more addresses than we'd ever try: 2^64 for a /64
+	ones, bits := subnet.Mask.Size()
+	size := uint64(1) << min(bits-ones, 32)
+	// Not the network address, the gateway or the broadcast address (IPv6 has none, but the last
+	// address is never missed)
+	for n := uint32(2); uint64(n) < size-1; n++ {
+		ip := ipAdd(subnet.IP, n)
+		path := filepath.Join(dir, ip.String())
+		owner, err := os.ReadFile(path)
+		if err == nil {
+			if inUse(strings.TrimSpace(string(owner))) {
+				continue
+			}
+			// Left behind by a container that is gone
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(id), 0600); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free address left in %s", subnet)
+}
+
+// releaseIP frees the address of container id, if it has one.
+func releaseIP(id string) error {
+	return releaseAddress(ipamDir, id)
+}
+
+// releaseAddress frees the addresses of id in dir.
+func releaseAddress(dir, id string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Never had a bridge network, or not root
+		return nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if owner, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(owner)) == id {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("release %s: %w", entry.Name(), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// The OCI runtime spec splits a container's life into steps, each a runc command of its own:
+//
+//	create  the namespaces, cgroup and mounts are set up, the command doesn't run yet ("created")
+//	start   the command runs ("running")
+//	state   prints the state, as the spec defines it
+//	kill    sends a signal, the container is "stopped" once its init exited
+//	delete  removes what is left
+//
+// containerd and CRI-O use runc exactly like that: between create and start they set up the
+// network, or let a Kubernetes pod's other containers join the namespaces. Our `run` does create
+// and start in one go, `create` stops in between.
+
+// execFifo is the named pipe in the state directory the init of a created container waits on.
+// runc names it exec.fifo too.
+const execFifo = "exec.fifo"
+
+// execFifoFd is where the child finds the FIFO. Only create passes it, and create can't have -t,
+// so it doesn't collide with consoleSocketFd.
+const execFifoFd = 4
+
+// oPath is O_PATH from <fcntl.h>, the same on x86 and arm64. The syscall package lacks it.
+const oPath = 0x200000
+
+// openExecFifo creates the FIFO of container id and opens it with O_PATH for the child: a handle
+// that pins the FIFO without reading or writing it, so it doesn't count as a reader.
+func openExecFifo(id string) (*os.File, error) {
+	path := filepath.Join(stateDir(id), execFifo)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return nil, fmt.Errorf("create %s: %w", execFifo, err)
+	}
+	f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", execFifo, err)
+	}
+	return f, nil
+}
+
+// awaitStart runs in the child of a created container right before the command starts, and
+// blocks until `start` writes to the FIFO.
+//
+// The child is already in its new root, where the state directory is gone. But /proc/self/fd/N
+// isn't a path like others: opening it reopens whatever fd N refers to, wherever that is.
+func awaitStart() error {
+	fifo, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", execFifoFd), os.O_RDONLY, 0)
+	// The O_PATH handle is not close-on-exec, the command must not get it
+	syscall.Close(execFifoFd)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", execFifo, err)
+	}
+	defer fifo.Close()
+	// Opening blocks until `start` opens the other end, reading until it has written
+	if _, err := fifo.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("wait for start: %w", err)
+	}
+	return nil
+}
+
+// create implements `create [OPTIONS] COMMAND [ARG...]`, like `runc create`: the options of run,
+// but the command only runs after `start`.
+func create(args []string) error {
+	root := startSpan(progName() + " create")
+	cfg, err := parseRunFlags("create", args)
+	if err != nil {
+		root.end(err)
+		return err
+	}
+	root.set("container.id", cfg.ID)
+	err = runDetached(cfg)
+	root.end(err)
+	return err
+}
+
+// start implements `start CONTAINER...`: run the command of created containers.
+func start(args []string) error {
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s start CONTAINER...\n\nRun the command of created containers.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+
+	for _, arg := range fs.Args() {
+		s, err := findContainer(arg)
+		if err != nil {
+			return err
+		}
+		// A trace of its own for each container, like create made one
+		root := startSpan(progName()+" start", "container.id", s.ID)
+		err = startCreated(s.ID)
+		root.end(err)
+		if err != nil {
+			return err
+		}
+		fmt.Println(shortID(s.ID))
+	}
+	return nil
+}
+
+// startCreated lets the init of created container id go on.
+func startCreated(id string) error {
+	cfg, err := readConfig(id)
+	if err != nil {
+		return err
+	}
+	// Two `start`s at the same time must not both see "created"
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := readState(id)
+	if err != nil {
+		return err
+	}
+	if status := s.currentStatus(); status != statusCreated {
+		return fmt.Errorf("container %s is %s, only created containers can be started", shortID(id), status)
+	}
+	// Running before the command can exit, or the monitor's "exited" would come first. It can't
+	// overwrite us, it records the exit under the lock too.
+	s.Status, s.Started = statusRunning, time.Now()
+	if err := writeState(s); err != nil {
+		return err
+	}
+	addCounter(counterStarts, 1)
+	recordEvent(id, eventStart)
+
+	// O_NONBLOCK: opening for writing fails with ENXIO instead of blocking while the child has
+	// not opened the FIFO yet, so we notice when it died before it got there
+	path := filepath.Join(stateDir(id), execFifo)
+	var fifo *os.File
+	for {
+		fifo, err = os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return fmt.Errorf("start %s: %w", shortID(id), err)
+		}
+		if !s.alive() {
+			return fmt.Errorf("start %s: the container exited before it could start", shortID(id))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = fifo.Write([]byte{0})
+	fifo.Close()
+	if err != nil {
+		return fmt.Errorf("start %s: %w", shortID(id), err)
+	}
+	// The FIFO is gone once the container has started, like in runc
+	os.Remove(path)
+	// A hook may well run commands on the container itself, they would wait for the lock forever
+	unlock()
+
+	// runc runs the poststart hooks from `start`, the monitor doesn't know when that happens
+	if err := runHooks("poststart", cfg.Hooks.Poststart, newOCIState(cfg, s.Pid, "running")); err != nil {
+		slog.Warn("hook failed", "err", err)
+	}
+	return nil
+}
+
+// ociStatus maps our status to the four of the OCI runtime spec.
+func (s *containerState) ociStatus() string {
+	switch status := s.currentStatus(); status {
+	case statusCreated, statusRunning:
+		return status
+	default:
+		return "stopped"
+	}
+}
+
+// printState implements `state CONTAINER`: the state of a container as the OCI runtime spec
+// defines it, like `runc state`.
+func printState(args []string) error {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s state CONTAINER\n\nShow the OCI state of a container as JSON.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected exactly one CONTAINER")
+	}
+
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg, err := readConfig(s.ID)
+	if err != nil {
+		return err
+	}
+	status := s.ociStatus()
+	pid := s.Pid
+	// The spec only has a PID while there is a process
+	if status == "stopped" {
+		pid = 0
+	}
+	out, err := json.MarshalIndent(newOCIState(cfg, pid, status), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
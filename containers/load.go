@@ -0,0 +1,357 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// `image load` reads what `image save`, `docker save` and `podman save` write, and puts the
+// images into the store without a registry: for a machine without network, or a classroom that
+// shouldn't pull the same image thirty times. Two formats are around:
+//
+//	OCI image layout (image save, docker save since 25.0, podman save --format oci-archive)
+//	  index.json           the manifests, named in annotations
+//	  blobs/sha256/<hex>   the manifests, configs and layers
+//
+//	docker save before 25.0 (podman save's default, docker-archive)
+//	  manifest.json        [{"Config": "<hex>.json", "RepoTags": ["alpine:latest"],
+//	                         "Layers": ["<id>/layer.tar", ...]}]
+//	  <hex>.json           the config
+//	  <id>/layer.tar       a layer, uncompressed, or a symlink to the same layer of another image
+//
+// A docker save has no image manifest, we write one. The archive may come from a pipe, and
+// index.json or manifest.json may come last: so every file goes into the blob store as it is
+// read, under the digest we compute, and is looked at once the archive is read. A file named
+// blobs/sha256/<hex> must have that digest. What no image references afterwards, like the
+// index, is removed again.
+
+// loadImages implements `image load [-i FILE]`.
+func loadImages(args []string) error {
+	fs := flag.NewFlagSet("image load", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s image load [OPTIONS]\n\nLoad images from a tar archive of an OCI image layout or of docker save, gzipped or not.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	input := fs.String("i", "", "read the archive from `FILE`, not from the standard input")
+	fs.StringVar(input, "input", "", "same as -i")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "load takes no arguments, the archive is -i FILE or the standard input")
+	}
+	in := os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	} else if isTerminal(os.Stdin) {
+		return usageErrorf(fs, "refusing to read an archive from a terminal, use -i FILE or redirect the input")
+	}
+	archive, err := openArchive(in)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, written, err := readArchiveBlobs(archive)
+	// The files of the archive that no image names are of no use
+	defer func() {
+		refs, err := blobRefs()
+		if err != nil {
+			return
+		}
+		for _, digest := range written {
+			if p, err := blobPath(digest); err == nil && refs[digest] == 0 {
+				os.Remove(p)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if index, ok := files.lookup("index.json"); ok {
+		return loadOCILayout(index)
+	}
+	if manifest, ok := files.lookup("manifest.json"); ok {
+		return loadDockerArchive(files, manifest)
+	}
+	return errors.New("the archive has neither index.json nor manifest.json, it is no OCI image layout and no docker save")
+}
+
+// archiveFiles are the files of an archive, by their paths in it, each a blob of the store.
+type archiveFiles struct {
+	blobs map[string]ociDescriptor
+	// links are the symlinks and hard links, to the path they point to
+	links map[string]string
+}
+
+// lookup returns the blob of the file name, through links.
+func (f archiveFiles) lookup(name string) (ociDescriptor, bool) {
+	name = path.Clean(name)
+	// A symlink loop ends here
+	for range 16 {
+		if desc, ok := f.blobs[name]; ok {
+			return desc, true
+		}
+		target, ok := f.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return ociDescriptor{}, false
+}
+
+// readArchiveBlobs puts every file of the archive r into the blob store, and returns them with
+// the digests it wrote. The lock of the store must be taken.
+func readArchiveBlobs(r io.Reader) (files archiveFiles, written []string, err error) {
+	files = archiveFiles{blobs: map[string]ociDescriptor{}, links: map[string]string{}}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, written, nil
+		} else if err != nil {
+			return files, written, err
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			w, err := newBlobWriter()
+			if err != nil {
+				return files, written, err
+			}
+			if _, err := io.Copy(w, tr); err != nil {
+				w.discard()
+				return files, written, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			digest, err := w.commit()
+			if err != nil {
+				return files, written, err
+			}
+			written = append(written, digest)
+			if hex, ok := strings.CutPrefix(name, "blobs/sha256/"); ok && digest != "sha256:"+hex {
+				return files, written, fmt.Errorf("%s: the content has the digest %s", hdr.Name, digest)
+			}
+			files.blobs[name] = ociDescriptor{Digest: digest, Size: w.size}
+		case tar.TypeSymlink:
+			files.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			files.links[name] = path.Clean(hdr.Linkname)
+		}
+	}
+}
+
+// loadOCILayout loads the images of the index.json of an OCI image layout, whose blobs are in
+// the store now.
+func loadOCILayout(index ociDescriptor) error {
+	var idx ociManifest
+	if err := readBlobJSON(index.Digest, &idx); err != nil {
+		return fmt.Errorf("index.json: %w", err)
+	}
+	if len(idx.Manifests) == 0 {
+		return errors.New("index.json has no images")
+	}
+	for _, desc := range idx.Manifests {
+		data, err := readBlob(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %w", desc.Digest, err)
+		}
+		var m ociManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("manifest %s: %w", desc.Digest, err)
+		}
+		if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList {
+			// An image for several platforms, ours is enough
+			platformDesc, err := selectPlatform(&m, hostPlatform())
+			if err != nil {
+				return fmt.Errorf("manifest %s: %w", desc.Digest, err)
+			}
+			if data, err = readBlob(platformDesc.Digest); err != nil {
+				return fmt.Errorf("manifest %s: %w, the archive has only some platforms", platformDesc.Digest, err)
+			}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("manifest %s: %w", platformDesc.Digest, err)
+			}
+		}
+		// containerd's annotation has the whole name. The spec's may have one too, or only the tag,
+		// which names no image
+		var names []string
+		if name := desc.Annotations[annotationImageName]; name != "" {
+			names = append(names, name)
+		} else if name := desc.Annotations[annotationRefName]; strings.ContainsAny(name, ":/") {
+			names = append(names, name)
+		}
+		if err := loadImage(names, data, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDockerArchive loads the images of the manifest.json of a docker save, whose files are in
+// the store now.
+func loadDockerArchive(files archiveFiles, manifest ociDescriptor) error {
+	var entries []dockerSaveManifest
+	if err := readBlobJSON(manifest.Digest, &entries); err != nil {
+		return fmt.Errorf("manifest.json: %w", err)
+	}
+	if len(entries) == 0 {
+		return errors.New("manifest.json has no images")
+	}
+	for _, entry := range entries {
+		config, ok := files.lookup(entry.Config)
+		if !ok {
+			return fmt.Errorf("manifest.json: the archive has no %s", entry.Config)
+		}
+		config.MediaType = mediaTypeOCIConfig
+		m := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest, Config: config}
+		for _, name := range entry.Layers {
+			layer, ok := files.lookup(name)
+			if !ok {
+				return fmt.Errorf("manifest.json: the archive has no %s", name)
+			}
+			// Uncompressed before 25.0, since then as they were pulled
+			if layer.MediaType, ok = blobLayerMediaType(layer.Digest); !ok {
+				return fmt.Errorf("%s: not a tar archive", name)
+			}
+			m.Layers = append(m.Layers, layer)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err := loadImage(entry.RepoTags, data, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadImage adds the image with manifest m, data as bytes, to the store under names, once its
+// blobs are there, and unpacks its layers. The lock of the store must be taken.
+func loadImage(names []string, data []byte, m *ociManifest) error {
+	if m.MediaType != "" && m.MediaType != mediaTypeOCIManifest && m.MediaType != mediaTypeDockerManifest {
+		return fmt.Errorf("unsupported manifest type %q", m.MediaType)
+	}
+	for i, name := range names {
+		normalized, err := normalizeImageName(name)
+		if err != nil {
+			return fmt.Errorf("image name %q: %w", name, err)
+		}
+		names[i] = normalized
+	}
+	configData, err := readBlob(m.Config.Digest)
+	if err != nil {
+		return fmt.Errorf("config %s: %w, the archive is incomplete", m.Config.Digest, err)
+	}
+	var config imageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("config %s: %w", m.Config.Digest, err)
+	}
+	if host := hostPlatform(); config.Architecture != host.Architecture {
+		fmt.Printf("Warning: the image is for %s, this machine is %s: its programs need qemu-user and binfmt_misc to run\n", config.platform(), host)
+	}
+
+	skipped := 0
+	for _, layer := range m.Layers {
+		if strings.HasSuffix(layer.MediaType, "+zstd") {
+			return fmt.Errorf("layer %s is compressed with zstd, which is not supported", layer.Digest)
+		}
+		if !hasBlob(layer.Digest) {
+			return fmt.Errorf("layer %s: the archive hasn't got it", layer.Digest)
+		}
+		if hasLayer(layer.Digest) {
+			continue
+		}
+		result, err := unpackLayer(layer, "", nil)
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+		skipped += result.SkippedDevices
+	}
+	if skipped > 0 {
+		fmt.Printf("Warning: skipped %d device nodes, creating them takes root (the container gets its own /dev)\n", skipped)
+	}
+
+	first := ""
+	if len(names) > 0 {
+		first = names[0]
+	}
+	id, err := addImage(first, configData, data)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Println("Loaded image ID: sha256:" + id)
+		return nil
+	}
+	for i, name := range names {
+		if i > 0 {
+			if err := tagImage(name, id); err != nil {
+				return err
+			}
+		}
+		fmt.Println("Loaded image: " + name)
+	}
+	return nil
+}
+
+// readBlob reads the blob with digest, a manifest or a config, whole.
+func readBlob(digest string) ([]byte, error) {
+	f, err := openBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, 4<<20))
+}
+
+// readBlobJSON reads the blob with digest as JSON into v.
+func readBlobJSON(digest string, v any) error {
+	data, err := readBlob(digest)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// blobLayerMediaType tells a layer blob's media type from its first bytes: gzip's magic, or the
+// "ustar" of a tar header at offset 257. ok is false when it's neither.
+func blobLayerMediaType(digest string) (mediaType string, ok bool) {
+	f, err := openBlob(digest)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	head := make([]byte, 262)
+	n, _ := io.ReadFull(f, head)
+	switch {
+	case n >= 2 && head[0] == 0x1f && head[1] == 0x8b:
+		return mediaTypeOCILayerGzip, true
+	case n == len(head) && string(head[257:262]) == "ustar":
+		return mediaTypeOCILayer, true
+	}
+	return "", false
+}
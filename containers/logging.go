@@ -0,0 +1,101 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// What the runtime says about itself, as opposed to what a command prints as its result (an ID,
+// a table), goes through log/slog: a record with a level, a message and attributes, on stderr.
+//
+//	time=2026-10-14T09:12:03.512Z level=INFO msg="running the command" args=[/bin/sh] pid=4711 id=1f9fc284afae
+//	time=2026-10-14T09:12:03.515Z level=WARN msg="could not set cgroup file" file=cpu.max err="permission denied"
+//
+// `--log-level debug`, before the command, shows what the runtime does step by step: every
+// cgroup file it writes, the interfaces and addresses of the network, the root it pivots into.
+// `--log-format json` makes a line of JSON of every record, for a program to read. Both have
+// an environment variable, and pass through it to the processes we start again: the child in the
+// container's namespaces and the monitor of -d. The child's records end up where the
+// container's output does, the monitor's in monitor.log in the state directory of its container.
+
+// The environment variables of --log-level and --log-format
+const (
+	logLevelEnv  = "CONTAINER_LOG_LEVEL"
+	logFormatEnv = "CONTAINER_LOG_FORMAT"
+)
+
+// monitorLogFile is the log of the monitor of a detached container, in its state directory
+const monitorLogFile = "monitor.log"
+
+// parseGlobalFlags parses the options before the command, sets up the logger and --explain (see
+// explain.go) with them, and returns the command with its arguments.
+func parseGlobalFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(progName(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	level := fs.String("log-level", envOr(logLevelEnv, "info"), "")
+	format := fs.String("log-format", envOr(logFormatEnv, "text"), "")
+	explain := fs.Bool("explain", explaining(), "")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return []string{"help"}, nil
+		}
+		return nil, err
+	}
+	if err := setupLogging(os.Stderr, *level, *format); err != nil {
+		return nil, err
+	}
+	// For the child and the monitor, which only get a command
+	os.Setenv(logLevelEnv, *level)
+	os.Setenv(logFormatEnv, *format)
+	if *explain {
+		os.Setenv(explainEnv, "1")
+	} else {
+		os.Unsetenv(explainEnv)
+	}
+	return fs.Args(), nil
+}
+
+// setupLogging makes the default logger of slog write the records of level and above to w, in
+// format: text or json.
+func setupLogging(w io.Writer, level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q, expected debug, info, warn or error", level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, options)))
+	default:
+		return fmt.Errorf("invalid --log-format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// logToStateDir sends the records of the monitor of container id to its monitor.log: the
+// monitor has no terminal, its stderr is /dev/null. The file becomes its stderr, for what else it
+// prints there, like --explain.
+func logToStateDir(id string) {
+	if err := os.MkdirAll(stateDir(id), 0700); err != nil {
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(stateDir(id), monitorLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	// It stays open until the monitor exits
+	if syscall.Dup3(int(file.Fd()), 2, 0) == nil {
+		os.Stderr = file
+	}
+	setupLogging(file, envOr(logLevelEnv, "info"), envOr(logFormatEnv, "text"))
+}
@@ -0,0 +1,407 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFile holds the output of a container started with -d, in its state directory
+const logFile = "container.log"
+
+// A container that runs for weeks writes a lot, and its log is in /run, in memory. Like Docker's
+// json-file driver with --log-opt, the log has a maximum size: once container.log would grow past
+// it, it becomes container.log.1, the one before that container.log.2 and so on, and a new
+// container.log starts. max-file is how many files there are, the current one included, the
+// oldest beyond them is deleted. With compress the rotated ones are gzipped, container.log.1.gz,
+// which JSON of this kind shrinks to a tenth of its size.
+//
+//	--log-opt max-size=10m   the size a file grows to, 0 for no limit (the default is 10m)
+//	--log-opt max-file=3     the files kept, with the current one (the default is 3)
+//	--log-opt compress=true  gzip the rotated files
+//
+// `logs` reads them all, the oldest first.
+
+// The defaults of --log-opt. Docker's json-file driver has no limit by default, its local driver
+// keeps 5 files of 20 MB.
+const (
+	defaultLogMaxSize = 10 << 20
+	defaultLogMaxFile = 3
+)
+
+// logOptions are the --log-opt settings of a container.
+type logOptions struct {
+	// MaxSize is the size of a log file in bytes, 0 for no limit
+	MaxSize int64 `json:"maxSize"`
+	// MaxFile is the number of log files, the current one included
+	MaxFile  int  `json:"maxFile"`
+	Compress bool `json:"compress,omitempty"`
+}
+
+// parseLogOptions parses the --log-opt entries: max-size, max-file and compress.
+func parseLogOptions(entries []string) (logOptions, error) {
+	opts := logOptions{MaxSize: defaultLogMaxSize, MaxFile: defaultLogMaxFile}
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return opts, fmt.Errorf("%q is not KEY=VALUE", entry)
+		}
+		var err error
+		switch key {
+		case "max-size":
+			if opts.MaxSize, err = parseBytes(value); err != nil || opts.MaxSize < 0 {
+				return opts, fmt.Errorf("invalid max-size %q", value)
+			}
+		case "max-file":
+			if opts.MaxFile, err = strconv.Atoi(value); err != nil || opts.MaxFile < 1 {
+				return opts, fmt.Errorf("invalid max-file %q, expected at least 1", value)
+			}
+		case "compress":
+			if opts.Compress, err = strconv.ParseBool(value); err != nil {
+				return opts, fmt.Errorf("invalid compress %q, expected true or false", value)
+			}
+		default:
+			return opts, fmt.Errorf("unknown log option %q, expected max-size, max-file or compress", key)
+		}
+	}
+	return opts, nil
+}
+
+// rotatedLogFile is the name of the log file n rotations back, 0 is the current one.
+func rotatedLogFile(n int, compressed bool) string {
+	if n == 0 {
+		return logFile
+	}
+	name := logFile + "." + strconv.Itoa(n)
+	if compressed {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotatingLog is the log file of a container, an io.Writer that rotates it by its logOptions.
+// Every Write is a line of the log, so a line never straddles two files.
+type rotatingLog struct {
+	dir  string
+	opts logOptions
+	file *os.File
+	size int64
+}
+
+// openLog opens the log file in dir to append to it.
+func openLog(dir string, opts logOptions) (*rotatingLog, error) {
+	l := &rotatingLog{dir: dir, opts: opts}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(filepath.Join(l.dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	// After a restart the container goes on where it left off
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, fi.Size()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	// A line longer than max-size gets a file of its own
+	if l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves every log file one back, deletes the one beyond max-file and starts a new one.
+// The container waits for it: its output pipe fills meanwhile, not for long even with compress.
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	path := func(n int, compressed bool) string { return filepath.Join(l.dir, rotatedLogFile(n, compressed)) }
+	for _, compressed := range []bool{false, true} {
+		os.Remove(path(l.opts.MaxFile-1, compressed))
+	}
+	for n := l.opts.MaxFile - 2; n >= 1; n-- {
+		for _, compressed := range []bool{false, true} {
+			os.Rename(path(n, compressed), path(n+1, compressed))
+		}
+	}
+	if l.opts.MaxFile > 1 {
+		if err := os.Rename(path(0, false), path(1, false)); err != nil {
+			return err
+		}
+		if l.opts.Compress {
+			if err := compressFile(path(1, false), path(1, true)); err != nil {
+				slog.Warn("could not compress the log", "file", path(1, false), "err", err)
+			}
+		}
+	}
+	return l.open()
+}
+
+func (l *rotatingLog) Close() error {
+	return l.file.Close()
+}
+
+// compressFile gzips the file at from into a new file at to, and removes it.
+func compressFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	// The name last: logs reads a .gz as a whole file
+	if err == nil {
+		err = os.Rename(to+".tmp", to)
+	}
+	if err != nil {
+		os.Remove(to + ".tmp")
+		return err
+	}
+	return os.Remove(from)
+}
+
+// logEntry is one line of the log file. It is the format of Docker's default "json-file" log
+// driver (/var/lib/docker/containers/<id>/<id>-json.log): one JSON object per line of output, so
+// the log can be read back line by line and we know which stream each line came from and when.
+type logEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// startLogging creates the pipes that become stdout and stderr of a detached container, and copies
+// everything written to them into its log file. Close the returned files once the container has
+// started, then call wait after it exited: it returns when all output is in the log.
+func startLogging(id string, opts logOptions) (stdout, stderr *os.File, wait func(), err error) {
+	if err := os.MkdirAll(stateDir(id), 0700); err != nil {
+		return nil, nil, nil, fmt.Errorf("create state directory: %w", err)
+	}
+	file, err := openLog(stateDir(id), opts)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("open log: %w", err)
+	}
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(file)
+	// Keep <, > and & as they are, the log is meant to be read by people too
+	encoder.SetEscapeHTML(false)
+	var copying sync.WaitGroup
+	pipe := func(stream string) (*os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		copying.Add(1)
+		go func() {
+			defer copying.Done()
+			defer r.Close()
+			reader := bufio.NewReader(r)
+			for {
+				// EOF comes when every process in the container has closed the pipe. A last line
+				// without a newline is logged as it is.
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					mu.Lock()
+					encoder.Encode(logEntry{Log: line, Stream: stream, Time: time.Now().UTC()})
+					mu.Unlock()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		return w, nil
+	}
+
+	if stdout, err = pipe("stdout"); err == nil {
+		stderr, err = pipe("stderr")
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, fmt.Errorf("create log pipe: %w", err)
+	}
+	return stdout, stderr, func() {
+		copying.Wait()
+		file.Close()
+	}, nil
+}
+
+// logs implements `logs [OPTIONS] CONTAINER`, like `docker logs`.
+func logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s logs [OPTIONS] CONTAINER\n\nShow the output of a container started with -d.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var follow, timestamps bool
+	fs.BoolVar(&follow, "f", false, "keep printing new output until the container stops")
+	fs.BoolVar(&follow, "follow", false, "same as -f")
+	fs.BoolVar(&timestamps, "t", false, "show the time of every line")
+	fs.BoolVar(&timestamps, "timestamps", false, "same as -t")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected exactly one CONTAINER")
+	}
+
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir(s.ID), logFile)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("container %s has no logs: only containers started with -d are logged", shortID(s.ID))
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+	// The rotated files first, the oldest of them first
+	if err := printRotatedLogs(stateDir(s.ID), timestamps); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var partial string
+	for stopped, next := false, false; ; {
+		line, err := reader.ReadString('\n')
+		// The monitor may be writing this very line, keep what we got until the rest is there
+		partial += line
+		if err == nil {
+			printLogEntry(partial, timestamps)
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if next {
+			// Rotated, like the event log (see eventsCommand): the rest of the old file is read,
+			// on to the new one
+			if newer, err := os.Open(path); err == nil {
+				file.Close()
+				file, partial = newer, ""
+				reader.Reset(file)
+			}
+			next = false
+			continue
+		}
+		// At the end of the file. With -f wait for more, unless the container has stopped and we
+		// just read what was left.
+		if !follow || stopped {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+		current, err := readState(s.ID)
+		stopped = err != nil || current.stopped()
+		next = rotated(file, path)
+	}
+}
+
+// printRotatedLogs prints the log files that were rotated in dir, container.log.1 and older,
+// compressed or not.
+func printRotatedLogs(dir string, timestamps bool) error {
+	var names []string
+	for n := 1; ; n++ {
+		name := rotatedLogFile(n, false)
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			name = rotatedLogFile(n, true)
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	for _, name := range slices.Backward(names) {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			// Rotated away meanwhile
+			continue
+		}
+		var r io.Reader = file
+		if strings.HasSuffix(name, ".gz") {
+			zr, err := gzip.NewReader(file)
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			r = zr
+		}
+		// Like the current file: a line has no limit, one too long for a file has a file of its own
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				printLogEntry(line, timestamps)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// printLogEntry prints one line of a log file to stdout or stderr, where the container wrote it.
+func printLogEntry(line string, timestamps bool) {
+	var entry logEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return
+	}
+	out := os.Stdout
+	if entry.Stream == "stderr" {
+		out = os.Stderr
+	}
+	if timestamps {
+		fmt.Fprint(out, entry.Time.Format(time.RFC3339Nano), " ")
+	}
+	fmt.Fprint(out, entry.Log)
+}
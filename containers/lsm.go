@@ -0,0 +1,93 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Linux Security Modules (LSMs) like AppArmor and SELinux are the last layer of the sandbox. They
+// don't care about UIDs or capabilities: a policy loaded by the host says which files, sockets
+// and operations a *label* may use, and even root with every capability can't step outside it.
+// AppArmor (Ubuntu, Debian, SUSE) labels processes with a profile name and describes access by
+// path. SELinux (Fedora, RHEL) labels processes and files with contexts like
+// system_u:system_r:container_t:s0 and describes access between types.
+
+// apparmorEnabled reports whether the kernel runs AppArmor
+func apparmorEnabled() bool {
+	data, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && strings.TrimSpace(string(data)) == "Y"
+}
+
+// selinuxEnabled reports whether the kernel runs SELinux (its filesystem is mounted then)
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// validateAppArmorProfile checks that the profile is loaded. The list is only readable by root,
+// so a rootless run skips the check and finds out when the child applies the profile.
+func validateAppArmorProfile(profile string) error {
+	if !apparmorEnabled() {
+		return errors.New("AppArmor is not enabled on this host")
+	}
+	f, err := os.Open("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	// Lines look like "docker-default (enforce)"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name, _, _ := strings.Cut(scanner.Text(), " ("); name == profile {
+			return nil
+		}
+	}
+	return fmt.Errorf("AppArmor profile %q is not loaded (load it with apparmor_parser -r FILE)", profile)
+}
+
+// parseSELinuxLabel builds a full SELinux context from Docker's `label=` options, e.g.
+// "type:container_t", "level:s0:c100,c200". Parts that aren't given get the usual container values.
+func parseSELinuxLabel(parts []string) (string, error) {
+	if !selinuxEnabled() {
+		return "", errors.New("SELinux is not enabled on this host")
+	}
+	context := map[string]string{"user": "system_u", "role": "system_r", "type": "container_t", "level": "s0"}
+	for _, part := range parts {
+		key, value, ok := strings.Cut(part, ":")
+		if _, known := context[key]; !ok || !known || value == "" {
+			return "", fmt.Errorf("expected user:, role:, type: or level:, got %q", part)
+		}
+		context[key] = value
+	}
+	return context["user"] + ":" + context["role"] + ":" + context["type"] + ":" + context["level"], nil
+}
+
+// applyLSMLabels tells the kernel which AppArmor profile or SELinux context the next exec of the
+// calling thread should switch to (see startRestricted). Writing /proc/thread-self/attr/exec
+// changes nothing right away, the label is applied by execve() itself, so the child can go on
+// with its setup unconfined while the command starts confined.
+func applyLSMLabels(apparmorProfile, selinuxLabel string) error {
+	if apparmorProfile != "" {
+		// Newer kernels, which can run several LSMs side by side, have a directory per LSM
+		value := "exec " + apparmorProfile
+		err := os.WriteFile("/proc/thread-self/attr/apparmor/exec", []byte(value), 0)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.WriteFile("/proc/thread-self/attr/exec", []byte(value), 0)
+		}
+		if err != nil {
+			return fmt.Errorf("set AppArmor profile %s: %w", apparmorProfile, err)
+		}
+	}
+	if selinuxLabel != "" {
+		if err := os.WriteFile("/proc/thread-self/attr/exec", []byte(selinuxLabel), 0); err != nil {
+			return fmt.Errorf("set SELinux label %s: %w", selinuxLabel, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The bridge network hides the containers behind the host: they have addresses only the host
+// knows, and reach everything else through NAT. A macvlan network puts them on the host's own
+// network instead, like computers of their own. The container's eth0 is a macvlan interface on a
+// host interface, the parent:
+//
+//	LAN ── eth0 (parent, 192.168.1.10) ─┬─ the host
+//	                                    └─ macvlan (192.168.1.50) ═══ the container's eth0
+//
+// A macvlan has a MAC address of its own, and the parent hands it every frame for that address.
+// To the rest of the network the container is just another machine on the cable: it gets an
+// address from the network's DHCP server, or a static one (--ip, --gateway), and is reachable
+// there without -p. Docker's macvlan driver does the same.
+//
+// The price: the host can't talk to its own containers. The parent passes the frames of its
+// macvlans to the cable and the cable's to them, but never its own, this is how macvlan works.
+// And a network that allows one MAC address per port (some switches, most WiFi) drops the frames
+// of the macvlans.
+
+// macvlanAddress is the MAC address of container id's macvlan. It comes from the ID, so after a
+// restart the DHCP server recognizes the container and gives it the same address. The 02 in the
+// first byte marks a locally administered address, one no network card has; Docker's are 02:42:...
+func macvlanAddress(id string) net.HardwareAddr {
+	b, _ := hex.DecodeString(id[:10])
+	return append(net.HardwareAddr{0x02}, b...)
+}
+
+// setupMacvlan gives the container whose init is process pid its eth0 on the parent's network.
+// The monitor does this, like setupNetwork. With DHCP it fills in the address and returns the
+// lease, close it when the container exits.
+func setupMacvlan(cfg *containerConfig, pid int) (*dhcpLease, error) {
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Close()
+	mac := macvlanAddress(cfg.ID)
+	if err := nl.createMacvlan("eth0", cfg.MacvlanParent, mac, pid); err != nil {
+		return nil, err
+	}
+	if !cfg.DHCP {
+		return nil, nil
+	}
+
+	conn, err := listenDHCP(pid)
+	if err != nil {
+		return nil, err
+	}
+	lease := newDHCPLease(conn, mac, cfg.Hostname)
+	// After a restart we ask for the address we had
+	previous, _, _ := net.ParseCIDR(cfg.IPAddress)
+	if err := lease.obtain(previous); err != nil {
+		lease.close()
+		return nil, fmt.Errorf("DHCP on %s: %w", cfg.MacvlanParent, err)
+	}
+	cfg.IPAddress = lease.address.String()
+	cfg.Gateway = ""
+	if lease.router != nil {
+		cfg.Gateway = lease.router.String()
+	}
+	cfg.Nameservers = lease.nameservers
+	go lease.keepRenewing()
+	return lease, nil
+}
+
+// listenDHCP opens the socket of a DHCP client in the network namespace of process pid, on its
+// eth0, which it brings up for that. A socket stays in the namespace it was created in, only the
+// thread that creates it has to join it.
+func listenDHCP(pid int) (net.PacketConn, error) {
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, fmt.Errorf("open network namespace: %w", err)
+	}
+	defer ns.Close()
+	var conn net.PacketConn
+	err = inNetworkNamespace(ns, func() error {
+		nl, err := openNetlink(syscall.NETLINK_ROUTE)
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		if err := nl.setLinkUp("eth0"); err != nil {
+			return err
+		}
+		// Without an address the kernel only sends broadcasts through an interface the socket is
+		// bound to
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err == nil {
+					err = syscall.BindToDevice(int(fd), "eth0")
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}}
+		conn, err = lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", dhcpClientPort))
+		if err != nil {
+			return fmt.Errorf("open DHCP socket: %w", err)
+		}
+		return nil
+	})
+	return conn, err
+}
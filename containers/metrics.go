@@ -0,0 +1,216 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// `metrics` is the runtime as a scrape target for Prometheus. It runs until it's stopped, like a
+// daemon, and answers GET /metrics with what the kernel counts for every running container, in
+// the text format of Prometheus (https://prometheus.io/docs/instrumenting/exposition_formats/):
+//
+//	# HELP mycontainer_container_memory_bytes Memory the container uses, memory.current of its cgroup.
+//	# TYPE mycontainer_container_memory_bytes gauge
+//	mycontainer_container_memory_bytes{id="1f9fc284afae",image="alpine"} 1.2288e+06
+//
+// Each scrape reads the cgroup files again, the same as `stats` (see stats.go): nothing is kept,
+// so a container that started a second ago is in the next scrape. A gauge is a value now, memory
+// or processes. A counter only grows, CPU seconds or OOM kills, and Prometheus computes the rate:
+// rate(mycontainer_container_cpu_seconds_total[1m]) is how many CPUs a container keeps busy.
+//
+// There are no processes that would count how often containers started, each `run` and every
+// monitor is a process of its own. They count into counters.json next to the states instead,
+// under a lock, and metrics reads it. Like the states it is in /run: after a reboot it starts at
+// 0, which Prometheus takes for a restart of the target.
+//
+// Rootless containers don't get a cgroup, so there are only the runtime's counters for them.
+
+// metricsAddr is where metrics listens unless --listen or metricsAddrEnv says otherwise: dockerd's
+// --metrics-addr in its documentation. Only on the loopback interface, the metrics say what runs
+// on the host.
+const (
+	metricsAddr    = "127.0.0.1:9323"
+	metricsAddrEnv = "CONTAINER_METRICS_ADDR"
+)
+
+// The counters of counters.json
+const (
+	counterStarts   = "starts"
+	counterOOMKills = "oom_kills"
+)
+
+// metricsCommand implements `metrics [--listen ADDR]`.
+func metricsCommand(args []string) error {
+	fs := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s metrics [OPTIONS]\n\nServe the cgroup counters of the running containers and of the runtime at /metrics, for Prometheus.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", envOr(metricsAddrEnv, metricsAddr), "the `ADDR` to listen on, env "+metricsAddrEnv)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "unexpected argument %q", fs.Arg(0))
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "The metrics are at /metrics")
+	})
+	fmt.Printf("Serving metrics at http://%s/metrics\n", listener.Addr())
+	return http.Serve(listener, mux)
+}
+
+// metricSample is a value of a metric, with its labels already in the text format.
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes a metric family: its help, its type and its samples.
+func writeMetric(w io.Writer, name, kind, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %g\n", name, s.labels, s.value)
+	}
+}
+
+// metricLabels formats labels, name and value after each other, as {name="value",...}.
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		// A value escapes \, " and the newline
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], value)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// writeMetrics writes all metrics, the ones of the runtime and those of every running container
+// with a cgroup.
+func writeMetrics(w io.Writer) {
+	type container struct {
+		labels string
+		stats  cgroupStats
+		oom    int64
+	}
+	var containers []container
+	statuses := map[string]int{}
+	for _, s := range listStates() {
+		status := s.currentStatus()
+		statuses[status]++
+		if status != statusRunning || s.Cgroup == "" {
+			continue
+		}
+		stats, err := readCgroupStats(s.ID)
+		if err != nil {
+			// It exited since listStates
+			continue
+		}
+		image := ""
+		if cfg, err := readConfig(s.ID); err == nil {
+			image = cfg.Image
+		}
+		containers = append(containers, container{metricLabels("id", shortID(s.ID), "image", image), stats, oomKills(s.ID)})
+	}
+	slices.SortFunc(containers, func(a, b container) int { return strings.Compare(a.labels, b.labels) })
+
+	counters := readCounters()
+	writeMetric(w, "mycontainer_starts_total", "counter", "Containers the runtime started, restarts of the restart policy included.",
+		[]metricSample{{"", float64(counters[counterStarts])}})
+	writeMetric(w, "mycontainer_oom_kills_total", "counter", "Processes the kernel OOM-killed in a container, as the monitors of the containers saw them.",
+		[]metricSample{{"", float64(counters[counterOOMKills])}})
+	var byStatus []metricSample
+	for _, status := range []string{statusCreated, statusRunning, statusRestarting, statusExited, statusDead} {
+		byStatus = append(byStatus, metricSample{metricLabels("status", status), float64(statuses[status])})
+	}
+	writeMetric(w, "mycontainer_containers", "gauge", "Containers in the state directory, by status.", byStatus)
+
+	// One family after the other, with a sample of every container each
+	family := func(name, kind, help string, value func(c container) (float64, bool)) {
+		var samples []metricSample
+		for _, c := range containers {
+			if v, ok := value(c); ok {
+				samples = append(samples, metricSample{c.labels, v})
+			}
+		}
+		writeMetric(w, name, kind, help, samples)
+	}
+	family("mycontainer_container_memory_bytes", "gauge", "Memory the container uses, memory.current of its cgroup.",
+		func(c container) (float64, bool) { return float64(c.stats.Memory), true })
+	family("mycontainer_container_memory_limit_bytes", "gauge", "The memory limit of the container, memory.max. Without --memory there is none.",
+		func(c container) (float64, bool) { return float64(c.stats.MemoryLimit), c.stats.MemoryLimit > 0 })
+	family("mycontainer_container_cpu_seconds_total", "counter", "CPU time the processes of the container used, usage_usec of cpu.stat.",
+		func(c container) (float64, bool) { return c.stats.CPUUsage.Seconds(), true })
+	family("mycontainer_container_cpu_periods_total", "counter", "CFS periods of the CPU quota of --cpus, nr_periods of cpu.stat.",
+		func(c container) (float64, bool) { return float64(c.stats.Periods), true })
+	family("mycontainer_container_cpu_throttled_periods_total", "counter", "Periods in which the container used up its CPU quota and had to wait, nr_throttled of cpu.stat.",
+		func(c container) (float64, bool) { return float64(c.stats.ThrottledPeriods), true })
+	family("mycontainer_container_cpu_throttled_seconds_total", "counter", "How long the container waited for its next CPU period, throttled_usec of cpu.stat.",
+		func(c container) (float64, bool) { return c.stats.Throttled.Seconds(), true })
+	family("mycontainer_container_pids", "gauge", "Processes and threads in the container, pids.current.",
+		func(c container) (float64, bool) { return float64(c.stats.Pids), true })
+	family("mycontainer_container_pids_limit", "gauge", "The limit of --pids-limit, pids.max. Without it there is none.",
+		func(c container) (float64, bool) { return float64(c.stats.PidsLimit), c.stats.PidsLimit > 0 })
+	family("mycontainer_container_oom_kills_total", "counter", "Processes the kernel OOM-killed in the container, oom_kill of memory.events.",
+		func(c container) (float64, bool) { return float64(c.oom), true })
+}
+
+// countersPath is the file of the runtime's counters, next to the directories of the states.
+func countersPath() string {
+	return filepath.Join(filepath.Dir(stateRoot()), "counters.json")
+}
+
+// readCounters returns the runtime's counters, none when nothing was counted yet.
+func readCounters() map[string]int64 {
+	counters := map[string]int64{}
+	if data, err := os.ReadFile(countersPath()); err == nil {
+		json.Unmarshal(data, &counters)
+	}
+	return counters
+}
+
+// addCounter adds n to the runtime's counter name. A counter that can't be written isn't worth
+// failing a container for, it's only metrics.
+func addCounter(name string, n int64) {
+	if err := os.MkdirAll(filepath.Dir(countersPath()), 0700); err != nil {
+		return
+	}
+	unlock, err := lockPath(countersPath() + ".lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+	counters := readCounters()
+	counters[name] += n
+	if data, err := json.MarshalIndent(counters, "", "  "); err == nil {
+		writeFileAtomic(countersPath(), append(data, '\n'))
+	}
+}
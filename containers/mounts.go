@@ -0,0 +1,490 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// maskedPaths are hidden from the container, the same list runc uses by default. Even without
+// privileges they leak information about the host (kernel memory layout, timers of other
+// processes, keys) or talk directly to hardware drivers. Paths that don't exist are skipped; the
+// /sys entries only matter once a sysfs is mounted in the container.
+var maskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore", // the host's physical memory as an ELF core file
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// readonlyPaths stay readable but can't be written. /proc is not namespaced in these places:
+// a write to /proc/sys/kernel/... or /proc/sysrq-trigger changes the *host* kernel, e.g.
+// `echo b > /proc/sysrq-trigger` reboots the machine.
+var readonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// protectProcPaths masks and write-protects the dangerous parts of /proc and /sys, the way runc
+// does: masked are hidden, readonly made read-only (maskedPaths and readonlyPaths by default). It
+// runs after pivot_root, so the paths and /dev/null are the container's.
+func protectProcPaths(masked, readonly []string) error {
+	for _, path := range masked {
+		if err := maskPath(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range readonly {
+		// Bind-mount the path onto itself to get a mount of its own that we can make read-only
+		err := mountFS(path, path, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if errors.Is(err, syscall.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("bind mount %s: %w", path, err)
+		}
+		if err := remountReadOnly(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskPath hides a path: a file gets /dev/null mounted over it (reads return nothing), a
+// directory an empty read-only tmpfs.
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s: %w", path, err)
+	}
+	if info.IsDir() {
+		err = mountFS("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "")
+	} else {
+		err = mountFS("/dev/null", path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s: %w", path, err)
+	}
+	return nil
+}
+
+// tmpfsMount is a tmpfs to mount inside the container, created from a `--tmpfs PATH:OPTIONS` flag.
+type tmpfsMount struct {
+	Path string `json:"path"`
+	// Flags are mount(2) flags like MS_NOSUID, Data the tmpfs options like "size=64m,mode=1777"
+	Flags uintptr `json:"flags"`
+	Data  string  `json:"data"`
+}
+
+// defaultTmpfs are the writable places most programs expect. tmpfs lives in RAM (and swap),
+// which is charged to the container's memory cgroup, so each one gets a size limit. nosuid and
+// nodev because a writable place is the first spot to drop a setuid binary or device node.
+var defaultTmpfs = []tmpfsMount{
+	{Path: "/tmp", Flags: syscall.MS_NOSUID | syscall.MS_NODEV, Data: "mode=1777,size=64m"},
+	{Path: "/run", Flags: syscall.MS_NOSUID | syscall.MS_NODEV, Data: "mode=755,size=64m"},
+	// POSIX shared memory (shm_open) lives here, Docker limits it to 64MB as well (--shm-size)
+	{Path: "/dev/shm", Flags: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, Data: "mode=1777,size=64m"},
+}
+
+// tmpfsFlags are the options of --tmpfs that become mount(2) flags (Docker's syntax):
+// "noexec" sets MS_NOEXEC, "exec" clears it again.
+var tmpfsFlags = map[string]struct{ set, clear uintptr }{
+	"ro":     {set: syscall.MS_RDONLY},
+	"rw":     {clear: syscall.MS_RDONLY},
+	"nosuid": {set: syscall.MS_NOSUID},
+	"suid":   {clear: syscall.MS_NOSUID},
+	"nodev":  {set: syscall.MS_NODEV},
+	"dev":    {clear: syscall.MS_NODEV},
+	"noexec": {set: syscall.MS_NOEXEC},
+	"exec":   {clear: syscall.MS_NOEXEC},
+}
+
+// tmpfsData are the options tmpfs itself understands, passed on in the data argument of mount(2)
+var tmpfsData = []string{"size", "mode", "uid", "gid", "nr_inodes", "nr_blocks"}
+
+// parseTmpfs parses PATH[:OPTIONS], e.g. "/tmp:size=64m,noexec". The options start from the
+// defaults of the path (or of /tmp for other paths), so `--tmpfs /tmp:size=1g` only changes the size.
+func parseTmpfs(spec string) (tmpfsMount, error) {
+	path, options, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(path) {
+		return tmpfsMount{}, errors.New("path must be absolute")
+	}
+	m := tmpfsMount{Path: filepath.Clean(path), Flags: defaultTmpfs[0].Flags, Data: defaultTmpfs[0].Data}
+	for _, d := range defaultTmpfs {
+		if d.Path == m.Path {
+			m = d
+		}
+	}
+	if options == "" {
+		return m, nil
+	}
+
+	data := map[string]string{}
+	var order []string
+	for _, kv := range strings.Split(m.Data, ",") {
+		key, value, _ := strings.Cut(kv, "=")
+		data[key] = value
+		order = append(order, key)
+	}
+	for _, option := range strings.Split(options, ",") {
+		if flag, ok := tmpfsFlags[option]; ok {
+			m.Flags = m.Flags&^flag.clear | flag.set
+			continue
+		}
+		key, value, ok := strings.Cut(option, "=")
+		if !ok || !slices.Contains(tmpfsData, key) {
+			return tmpfsMount{}, fmt.Errorf("unknown option %q", option)
+		}
+		if _, seen := data[key]; !seen {
+			order = append(order, key)
+		}
+		data[key] = value
+	}
+	var parts []string
+	for _, key := range order {
+		parts = append(parts, key+"="+data[key])
+	}
+	m.Data = strings.Join(parts, ",")
+	return m, nil
+}
+
+// mountSysfs mounts a read-only sysfs on /sys below rootfs, like Docker. Most of /sys is the
+// host's hardware, but the network devices are those of our network namespace, and
+// /sys/fs/cgroup is where the container's cgroups go. Like proc it has to be mounted before
+// pivot_root: inside a user namespace only while a fully visible sysfs is still mounted.
+//
+// A user namespace may only mount the sysfs of a network namespace it owns. A rootless container
+// with --network host has the host's, it gets the host's /sys bind-mounted instead, like runc
+// does: the same files, read-only.
+func mountSysfs(rootfs string) error {
+	target := filepath.Join(rootfs, "sys")
+	if err := os.MkdirAll(target, 0555); err != nil {
+		return fmt.Errorf("create /sys: %w", err)
+	}
+	const flags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	err := mountFS("sysfs", target, "sysfs", flags, "")
+	if errors.Is(err, syscall.EPERM) {
+		if err = mountFS("/sys", target, "", syscall.MS_BIND|syscall.MS_REC, ""); err == nil {
+			err = mountFS("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|flags, "")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("mount sysfs: %w", err)
+	}
+	return nil
+}
+
+// mountTmpfs mounts the tmpfs filesystems below rootfs. It runs before pivot_root, so that
+// volumes can be mounted on top (e.g. -v /data:/tmp/data).
+func mountTmpfs(rootfs string, mounts []tmpfsMount) error {
+	for _, m := range mounts {
+		target, err := resolveInRoot(rootfs, m.Path)
+		if err != nil {
+			return err
+		}
+		// Create the mount point, the rootfs is still writable at this point
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("create %s: %w", m.Path, err)
+		}
+		if err := mountFS("tmpfs", target, "tmpfs", m.Flags, m.Data); err != nil {
+			return fmt.Errorf("mount tmpfs on %s (%s): %w", m.Path, m.Data, err)
+		}
+	}
+	return nil
+}
+
+// volumeMount is a host directory or file bind-mounted into the container (-v HOST:CONTAINER).
+type volumeMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	// Recursive also brings along the mounts below Source (rbind, the default), a plain bind
+	// only the filesystem Source itself is on
+	Recursive bool `json:"recursive"`
+	// Propagation is one of the propagationFlags names, empty keeps what the mount inherited
+	Propagation string `json:"propagation,omitempty"`
+}
+
+// parseVolume parses Docker's -v syntax: HOST:CONTAINER[:OPTIONS], with the options
+// ro, rw, rbind, bind and a propagation mode like rshared separated by commas.
+func parseVolume(spec string) (volumeMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return volumeMount{}, errors.New("expected HOST:CONTAINER[:OPTIONS]")
+	}
+	v := volumeMount{Source: parts[0], Destination: parts[1], Recursive: true}
+	if !filepath.IsAbs(v.Source) {
+		return volumeMount{}, fmt.Errorf("host path %q must be absolute (named volumes are not supported)", v.Source)
+	}
+	if _, err := os.Stat(v.Source); err != nil {
+		return volumeMount{}, err
+	}
+	if !filepath.IsAbs(v.Destination) || filepath.Clean(v.Destination) == "/" {
+		return volumeMount{}, fmt.Errorf("container path %q must be absolute and not /", v.Destination)
+	}
+	v.Source, v.Destination = filepath.Clean(v.Source), filepath.Clean(v.Destination)
+
+	if len(parts) == 3 {
+		for _, option := range strings.Split(parts[2], ",") {
+			switch option {
+			case "ro", "rw":
+				v.ReadOnly = option == "ro"
+			case "rbind", "bind":
+				v.Recursive = option == "rbind"
+			default:
+				if _, ok := propagationFlags[option]; ok {
+					v.Propagation = option
+					continue
+				}
+				return volumeMount{}, fmt.Errorf("unknown option %q", option)
+			}
+		}
+	}
+	return v, nil
+}
+
+// mountVolumes bind-mounts the volumes below rootfs, before pivot_root: afterwards the host
+// paths are gone.
+//
+// A bind mount makes a directory (or file) visible at a second place, it is the same inode and
+// not a copy. Because our mount namespace is private, the mount only exists inside the container.
+func mountVolumes(rootfs string, volumes []volumeMount) error {
+	for _, v := range volumes {
+		target, err := resolveInRoot(rootfs, v.Destination)
+		if err != nil {
+			return err
+		}
+
+		// The mount point must be of the same kind as the source: a directory, or a file to
+		// bind a single file like -v /etc/resolv.conf:/etc/resolv.conf
+		info, err := os.Stat(v.Source)
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", v.Source, err)
+		}
+		if info.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else if _, statErr := os.Stat(target); statErr != nil {
+			// Only a missing one: a rootless container may not write the rootfs's own files
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				var f *os.File
+				if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+					f.Close()
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("create mount point %s: %w", v.Destination, err)
+		}
+
+		flags := uintptr(syscall.MS_BIND)
+		if v.Recursive {
+			flags |= syscall.MS_REC
+		}
+		if err := mountFS(v.Source, target, "", flags, ""); err != nil {
+			return fmt.Errorf("bind mount %s to %s: %w", v.Source, v.Destination, err)
+		}
+		if v.Propagation != "" {
+			if err := mountFS("", target, "", propagationFlags[v.Propagation], ""); err != nil {
+				return fmt.Errorf("set %s propagation on %s: %w", v.Propagation, v.Destination, err)
+			}
+		}
+		// A bind mount can't be made read-only in the same call, it needs a remount. Only the top
+		// mount becomes read-only, mounts below it (brought along by MS_REC) stay as they are.
+		if v.ReadOnly {
+			if err := remountReadOnly(target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// propagationFlags are the mount propagation modes. A mount is in one of these states:
+//   - shared:  mounts and unmounts below it are passed on to its peers in other mount namespaces,
+//     and it receives theirs (this is how the host's mounts show up in a new mount namespace)
+//   - slave:   it receives events from its master, but its own mounts stay private
+//   - private: nothing goes in or out
+//
+// The "r" variants apply the mode to every mount below as well.
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+// setRootPropagation sets the propagation of our whole mount tree. It is the very first mount
+// operation in the child: until then our mount namespace is a copy of the host's, and with the
+// usual shared `/` (systemd makes it shared) every mount we make would appear on the host too.
+//
+// With rprivate (the default) the container is completely cut off. With rslave mounts made on the
+// host later on (e.g. plugging in a USB disk below a volume) still show up in the container.
+// With rshared they also go the other way, which volumes with the rshared option need.
+func setRootPropagation(rootfs, propagation string) error {
+	if err := mountFS("", "/", "", propagationFlags[propagation], ""); err != nil {
+		return fmt.Errorf("set %s propagation on /: %w", propagation, err)
+	}
+	if propagationFlags[propagation]&syscall.MS_SHARED == 0 {
+		return nil
+	}
+
+	// pivot_root refuses to work when the mount new_root sits on is shared, the new root would
+	// show up in every peer. Like runc we make just that one mount private again (the mounts
+	// below it, like a shared volume source, keep their propagation).
+	parent, err := mountPointOf(rootfs)
+	if err != nil {
+		return err
+	}
+	if err := mountFS("", parent, "", syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make %s private: %w", parent, err)
+	}
+	return nil
+}
+
+// mountPointOf returns the mount point of the mount that path is on, from /proc/self/mountinfo.
+func mountPointOf(path string) (string, error) {
+	mounts, err := readMountInfo("self")
+	if err != nil {
+		return "", err
+	}
+	best := "/"
+	for _, m := range mounts {
+		if (path == m.Destination || strings.HasPrefix(path, strings.TrimSuffix(m.Destination, "/")+"/")) && len(m.Destination) > len(best) {
+			best = m.Destination
+		}
+	}
+	return best, nil
+}
+
+// mountInfo is one line of /proc/PID/mountinfo
+type mountInfo struct {
+	Destination string `json:"destination"`
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Options     string `json:"options"`
+	// Propagation is "shared", "slave" or "private"
+	Propagation string `json:"propagation"`
+}
+
+// readMountInfo returns the mount table of process pid ("self" for ourselves), as the process
+// sees it: paths are relative to its root.
+func readMountInfo(pid string) ([]mountInfo, error) {
+	data, err := os.ReadFile("/proc/" + pid + "/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	// Spaces and other special characters in paths are written as octal escapes
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	var mounts []mountInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		// Field 5 is the mount point and 6 the mount options, then come optional fields like
+		// "shared:1" up to the "-", then the filesystem type and the source
+		before, after, ok := strings.Cut(line, " - ")
+		fields, tail := strings.Fields(before), strings.Fields(after)
+		if !ok || len(fields) < 6 || len(tail) < 2 {
+			continue
+		}
+		m := mountInfo{
+			Destination: unescape.Replace(fields[4]),
+			Type:        tail[0],
+			Source:      unescape.Replace(tail[1]),
+			Options:     fields[5],
+			Propagation: "private",
+		}
+		for _, optional := range fields[6:] {
+			switch {
+			case strings.HasPrefix(optional, "shared:"):
+				m.Propagation = "shared"
+			case strings.HasPrefix(optional, "master:") && m.Propagation != "shared":
+				m.Propagation = "slave"
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// resolveInRoot turns a path inside the container into a host path below root, following
+// symlinks the way the container will see them.
+//
+// A plain filepath.Join(root, path) is dangerous while we are still on the host side of
+// pivot_root: if the image contains a symlink /data -> /etc, mounting a volume at /data would
+// cover the host's /etc. Here an absolute symlink starts over at root, and ".." stops at root.
+func resolveInRoot(root, path string) (string, error) {
+	current := "/"
+	remaining := path
+	for links := 0; remaining != ""; {
+		var part string
+		part, remaining, _ = strings.Cut(strings.TrimLeft(remaining, "/"), "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			// Not a symlink, or doesn't exist (yet): a plain path component
+			current = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("resolve %s: %w", path, syscall.ELOOP)
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, current), nil
+}
+
+// remountReadOnly makes the mount at path read-only.
+//
+// MS_REMOUNT|MS_BIND changes the flags of this one mount only, not of the filesystem below it:
+// the rootfs stays writable on the host and for other containers. The remount replaces *all*
+// per-mount flags, so we pass the current ones along. Inside a user namespace that is required,
+// the kernel refuses to clear flags like nosuid that the host set on a mount ("locked" flags).
+func remountReadOnly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", path, err)
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	// statfs reports the mount flags with ST_* constants, most of which have the MS_* value
+	flags |= uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	if err := mountFS("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// stRelatime is ST_RELATIME from <sys/statvfs.h>, the one flag whose MS_* value differs
+const stRelatime = 0x1000
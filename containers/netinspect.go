@@ -0,0 +1,438 @@
+//go:build linux
+
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The network of the containers is spread over the host: a bridge and its addresses, a veth per
+// container, an address file per container in /run/mycontainer/networks, the rules in two
+// nftables tables, and inside each network namespace the other ends. When a container can't
+// reach something, the answer is in one of them, each with a tool of its own: ip link, ip addr,
+// bridge link, nft list ruleset, ip netns exec. `network inspect` collects them in one JSON
+// document, like `docker network inspect`, and reads the rules back into nft's syntax, for a host
+// without the nft binary.
+
+// networkInspect is what `network inspect` prints.
+type networkInspect struct {
+	// Bridge is mycontainer0, missing before the first bridge container
+	Bridge *interfaceInspect `json:"bridge,omitempty"`
+	// Subnets are the networks the IPAM hands out addresses in, those of the bridge's addresses
+	Subnets []subnetInspect `json:"subnets,omitempty"`
+	// CNI are the networks of the CNI plugin (see cni.go), by name
+	CNI map[string][]allocationInspect `json:"cni,omitempty"`
+	// Veths are the host ends of the veth pairs on the bridge
+	Veths []vethInspect `json:"veths,omitempty"`
+	// Rules are the nftables rules of our tables
+	Rules []ruleInspect `json:"rules,omitempty"`
+	// Containers are the network namespaces of the running containers, as they see them
+	Containers []containerNetworkInspect `json:"containers,omitempty"`
+}
+
+// interfaceInspect is a network interface, like a line of `ip addr`.
+type interfaceInspect struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	MTU       int      `json:"mtu"`
+	MAC       string   `json:"mac,omitempty"`
+	Flags     string   `json:"flags"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// subnetInspect is a subnet of the bridge and the addresses taken in it.
+type subnetInspect struct {
+	Subnet      string              `json:"subnet"`
+	Gateway     string              `json:"gateway"`
+	Allocations []allocationInspect `json:"allocations,omitempty"`
+}
+
+// allocationInspect is an address file of the IPAM. Stale ones belong to containers that are
+// gone, the next container gets the address.
+type allocationInspect struct {
+	Address string `json:"address"`
+	Owner   string `json:"owner"`
+	Stale   bool   `json:"stale,omitempty"`
+}
+
+// vethInspect is a port of the bridge, and the container on the other end.
+type vethInspect struct {
+	Name      string `json:"name"`
+	Container string `json:"container,omitempty"`
+	// State is the operstate: "up" once both ends are, "lowerlayerdown" while the peer is down
+	State string `json:"state"`
+}
+
+// ruleInspect is an nftables rule, in nft's syntax.
+type ruleInspect struct {
+	Table     string `json:"table"`
+	Chain     string `json:"chain"`
+	Handle    uint64 `json:"handle"`
+	Container string `json:"container,omitempty"`
+	Rule      string `json:"rule"`
+}
+
+// containerNetworkInspect is the network of a running container.
+type containerNetworkInspect struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname,omitempty"`
+	Network  string `json:"network"`
+	// Interfaces are those of its network namespace. A container with --network host has none of
+	// its own, they're the host's.
+	Interfaces []interfaceInspect `json:"interfaces,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// networkCommand implements `network inspect`.
+func networkCommand(args []string) error {
+	fs := flag.NewFlagSet("network", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s network inspect\n\nShow the bridge, its subnets, veth pairs and nftables rules, and the interfaces of every container, as JSON.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	switch {
+	case fs.NArg() == 0:
+		return usageErrorf(fs, "missing command")
+	case fs.Arg(0) != "inspect":
+		return usageErrorf(fs, "unknown command %q", fs.Arg(0))
+	case fs.NArg() > 1:
+		return usageErrorf(fs, "inspect takes no arguments")
+	}
+	// The rules and the other network namespaces are root's business
+	if os.Geteuid() != 0 {
+		return errors.New("network inspect needs root")
+	}
+
+	var info networkInspect
+	states := listStates()
+	if bridge, err := net.InterfaceByName(bridgeName); err == nil {
+		b := inspectInterface(*bridge)
+		info.Bridge = &b
+		info.Subnets = inspectSubnets(bridge, states)
+		info.Veths = inspectVeths(states)
+	}
+	info.CNI = inspectCNI()
+	rules, err := inspectRules()
+	if err != nil {
+		return fmt.Errorf("list nftables rules: %w", err)
+	}
+	info.Rules = rules
+	for _, s := range states {
+		if s.currentStatus() == statusRunning {
+			info.Containers = append(info.Containers, inspectContainerNetwork(s))
+		}
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// inspectInterface describes iface, with its addresses in CIDR notation.
+func inspectInterface(iface net.Interface) interfaceInspect {
+	info := interfaceInspect{Name: iface.Name, Index: iface.Index, MTU: iface.MTU, MAC: iface.HardwareAddr.String(), Flags: iface.Flags.String()}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		info.Addresses = append(info.Addresses, addr.String())
+	}
+	return info
+}
+
+// inspectSubnets returns the subnets of bridge's addresses, each gateway is one, with the address
+// files of the IPAM in them.
+func inspectSubnets(bridge *net.Interface, states []*containerState) []subnetInspect {
+	allocations := readAllocations(ipamDir, func(owner string) bool {
+		return !slices.ContainsFunc(states, func(s *containerState) bool { return s.ID == owner })
+	})
+	var subnets []subnetInspect
+	addrs, _ := bridge.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		// The kernel's link-local address of IPv6 isn't one of ours
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		subnet := &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+		s := subnetInspect{Subnet: subnet.String(), Gateway: ipnet.IP.String()}
+		for _, a := range allocations {
+			if subnet.Contains(net.ParseIP(a.Address)) {
+				s.Allocations = append(s.Allocations, a)
+			}
+		}
+		subnets = append(subnets, s)
+	}
+	return subnets
+}
+
+// inspectCNI returns the address files of every CNI network. The owner is the container ID of
+// the runtime and the interface, whether a container still has it only the runtime knows.
+func inspectCNI() map[string][]allocationInspect {
+	entries, _ := os.ReadDir(cniDir)
+	networks := map[string][]allocationInspect{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			networks[entry.Name()] = readAllocations(filepath.Join(cniDir, entry.Name()), func(string) bool { return false })
+		}
+	}
+	return networks
+}
+
+// readAllocations reads the address files in dir, see allocateAddress.
+func readAllocations(dir string, stale func(owner string) bool) []allocationInspect {
+	entries, _ := os.ReadDir(dir)
+	var allocations []allocationInspect
+	for _, entry := range entries {
+		owner, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil || net.ParseIP(entry.Name()) == nil {
+			// The lock file
+			continue
+		}
+		id := strings.TrimSpace(string(owner))
+		allocations = append(allocations, allocationInspect{Address: entry.Name(), Owner: id, Stale: stale(id)})
+	}
+	return allocations
+}
+
+// inspectVeths returns the ports of the bridge, which the kernel lists in its brif directory.
+func inspectVeths(states []*containerState) []vethInspect {
+	entries, _ := os.ReadDir(filepath.Join("/sys/class/net", bridgeName, "brif"))
+	var veths []vethInspect
+	for _, entry := range entries {
+		v := vethInspect{Name: entry.Name()}
+		if state, err := os.ReadFile(filepath.Join("/sys/class/net", entry.Name(), "operstate")); err == nil {
+			v.State = strings.TrimSpace(string(state))
+		}
+		// The veths of CNI's containers have other names, see cniVethName
+		for _, s := range states {
+			if vethName(s.ID) == v.Name {
+				v.Container = s.ID
+			}
+		}
+		veths = append(veths, v)
+	}
+	return veths
+}
+
+// inspectContainerNetwork lists the interfaces in the network namespace of container s, seen
+// from a thread that joined it.
+func inspectContainerNetwork(s *containerState) containerNetworkInspect {
+	info := containerNetworkInspect{ID: s.ID, Hostname: s.Hostname, Network: networkNone}
+	if cfg, err := readConfig(s.ID); err == nil && cfg.Network != "" {
+		info.Network = cfg.Network
+	}
+	if info.Network == networkHost {
+		return info
+	}
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", s.Pid))
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	defer ns.Close()
+	err = inNetworkNamespace(ns, func() error {
+		ifaces, err := net.Interfaces()
+		for _, iface := range ifaces {
+			info.Interfaces = append(info.Interfaces, inspectInterface(iface))
+		}
+		return err
+	})
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+// inspectRules returns the rules of both our tables.
+func inspectRules() ([]ruleInspect, error) {
+	nl, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Close()
+
+	var rules []ruleInspect
+	for _, family := range []nftFamily{nftIPv4, nftIPv6} {
+		typ, header := nftMessage(family, nftMsgGetRule)
+		msgs, err := nl.dump(typ, header, nlAttr(nftaRuleTable, nlString(nftTable)))
+		if errors.Is(err, syscall.ENOENT) {
+			// No container ever had an address of the family
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		table := "ip " + nftTable
+		if family == nftIPv6 {
+			table = "ip6 " + nftTable
+		}
+		for _, msg := range msgs {
+			if len(msg.Data) < 4 {
+				continue
+			}
+			attrs := parseNlAttrs(msg.Data[4:])
+			rule := ruleInspect{
+				Table:     table,
+				Chain:     strings.TrimRight(string(attrs[nftaRuleChain]), "\x00"),
+				Container: nftRuleComment(attrs[nftaRuleUserdata]),
+				Rule:      formatNftRule(family, attrs[nftaRuleExprs]),
+			}
+			if len(attrs[nftaRuleHandle]) == 8 {
+				rule.Handle = binary.BigEndian.Uint64(attrs[nftaRuleHandle])
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// formatNftRule turns the expressions of a rule back into what `nft list` prints, for those our
+// rules are made of (see nftables.go). Expressions pass values in registers, a load puts what
+// the next cmp compares there: "payload ip saddr, cmp eq 172.29.0.2" is "ip saddr 172.29.0.2".
+func formatNftRule(family nftFamily, exprs []byte) string {
+	ipName, ipLen := "ip", net.IPv4len
+	if family == nftIPv6 {
+		ipName, ipLen = "ip6", net.IPv6len
+	}
+	var words []string
+	// What the first register holds, how to print values compared with it, the l4proto the
+	// rule matched and the immediate values, by register
+	var loaded string
+	var format func([]byte) string
+	var proto string
+	immediates := map[uint32][]byte{}
+	for _, attrs := range nlAttrList(exprs) {
+		expr := parseNlAttrs(attrs)
+		data := parseNlAttrs(expr[nftaExprData])
+		be32 := func(typ uint16) uint32 {
+			if len(data[typ]) < 4 {
+				return 0
+			}
+			return binary.BigEndian.Uint32(data[typ])
+		}
+		value := func(typ uint16) []byte { return parseNlAttrs(data[typ])[nftaDataValue] }
+
+		switch name := strings.TrimRight(string(expr[nftaExprName]), "\x00"); name {
+		case "payload":
+			base, offset, length := be32(nftaPayloadBase), be32(nftaPayloadOffset), int(be32(nftaPayloadLen))
+			switch {
+			case base == nftPayloadNetwork && offset == family.saddr && length == ipLen:
+				loaded, format = ipName+" saddr", formatIP
+			case base == nftPayloadNetwork && offset == family.daddr && length == ipLen:
+				loaded, format = ipName+" daddr", formatIP
+			case base == nftPayloadTransport && offset == 2 && length == 2:
+				loaded, format = cmp.Or(proto, "th")+" dport", formatPort
+			default:
+				loaded, format = fmt.Sprintf("@%d,%d,%d", base, offset*8, length*8), formatHex
+			}
+		case "meta":
+			switch be32(nftaMetaKey) {
+			case nftMetaIifname:
+				loaded, format = "iifname", formatIfname
+			case nftMetaOifname:
+				loaded, format = "oifname", formatIfname
+			case nftMetaL4proto:
+				loaded, format = "meta l4proto", formatProto
+			default:
+				loaded, format = fmt.Sprintf("meta %d", be32(nftaMetaKey)), formatHex
+			}
+		case "fib":
+			loaded, format = "fib daddr type", formatAddrType
+		case "bitwise":
+			// A mask of the address: a prefix, like ip daddr != 127.0.0.0/8
+			mask := value(nftaBitwiseMask)
+			ones, _ := net.IPMask(mask).Size()
+			format = func(b []byte) string { return fmt.Sprintf("%s/%d", net.IP(b), ones) }
+		case "cmp":
+			v := value(nftaCmpData)
+			// "meta l4proto tcp th dport 80" is "tcp dport 80"
+			if loaded == "meta l4proto" && be32(nftaCmpOp) == nftCmpEq {
+				proto = formatProto(v)
+				continue
+			}
+			op := ""
+			if be32(nftaCmpOp) == nftCmpNeq {
+				op = "!= "
+			}
+			if format == nil {
+				format = formatHex
+			}
+			words = append(words, loaded+" "+op+format(v))
+		case "immediate":
+			immediates[be32(nftaImmediateDreg)] = value(nftaImmediateData)
+		case "nat":
+			addr, port := immediates[be32(nftaNatRegAddrMin)], immediates[be32(nftaNatRegProtoMin)]
+			to := formatIP(addr)
+			if len(port) == 2 {
+				to = net.JoinHostPort(to, formatPort(port))
+			}
+			kind := "snat"
+			if be32(nftaNatType) == nftNatDnat {
+				kind = "dnat"
+			}
+			words = append(words, kind+" to "+to)
+		case "masq":
+			words = append(words, "masquerade")
+		default:
+			words = append(words, name)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// nlAttrList returns the values of a list of attributes in their order, like the expressions of
+// a rule, which parseNlAttrs would fold into one.
+func nlAttrList(b []byte) [][]byte {
+	var list [][]byte
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(b[0:]))
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		list = append(list, b[syscall.SizeofRtAttr:length])
+		b = b[min(len(b), (length+syscall.NLMSG_ALIGNTO-1)&^(syscall.NLMSG_ALIGNTO-1)):]
+	}
+	return list
+}
+
+// The formats of the values a rule compares
+func formatIP(b []byte) string     { return net.IP(b).String() }
+func formatPort(b []byte) string   { return strconv.Itoa(int(binary.BigEndian.Uint16(b))) }
+func formatIfname(b []byte) string { return strconv.Quote(strings.TrimRight(string(b), "\x00")) }
+func formatHex(b []byte) string    { return fmt.Sprintf("0x%x", b) }
+
+func formatProto(b []byte) string {
+	switch {
+	case len(b) == 1 && b[0] == syscall.IPPROTO_TCP:
+		return "tcp"
+	case len(b) == 1 && b[0] == syscall.IPPROTO_UDP:
+		return "udp"
+	}
+	return formatHex(b)
+}
+
+// formatAddrType prints an address type of fib, which is in our byte order.
+func formatAddrType(b []byte) string {
+	if len(b) == 4 && binary.NativeEndian.Uint32(b) == syscall.RTN_LOCAL {
+		return "local"
+	}
+	return formatHex(b)
+}
@@ -0,0 +1,374 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Network interfaces, addresses and routes are configured over netlink, a socket to the kernel:
+// `ip link add`, `ip addr add` and `ip route add` only send netlink messages. We send them
+// ourselves, the rootfs of a container usually has no `ip`, and the host needn't have one either.
+//
+// A message is a header (nlmsghdr: length, type, flags, sequence number) followed by a fixed struct
+// for the type, e.g. ifinfomsg for RTM_NEWLINK, and then attributes: type-length-value records,
+// each padded to 4 bytes, which may nest other attributes. The kernel answers every request that
+// has NLM_F_ACK with an NLMSG_ERROR message, whose error code 0 means success.
+
+// Attributes the syscall package lacks, from <linux/if_link.h> and <linux/veth.h>
+const (
+	iflaInfoKind = 1 // IFLA_INFO_KIND, nested in IFLA_LINKINFO: "bridge", "veth", ...
+	iflaInfoData = 2 // IFLA_INFO_DATA, nested in IFLA_LINKINFO: settings of that kind
+	vethInfoPeer = 1 // VETH_INFO_PEER, nested in IFLA_INFO_DATA: the other end of a veth pair
+
+	iflaNetNsFd = 28 // IFLA_NET_NS_FD: like IFLA_NET_NS_PID, but a file descriptor of the namespace
+
+	iflaMacvlanMode   = 1 // IFLA_MACVLAN_MODE, nested in IFLA_INFO_DATA
+	macvlanModeBridge = 4 // MACVLAN_MODE_BRIDGE: the macvlans of a parent reach each other
+)
+
+// netlinkConn is a netlink socket: NETLINK_ROUTE for interfaces, addresses and routes,
+// NETLINK_NETFILTER for the firewall (see nftables.go). It talks to the network namespace of
+// the thread that opened it.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+// openNetlink opens a netlinkConn for protocol. Close it when done.
+func openNetlink(protocol int) (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("open netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind netlink socket: %w", err)
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends a message of type typ, made of the parts after the header, and waits for the
+// kernel's answer. flags are added to NLM_F_REQUEST|NLM_F_ACK.
+func (c *netlinkConn) request(typ, flags uint16, parts ...[]byte) error {
+	msg := c.message(typ, syscall.NLM_F_ACK|flags, parts...)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	return c.awaitAcks(c.seq, 1)
+}
+
+// message encodes a message with the next sequence number. flags are added to NLM_F_REQUEST.
+func (c *netlinkConn) message(typ, flags uint16, parts ...[]byte) []byte {
+	c.seq++
+	msg := make([]byte, syscall.SizeofNlMsghdr)
+	for _, part := range parts {
+		msg = append(msg, part...)
+	}
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(msg[8:], c.seq)
+	return msg
+}
+
+// awaitAcks waits for the answers to the n messages sent with the sequence numbers from first on,
+// and returns the first error among them.
+func (c *netlinkConn) awaitAcks(first uint32, n int) error {
+	var firstErr error
+	end := first + uint32(n)
+	buf := make([]byte, 1<<16)
+	for n > 0 {
+		got, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:got])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq < first || m.Header.Seq >= end || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			n--
+			if len(m.Data) < syscall.SizeofNlMsgerr {
+				return errors.New("short netlink error message")
+			}
+			// The error is negative, like the return value of a syscall in the kernel
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 && firstErr == nil {
+				firstErr = syscall.Errno(errno)
+			}
+		}
+	}
+	return firstErr
+}
+
+// dump sends a request for a list, like all the rules of a table, and returns the messages of
+// the answer, which can take several reads: the kernel sends them until NLMSG_DONE.
+func (c *netlinkConn) dump(typ uint16, parts ...[]byte) ([]syscall.NetlinkMessage, error) {
+	msg := c.message(typ, syscall.NLM_F_DUMP, parts...)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	var result []syscall.NetlinkMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return result, nil
+			case syscall.NLMSG_ERROR:
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+			default:
+				result = append(result, m)
+			}
+		}
+	}
+}
+
+// nlAttr encodes a netlink attribute, with data as its value: bytes, or more attributes.
+func nlAttr(typ uint16, data ...[]byte) []byte {
+	attr := make([]byte, syscall.SizeofRtAttr)
+	for _, d := range data {
+		attr = append(attr, d...)
+	}
+	binary.NativeEndian.PutUint16(attr[0:], uint16(len(attr)))
+	binary.NativeEndian.PutUint16(attr[2:], typ)
+	// The length excludes the padding, the next attribute starts after it
+	for len(attr)%syscall.NLMSG_ALIGNTO != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// nlNested marks an attribute that holds more attributes. nftables wants it, the older
+// parts of the kernel don't care.
+const nlNested = 0x8000
+
+// parseNlAttrs decodes attributes into a map from type to value. A type that appears more than
+// once keeps its last value.
+func parseNlAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(b[0:]))
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs[binary.NativeEndian.Uint16(b[2:])&^nlNested] = b[syscall.SizeofRtAttr:length]
+		b = b[min(len(b), (length+syscall.NLMSG_ALIGNTO-1)&^(syscall.NLMSG_ALIGNTO-1)):]
+	}
+	return attrs
+}
+
+// nlString is the value of a string attribute, which the kernel wants NUL-terminated.
+func nlString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// nlUint32 is the value of a 32-bit attribute.
+func nlUint32(v uint32) []byte {
+	return binary.NativeEndian.AppendUint32(nil, v)
+}
+
+// ifInfomsg is the struct of the link messages, for the interface with index (0 for a new one).
+// The flags in change are set to their value in flags, the others stay alone.
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(index), Flags: flags, Change: change}
+	return (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+}
+
+// createBridge creates a bridge, a virtual switch: the interfaces attached to it are like cables
+// plugged into it. It is fine if it exists already.
+func (c *netlinkConn) createBridge(name string) error {
+	err := c.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		ifInfomsg(0, 0, 0),
+		nlAttr(syscall.IFLA_IFNAME, nlString(name)),
+		nlAttr(syscall.IFLA_LINKINFO, nlAttr(iflaInfoKind, nlString("bridge"))))
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("create bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// createVeth creates a veth pair, two interfaces connected like the ends of a cable: name here,
+// and peer in the network namespace netns, netnsPid or netnsFd. The peer is created there right
+// away, so it can have a name that is taken here, like eth0.
+func (c *netlinkConn) createVeth(name, peer string, netns []byte) error {
+	err := c.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		ifInfomsg(0, 0, 0),
+		nlAttr(syscall.IFLA_IFNAME, nlString(name)),
+		nlAttr(syscall.IFLA_LINKINFO,
+			nlAttr(iflaInfoKind, nlString("veth")),
+			nlAttr(iflaInfoData,
+				// The peer is described like a link of its own: the struct, then its attributes
+				nlAttr(vethInfoPeer,
+					ifInfomsg(0, 0, 0),
+					nlAttr(syscall.IFLA_IFNAME, nlString(peer)),
+					netns))))
+	if err != nil {
+		return fmt.Errorf("create veth pair %s: %w", name, err)
+	}
+	return nil
+}
+
+// netnsPid is the attribute for the network namespace of process pid.
+func netnsPid(pid int) []byte {
+	return nlAttr(syscall.IFLA_NET_NS_PID, nlUint32(uint32(pid)))
+}
+
+// netnsFd is the attribute for the network namespace ns, an open /proc/PID/ns/net or a file
+// `ip netns add` bind-mounted it on, which has no process in it to name.
+func netnsFd(ns *os.File) []byte {
+	return nlAttr(iflaNetNsFd, nlUint32(uint32(ns.Fd())))
+}
+
+// createMacvlan creates a macvlan interface on parent, with its own MAC address mac: a second
+// network card on the same cable. Like createVeth it creates it as name in the network namespace
+// of process pid right away.
+func (c *netlinkConn) createMacvlan(name, parent string, mac net.HardwareAddr, pid int) error {
+	link, err := net.InterfaceByName(parent)
+	if err != nil {
+		return err
+	}
+	err = c.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		ifInfomsg(0, 0, 0),
+		nlAttr(syscall.IFLA_IFNAME, nlString(name)),
+		nlAttr(syscall.IFLA_LINK, nlUint32(uint32(link.Index))),
+		nlAttr(syscall.IFLA_ADDRESS, mac),
+		netnsPid(pid),
+		nlAttr(syscall.IFLA_LINKINFO,
+			nlAttr(iflaInfoKind, nlString("macvlan")),
+			nlAttr(iflaInfoData, nlAttr(iflaMacvlanMode, nlUint32(macvlanModeBridge)))))
+	if err != nil {
+		return fmt.Errorf("create macvlan on %s: %w", parent, err)
+	}
+	return nil
+}
+
+// setLinkUp brings interface name up, like `ip link set NAME up`.
+func (c *netlinkConn) setLinkUp(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if err := c.request(syscall.RTM_NEWLINK, 0, ifInfomsg(link.Index, syscall.IFF_UP, syscall.IFF_UP)); err != nil {
+		return fmt.Errorf("set %s up: %w", name, err)
+	}
+	return nil
+}
+
+// setLinkMaster attaches interface name to a bridge, like `ip link set NAME master BRIDGE`.
+func (c *netlinkConn) setLinkMaster(name, bridge string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	master, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return err
+	}
+	if err := c.request(syscall.RTM_NEWLINK, 0, ifInfomsg(link.Index, 0, 0), nlAttr(syscall.IFLA_MASTER, nlUint32(uint32(master.Index)))); err != nil {
+		return fmt.Errorf("attach %s to %s: %w", name, bridge, err)
+	}
+	return nil
+}
+
+// addAddress gives interface name an address, like `ip addr add 172.29.0.2/16 dev NAME`. The
+// prefix length also adds the route to the subnet: everything in it is reachable right there.
+func (c *netlinkConn) addAddress(name string, addr *net.IPNet) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	ones, _ := addr.Mask.Size()
+	family, ip := ipFamily(addr.IP)
+	msg := syscall.IfAddrmsg{Family: family, Prefixlen: uint8(ones), Index: uint32(link.Index)}
+	if family == syscall.AF_INET6 {
+		// An IPv6 address is first "tentative", unusable for a second or two, until duplicate
+		// address detection asked the link whether someone else has it. The addresses of our
+		// networks are handed out by us, like `ip addr add ... nodad`.
+		msg.Flags = syscall.IFA_F_NODAD
+	}
+	err = c.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		(*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:],
+		// LOCAL is the address of the interface, ADDRESS the other end of a point-to-point link,
+		// on anything else the same
+		nlAttr(syscall.IFA_LOCAL, ip),
+		nlAttr(syscall.IFA_ADDRESS, ip))
+	if err != nil {
+		return fmt.Errorf("add address %s to %s: %w", addr, name, err)
+	}
+	return nil
+}
+
+// addDefaultRoute sends everything without a more specific route to gateway, through interface
+// name: `ip route add default via GATEWAY dev NAME`, or `ip -6 route ...` for an IPv6 gateway.
+func (c *netlinkConn) addDefaultRoute(gateway net.IP, name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	family, gw := ipFamily(gateway)
+	// "default" is the route to 0.0.0.0/0 (::/0), which is why it has no destination attribute
+	msg := syscall.RtMsg{
+		Family:   family,
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	err = c.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		(*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:],
+		nlAttr(syscall.RTA_GATEWAY, gw),
+		nlAttr(syscall.RTA_OIF, nlUint32(uint32(link.Index))))
+	if err != nil {
+		return fmt.Errorf("add default route via %s: %w", gateway, err)
+	}
+	return nil
+}
+
+// ipFamily returns the address family of ip, and ip in the length the kernel wants for it: 4
+// bytes for IPv4, 16 for IPv6.
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+// deleteLink deletes interface name, with a veth pair both ends. It is fine if it doesn't exist.
+func (c *netlinkConn) deleteLink(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		// The net package doesn't say why, but a missing interface is the one reason we expect
+		return nil
+	}
+	if err := c.request(syscall.RTM_DELLINK, 0, ifInfomsg(link.Index, 0, 0)); err != nil && !errors.Is(err, syscall.ENODEV) {
+		return fmt.Errorf("delete %s: %w", name, err)
+	}
+	return nil
+}
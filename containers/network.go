@@ -0,0 +1,278 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// A new network namespace starts empty: no interfaces but a loopback device, no routes, no way
+// out. Docker's default "bridge" network connects it like a computer plugged into a switch:
+//
+//	host                                    container
+//	mycontainer0 (bridge) ── vethXXXXXXX ═══ eth0
+//
+// The bridge is a switch in the kernel, created once for all containers. Every container gets a
+// veth pair, a virtual cable: one end stays on the host, attached to the bridge, the other end
+// is the container's eth0. Everything attached to the bridge can reach everything else on it.
+//
+// The bridge has an address in the subnet too, the first one: to the host it is an interface
+// like eth0, with a route to the subnet. The containers get the addresses after it (see ipam.go),
+// and the bridge's as their default route, so the host is their way out, and it masquerades their
+// packets to everywhere else (see nftables.go).
+//
+// --network host is the other end of the scale: no network namespace at all, the container
+// shares the host's interfaces, addresses, routes, firewall and ports, like every process on the
+// host. It costs nothing, no NAT, no proxy, no bridge in between, and a server in it is reachable
+// on the host's port right away. But it isn't isolated either: it can bind any port of the host,
+// talk to every service on the host's 127.0.0.1 and, as root with CAP_NET_ADMIN, change the
+// host's network. Docker gives --net=host the same tradeoff.
+//
+// --network container:ID is the middle ground, a Kubernetes pod: the container joins the network
+// namespace of another one instead of getting its own. Both have the same interfaces and
+// address, and reach each other on localhost, like a web server and the sidecar in front of it.
+// Kubernetes starts a "pause" container first in each pod, which does nothing but hold the
+// namespace, and joins every container of the pod to it.
+
+// The --network modes
+const (
+	networkBridge    = "bridge"
+	networkMacvlan   = "macvlan"
+	networkHost      = "host"
+	networkContainer = "container"
+	networkNone      = "none"
+)
+
+// bridgeName is the bridge all containers are attached to, our docker0
+const bridgeName = "mycontainer0"
+
+// vethName is the host end of the veth pair of container id. Interface names have 15 characters
+// at most (IFNAMSIZ, with the NUL), so it takes a short ID like Docker's "veth1a2b3c4".
+func vethName(id string) string {
+	return "veth" + id[:7]
+}
+
+// setupNetwork connects the container whose init is process pid to the bridge. The monitor does
+// this, like setupCgroups, while the child still waits for its config.
+//
+// Hardly anything has to clean up after it: the container's eth0 is destroyed with its network
+// namespace, when the last process in it exits, and the host end of a veth pair goes with the
+// other end. Only the rules of the published ports have to go, the monitor removes them.
+func setupNetwork(cfg *containerConfig, pid int) error {
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	if err := nl.createBridge(bridgeName); err != nil {
+		return err
+	}
+	if err := nl.setLinkUp(bridgeName); err != nil {
+		return err
+	}
+	subnet, err := parseSubnet(cfg.Subnet)
+	if err != nil {
+		return err
+	}
+	if err := bridgeAddress(nl, cfg.ID, subnet, &cfg.IPAddress, &cfg.Gateway); err != nil {
+		return err
+	}
+	if err := enableIPForwarding(); err != nil {
+		return fmt.Errorf("enable IP forwarding: %w", err)
+	}
+	if cfg.IPv6 {
+		subnet6, err := parseSubnet6(cfg.Subnet6)
+		if err != nil {
+			return err
+		}
+		if err := bridgeAddress(nl, cfg.ID, subnet6, &cfg.IPAddress6, &cfg.Gateway6); err != nil {
+			return err
+		}
+		if err := enableIPv6Forwarding(); err != nil {
+			return fmt.Errorf("enable IPv6 forwarding: %w", err)
+		}
+	}
+
+	veth := vethName(cfg.ID)
+	// After a restart the old pair may still be there: the kernel destroys a network namespace
+	// in the background, a moment after its last process exited
+	if err := nl.deleteLink(veth); err != nil {
+		return err
+	}
+	if err := nl.createVeth(veth, "eth0", netnsPid(pid)); err != nil {
+		return err
+	}
+	if err := nl.setLinkMaster(veth, bridgeName); err != nil {
+		return err
+	}
+	if err := nl.setLinkUp(veth); err != nil {
+		return err
+	}
+	if err := limitBandwidth(nl, cfg, veth, pid); err != nil {
+		return err
+	}
+	slog.Debug("connected the container to the bridge", "bridge", bridgeName, "veth", veth,
+		"address", cfg.IPAddress, "gateway", cfg.Gateway, "address6", cfg.IPAddress6)
+	for _, address := range []string{cfg.IPAddress, cfg.IPAddress6} {
+		if len(cfg.Ports) == 0 || address == "" {
+			continue
+		}
+		ip, _, _ := net.ParseCIDR(address)
+		if err := addPortRules(cfg.ID, ip, cfg.Ports); err != nil {
+			return fmt.Errorf("add port rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// bridgeAddress gives the bridge its address in subnet, the gateway, and container id an address
+// there, unless it kept the one of its last start. address and gateway are cfg.IPAddress and
+// cfg.Gateway, or their IPv6 twins.
+func bridgeAddress(nl *netlinkConn, id string, subnet *net.IPNet, address, gateway *string) error {
+	gw := &net.IPNet{IP: subnetGateway(subnet), Mask: subnet.Mask}
+	// Containers with different --subnet share the bridge, it gets the gateway of each
+	if err := nl.addAddress(bridgeName, gw); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	if *address != "" {
+		return nil
+	}
+	ip, err := allocateIP(id, subnet)
+	if err != nil {
+		return err
+	}
+	*address = (&net.IPNet{IP: ip, Mask: subnet.Mask}).String()
+	*gateway = gw.IP.String()
+	// The rule lives as long as the address, see nftables.go
+	if err := addMasquerade(id, ip, bridgeName); err != nil {
+		return fmt.Errorf("add masquerade rule: %w", err)
+	}
+	return nil
+}
+
+// openContainerNetwork opens the network namespace of container cfg.NetworkContainer, for
+// --network container:ID, and takes over its resolv.conf and hosts: they describe that network.
+// The open file keeps the namespace, even if the container exits before we joined it.
+func openContainerNetwork(cfg *containerConfig) (*os.File, error) {
+	state, err := readState(cfg.NetworkContainer)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", state.Pid))
+	// Still the same process means the namespace is the container's
+	if err != nil || !state.alive() {
+		if ns != nil {
+			ns.Close()
+		}
+		return nil, fmt.Errorf("can't join the network of container %s: it is not running", shortID(state.ID))
+	}
+	if other, err := readConfig(state.ID); err == nil {
+		cfg.ResolvConf, cfg.HostsFile = other.ResolvConf, other.HostsFile
+	}
+	return ns, nil
+}
+
+// joinNetworkNamespace moves the calling thread into network namespace ns. Namespaces belong to a
+// thread: lock it first, and never unlock it, the Go runtime throws it away afterwards.
+func joinNetworkNamespace(ns *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("join network namespace: %w", errno)
+	}
+	return nil
+}
+
+// inNetworkNamespace runs fn in network namespace ns, on a thread of its own that has joined it:
+// the sockets fn opens, netlink ones too, stay in ns, and the rest of the program doesn't notice.
+func inNetworkNamespace(ns *os.File, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := joinNetworkNamespace(ns); err != nil {
+			done <- err
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
+
+// releaseNetwork frees what container id got from setupNetwork that outlives it, its address and
+// masquerade rule, when the container is removed.
+func releaseNetwork(id string) {
+	if err := releaseIP(id); err != nil {
+		slog.Warn("could not release the address", "id", shortID(id), "err", err)
+	}
+	// Rootless containers have no rules, and couldn't even list them without CAP_NET_ADMIN
+	if os.Geteuid() != 0 {
+		return
+	}
+	if err := removeRules(id); err != nil {
+		slog.Warn("could not remove the nftables rules", "id", shortID(id), "err", err)
+	}
+}
+
+// setupLoopback runs in the child, in every container: even the loopback device starts out down,
+// and without it nothing gets through to 127.0.0.1, not even from inside. A server that listens
+// on localhost, or a program talking to its own database, would get "network is unreachable".
+func setupLoopback() error {
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	// lo brings its addresses, 127.0.0.1/8 and ::1, and their routes up with it
+	if err := nl.setLinkUp("lo"); err != nil {
+		return fmt.Errorf("set lo up: %w", err)
+	}
+	return nil
+}
+
+// configureNetwork runs in the child: eth0 gets its address and goes up, and the default route
+// leads to the bridge, or the gateway of a macvlan network. With --ipv6 it gets both.
+func configureNetwork(cfg *containerConfig) error {
+	ip, subnet, err := net.ParseCIDR(cfg.IPAddress)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", cfg.IPAddress, err)
+	}
+	// A macvlan network may have no gateway, it is the only network the container reaches then
+	if err := configureInterface("eth0", &net.IPNet{IP: ip, Mask: subnet.Mask}, net.ParseIP(cfg.Gateway)); err != nil {
+		return err
+	}
+	if cfg.IPAddress6 == "" {
+		return nil
+	}
+	ip, subnet, err = net.ParseCIDR(cfg.IPAddress6)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", cfg.IPAddress6, err)
+	}
+	return configureInterface("eth0", &net.IPNet{IP: ip, Mask: subnet.Mask}, net.ParseIP(cfg.Gateway6))
+}
+
+// configureInterface gives interface name its address, brings it up and, unless gateway is nil,
+// adds the default route to it, in the network namespace of the calling thread.
+func configureInterface(name string, addr *net.IPNet, gateway net.IP) error {
+	slog.Debug("configure interface", "name", name, "address", addr, "gateway", gateway)
+	nl, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	if err := nl.addAddress(name, addr); err != nil {
+		return err
+	}
+	if err := nl.setLinkUp(name); err != nil {
+		return err
+	}
+	if gateway == nil {
+		return nil
+	}
+	// The route to the gateway came with the address, now it can be the way to everywhere else
+	return nl.addDefaultRoute(gateway, name)
+}
@@ -0,0 +1,451 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// The bridge's subnet is private: a router on the internet drops packets from 172.29.0.2, and
+// couldn't send the answers back anyway. So the host has to do what a home router does for the
+// computers behind it, network address translation. Packets from a container that leave through
+// another interface get the host's address as their source, and the kernel remembers the
+// connection (conntrack) to put the container's address back into the answers. iptables calls
+// it MASQUERADE, Docker adds one rule for docker0's subnet:
+//
+//	iptables -t nat -A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+//
+// We add a rule like it per container, to the nftables table "mycontainer", which is the same
+// as running
+//
+//	nft add table ip mycontainer
+//	nft add chain ip mycontainer postrouting '{ type nat hook postrouting priority srcnat; }'
+//	nft add rule ip mycontainer postrouting ip saddr 172.29.0.2 oifname != mycontainer0 masquerade comment '"<id>"'
+//
+// There is no nft (or iptables) binary to run though: like `ip`, it is only a front end for
+// netlink messages, which we send ourselves. `nft list table ip mycontainer` shows the result.
+// The rule goes away with the container, found by its comment. iptables rules end up in
+// nftables too on current distributions (iptables-nft), the kernel runs both tables.
+//
+// And the host has to be a router in the first place: Linux only forwards packets between its
+// interfaces with net.ipv4.ip_forward=1.
+//
+// Published ports (-p 8080:80) are the same trick the other way around, destination NAT: a
+// packet for port 8080 of the host gets the container's address and port 80 as its destination,
+// before the routing decision sends it on to the bridge. Docker's rules, one chain for packets
+// from outside, one for those the host sends itself, are ours too:
+//
+//	nft add chain ip mycontainer prerouting '{ type nat hook prerouting priority dstnat; }'
+//	nft add chain ip mycontainer output '{ type nat hook output priority dstnat; }'
+//	nft add rule ip mycontainer prerouting fib daddr type local iifname != mycontainer0 tcp dport 8080 dnat to 172.29.0.2:80
+//	nft add rule ip mycontainer output ip daddr != 127.0.0.0/8 fib daddr type local tcp dport 8080 dnat to 172.29.0.2:80
+//
+// "fib daddr type local" is any address of the host. Not 127.0.0.1 though: the kernel won't route
+// a packet from 127.0.0.1 out of another interface than lo, so connections to localhost and those
+// of other containers (iifname mycontainer0) go to the proxy in ports.go instead.
+//
+// IPv6 (--ipv6) has the same rules, in a table of its own: nftables keeps IPv4 and IPv6 apart,
+// like iptables and ip6tables, and `nft list table ip6 mycontainer` shows it. NAT is frowned upon
+// with IPv6, there are enough addresses for every container to have a public one. But then the
+// network has to route the container's prefix to the host, or the host answers the neighbor
+// discovery of the LAN for each container's address (proxy NDP), and a unique local address like
+// our fd00:29::2 is never routed at all. Docker masquerades them too.
+
+// Our table and its chains
+const (
+	nftTable       = "mycontainer"
+	nftPostrouting = "postrouting"
+	nftPrerouting  = "prerouting"
+	nftOutput      = "output"
+)
+
+// From <linux/netfilter/nfnetlink.h> and <linux/netfilter/nf_tables.h>. Every nftables message
+// starts with an nfgenmsg, and the changes are sent in a batch, which the kernel applies all at once
+// or not at all.
+const (
+	nfnlSubsysNftables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+	nfprotoIPv4        = 2
+	nfprotoIPv6        = 10
+
+	nftMsgNewTable = 0
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+	nftMsgGetRule  = 7
+	nftMsgDelRule  = 8
+
+	nftaTableName      = 1
+	nftaChainTable     = 1
+	nftaChainName      = 3
+	nftaChainHook      = 4
+	nftaChainType      = 7
+	nftaHookHooknum    = 1
+	nftaHookPriority   = 2
+	nftaRuleTable      = 1
+	nftaRuleChain      = 2
+	nftaRuleHandle     = 3
+	nftaRuleExprs      = 4
+	nftaRuleUserdata   = 7
+	nftaListElem       = 1
+	nftaExprName       = 1
+	nftaExprData       = 2
+	nftaDataValue      = 1
+	nftaPayloadDreg    = 1
+	nftaPayloadBase    = 2
+	nftaPayloadOffset  = 3
+	nftaPayloadLen     = 4
+	nftaCmpSreg        = 1
+	nftaCmpOp          = 2
+	nftaCmpData        = 3
+	nftaMetaDreg       = 1
+	nftaMetaKey        = 2
+	nftaBitwiseSreg    = 1
+	nftaBitwiseDreg    = 2
+	nftaBitwiseLen     = 3
+	nftaBitwiseMask    = 4
+	nftaBitwiseXor     = 5
+	nftaFibDreg        = 1
+	nftaFibResult      = 2
+	nftaFibFlags       = 3
+	nftaImmediateDreg  = 1
+	nftaImmediateData  = 2
+	nftaNatType        = 1
+	nftaNatFamily      = 2
+	nftaNatRegAddrMin  = 3
+	nftaNatRegProtoMin = 5
+
+	nfInetPreRouting    = 0
+	nfInetLocalOut      = 3
+	nfInetPostRouting   = 4
+	nftReg1             = 1 // the registers expressions pass values in
+	nftReg2             = 2
+	nftPayloadNetwork   = 1 // the IP header
+	nftPayloadTransport = 2 // the TCP or UDP header
+	nftCmpEq            = 0
+	nftCmpNeq           = 1
+	nftMetaIifname      = 6
+	nftMetaOifname      = 7
+	nftMetaL4proto      = 16
+	nftFibResultAddr    = 3 // the address type, like RTN_LOCAL
+	nftFibDaddr         = 2
+	nftNatDnat          = 1
+	nftUdataRuleComment = 0 // nft's own format for comments, in the rule's user data
+
+	// The priorities of the chains, named like in nft: "dstnat" before the routing decision
+	// so it goes by the new destination, "srcnat" after the filter chains (0) let the packet
+	// through
+	nftPriorityDstnat = -100
+	nftPrioritySrcnat = 100
+)
+
+// nftRequest is one change in a batch, e.g. nftMsgNewRule with the rule's attributes.
+type nftRequest struct {
+	msg   uint16
+	flags uint16
+	attrs [][]byte
+}
+
+// nftFamily is one of our tables, ip or ip6 mycontainer. Their rules only differ in where they
+// find the addresses in the IP header.
+type nftFamily struct {
+	proto        byte
+	saddr, daddr uint32
+	addrLen      uint32
+}
+
+var (
+	nftIPv4 = nftFamily{nfprotoIPv4, 12, 16, net.IPv4len}
+	nftIPv6 = nftFamily{nfprotoIPv6, 8, 24, net.IPv6len}
+)
+
+// nftFamilyOf returns the table for ip, and ip in the length of its family.
+func nftFamilyOf(ip net.IP) (nftFamily, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return nftIPv4, ip4
+	}
+	return nftIPv6, ip.To16()
+}
+
+// nftMessage returns the type and nfgenmsg header of an nftables message about our table of
+// family.
+func nftMessage(family nftFamily, msg uint16) (uint16, []byte) {
+	return nfnlSubsysNftables<<8 | msg, []byte{family.proto, 0, 0, 0}
+}
+
+// nftBatch sends requests for the table of family wrapped in a batch.
+func (c *netlinkConn) nftBatch(family nftFamily, requests ...nftRequest) error {
+	// The batch header's res_id names the subsystem, big-endian
+	batch := c.message(nfnlMsgBatchBegin, 0, []byte{0, 0, 0, nfnlSubsysNftables})
+	first := c.seq + 1
+	for _, r := range requests {
+		typ, header := nftMessage(family, r.msg)
+		batch = append(batch, c.message(typ, syscall.NLM_F_ACK|r.flags, append([][]byte{header}, r.attrs...)...)...)
+	}
+	batch = append(batch, c.message(nfnlMsgBatchEnd, 0, []byte{0, 0, 0, nfnlSubsysNftables})...)
+	if err := syscall.Sendto(c.fd, batch, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	return c.awaitAcks(first, len(requests))
+}
+
+// nlBe32 is the value of a 32-bit attribute of nftables, which are all big-endian.
+func nlBe32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// nftExpr is one expression of a rule: its name and attributes.
+func nftExpr(name string, attrs ...[]byte) []byte {
+	expr := nlAttr(nftaExprName, nlString(name))
+	if len(attrs) > 0 {
+		expr = append(expr, nlAttr(nftaExprData|nlNested, attrs...)...)
+	}
+	return nlAttr(nftaListElem|nlNested, expr)
+}
+
+// nftCmp compares the first register to value.
+func nftCmp(op uint32, value []byte) []byte {
+	return nftExpr("cmp",
+		nlAttr(nftaCmpSreg, nlBe32(nftReg1)),
+		nlAttr(nftaCmpOp, nlBe32(op)),
+		nlAttr(nftaCmpData|nlNested, nlAttr(nftaDataValue, value)))
+}
+
+// nftLoad loads length bytes at offset of a packet header into the first register.
+func nftLoad(base, offset, length uint32) []byte {
+	return nftExpr("payload",
+		nlAttr(nftaPayloadDreg, nlBe32(nftReg1)),
+		nlAttr(nftaPayloadBase, nlBe32(base)),
+		nlAttr(nftaPayloadOffset, nlBe32(offset)),
+		nlAttr(nftaPayloadLen, nlBe32(length)))
+}
+
+// nftMeta loads something the kernel knows about the packet, like its interface, into the first
+// register.
+func nftMeta(key uint32) []byte {
+	return nftExpr("meta",
+		nlAttr(nftaMetaDreg, nlBe32(nftReg1)),
+		nlAttr(nftaMetaKey, nlBe32(key)))
+}
+
+// nftIfname is an interface name the way meta compares it, with the NUL padding of IFNAMSIZ.
+func nftIfname(name string) []byte {
+	b := make([]byte, syscall.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// nftChains are the requests for our table and chains. NLM_F_CREATE without NLM_F_EXCL: they're
+// there after the first container, creating them again changes nothing.
+func nftChains() []nftRequest {
+	chain := func(name string, hook uint32, priority int32) nftRequest {
+		return nftRequest{nftMsgNewChain, syscall.NLM_F_CREATE, [][]byte{
+			nlAttr(nftaChainTable, nlString(nftTable)),
+			nlAttr(nftaChainName, nlString(name)),
+			nlAttr(nftaChainHook|nlNested,
+				nlAttr(nftaHookHooknum, nlBe32(hook)),
+				nlAttr(nftaHookPriority, nlBe32(uint32(priority)))),
+			nlAttr(nftaChainType, nlString("nat"))}}
+	}
+	return []nftRequest{
+		{nftMsgNewTable, syscall.NLM_F_CREATE, [][]byte{nlAttr(nftaTableName, nlString(nftTable))}},
+		chain(nftPostrouting, nfInetPostRouting, nftPrioritySrcnat),
+		chain(nftPrerouting, nfInetPreRouting, nftPriorityDstnat),
+		chain(nftOutput, nfInetLocalOut, nftPriorityDstnat),
+	}
+}
+
+// nftRule is the request for a rule of container id at the end of chain.
+func nftRule(id, chain string, exprs ...[]byte) nftRequest {
+	comment := append([]byte{nftUdataRuleComment, byte(len(id) + 1)}, id+"\x00"...)
+	return nftRequest{nftMsgNewRule, syscall.NLM_F_CREATE | syscall.NLM_F_APPEND, [][]byte{
+		nlAttr(nftaRuleTable, nlString(nftTable)),
+		nlAttr(nftaRuleChain, nlString(chain)),
+		nlAttr(nftaRuleExprs|nlNested, exprs...),
+		nlAttr(nftaRuleUserdata, comment)}}
+}
+
+// addMasquerade adds the rule that translates the packets of container id, with address ip on
+// bridge.
+func addMasquerade(id string, ip net.IP, bridge string) error {
+	nl, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	family, addr := nftFamilyOf(ip)
+	return nl.nftBatch(family, append(nftChains(), nftRule(id, nftPostrouting,
+		// ip saddr <ip>: the 4 bytes at offset 12 of the IP header, or the 16 at offset 8 of IPv6
+		nftLoad(nftPayloadNetwork, family.saddr, family.addrLen),
+		nftCmp(nftCmpEq, addr),
+		// oifname != mycontainer0: traffic between containers keeps its addresses
+		nftMeta(nftMetaOifname),
+		nftCmp(nftCmpNeq, nftIfname(bridge)),
+		nftExpr("masq")))...)
+}
+
+// addPortRules adds the DNAT rules for the ports container id with address ip publishes. They
+// only exist while it runs, the monitor removes them with removeRules when it exits. With an
+// IPv6 address they're the rules for the host's IPv6 addresses.
+func addPortRules(id string, ip net.IP, ports []portMapping) error {
+	nl, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	family, addr := nftFamilyOf(ip)
+	requests := nftChains()
+	for _, p := range ports {
+		hostIP := net.ParseIP(p.HostIP)
+		// Only the proxy can reach a container from 127.0.0.1. A host address is an IPv4 one, the
+		// host's IPv6 addresses only have the ports for all of them.
+		if hostIP != nil && (hostIP.IsLoopback() || family == nftIPv6) {
+			continue
+		}
+		// ip daddr <host IP>, or fib daddr type local: any address of the host
+		daddr := [][]byte{nftLoad(nftPayloadNetwork, family.daddr, family.addrLen), nftCmp(nftCmpEq, hostIP.To4())}
+		if hostIP == nil || hostIP.IsUnspecified() {
+			daddr = [][]byte{
+				nftExpr("fib",
+					nlAttr(nftaFibDreg, nlBe32(nftReg1)),
+					nlAttr(nftaFibResult, nlBe32(nftFibResultAddr)),
+					nlAttr(nftaFibFlags, nlBe32(nftFibDaddr))),
+				// The address type is in our byte order, not the network's
+				nftCmp(nftCmpEq, nlUint32(syscall.RTN_LOCAL)),
+			}
+		}
+		// tcp dport <port>: the 2 bytes at offset 2 of the TCP (and UDP) header
+		proto := byte(syscall.IPPROTO_TCP)
+		if p.Protocol == "udp" {
+			proto = syscall.IPPROTO_UDP
+		}
+		dport := [][]byte{
+			nftMeta(nftMetaL4proto),
+			nftCmp(nftCmpEq, []byte{proto}),
+			nftLoad(nftPayloadTransport, 2, 2),
+			nftCmp(nftCmpEq, binary.BigEndian.AppendUint16(nil, p.HostPort)),
+		}
+		// dnat to <ip>:<port>: the address goes into the first register, the port into the second
+		dnat := [][]byte{
+			nftExpr("immediate",
+				nlAttr(nftaImmediateDreg, nlBe32(nftReg1)),
+				nlAttr(nftaImmediateData|nlNested, nlAttr(nftaDataValue, addr))),
+			nftExpr("immediate",
+				nlAttr(nftaImmediateDreg, nlBe32(nftReg2)),
+				nlAttr(nftaImmediateData|nlNested, nlAttr(nftaDataValue, binary.BigEndian.AppendUint16(nil, p.ContainerPort)))),
+			nftExpr("nat",
+				nlAttr(nftaNatType, nlBe32(nftNatDnat)),
+				nlAttr(nftaNatFamily, nlBe32(uint32(family.proto))),
+				nlAttr(nftaNatRegAddrMin, nlBe32(nftReg1)),
+				nlAttr(nftaNatRegProtoMin, nlBe32(nftReg2))),
+		}
+
+		// iifname != mycontainer0
+		fromOutside := [][]byte{nftMeta(nftMetaIifname), nftCmp(nftCmpNeq, nftIfname(bridgeName))}
+		// ip daddr != 127.0.0.0/8: the address ANDed with 255.0.0.0 isn't 127.0.0.0
+		notLoopback := [][]byte{
+			nftLoad(nftPayloadNetwork, 16, 4),
+			nftExpr("bitwise",
+				nlAttr(nftaBitwiseSreg, nlBe32(nftReg1)),
+				nlAttr(nftaBitwiseDreg, nlBe32(nftReg1)),
+				nlAttr(nftaBitwiseLen, nlBe32(4)),
+				nlAttr(nftaBitwiseMask|nlNested, nlAttr(nftaDataValue, []byte{255, 0, 0, 0})),
+				nlAttr(nftaBitwiseXor|nlNested, nlAttr(nftaDataValue, []byte{0, 0, 0, 0}))),
+			nftCmp(nftCmpNeq, []byte{127, 0, 0, 0}),
+		}
+		// ip6 daddr != ::1, IPv6 has only the one
+		if family == nftIPv6 {
+			notLoopback = [][]byte{nftLoad(nftPayloadNetwork, family.daddr, family.addrLen), nftCmp(nftCmpNeq, net.IPv6loopback)}
+		}
+		requests = append(requests,
+			nftRule(id, nftPrerouting, slices.Concat(daddr, fromOutside, dport, dnat)...),
+			nftRule(id, nftOutput, slices.Concat(notLoopback, daddr, dport, dnat)...))
+	}
+	return nl.nftBatch(family, requests...)
+}
+
+// removeRules deletes the rules of container id in chains, or in all of our chains without any,
+// in both tables. There is nothing to delete if it never had a network, or a table doesn't exist.
+func removeRules(id string, chains ...string) error {
+	nl, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+
+	for _, family := range []nftFamily{nftIPv4, nftIPv6} {
+		if err := nl.removeRules(family, id, chains); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRules deletes the rules of container id in chains of the table of family.
+func (c *netlinkConn) removeRules(family nftFamily, id string, chains []string) error {
+	typ, header := nftMessage(family, nftMsgGetRule)
+	rules, err := c.dump(typ, header, nlAttr(nftaRuleTable, nlString(nftTable)))
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var deletes []nftRequest
+	for _, rule := range rules {
+		if len(rule.Data) < 4 {
+			continue
+		}
+		attrs := parseNlAttrs(rule.Data[4:])
+		if nftRuleComment(attrs[nftaRuleUserdata]) != id {
+			continue
+		}
+		if chain := strings.TrimRight(string(attrs[nftaRuleChain]), "\x00"); len(chains) > 0 && !slices.Contains(chains, chain) {
+			continue
+		}
+		deletes = append(deletes, nftRequest{nftMsgDelRule, 0, [][]byte{
+			nlAttr(nftaRuleTable, nlString(nftTable)),
+			nlAttr(nftaRuleChain, attrs[nftaRuleChain]),
+			nlAttr(nftaRuleHandle, attrs[nftaRuleHandle])}})
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+	return c.nftBatch(family, deletes...)
+}
+
+// nftRuleComment returns the comment in a rule's user data, which is a list of type, length and
+// value, like netlink attributes with one byte each for the type and length.
+func nftRuleComment(udata []byte) string {
+	for len(udata) >= 2 {
+		typ, length := udata[0], int(udata[1])
+		if 2+length > len(udata) {
+			break
+		}
+		if typ == nftUdataRuleComment {
+			return strings.TrimRight(string(udata[2:2+length]), "\x00")
+		}
+		udata = udata[2+length:]
+	}
+	return ""
+}
+
+// enableIPForwarding makes the host route packets between its interfaces, for all of them: the
+// setting is per network namespace. Docker does the same at startup.
+func enableIPForwarding() error {
+	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0)
+}
+
+// enableIPv6Forwarding is the same for IPv6. An interface of a router ignores router
+// advertisements (unless its accept_ra is 2): a host that configures its own IPv6 address and
+// route from them keeps them only until they expire. Docker's --ipv6 has the same catch.
+func enableIPv6Forwarding() error {
+	return os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0)
+}
@@ -0,0 +1,493 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+)
+
+// `observe CONTAINER` watches a container from the kernel, with eBPF: which programs it runs, as
+// they start, and which system calls it makes most.
+//
+//	exec  4711  /bin/sh
+//	exec  4712  /usr/bin/wget
+//
+//	SYSCALL      LAST 2s   TOTAL
+//	read         1204      1204
+//	write        1198      1198
+//	poll         37        37
+//
+// --trace (see trace.go) stops a process at every system call. eBPF doesn't stop anything: the
+// kernel runs a small program of ours at a tracepoint, a place in its code that is there to be
+// watched, and the program counts into a map that we read from here. Two tracepoints:
+//
+//	raw_syscalls/sys_enter      every system call of every process, with its number
+//	sched/sched_process_exec    every execve() that succeeded, with the file it ran
+//
+// They fire for the whole host, so the programs first check that the process is in the
+// container: on cgroups v2 by the ID of the container's cgroup (bpf_get_current_ancestor_cgroup_id,
+// which also counts the cgroups below it), on v1, where the programs only see the v2 cgroup,
+// by the container's PID namespace (bpf_get_ns_current_pid_tgid).
+//
+// Like the device filter of v2 (see devices.go) the programs are assembled by hand and loaded
+// with bpf(2): the demo builds with `go build *.go`, without the eBPF library or the C compiler
+// and clang's BPF target a real tool would use. Loading tracing programs takes root
+// (CAP_BPF and CAP_PERFMON), and Linux 5.8 or later. The IDs of the tracepoints are in tracefs,
+// which observe mounts on /sys/kernel/tracing when nobody has.
+//
+// The counts are per system call number over the whole container. A syscall the table of
+// sysnum.go doesn't know shows as its number.
+
+// The tracepoints of observe
+const (
+	tracepointSysEnter = "raw_syscalls/sys_enter"
+	tracepointExec     = "sched/sched_process_exec"
+)
+
+// observeExec is an exec the program pushed into its queue: the host PID and the start of the
+// path, NUL-terminated
+type observeExec struct {
+	Pid      uint32
+	_        uint32
+	Filename [64]byte
+}
+
+// observe implements `observe [OPTIONS] CONTAINER`.
+func observe(args []string) error {
+	fs := flag.NewFlagSet("observe", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s observe [OPTIONS] CONTAINER\n\nWatch a running container with eBPF: the programs it runs, and the system calls it makes most.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	interval := fs.Duration("interval", 2*time.Second, "time between the tables of system calls")
+	top := fs.Int("top", 10, "how many system calls a table shows")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected one CONTAINER")
+	}
+	if *interval <= 0 {
+		return usageErrorf(fs, "invalid --interval %v", *interval)
+	}
+	if *top <= 0 {
+		return usageErrorf(fs, "invalid --top %d", *top)
+	}
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if s.currentStatus() != statusRunning {
+		return fmt.Errorf("container %s is not running", shortID(s.ID))
+	}
+
+	filter, err := observeFilter(s)
+	if err != nil {
+		return err
+	}
+	counts, err := createBPFMap(bpfMapTypeHash, 4, 8, 1024, "observe_counts")
+	if err != nil {
+		return fmt.Errorf("create the map of counts: %w", err)
+	}
+	defer syscall.Close(counts)
+	execs, err := createBPFMap(bpfMapTypeQueue, 0, uint32(unsafe.Sizeof(observeExec{})), 256, "observe_execs")
+	if err != nil {
+		return fmt.Errorf("create the queue of execs: %w", err)
+	}
+	defer syscall.Close(execs)
+
+	programs := []struct {
+		tracepoint, name string
+		insns            []bpfInsn
+	}{
+		{tracepointSysEnter, "observe_sys", countSyscallsProgram(filter, counts)},
+		{tracepointExec, "observe_exec", recordExecsProgram(filter, execs)},
+	}
+	for _, p := range programs {
+		closeProgram, err := attachTracepoint(p.tracepoint, p.name, p.insns)
+		if err != nil {
+			return err
+		}
+		// Detached when the perf event closes, the kernel keeps nothing of us
+		defer closeProgram()
+	}
+	fmt.Fprintf(os.Stderr, "Observing %s, Ctrl-C to stop\n", shortID(s.ID))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	tables := time.NewTicker(*interval)
+	defer tables.Stop()
+	previous := map[uint32]uint64{}
+	for {
+		select {
+		case <-interrupt:
+			printExecs(execs)
+			return nil
+		case <-poll.C:
+			printExecs(execs)
+			if !s.alive() {
+				fmt.Fprintf(os.Stderr, "Container %s exited\n", shortID(s.ID))
+				return nil
+			}
+		case <-tables.C:
+			printExecs(execs)
+			previous = printSyscallTable(counts, previous, *interval, *top)
+		}
+	}
+}
+
+// observeFilter returns the instructions that end a program when the process isn't in the
+// container of s: by its cgroup on v2, by its PID namespace on v1.
+func observeFilter(s *containerState) ([]bpfInsn, error) {
+	const r0, r1, r2, r3, r4, r10 = 0, 1, 2, 3, 4, 10
+	if cgroupV2() && s.Cgroup != "" {
+		// The ID of a v2 cgroup is the inode number of its directory, and its level how deep it is
+		var st syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(cgroupRoot, s.Cgroup), &st); err != nil {
+			return nil, fmt.Errorf("the cgroup of %s: %w", shortID(s.ID), err)
+		}
+		level := len(strings.Split(strings.Trim(s.Cgroup, "/"), "/"))
+		return slices.Concat(
+			[]bpfInsn{insn(bpfAlu64MovK, r1, 0, 0, int32(level)), insn(bpfCall, 0, 0, 0, bpfFuncGetCurrentAncestorCgroupID)},
+			loadImm64(r1, st.Ino),
+			[]bpfInsn{insn(bpfJmpJneX, r0, r1, jumpToExit, 0)},
+		), nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/ns/pid", s.Pid), &st); err != nil {
+		return nil, fmt.Errorf("the PID namespace of %s: %w", shortID(s.ID), err)
+	}
+	// struct bpf_pidns_info, 8 bytes, at the bottom of the 512 bytes of stack a program has
+	return slices.Concat(
+		loadImm64(r1, st.Dev),
+		loadImm64(r2, st.Ino),
+		[]bpfInsn{
+			insn(bpfAlu64MovX, r3, r10, 0, 0),
+			insn(bpfAlu64AddK, r3, 0, 0, -128),
+			insn(bpfAlu64MovK, r4, 0, 0, 8),
+			insn(bpfCall, 0, 0, 0, bpfFuncGetNsCurrentPidTgid),
+			insn(bpfJmpJneK, r0, 0, jumpToExit, 0),
+		},
+	), nil
+}
+
+// countSyscallsProgram is the program of raw_syscalls/sys_enter, which counts the system calls
+// of the container by number in the hash map counts:
+//
+//	r6 = ctx
+//	filter
+//	key = ctx->id                    // struct trace_event_raw_sys_enter, the number at offset 8
+//	if value = lookup(counts, &key): *value += 1 (atomically, other CPUs count too)
+//	else: update(counts, &key, &1)
+//	return 0
+func countSyscallsProgram(filter []bpfInsn, counts int) []bpfInsn {
+	const r0, r1, r2, r3, r4, r6, r10 = 0, 1, 2, 3, 4, 6, 10
+	prog := []bpfInsn{insn(bpfAlu64MovX, r6, r1, 0, 0)}
+	prog = append(prog, filter...)
+	prog = append(prog,
+		insn(bpfLdxMemDW, r1, r6, 8, 0),
+		insn(bpfStxMemW, r10, r1, -4, 0),
+	)
+	prog = append(prog, loadMapFD(r1, counts)...)
+	prog = append(prog,
+		insn(bpfAlu64MovX, r2, r10, 0, 0),
+		insn(bpfAlu64AddK, r2, 0, 0, -4),
+		insn(bpfCall, 0, 0, 0, bpfFuncMapLookupElem),
+		insn(bpfJmpJeqK, r0, 0, 3, 0),
+		insn(bpfAlu64MovK, r1, 0, 0, 1),
+		insn(bpfAtomicAddDW, r0, r1, 0, 0),
+		insn(bpfJa, 0, 0, jumpToExit, 0),
+		insn(bpfStMemDW, r10, 0, -16, 1),
+	)
+	prog = append(prog, loadMapFD(r1, counts)...)
+	prog = append(prog,
+		insn(bpfAlu64MovX, r2, r10, 0, 0),
+		insn(bpfAlu64AddK, r2, 0, 0, -4),
+		insn(bpfAlu64MovX, r3, r10, 0, 0),
+		insn(bpfAlu64AddK, r3, 0, 0, -16),
+		insn(bpfAlu64MovK, r4, 0, 0, bpfAny),
+		insn(bpfCall, 0, 0, 0, bpfFuncMapUpdateElem),
+	)
+	return finishProgram(prog)
+}
+
+// recordExecsProgram is the program of sched/sched_process_exec, which pushes every exec in the
+// container as an observeExec into the queue execs:
+//
+//	r6 = ctx
+//	filter
+//	exec.pid = ctx->pid                                  // offset 12
+//	exec.filename = the string at ctx + ctx->filename    // a __data_loc: offset in the low 16 bits
+//	push(execs, &exec), the oldest goes when it's full
+//	return 0
+func recordExecsProgram(filter []bpfInsn, execs int) []bpfInsn {
+	const r1, r2, r3, r6, r10 = 1, 2, 3, 6, 10
+	// The observeExec on the stack
+	const exec, filename = -72, -64
+	prog := []bpfInsn{insn(bpfAlu64MovX, r6, r1, 0, 0)}
+	prog = append(prog, filter...)
+	prog = append(prog,
+		insn(bpfLdxMemW, r1, r6, 12, 0),
+		insn(bpfStxMemW, r10, r1, exec, 0),
+		insn(bpfStMemW, r10, 0, exec+4, 0),
+		insn(bpfLdxMemW, r2, r6, 8, 0),
+		insn(bpfAlu32AndK, r2, 0, 0, 0xffff),
+		insn(bpfAlu64MovX, r3, r6, 0, 0),
+		insn(bpfAlu64AddX, r3, r2, 0, 0),
+		insn(bpfAlu64MovX, r1, r10, 0, 0),
+		insn(bpfAlu64AddK, r1, 0, 0, filename),
+		insn(bpfAlu64MovK, r2, 0, 0, int32(len(observeExec{}.Filename))),
+		insn(bpfCall, 0, 0, 0, bpfFuncProbeReadKernelStr),
+	)
+	prog = append(prog, loadMapFD(r1, execs)...)
+	prog = append(prog,
+		insn(bpfAlu64MovX, r2, r10, 0, 0),
+		insn(bpfAlu64AddK, r2, 0, 0, exec),
+		insn(bpfAlu64MovK, r3, 0, 0, bpfExist),
+		insn(bpfCall, 0, 0, 0, bpfFuncMapPushElem),
+	)
+	return finishProgram(prog)
+}
+
+// jumpToExit is the offset of a jump to the end of the program, until finishProgram knows it
+const jumpToExit = -0x8000
+
+// finishProgram appends `return 0` to prog and points the jumps to the end at it.
+func finishProgram(prog []bpfInsn) []bpfInsn {
+	prog = append(prog, insn(bpfAlu64MovK, 0, 0, 0, 0), insn(bpfExit, 0, 0, 0, 0))
+	for i := range prog {
+		if prog[i].off == jumpToExit && prog[i].code&0x07 == 0x05 /* BPF_JMP */ {
+			// Relative to the next instruction
+			prog[i].off = int16(len(prog) - 2 - i - 1)
+		}
+	}
+	return prog
+}
+
+// loadImm64 is the instruction pair dst = v, a 64-bit immediate takes two instructions.
+func loadImm64(dst uint8, v uint64) []bpfInsn {
+	return []bpfInsn{insn(bpfLdImm64, dst, 0, 0, int32(uint32(v))), insn(0, 0, 0, 0, int32(uint32(v>>32)))}
+}
+
+// loadMapFD is dst = the map with file descriptor fd: the kernel puts the map's address there.
+func loadMapFD(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{insn(bpfLdImm64, dst, bpfPseudoMapFD, 0, int32(fd)), insn(0, 0, 0, 0, 0)}
+}
+
+// createBPFMap creates a map and returns its file descriptor.
+func createBPFMap(mapType, keySize, valueSize, maxEntries uint32, name string) (int, error) {
+	// union bpf_attr for BPF_MAP_CREATE
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+		innerMapFD uint32
+		numaNode   uint32
+		mapName    [16]byte
+	}{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries}
+	copy(attr.mapName[:], name)
+	fd, _, errno := syscall.Syscall(sysBPF, bpfMapCreate, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// bpfMapCall is a map command of bpf(2) on the map fd: key and value are addresses, 0 for none.
+func bpfMapCall(cmd uintptr, fd int, key, value unsafe.Pointer) syscall.Errno {
+	// union bpf_attr for the BPF_MAP_*_ELEM commands, value is next_key for BPF_MAP_GET_NEXT_KEY
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFD: uint32(fd), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	return errno
+}
+
+// attachTracepoint loads insns as a tracepoint program and attaches it to tracepoint, a
+// CATEGORY/NAME of tracefs. Closing detaches it again.
+func attachTracepoint(tracepoint, name string, insns []bpfInsn) (func(), error) {
+	id, err := tracepointID(tracepoint)
+	if err != nil {
+		return nil, err
+	}
+	// The helpers that read kernel memory are only for GPL programs
+	progFD, errno := loadBPFProgram(bpfProgTypeTracepoint, name, "GPL", insns, nil)
+	if errno != 0 {
+		logBuf := make([]byte, 1<<16)
+		loadBPFProgram(bpfProgTypeTracepoint, name, "GPL", insns, logBuf)
+		return nil, fmt.Errorf("load the program of %s: %w (verifier: %s)", tracepoint, errno, cString(logBuf))
+	}
+	// A tracepoint program runs when the tracepoint's perf event is on, on whatever CPU. The event
+	// itself only needs to exist, on one CPU.
+	attr := struct {
+		eventType    uint32
+		size         uint32
+		config       uint64
+		samplePeriod uint64
+		sampleType   uint64
+		readFormat   uint64
+		flags        uint64
+		wakeupEvents uint32
+		bpType       uint32
+		config1      uint64
+	}{eventType: perfTypeTracepoint, config: id, samplePeriod: 1, wakeupEvents: 1}
+	attr.size = uint32(unsafe.Sizeof(attr))
+	eventFD, _, errno := syscall.Syscall6(sysPerfEventOpen, uintptr(unsafe.Pointer(&attr)), ^uintptr(0) /* any process */, 0 /* CPU 0 */, ^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		syscall.Close(int(progFD))
+		return nil, fmt.Errorf("perf_event_open %s: %w", tracepoint, errno)
+	}
+	closeAll := func() {
+		syscall.Close(int(eventFD))
+		syscall.Close(int(progFD))
+	}
+	for _, ioctl := range []struct{ request, arg uintptr }{{perfEventIocSetBPF, progFD}, {perfEventIocEnable, 0}} {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, eventFD, ioctl.request, ioctl.arg); errno != 0 {
+			closeAll()
+			return nil, fmt.Errorf("attach the program to %s: %w", tracepoint, errno)
+		}
+	}
+	return closeAll, nil
+}
+
+// tracepointID reads the ID of a tracepoint from tracefs, mounting it first if nobody did.
+func tracepointID(tracepoint string) (uint64, error) {
+	var dir string
+	for _, candidate := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if _, err := os.Stat(filepath.Join(candidate, "events")); err == nil {
+			dir = candidate
+			break
+		}
+	}
+	if dir == "" {
+		dir = "/sys/kernel/tracing"
+		if err := syscall.Mount("tracefs", dir, "tracefs", 0, ""); err != nil {
+			return 0, fmt.Errorf("mount tracefs on %s: %w", dir, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "events", tracepoint, "id"))
+	if err != nil {
+		return 0, fmt.Errorf("tracepoint %s: %w", tracepoint, err)
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// printExecs prints the execs the program queued since the last time.
+func printExecs(execs int) {
+	for {
+		var e observeExec
+		if bpfMapCall(bpfMapLookupAndDeleteElem, execs, nil, unsafe.Pointer(&e)) != 0 {
+			// ENOENT: the queue is empty
+			return
+		}
+		fmt.Printf("exec  %-6d  %s\n", e.Pid, cString(e.Filename[:]))
+	}
+}
+
+// printSyscallTable prints the top system calls of the last interval and in total, from the
+// counts since the start. It returns the counts, for the next table.
+func printSyscallTable(counts int, previous map[uint32]uint64, interval time.Duration, top int) map[uint32]uint64 {
+	current := map[uint32]uint64{}
+	var key, next uint32
+	keyPointer := unsafe.Pointer(nil)
+	for bpfMapCall(bpfMapGetNextKey, counts, keyPointer, unsafe.Pointer(&next)) == 0 {
+		var count uint64
+		if bpfMapCall(bpfMapLookupElem, counts, unsafe.Pointer(&next), unsafe.Pointer(&count)) == 0 {
+			current[next] = count
+		}
+		key, keyPointer = next, unsafe.Pointer(&key)
+	}
+	runtime.KeepAlive(&key)
+
+	nrs := make([]uint32, 0, len(current))
+	for nr := range current {
+		if current[nr] > previous[nr] {
+			nrs = append(nrs, nr)
+		}
+	}
+	if len(nrs) == 0 {
+		return current
+	}
+	slices.SortFunc(nrs, func(a, b uint32) int {
+		return int(current[b]-previous[b]) - int(current[a]-previous[a])
+	})
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "\nSYSCALL\tLAST %v\tTOTAL\n", interval)
+	for _, nr := range nrs[:min(top, len(nrs))] {
+		name := syscallName(int(nr))
+		if name == "" {
+			name = strconv.Itoa(int(nr))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", name, current[nr]-previous[nr], current[nr])
+	}
+	tw.Flush()
+	return current
+}
+
+// Constants from <linux/bpf.h> and <linux/perf_event.h>
+const (
+	bpfMapCreate              = 0
+	bpfMapLookupElem          = 1
+	bpfMapGetNextKey          = 4
+	bpfMapLookupAndDeleteElem = 21
+
+	bpfMapTypeHash        = 1
+	bpfMapTypeQueue       = 22
+	bpfProgTypeTracepoint = 5
+	bpfPseudoMapFD        = 1
+	bpfAny                = 0
+	bpfExist              = 2
+
+	bpfFuncMapLookupElem              = 1
+	bpfFuncMapUpdateElem              = 2
+	bpfFuncMapPushElem                = 87
+	bpfFuncProbeReadKernelStr         = 115
+	bpfFuncGetNsCurrentPidTgid        = 120
+	bpfFuncGetCurrentAncestorCgroupID = 123
+
+	perfTypeTracepoint = 2
+	perfFlagFDCloexec  = 8
+	perfEventIocEnable = 0x2400
+	perfEventIocSetBPF = 0x40042408
+)
+
+// More eBPF opcodes than the device filter needs
+const (
+	bpfLdImm64     = 0x18 // dst = imm64, over two instructions
+	bpfLdxMemDW    = 0x79 // dst = *(u64 *)(src + off)
+	bpfStxMemW     = 0x63 // *(u32 *)(dst + off) = src
+	bpfStMemW      = 0x62 // *(u32 *)(dst + off) = imm
+	bpfStMemDW     = 0x7a // *(u64 *)(dst + off) = imm
+	bpfAtomicAddDW = 0xdb // *(u64 *)(dst + off) += src, atomically
+	bpfAlu64AddK   = 0x07 // dst += imm
+	bpfAlu64AddX   = 0x0f // dst += src
+	bpfJmpJeqK     = 0x15 // if dst == imm: pc += off
+	bpfJmpJneX     = 0x5d // if dst != src: pc += off
+	bpfJa          = 0x05 // pc += off
+	bpfCall        = 0x85 // r0 = helper imm(r1, ..., r5)
+)
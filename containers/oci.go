@@ -0,0 +1,441 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An OCI bundle is what runc runs: a directory with a config.json (the OCI runtime spec) and,
+// usually, the root filesystem in rootfs/. `runc spec` writes a default config.json. The spec
+// says *what* a container looks like; which syscalls make it so is up to the runtime. ociSpec
+// is the part of the config we understand, loadBundle maps it to the containerConfig our
+// flags produce otherwise, and from there it's the same code path.
+type ociSpec struct {
+	OCIVersion  string            `json:"ociVersion"`
+	Process     *ociProcess       `json:"process"`
+	Root        *ociRoot          `json:"root"`
+	Hostname    string            `json:"hostname"`
+	Mounts      []ociMount        `json:"mounts"`
+	Hooks       containerHooks    `json:"hooks"`
+	Annotations map[string]string `json:"annotations"`
+	Linux       *ociLinux         `json:"linux"`
+}
+
+type ociProcess struct {
+	Terminal bool `json:"terminal"`
+	User     struct {
+		UID uint32 `json:"uid"`
+		GID uint32 `json:"gid"`
+	} `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    *ociCapabilities `json:"capabilities"`
+	Rlimits         []rlimit         `json:"rlimits"`
+	NoNewPrivileges bool             `json:"noNewPrivileges"`
+	ApparmorProfile string           `json:"apparmorProfile"`
+	SelinuxLabel    string           `json:"selinuxLabel"`
+	OOMScoreAdj     *int             `json:"oomScoreAdj"`
+}
+
+// ociCapabilities are the five capability sets of the process
+type ociCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+	Ambient     []string `json:"ambient"`
+}
+
+type ociRoot struct {
+	// Path is the rootfs, relative to the bundle unless it is absolute
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options"`
+}
+
+type ociLinux struct {
+	Namespaces []struct {
+		Type string `json:"type"`
+		Path string `json:"path"`
+	} `json:"namespaces"`
+	Resources         *ociResources     `json:"resources"`
+	RootfsPropagation string            `json:"rootfsPropagation"`
+	Seccomp           *seccompProfile   `json:"seccomp"`
+	MaskedPaths       []string          `json:"maskedPaths"`
+	ReadonlyPaths     []string          `json:"readonlyPaths"`
+	Devices           []json.RawMessage `json:"devices"`
+	// TimeOffsets are the clock offsets of the time namespace, by clock: boottime and monotonic
+	TimeOffsets map[string]ociTimeOffset `json:"timeOffsets"`
+}
+
+type ociTimeOffset struct {
+	Secs     int64  `json:"secs"`
+	Nanosecs uint32 `json:"nanosecs"`
+}
+
+// ociResources are the cgroup limits
+type ociResources struct {
+	Memory *struct {
+		Limit *int64 `json:"limit"`
+		Swap  *int64 `json:"swap"`
+	} `json:"memory"`
+	CPU *struct {
+		Quota  *int64  `json:"quota"`
+		Period *uint64 `json:"period"`
+		Cpus   string  `json:"cpus"`
+		Mems   string  `json:"mems"`
+	} `json:"cpu"`
+	Pids *struct {
+		Limit int64 `json:"limit"`
+	} `json:"pids"`
+	BlockIO *struct {
+		ThrottleReadBpsDevice  []ociThrottle `json:"throttleReadBpsDevice"`
+		ThrottleWriteBpsDevice []ociThrottle `json:"throttleWriteBpsDevice"`
+	} `json:"blockIO"`
+	HugepageLimits []hugetlbLimit `json:"hugepageLimits"`
+}
+
+type ociThrottle struct {
+	Major uint32 `json:"major"`
+	Minor uint32 `json:"minor"`
+	Rate  int64  `json:"rate"`
+}
+
+// ociNamespaces are the namespaces a config.json must ask for, the ones we always create
+var ociNamespaces = []string{"pid", "ipc", "uts", "mount"}
+
+// loadBundle fills cfg from the config.json in bundle. Fields we can't honor are errors when
+// ignoring them would run the command with more privileges than asked for, warnings otherwise.
+func loadBundle(cfg *containerConfig, bundle string) error {
+	var err error
+	if cfg.Bundle, err = filepath.Abs(bundle); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.Bundle, "config.json"))
+	if err != nil {
+		return fmt.Errorf("bundle: %w", err)
+	}
+	var spec ociSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("bundle: config.json: %w", err)
+	}
+	warn := func(format string, a ...any) {
+		// On stderr: with -d stdout is only for the ID
+		slog.Warn("config.json: " + fmt.Sprintf(format, a...))
+	}
+	invalid := func(format string, a ...any) error {
+		return fmt.Errorf("bundle: config.json: "+format, a...)
+	}
+	if !strings.HasPrefix(spec.OCIVersion, "1.") {
+		return invalid("unsupported ociVersion %q", spec.OCIVersion)
+	}
+
+	p := spec.Process
+	if p == nil || len(p.Args) == 0 {
+		return invalid("process.args is missing")
+	}
+	if p.User.UID != 0 || p.User.GID != 0 {
+		return invalid("process.user: only uid and gid 0 are supported")
+	}
+	if !filepath.IsAbs(p.Cwd) {
+		return invalid("process.cwd %q must be an absolute path", p.Cwd)
+	}
+	cfg.Args, cfg.Env, cfg.Tty = p.Args, p.Env, p.Terminal
+	cfg.Workdir = filepath.Clean(p.Cwd)
+	// We keep one set of capabilities: the command runs as root, which gets its whole bounding
+	// set effective on exec. So what it keeps is what the bounding, effective and permitted sets
+	// all have, a wide bounding set with a narrow effective one stays narrow. For root the
+	// inheritable and ambient sets add nothing to that, and one only in them is left out.
+	cfg.Capabilities = []string{}
+	if c := p.Capabilities; c != nil {
+		for _, set := range [][]string{c.Bounding, c.Effective, c.Permitted, c.Inheritable, c.Ambient} {
+			for _, name := range set {
+				if _, ok := capabilityNumber(name); !ok {
+					return invalid("unknown capability %q", name)
+				}
+			}
+		}
+		for _, name := range c.Bounding {
+			if slices.Contains(c.Effective, name) && slices.Contains(c.Permitted, name) && !slices.Contains(cfg.Capabilities, name) {
+				cfg.Capabilities = append(cfg.Capabilities, name)
+			}
+		}
+	}
+	cfg.NoNewPrivileges = p.NoNewPrivileges
+	if p.ApparmorProfile != "" {
+		if err := validateAppArmorProfile(p.ApparmorProfile); err != nil {
+			return invalid("process.apparmorProfile: %v", err)
+		}
+	}
+	cfg.AppArmorProfile, cfg.SELinuxLabel = p.ApparmorProfile, p.SelinuxLabel
+	for _, l := range p.Rlimits {
+		if _, ok := rlimitResource(l.Type); !ok {
+			return invalid("process.rlimits: unknown type %q", l.Type)
+		}
+		if l.Soft > l.Hard {
+			return invalid("process.rlimits: the soft limit of %s is above the hard limit", l.Type)
+		}
+	}
+	cfg.Rlimits = p.Rlimits
+	if p.OOMScoreAdj != nil && (*p.OOMScoreAdj < -1000 || *p.OOMScoreAdj > 1000) {
+		return invalid("process.oomScoreAdj %d is not between -1000 and 1000", *p.OOMScoreAdj)
+	}
+	cfg.OOMScoreAdj = p.OOMScoreAdj
+
+	cfg.Hostname = spec.Hostname
+	if cfg.Hostname == "" {
+		cfg.Hostname = "container"
+	}
+	if err := validateHostname(cfg.Hostname); err != nil {
+		return invalid("hostname %q: %v", cfg.Hostname, err)
+	}
+	cfg.Hooks, cfg.Annotations = spec.Hooks, spec.Annotations
+	for _, list := range [][]hook{cfg.Hooks.Prestart, cfg.Hooks.Poststart, cfg.Hooks.Poststop} {
+		for _, h := range list {
+			if err := h.validate(); err != nil {
+				return invalid("%v", err)
+			}
+		}
+	}
+
+	if spec.Root == nil || spec.Root.Path == "" {
+		return invalid("root.path is missing")
+	}
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(cfg.Bundle, rootfs)
+	}
+	if cfg.Rootfs, err = validateRootfs(rootfs, cfg.Args[0]); err != nil {
+		return err
+	}
+	cfg.ReadOnly = spec.Root.Readonly
+
+	if err := mapOCIMounts(cfg, spec.Mounts, warn); err != nil {
+		return invalid("%v", err)
+	}
+
+	linux := spec.Linux
+	if linux == nil {
+		linux = &ociLinux{}
+	}
+	created := map[string]bool{}
+	// Only a config.json that asks for a cgroup namespace gets one, and a network namespace:
+	// without, the container shares the host's (--network host). The network in it is up to the
+	// hooks, it is how Docker and CNI plugins connect a runc container.
+	cfg.Cgroupns, cfg.Network = cgroupnsHost, networkHost
+	for _, ns := range linux.Namespaces {
+		if ns.Path != "" {
+			return invalid("joining the existing %s namespace %s is not supported", ns.Type, ns.Path)
+		}
+		switch {
+		case slices.Contains(ociNamespaces, ns.Type):
+			created[ns.Type] = true
+		case ns.Type == "network":
+			cfg.Network = networkNone
+		case ns.Type == "cgroup":
+			cfg.Cgroupns = cgroupnsPrivate
+		case ns.Type == "time":
+			cfg.TimeNamespace = true
+		case ns.Type == "user":
+			// rootless() sets it up whenever we don't run as root
+			if os.Geteuid() == 0 {
+				warn("ignoring the user namespace, it is only used for rootless containers")
+			}
+		default:
+			warn("ignoring the %s namespace", ns.Type)
+		}
+	}
+	for _, name := range ociNamespaces {
+		if !created[name] {
+			// Without it the container would share the host's, which we never do
+			return invalid("linux.namespaces must include %s: we always create it", name)
+		}
+	}
+
+	for clock, offset := range linux.TimeOffsets {
+		if !cfg.TimeNamespace {
+			return invalid("linux.timeOffsets needs a time namespace in linux.namespaces")
+		}
+		d := time.Duration(offset.Secs)*time.Second + time.Duration(offset.Nanosecs)
+		switch clock {
+		case "boottime":
+			cfg.TimeOffsets.Boottime = d
+		case "monotonic":
+			cfg.TimeOffsets.Monotonic = d
+		default:
+			return invalid("unknown clock %q in linux.timeOffsets", clock)
+		}
+	}
+
+	cfg.RootfsPropagation = linux.RootfsPropagation
+	if cfg.RootfsPropagation == "" {
+		cfg.RootfsPropagation = "rprivate"
+	}
+	if _, ok := propagationFlags[cfg.RootfsPropagation]; !ok {
+		return invalid("invalid linux.rootfsPropagation %q", cfg.RootfsPropagation)
+	}
+	// No lists means nothing is hidden or read-only, like in runc
+	cfg.MaskedPaths, cfg.ReadonlyPaths = linux.MaskedPaths, linux.ReadonlyPaths
+	if cfg.MaskedPaths == nil {
+		cfg.MaskedPaths = []string{}
+	}
+	if cfg.ReadonlyPaths == nil {
+		cfg.ReadonlyPaths = []string{}
+	}
+	if linux.Seccomp != nil {
+		if _, err := linux.Seccomp.compile(cfg.Capabilities); err != nil {
+			return invalid("linux.seccomp: %v", err)
+		}
+		cfg.Seccomp = linux.Seccomp
+	}
+	if len(linux.Devices) > 0 {
+		warn("ignoring linux.devices, the container gets the default /dev")
+	}
+	if linux.Resources != nil {
+		if err := mapOCIResources(cfg, linux.Resources); err != nil {
+			return invalid("%v", err)
+		}
+	}
+	return nil
+}
+
+// mapOCIMounts turns the mounts of a config.json into tmpfs mounts and volumes. The child always
+// mounts /proc, /dev and /dev/pts itself.
+func mapOCIMounts(cfg *containerConfig, mounts []ociMount, warn func(string, ...any)) error {
+	cfg.Tmpfs = []tmpfsMount{}
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.Destination) {
+			return fmt.Errorf("mount destination %q must be an absolute path", m.Destination)
+		}
+		destination := filepath.Clean(m.Destination)
+		bind := m.Type == "bind" || slices.Contains(m.Options, "bind") || slices.Contains(m.Options, "rbind")
+		switch {
+		case destination == "/proc" && m.Type == "proc", destination == "/dev" && m.Type == "tmpfs",
+			destination == "/dev/pts" && m.Type == "devpts", destination == "/sys" && m.Type == "sysfs":
+			continue
+		case destination == "/sys/fs/cgroup" && m.Type == "cgroup":
+			// Mounted with a cgroup namespace, without one it would show the host's cgroups
+			continue
+		case m.Type == "tmpfs":
+			t := tmpfsMount{Path: destination}
+			var data []string
+			for _, option := range m.Options {
+				key, _, _ := strings.Cut(option, "=")
+				if flag, ok := tmpfsFlags[option]; ok {
+					t.Flags = t.Flags&^flag.clear | flag.set
+				} else if slices.Contains(tmpfsData, key) {
+					data = append(data, option)
+				} else {
+					warn("ignoring option %s of the tmpfs on %s", option, destination)
+				}
+			}
+			t.Data = strings.Join(data, ",")
+			cfg.Tmpfs = append(cfg.Tmpfs, t)
+		case bind:
+			source := m.Source
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(cfg.Bundle, source)
+			}
+			if _, err := os.Stat(source); err != nil {
+				return fmt.Errorf("mount source: %w", err)
+			}
+			v := volumeMount{Source: filepath.Clean(source), Destination: destination}
+			for _, option := range m.Options {
+				switch option {
+				case "ro", "rw":
+					v.ReadOnly = option == "ro"
+				case "rbind":
+					v.Recursive = true
+				case "bind":
+				default:
+					if _, ok := propagationFlags[option]; ok {
+						v.Propagation = option
+					} else {
+						warn("ignoring option %s of the bind mount on %s", option, destination)
+					}
+				}
+			}
+			cfg.Volumes = append(cfg.Volumes, v)
+		default:
+			warn("ignoring the %s mount on %s", m.Type, destination)
+		}
+	}
+	return nil
+}
+
+// mapOCIResources turns linux.resources into our cgroup limits.
+func mapOCIResources(cfg *containerConfig, r *ociResources) error {
+	if r.Memory != nil {
+		if r.Memory.Limit != nil && *r.Memory.Limit > 0 {
+			cfg.Memory = *r.Memory.Limit
+		}
+		// Like Docker's --memory-swap, the spec's swap is memory plus swap
+		if r.Memory.Swap != nil && *r.Memory.Swap != 0 {
+			if cfg.Memory == 0 {
+				return errors.New("linux.resources.memory.swap needs a memory limit")
+			}
+			if *r.Memory.Swap != -1 && *r.Memory.Swap < cfg.Memory {
+				return errors.New("linux.resources.memory.swap counts memory plus swap, it must be at least the limit")
+			}
+			cfg.MemorySwap = *r.Memory.Swap
+		}
+	}
+	if c := r.CPU; c != nil {
+		if c.Quota != nil && *c.Quota > 0 {
+			period := uint64(cpuPeriod)
+			if c.Period != nil && *c.Period > 0 {
+				period = *c.Period
+			}
+			// We always use the default period, the same share of it gives the same limit
+			cfg.CPUs = float64(*c.Quota) / float64(period)
+			if cpuQuota(cfg.CPUs) < 1000 {
+				return errors.New("linux.resources.cpu.quota is less than 1% of the period")
+			}
+		}
+		if err := validateCPUList(c.Cpus); err != nil {
+			return fmt.Errorf("linux.resources.cpu.cpus: %v", err)
+		}
+		if err := validateCPUList(c.Mems); err != nil {
+			return fmt.Errorf("linux.resources.cpu.mems: %v", err)
+		}
+		cfg.CpusetCpus, cfg.CpusetMems = c.Cpus, c.Mems
+	}
+	if r.Pids != nil && r.Pids.Limit > 0 {
+		cfg.PidsLimit = r.Pids.Limit
+	}
+	if b := r.BlockIO; b != nil {
+		throttles := func(list []ociThrottle) []deviceRate {
+			var rates []deviceRate
+			for _, t := range list {
+				rates = append(rates, deviceRate{Path: fmt.Sprintf("%d:%d", t.Major, t.Minor), Major: t.Major, Minor: t.Minor, Rate: t.Rate})
+			}
+			return rates
+		}
+		cfg.DeviceReadBps, cfg.DeviceWriteBps = throttles(b.ThrottleReadBpsDevice), throttles(b.ThrottleWriteBpsDevice)
+	}
+	// The same checks as --hugetlb-limit, the spec has the same names for the page sizes
+	for _, h := range r.HugepageLimits {
+		l, err := parseHugetlbLimit(fmt.Sprintf("%s:%d", h.PageSize, h.Limit))
+		if err != nil {
+			return fmt.Errorf("linux.resources.hugepageLimits: %v", err)
+		}
+		cfg.HugetlbLimits = append(cfg.HugetlbLimits, l)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// oomWatcher tells the user when the kernel OOM-kills a process in the container.
+//
+// Without it a container that hits its memory limit just dies with "signal: killed", which
+// looks exactly like someone running `kill -9`. The kernel does record the reason in the cgroup,
+// and it can wake us up when that happens:
+//   - v2: memory.events has an "oom_kill N" counter and every change triggers an inotify event
+//   - v1: memory.oom_control can be registered with an eventfd through cgroup.event_control,
+//     the kernel then signals the eventfd on every OOM in the cgroup
+type oomWatcher struct {
+	id   string
+	file *os.File // the inotify fd (v2) or eventfd (v1) we block on
+	done chan struct{}
+
+	mu       sync.Mutex
+	reported int64 // OOM kills we already told the user about
+}
+
+// watchOOM starts watching the memory cgroup of container id. It returns nil if the kernel
+// offers no notification, the container then just runs without the watcher.
+func watchOOM(id string) *oomWatcher {
+	var file *os.File
+	var err error
+	if cgroupV2() {
+		file, err = inotifyMemoryEvents(id)
+	} else {
+		file, err = eventfdOOMControl(id)
+	}
+	if err != nil {
+		slog.Warn("could not watch for OOM kills", "err", err)
+		return nil
+	}
+
+	w := &oomWatcher{id: id, file: file, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		buf := make([]byte, 4096)
+		for {
+			// Blocks until the kernel signals; fails once stop() closes the file
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			w.check()
+		}
+	}()
+	return w
+}
+
+// stop ends the watcher. It must be called after the container exited but before its cgroup is
+// removed: the final check catches an OOM kill whose notification raced with the exit.
+func (w *oomWatcher) stop() {
+	if w == nil {
+		return
+	}
+	w.file.Close()
+	<-w.done
+	w.check()
+}
+
+// check reports new OOM kills together with the memory stats the cgroup has at that moment.
+func (w *oomWatcher) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kills := oomKills(w.id)
+	if kills <= w.reported {
+		return
+	}
+	addCounter(counterOOMKills, kills-w.reported)
+	recordEvent(w.id, eventOOM)
+	w.reported = kills
+
+	// One record, with what the cgroup files say at this moment
+	dir := cgroupPath("memory", w.id)
+	attrs := []any{"id", shortID(w.id), "oom_kills", kills}
+	if cgroupV2() {
+		attrs = append(attrs,
+			"memory.max", formatCgroupBytes(readCgroupFile(dir, "memory.max")),
+			"memory.current", formatCgroupBytes(readCgroupFile(dir, "memory.current")))
+		if peak := readCgroupFile(dir, "memory.peak"); peak != "" {
+			attrs = append(attrs, "memory.peak", formatCgroupBytes(peak))
+		}
+		attrs = append(attrs, "memory.events", strings.ReplaceAll(readCgroupFile(dir, "memory.events"), "\n", ", "))
+	} else {
+		attrs = append(attrs,
+			"memory.limit_in_bytes", formatCgroupBytes(readCgroupFile(dir, "memory.limit_in_bytes")),
+			"memory.usage_in_bytes", formatCgroupBytes(readCgroupFile(dir, "memory.usage_in_bytes")),
+			"memory.max_usage_in_bytes", formatCgroupBytes(readCgroupFile(dir, "memory.max_usage_in_bytes")),
+			// The times the limit was hit
+			"memory.failcnt", readCgroupFile(dir, "memory.failcnt"))
+	}
+	slog.Warn("container was OOM-killed: it ran out of memory in its cgroup", attrs...)
+}
+
+// oomKills returns the number of processes the OOM killer killed in the container's cgroup.
+// Both v2's memory.events and v1's memory.oom_control (kernel 4.13+) have an "oom_kill N" line.
+func oomKills(id string) int64 {
+	file := "memory.events"
+	if !cgroupV2() {
+		file = "memory.oom_control"
+	}
+	for _, line := range strings.Split(readCgroupFile(cgroupPath("memory", id), file), "\n") {
+		if n, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			count, _ := strconv.ParseInt(n, 10, 64)
+			return count
+		}
+	}
+	return 0
+}
+
+// inotifyMemoryEvents returns an inotify fd that becomes readable whenever memory.events changes.
+func inotifyMemoryEvents(id string) (*os.File, error) {
+	// IN_NONBLOCK lets os.File use Go's poller, so Close() wakes up a goroutine blocked in Read
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	path := cgroupPath("", id) + "/memory.events"
+	if _, err := syscall.InotifyAddWatch(fd, path, syscall.IN_MODIFY); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
+
+// eventfdOOMControl registers an eventfd for OOM events of the container's v1 memory cgroup.
+func eventfdOOMControl(id string) (*os.File, error) {
+	dir := cgroupPath("memory", id)
+	control, err := os.Open(dir + "/memory.oom_control")
+	if err != nil {
+		return nil, err
+	}
+	// The kernel holds its own reference once registered
+	defer control.Close()
+
+	// eventfd(2) is a kernel-maintained counter: the kernel adds to it, a read returns and resets it
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("eventfd2: %w", errno)
+	}
+
+	// "<event_fd> <fd of memory.oom_control>" asks for OOM notifications on event_fd
+	registration := fmt.Sprintf("%d %d", fd, control.Fd())
+	if err := os.WriteFile(dir+"/cgroup.event_control", []byte(registration), 0700); err != nil {
+		syscall.Close(int(fd))
+		return nil, fmt.Errorf("register for OOM events: %w", err)
+	}
+	return os.NewFile(fd, "eventfd"), nil
+}
+
+// formatCgroupBytes makes a byte count from a cgroup file readable, "max" stays "max"
+func formatCgroupBytes(v string) string {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return v
+	}
+	return formatBytes(n)
+}
+
+// Which process the OOM killer picks, on the host or in a cgroup that hit its limit, depends on
+// its oom_score: the share of memory it uses, in thousandths, plus its oom_score_adj from -1000 to
+// 1000. The highest score dies. -1000 means never, which systemd gives itself and the services
+// that set OOMScoreAdjust=-1000, like udev; Docker's daemon runs at -999. Every process inherits
+// the value of its parent, so without --oom-score-adj a container gets ours.
+
+// setOOMScoreAdj sets the oom_score_adj of process pid, 0 for ourselves. Lowering it takes
+// CAP_SYS_RESOURCE, in the host's user namespace: a rootless container can only raise it.
+func setOOMScoreAdj(pid, adj int) error {
+	path := "/proc/self/oom_score_adj"
+	if pid != 0 {
+		path = fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	}
+	err := os.WriteFile(path, []byte(strconv.Itoa(adj)), 0)
+	if err != nil {
+		return fmt.Errorf("set oom_score_adj: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With OTEL_EXPORTER_OTLP_ENDPOINT set, like for any program instrumented with OpenTelemetry, run,
+// create and start send a trace of how they made the container to a collector. Jaeger takes them
+// as it is, and shows the steps as a waterfall:
+//
+//	docker run --rm -p 16686:16686 -p 4318:4318 jaegertracing/all-in-one
+//	OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318 sudo -E container run alpine true
+//
+//	container run   ██████████████████████████████  1.32s
+//	  pull          ███████████████████              810ms
+//	  create                           ████████      340ms
+//	    rootfs                         ██████        260ms
+//	    clone                                █         4ms
+//	    cgroup-setup                         █         2ms
+//	    network-setup                         █       48ms
+//	  start                                    █       1ms
+//
+// A span is one step: its name, when it began and ended, and the span it is part of. All spans
+// of a trace carry the same 16-byte trace ID, each its own 8-byte span ID and its parent's. The
+// root is the command, the steps are below it, in this process a step started while another
+// runs is part of it. The monitor of `run -d` (see detach.go) does most of the work, in another
+// process: it gets the trace ID and its parent in the TRACEPARENT environment variable, in the
+// format of the W3C's traceparent HTTP header. With a TRACEPARENT of your own, a script's trace
+// has the container's start in it. The child isn't in the trace, it is in a network namespace
+// of its own, what it does counts towards start.
+//
+// OpenTelemetry's SDK for Go is go.opentelemetry.io/otel, but like observe (see observe.go) we
+// build with nothing but `go build`: the OTLP protocol has a JSON encoding, and a POST of it to
+// /v1/traces is all an exporter has to do. The spans go out in batches, once the container runs
+// and before we exit. Without an endpoint nothing is recorded.
+
+const (
+	// otlpEndpointEnv is the base URL of the collector, http://localhost:4318 for Jaeger
+	otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	// otlpTracesEndpointEnv is the whole URL of its traces, if it isn't at /v1/traces
+	otlpTracesEndpointEnv = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	// otelServiceNameEnv names us in the collector, the name we were run with otherwise
+	otelServiceNameEnv = "OTEL_SERVICE_NAME"
+	// traceparentEnv carries the trace into the processes we start
+	traceparentEnv = "TRACEPARENT"
+)
+
+// otlpExportTimeout is how long a collector that doesn't answer can hold up the container
+const otlpExportTimeout = 3 * time.Second
+
+// span is a step of a trace, the time something took.
+type span struct {
+	traceID       [16]byte
+	spanID        [8]byte
+	parentID      [8]byte // zero for the root
+	name          string
+	attributes    []string // key, value, key, value...
+	start, finish time.Time
+	err           error
+}
+
+// tracing has the spans of this process.
+var tracing struct {
+	sync.Mutex
+	initialized bool
+	endpoint    string
+	warned      bool  // about a collector that isn't there
+	remote      *span // TRACEPARENT's, only its IDs are set
+	open        []*span
+	ended       []*span
+}
+
+// startSpan starts the span name with the attributes in key, value pairs. It's part of the last
+// span started that hasn't ended yet, or TRACEPARENT's: without either it is the root of a new
+// trace. It is nil without a collector, the methods of a nil span do nothing.
+func startSpan(name string, attributes ...string) *span {
+	tracing.Lock()
+	defer tracing.Unlock()
+	if !tracing.initialized {
+		initTracing()
+	}
+	if tracing.endpoint == "" {
+		return nil
+	}
+	s := &span{name: name, attributes: attributes, start: time.Now()}
+	rand.Read(s.spanID[:])
+	parent := tracing.remote
+	if len(tracing.open) > 0 {
+		parent = tracing.open[len(tracing.open)-1]
+	}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	tracing.open = append(tracing.open, s)
+	return s
+}
+
+// initTracing finds the collector and TRACEPARENT in the environment.
+func initTracing() {
+	tracing.initialized = true
+	if tracing.endpoint = os.Getenv(otlpTracesEndpointEnv); tracing.endpoint == "" {
+		if base := os.Getenv(otlpEndpointEnv); base != "" {
+			tracing.endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if value := os.Getenv(traceparentEnv); value != "" {
+		remote, err := parseTraceparent(value)
+		if err != nil {
+			slog.Warn("ignoring "+traceparentEnv, "err", err)
+			return
+		}
+		tracing.remote = remote
+	}
+}
+
+// parseTraceparent parses a traceparent: "00-" the trace ID "-" the span ID "-" the flags, in hex.
+func parseTraceparent(value string) (*span, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, fmt.Errorf("invalid traceparent %q, expected 00-TRACEID-SPANID-FLAGS", value)
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, fmt.Errorf("invalid trace ID %q: %w", parts[1], err)
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, fmt.Errorf("invalid span ID %q: %w", parts[2], err)
+	}
+	return s, nil
+}
+
+// traceparent is the TRACEPARENT of a process we start now, to make its spans part of the last
+// one started here. It is empty without one.
+func traceparent() string {
+	tracing.Lock()
+	defer tracing.Unlock()
+	if len(tracing.open) == 0 {
+		return ""
+	}
+	s := tracing.open[len(tracing.open)-1]
+	// Flags 01: sampled, the collector is to keep it
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// set adds the attribute key to s.
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	s.attributes = append(s.attributes, key, value)
+}
+
+// end ends s, err is what went wrong or the exit code of the container. Only the first end
+// counts: a deferred one ends it on the ways out that didn't.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	tracing.Lock()
+	defer tracing.Unlock()
+	if !s.finish.IsZero() {
+		return
+	}
+	s.finish, s.err = time.Now(), err
+	tracing.open = slices.DeleteFunc(tracing.open, func(open *span) bool { return open == s })
+	tracing.ended = append(tracing.ended, s)
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest, of what we use of it. IDs are in hex,
+// the times in nanoseconds since 1970 as strings: JSON numbers are only exact up to 2^53.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        uint64         `json:"startTimeUnixNano,string"`
+	End          uint64         `json:"endTimeUnixNano,string"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1 // a step inside the program, not a request to another
+	otlpStatusError      = 2
+)
+
+// otlpAttributes turns pairs of key and value into attributes.
+func otlpAttributes(pairs ...string) []otlpKeyValue {
+	var attributes []otlpKeyValue
+	for i := 0; i+1 < len(pairs); i += 2 {
+		var kv otlpKeyValue
+		kv.Key, kv.Value.StringValue = pairs[i], pairs[i+1]
+		attributes = append(attributes, kv)
+	}
+	return attributes
+}
+
+// otelServiceName is our name in the collector: the monitor's is "exe" too, it's /proc/self/exe.
+func otelServiceName() string {
+	if name := os.Getenv(otelServiceNameEnv); name != "" {
+		return name
+	}
+	if path, err := os.Executable(); err == nil {
+		return filepath.Base(path)
+	}
+	return progName()
+}
+
+// flushSpans sends the spans that have ended to the collector. A collector that isn't there only
+// gets a warning, the container runs without it.
+func flushSpans() {
+	tracing.Lock()
+	ended := tracing.ended
+	tracing.ended = nil
+	tracing.Unlock()
+	if len(ended) == 0 {
+		return
+	}
+
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = otelServiceName()
+	for _, s := range ended {
+		out := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       otlpSpanKindInternal,
+			Start:      uint64(s.start.UnixNano()),
+			End:        uint64(s.finish.UnixNano()),
+			Attributes: otlpAttributes(s.attributes...),
+		}
+		if s.parentID != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		// The exit code of the container is no error of ours
+		var status exitStatus
+		if errors.As(s.err, &status) {
+			out.Attributes = append(out.Attributes, otlpAttributes("process.exit.code", fmt.Sprint(int(status)))...)
+		} else if s.err != nil {
+			out.Status = &otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	// Which of our processes it was: run, the monitor...
+	resource.Resource.Attributes = otlpAttributes("service.name", otelServiceName(), "process.command", os.Args[1])
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: otlpExportTimeout}
+	tracing.Lock()
+	endpoint := tracing.endpoint
+	tracing.Unlock()
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil {
+		// Once is enough, the next batch won't have more luck
+		tracing.Lock()
+		warned := tracing.warned
+		tracing.warned = true
+		tracing.Unlock()
+		if !warned {
+			slog.Warn("could not export the trace", "endpoint", endpoint, "err", err)
+		}
+	}
+}
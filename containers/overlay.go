@@ -0,0 +1,280 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// The container of an image doesn't run in a copy of it, and doesn't change it either. Its root
+// is an overlay filesystem, a stack of directories of which only the top one is written:
+//
+//	merged/   what the container sees, its /
+//	  upper/  the container's changes: new and changed files (copied up at the first write)
+//	  lower/  the image's layers, read-only, each unpacked once in layers/ of the image store
+//
+// Looking up a path finds it in the highest directory that has it, so a layer hides the files of
+// the layers below it, and the container's upper/ hides them all. The first write to a file of a
+// layer copies it up into upper/ and changes the copy. Removing one creates a "whiteout" in upper/,
+// a character device 0:0, which hides the file below. Every container of an image shares its
+// layers, starting one copies nothing, and `rm` throws away the container's upper/. That is
+// Docker's overlay2 driver, and our default snapshotter: see snapshot.go for the plain copy.
+//
+//	/var/lib/mycontainer/containers/<ID>/   (~/.local/share/mycontainer/... rootless)
+//	  upper/  work/ (overlayfs's scratch space, on the same filesystem as upper/)  merged/
+//
+// Image layers delete files too, and a tar can't hold a deleted file. The OCI image spec says it
+// with empty marker files instead, which we unpack into what overlayfs understands:
+//
+//	bin/.wh.sleep      a whiteout: bin/sleep of the layers below is gone, a character device 0:0
+//	app/.wh..wh..opq   an opaque directory: app/ of the layers below is gone, only this layer's
+//	                   entries are in it. The extended attribute overlay.opaque=y on app/
+//
+// A whiteout hides the layers below only: a bin/sleep of the same layer stays.
+//
+// The child mounts the overlay in its own mount namespace, right before the other mounts: it
+// disappears with the container and nobody has to unmount it. Since Linux 5.11 that works in a
+// user namespace too, with the option userxattr: overlayfs then reads its attributes with the
+// prefix "user." instead of "trusted.", which only the host's root may write. A rootless unpack
+// writes them that way. The whiteout device needs no CAP_MKNOD, since Linux 5.8.
+//
+// The directories are paths in one mount option, which takes a page at most: that's about 40
+// layers here, Docker shortens them with symlinks for more.
+
+// containerDataDir is the directory of a container's files that outlive a reboot: the writable
+// layer of its rootfs.
+func containerDataDir(id string) string {
+	return filepath.Join(filepath.Dir(imageRoot()), "containers", id)
+}
+
+// overlaySnapshotter is the default snapshotter (see snapshot.go): the container's root is the
+// overlay of the layers, and its changes are what upper/ has.
+type overlaySnapshotter struct{}
+
+// prepare creates the directories of the overlay. The rootfs is merged/ of containerDataDir,
+// which the child can't ask for: root in a user namespace has the data directory of the user.
+func (overlaySnapshotter) prepare(dir string, layers []string) error {
+	for _, name := range []string{"upper", "work", "merged"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mounts is the overlay of layers and upper/.
+func (overlaySnapshotter) mounts(dir string, layers []string) []snapshotMount {
+	// The mount wants the top layer first, the image lists the bottom one first
+	lower := slices.Clone(layers)
+	slices.Reverse(lower)
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+	if inUserNamespace() {
+		// The layers were unpacked by the user, with the attributes in "user."
+		options += ",userxattr"
+	}
+	return []snapshotMount{{fstype: "overlay", source: "overlay", options: options}}
+}
+
+// changes are the entries of upper/, see collectDiff.
+func (overlaySnapshotter) changes(dir string, layers []string) ([]diffEntry, error) {
+	return collectDiff(filepath.Join(dir, "upper"), "", layers)
+}
+
+// commit writes upper/ as a layer.
+func (s overlaySnapshotter) commit(tw *tar.Writer, dir string, layers []string) error {
+	entries, err := s.changes(dir, layers)
+	if err != nil {
+		return err
+	}
+	return writeChanges(tw, filepath.Join(dir, "upper"), entries)
+}
+
+// remove deletes the container's upper/ and the rest, the overlay went with the child.
+func (overlaySnapshotter) remove(dir string) error {
+	return removeTree(dir)
+}
+
+// inUserNamespace tells whether we run in a user namespace, like a rootless child: then our
+// UIDs aren't all of the host's.
+func inUserNamespace() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295")
+}
+
+// The names of the markers of the OCI image spec
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// overlayXattr is the name of overlayfs's extended attribute name, for layers unpacked by root
+// into trusted., by others into user.
+func overlayXattr(name string) string {
+	if os.Geteuid() == 0 {
+		return "trusted.overlay." + name
+	}
+	return "user.overlay." + name
+}
+
+// createWhiteout creates the overlayfs whiteout for name in the directory dir, unless the layer
+// has the file itself.
+func createWhiteout(dir, name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid whiteout %q", whiteoutPrefix+name)
+	}
+	target := filepath.Join(dir, name)
+	if _, err := os.Lstat(target); err == nil {
+		return nil
+	}
+	if err := syscall.Mknod(target, syscall.S_IFCHR, 0); err != nil {
+		return fmt.Errorf("whiteout %s: %w", target, err)
+	}
+	return nil
+}
+
+// isWhiteout tells whether fi is an overlayfs whiteout.
+func isWhiteout(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// markOpaque makes the directory dir of a layer opaque.
+func markOpaque(dir string) error {
+	if err := syscall.Setxattr(dir, overlayXattr("opaque"), []byte("y"), 0); err != nil {
+		return fmt.Errorf("opaque directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// isOpaque tells whether the directory dir of a layer is opaque, in either kind of attribute.
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if n, err := syscall.Getxattr(dir, name, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// walkLayers calls fn for every file of the overlay of layers, like the container sees them, with
+// its path relative to the root and where it is in the layers, the way filepath.WalkDir walks a
+// directory: parents before their entries, in lexical order. The layers' whiteouts and what they
+// hide are left out, for scans of an image without mounting it.
+func walkLayers(layers []string, fn func(name, path string, fi os.FileInfo) error) error {
+	top := slices.Clone(layers)
+	slices.Reverse(top)
+	return walkMergedDir(top, "", fn)
+}
+
+// walkMergedDir walks the directory name of the overlay, which is in dirs of the layers, the top
+// one first.
+func walkMergedDir(dirs []string, name string, fn func(name, path string, fi os.FileInfo) error) error {
+	// The highest layer with an entry has it, and a whiteout there hides it
+	found := map[string]int{}
+	for i, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if _, ok := found[entry.Name()]; !ok {
+				found[entry.Name()] = i
+			}
+		}
+	}
+	names := make([]string, 0, len(found))
+	for entry := range found {
+		names = append(names, entry)
+	}
+	slices.Sort(names)
+	for _, entry := range names {
+		i := found[entry]
+		path := filepath.Join(dirs[i], entry)
+		fi, err := os.Lstat(path)
+		if err != nil || isWhiteout(fi) {
+			continue
+		}
+		child := filepath.Join(name, entry)
+		if err := fn(child, path, fi); err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		// The directory merges the ones of the layers below, down to one that is opaque or
+		// something that isn't a directory
+		var below []string
+		for _, dir := range dirs[i:] {
+			p := filepath.Join(dir, entry)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				continue
+			}
+			if !fi.IsDir() {
+				break
+			}
+			below = append(below, p)
+			if isOpaque(p) {
+				break
+			}
+		}
+		if err := walkMergedDir(below, child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findInLayers tells whether path is in one of the layers, like the container will see it. For
+// run's check of the command, before there is an overlay.
+func findInLayers(layers []string, path string) bool {
+	fi, throughSymlink := lstatInLayers(layers, path)
+	return fi != nil || throughSymlink
+}
+
+// lstatInLayers returns the file at path in the overlay of layers, or nil if there is none. The
+// layers are looked at from the top one down, until a whiteout or an opaque directory hides the
+// rest. A symlink on the way, like /bin -> usr/bin, could lead anywhere in the overlay: then
+// throughSymlink is set instead.
+func lstatInLayers(layers []string, path string) (fi os.FileInfo, throughSymlink bool) {
+	parts := strings.Split(strings.Trim(filepath.Clean(path), "/"), "/")
+	for i := len(layers) - 1; i >= 0; i-- {
+		dir := layers[i]
+		hidesBelow := false
+		for j, part := range parts {
+			dir = filepath.Join(dir, part)
+			fi, err := os.Lstat(dir)
+			if err != nil {
+				break
+			}
+			if isWhiteout(fi) {
+				return nil, false
+			}
+			if j == len(parts)-1 {
+				return fi, false
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return nil, true
+			}
+			if !fi.IsDir() {
+				// A file of this layer hides the directory of the ones below
+				return nil, false
+			}
+			if isOpaque(dir) {
+				hidesBelow = true
+			}
+		}
+		if hidesBelow {
+			return nil, false
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// An image is made of binaries, and those are for one CPU architecture. A tag like alpine:latest
+// is built for many, and its manifest is an index with a manifest per platform:
+//
+//	{"manifests": [
+//	  {"digest": "sha256:1c4e...", "platform": {"os": "linux", "architecture": "amd64"}},
+//	  {"digest": "sha256:8f1d...", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+//	  {"digest": "sha256:a3f2...", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+//	  {"digest": "sha256:77ff...", "platform": {"os": "unknown", "architecture": "unknown"}}
+//	]}
+//
+// We pick ours, the platform Go was built for, so the same `run alpine` works on a laptop with
+// an Intel CPU and on a Raspberry Pi or an Apple Silicon VM. The variant tells versions of an
+// architecture apart, mostly ARM's: v6 for the first Raspberry Pi, v7, v8 for arm64 (which a
+// manifest may leave out). Entries of platform unknown/unknown are attestations, like the SBOM,
+// and aren't images.
+//
+// --platform asks for another one, like `docker pull --platform linux/arm64`. The kernel can't
+// run its binaries by itself: that takes qemu-user, registered with binfmt_misc, which runs the
+// foreign binaries in an emulator transparently.
+
+// hostPlatform is the platform we run on. Go knows the ARM version only at compile time (GOARM),
+// v7 is what Docker assumes too.
+func hostPlatform() ociPlatform {
+	p := ociPlatform{OS: "linux", Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = "v7"
+	}
+	return p
+}
+
+// parsePlatform parses OS/ARCH[/VARIANT], like linux/arm64 or linux/arm/v6.
+func parsePlatform(s string) (ociPlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ociPlatform{}, fmt.Errorf("invalid platform %q, expected OS/ARCH[/VARIANT] like linux/arm64", s)
+	}
+	if parts[0] != "linux" {
+		return ociPlatform{}, fmt.Errorf("invalid platform %q, containers of this demo are linux ones", s)
+	}
+	p := ociPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// String is the platform the way --platform takes it.
+func (p ociPlatform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// matches tells whether an image for platform other runs on p. Without a variant, p takes any of
+// the architecture.
+func (p ociPlatform) matches(other ociPlatform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	if p.Variant == "" {
+		return true
+	}
+	variant := other.Variant
+	if variant == "" && other.Architecture == "arm64" {
+		// arm64 has only one version that matters
+		variant = "v8"
+	}
+	return p.Variant == variant
+}
@@ -0,0 +1,278 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A server in the container listens on the container's own address, which only the host can
+// reach. -p 8080:80 publishes its port 80 as port 8080 of the host, for the whole network, two
+// ways at once, like Docker does by default:
+//   - DNAT rules (see nftables.go) rewrite the destination of packets for port 8080 to the
+//     container. The kernel does all the work and the server sees the real client address.
+//   - A proxy in the monitor listens on port 8080 itself, accepts the connections the rules
+//     don't catch and opens a new one to the container for each (Docker's docker-proxy). It
+//     sees localhost and the other containers, and holding the port lets nothing else take it:
+//     a second container with the same -p fails right away.
+//
+// A rootless container can't have rules, and has no address the host could connect to anyway,
+// only its loopback device. The proxy is all it gets then, with a twist: the monitor can't join
+// the container's network namespace, but the container's init, the child, is in there already.
+// So the monitor asks it over a socket pair, the child connects to 127.0.0.1:80 and sends the
+// connected socket back (SCM_RIGHTS). A socket stays in the namespace it was created in,
+// whoever holds it. rootlesskit's "builtin" port driver works the same way.
+
+// portMapping is one published port (-p).
+type portMapping struct {
+	// HostIP is the host address to listen on, empty for all of them
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort"`
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+}
+
+// String formats a mapping like `docker ps` does: 0.0.0.0:8080->80/tcp.
+func (p portMapping) String() string {
+	hostIP := p.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(hostIP, strconv.Itoa(int(p.HostPort))), p.ContainerPort, p.Protocol)
+}
+
+// portProxyFd is where the child finds its end of the proxy socket pair. 4 is the console socket
+// or the exec FIFO, or nothing.
+const portProxyFd = 5
+
+// parsePublish parses a -p value, Docker's syntax: [HOSTIP:]HOSTPORT:CONTAINERPORT[/PROTOCOL],
+// e.g. 8080:80 or 127.0.0.1:5353:53/udp.
+func parsePublish(v string) (portMapping, error) {
+	p := portMapping{Protocol: "tcp"}
+	ports, proto, ok := strings.Cut(v, "/")
+	if ok {
+		if proto != "tcp" && proto != "udp" {
+			return p, fmt.Errorf("unknown protocol %q, expected tcp or udp", proto)
+		}
+		p.Protocol = proto
+	}
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		ip := net.ParseIP(parts[0])
+		if ip == nil || ip.To4() == nil {
+			return p, fmt.Errorf("invalid host address %q, expected an IPv4 address", parts[0])
+		}
+		p.HostIP = ip.String()
+		parts = parts[1:]
+	default:
+		return p, errors.New("expected [HOSTIP:]HOSTPORT:CONTAINERPORT[/PROTOCOL], e.g. 8080:80")
+	}
+	for i, port := range []*uint16{&p.HostPort, &p.ContainerPort} {
+		n, err := strconv.ParseUint(parts[i], 10, 16)
+		if err != nil || n == 0 {
+			return p, fmt.Errorf("invalid port %q", parts[i])
+		}
+		*port = uint16(n)
+	}
+	// The proxy only knows TCP, and a rootless container has nothing but the proxy
+	if p.Protocol == "udp" && os.Geteuid() != 0 {
+		return p, errors.New("publishing UDP ports needs root")
+	}
+	return p, nil
+}
+
+// portProxy is the proxy of a container: a listener for each published TCP port.
+type portProxy struct {
+	listeners []net.Listener
+	ports     []portMapping
+	// child is the socket to the child of a rootless container
+	child net.Conn
+}
+
+// listenPorts listens on the host ports of ports, before the container starts: a port that is
+// taken stops it there.
+func listenPorts(ports []portMapping) (*portProxy, error) {
+	proxy := &portProxy{}
+	for _, p := range ports {
+		// UDP ports only have the DNAT rules
+		if p.Protocol != "tcp" {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(p.HostIP, strconv.Itoa(int(p.HostPort))))
+		if err != nil {
+			proxy.close()
+			return nil, fmt.Errorf("publish %s: %w", p, err)
+		}
+		proxy.listeners = append(proxy.listeners, l)
+		proxy.ports = append(proxy.ports, p)
+	}
+	return proxy, nil
+}
+
+// serve accepts connections until close, and relays each to a connection that dial opens to the
+// container port.
+func (proxy *portProxy) serve(dial func(port uint16) (net.Conn, error)) {
+	for i, l := range proxy.listeners {
+		go func() {
+			for {
+				client, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer client.Close()
+					conn, err := dial(proxy.ports[i].ContainerPort)
+					if err != nil {
+						// Nothing listening in the container yet, the client sees its connection closed
+						return
+					}
+					defer conn.Close()
+					relay(client, conn)
+				}()
+			}
+		}()
+	}
+}
+
+// close stops listening, the ports are free again. Connections being relayed carry on.
+func (proxy *portProxy) close() {
+	for _, l := range proxy.listeners {
+		l.Close()
+	}
+	if proxy.child != nil {
+		proxy.child.Close()
+	}
+}
+
+// relay copies between a and b in both directions, until both have closed their side.
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(b, a)
+		closeWrite(b)
+		close(done)
+	}()
+	io.Copy(a, b)
+	closeWrite(a)
+	<-done
+}
+
+// closeWrite tells the other side of c that nothing more comes, like shutdown(SHUT_WR): a client
+// may wait for the end of its request before it reads the answer.
+func closeWrite(c net.Conn) {
+	if c, ok := c.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// dialContainerAddress returns the dial function of a container with an address on the bridge.
+func dialContainerAddress(cfg *containerConfig) func(port uint16) (net.Conn, error) {
+	ip := strings.Split(cfg.IPAddress, "/")[0]
+	return func(port uint16) (net.Conn, error) {
+		return net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(int(port))), 5*time.Second)
+	}
+}
+
+// newPortProxySocket returns the socket pair for a rootless container's proxy: our end, and the
+// child's, which becomes its portProxyFd.
+func newPortProxySocket() (*os.File, *os.File, error) {
+	// SOCK_SEQPACKET keeps each request and answer a message of its own
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create port proxy socket: %w", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "port-proxy"), os.NewFile(uintptr(fds[1]), "port-proxy"), nil
+}
+
+// dialThroughChild returns the dial function of a rootless container: the child connects, from
+// inside the container, and sends us the socket. Our end of the socket pair is the proxy's now,
+// close closes it.
+func (proxy *portProxy) dialThroughChild(socket *os.File) (func(port uint16) (net.Conn, error), error) {
+	c, err := net.FileConn(socket)
+	socket.Close()
+	if err != nil {
+		return nil, err
+	}
+	proxy.child = c
+	conn := c.(*net.UnixConn)
+	// One request at a time, so every answer belongs to the request before it
+	var mu sync.Mutex
+	return func(port uint16) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, port)); err != nil {
+			return nil, err
+		}
+		msg := make([]byte, 256)
+		oob := make([]byte, syscall.CmsgSpace(4))
+		n, oobn, _, _, err := conn.ReadMsgUnix(msg, oob)
+		if err != nil {
+			return nil, err
+		}
+		// No socket means an error message instead
+		cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(cmsgs) == 0 {
+			return nil, errors.New(string(msg[:n]))
+		}
+		fds, err := syscall.ParseUnixRights(&cmsgs[0])
+		if err != nil || len(fds) != 1 {
+			return nil, errors.New("no socket in the answer of the container")
+		}
+		f := os.NewFile(uintptr(fds[0]), "container-conn")
+		defer f.Close()
+		// FileConn makes a copy of the descriptor
+		return net.FileConn(f)
+	}, nil
+}
+
+// servePortProxy runs in the child of a rootless container with published ports or a health
+// check that connects (see health.go): it answers the monitor's requests on portProxyFd, in the
+// background, for as long as the container runs.
+func servePortProxy() error {
+	f := os.NewFile(portProxyFd, "port-proxy")
+	c, err := net.FileConn(f)
+	// FileConn has a copy that is closed on exec. The command mustn't inherit the socket, it
+	// could ask for connections itself.
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("port proxy socket: %w", err)
+	}
+	conn := c.(*net.UnixConn)
+	go func() {
+		buf := make([]byte, 2)
+		for {
+			if n, err := conn.Read(buf); err != nil || n != 2 {
+				// The monitor is gone
+				return
+			}
+			port := binary.BigEndian.Uint16(buf)
+			target, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), 5*time.Second)
+			if err != nil {
+				conn.Write([]byte(err.Error()))
+				continue
+			}
+			f, err := target.(*net.TCPConn).File()
+			target.Close()
+			if err != nil {
+				conn.Write([]byte(err.Error()))
+				continue
+			}
+			conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+			f.Close()
+		}
+	}()
+	return nil
+}
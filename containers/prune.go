@@ -0,0 +1,253 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// A class pulls, builds and runs all afternoon, and every step leaves something on the disk:
+//
+//	images/<ID>/           images without a name: a tag that went to a newer build, a load
+//	                       of an archive without names ("dangling", <none> in docker images)
+//	images/blobs/, layers/ blobs and unpacked layers no image references any more
+//	containers/<ID>/       the upper/ of a stopped container, and of one whose state is gone:
+//	                       the states are in /run, which a reboot empties (see state.go)
+//	builds/<ID>/           the overlay of a RUN of `build` that was interrupted
+//
+// `image prune` removes the dangling images, with -a every image no container uses, and then
+// the blobs no image needs. `system prune` removes the stopped containers too, and what the
+// others left behind. Both say how much space that freed: what the directories took before,
+// less what they take after, in the blocks of the filesystem like du(1) counts them.
+
+// pruneImagesCommand implements `image prune [-a] [-f]`.
+func pruneImagesCommand(args []string) error {
+	fs := flag.NewFlagSet("image prune", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s image prune [OPTIONS]\n\nRemove the images without a name, and the blobs no image needs.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	all := fs.Bool("a", false, "remove every image no container uses, not only the ones without a name")
+	fs.BoolVar(all, "all", false, "same as -a")
+	force := fs.Bool("f", false, "don't ask for confirmation")
+	fs.BoolVar(force, "force", false, "same as -f")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "prune takes no arguments")
+	}
+	warning := "This will remove all dangling images."
+	if *all {
+		warning = "This will remove all images without at least one container associated to them."
+	}
+	if !*force && !confirm(warning) {
+		return nil
+	}
+	before := diskUsage(imageRoot())
+	if err := pruneImages(*all); err != nil {
+		return err
+	}
+	fmt.Printf("Total reclaimed space: %s\n", formatBytes(max(before-diskUsage(imageRoot()), 0)))
+	return nil
+}
+
+// systemCommand implements the `system` commands.
+func systemCommand(args []string) error {
+	fs := flag.NewFlagSet("system", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s system COMMAND\n\nCommands:\n  prune    Remove stopped containers, images without a name and what nothing uses\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing command")
+	}
+	if fs.Arg(0) == "prune" {
+		return systemPrune(fs.Args()[1:])
+	}
+	return usageErrorf(fs, "unknown command %q", fs.Arg(0))
+}
+
+// systemPrune implements `system prune [-a] [-f]`.
+func systemPrune(args []string) error {
+	fs := flag.NewFlagSet("system prune", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s system prune [OPTIONS]\n\nRemove stopped containers, images without a name, and the files nothing uses any more.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	all := fs.Bool("a", false, "remove every image no container uses, not only the ones without a name")
+	fs.BoolVar(all, "all", false, "same as -a")
+	force := fs.Bool("f", false, "don't ask for confirmation")
+	fs.BoolVar(force, "force", false, "same as -f")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "prune takes no arguments")
+	}
+	images := "all dangling images"
+	if *all {
+		images = "all images without at least one container associated to them"
+	}
+	if !*force && !confirm("This will remove:\n  - all stopped containers\n  - "+images+"\n  - the files of containers and builds that are gone") {
+		return nil
+	}
+	// The images, the containers' files and the builds' are below it, the states are in /run
+	dataDir := filepath.Dir(imageRoot())
+	before := diskUsage(dataDir) + diskUsage(stateRoot())
+
+	var stopped []*containerState
+	for _, s := range listStates() {
+		if s.stopped() && s.currentStatus() != statusCreated {
+			stopped = append(stopped, s)
+		}
+	}
+	if len(stopped) > 0 {
+		// removeOne prints each one, under the heading
+		fmt.Println("Deleted Containers:")
+		for _, s := range stopped {
+			if err := removeOne(s.ID, false); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+		fmt.Println()
+	}
+	// What has no state: a container whose state a reboot took, or a build's RUN that died
+	for _, dir := range []string{filepath.Join(dataDir, "containers"), filepath.Join(dataDir, "builds")} {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if _, err := os.Stat(stateDir(entry.Name())); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err := removeTree(filepath.Join(dir, entry.Name())); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				continue
+			}
+			fmt.Printf("Deleted files of gone container: %s\n", shortID(entry.Name()))
+		}
+	}
+	if err := pruneImages(*all); err != nil {
+		return err
+	}
+	after := diskUsage(dataDir) + diskUsage(stateRoot())
+	fmt.Printf("Total reclaimed space: %s\n", formatBytes(max(before-after, 0)))
+	return nil
+}
+
+// pruneImages removes the images without a name, or with all every one, that no container uses,
+// and then the blobs no image references.
+func pruneImages(all bool) error {
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	repos, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	ids, err := imageIDs()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, s := range listStates() {
+		if cfg, err := readConfig(s.ID); err == nil && cfg.ImageID != "" {
+			used[cfg.ImageID] = true
+		}
+	}
+	named := map[string]bool{}
+	for _, id := range repos {
+		named[id] = true
+	}
+
+	var deleted []string
+	for _, id := range ids {
+		if used[id] || (named[id] && !all) {
+			continue
+		}
+		if len(deleted) == 0 {
+			fmt.Println("Deleted Images:")
+		}
+		var names []string
+		for name, other := range repos {
+			if other == id {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			delete(repos, name)
+			fmt.Println("Untagged: " + name)
+		}
+		if len(names) > 0 {
+			if err := writeRepositories(repos); err != nil {
+				return err
+			}
+		}
+		if err := removeTree(imageDir(id)); err != nil {
+			return err
+		}
+		fmt.Println("Deleted: sha256:" + id)
+		deleted = append(deleted, id)
+	}
+	removed, _, err := removeUnreferencedBlobs()
+	for _, digest := range removed {
+		fmt.Println("Deleted blob: " + digest)
+	}
+	if len(deleted) > 0 || len(removed) > 0 {
+		fmt.Println()
+	}
+	return err
+}
+
+// confirm asks whether to go on with what warning says, on the terminal, like Docker's prune.
+func confirm(warning string) bool {
+	fmt.Printf("WARNING! %s\nAre you sure you want to continue? [y/N] ", warning)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// diskUsage is the space the files below dir take on the disk, each counted once like du(1)
+// does: a hard link takes no space of its own.
+func diskUsage(dir string) int64 {
+	var total int64
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]bool{}
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			// Gone already, or not ours to read
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && !seen[inode{st.Dev, st.Ino}] {
+			seen[inode{st.Dev, st.Ino}] = true
+			total += st.Blocks * 512
+		}
+		return nil
+	})
+	return total
+}
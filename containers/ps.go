@@ -0,0 +1,193 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ps implements `ps [OPTIONS]`: the containers in the state directory, like `docker ps`.
+func ps(args []string) error {
+	fs := flag.NewFlagSet("ps", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ps [OPTIONS]\n\nList running containers.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	all := fs.Bool("a", false, "also show containers that have exited")
+	quiet := fs.Bool("q", false, "only print the container IDs")
+	var filters stringList
+	fs.Var(&filters, "f", "only show containers that match: label=KEY, label=KEY=VALUE, status=STATUS or health=starting|healthy|unhealthy|none (repeatable)")
+	fs.Var(&filters, "filter", "same as -f")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "unexpected argument %q", fs.Arg(0))
+	}
+	filter, err := parsePsFilters(filters)
+	if err != nil {
+		return usageErrorf(fs, "invalid --filter: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(tw, "CONTAINER ID\tCOMMAND\tCREATED\tSTATUS\tPID\tPORTS\tLABELS")
+	}
+	for _, s := range listStates() {
+		status := s.currentStatus()
+		// Asking for a status is asking for the containers that have it, running or not
+		if status != statusRunning && status != statusRestarting && !*all && len(filter.statuses) == 0 {
+			continue
+		}
+		if !filter.match(s, status) {
+			continue
+		}
+		if *quiet {
+			fmt.Fprintln(tw, shortID(s.ID))
+			continue
+		}
+
+		var description string
+		switch status {
+		case statusRunning:
+			description = "Up " + humanDuration(time.Since(s.Started)) + healthSuffix(s)
+		case statusCreated:
+			description = "Created"
+		case statusRestarting:
+			description = fmt.Sprintf("Restarting (%d) %s ago", s.ExitCode, humanDuration(time.Since(s.Finished)))
+		case statusExited:
+			description = fmt.Sprintf("Exited (%d) %s ago", s.ExitCode, humanDuration(time.Since(s.Finished)))
+		default:
+			description = "Dead"
+		}
+		pid := "-"
+		if status == statusRunning || status == statusCreated {
+			pid = fmt.Sprint(s.Pid)
+		}
+		// Like in Docker only while the ports are published, which is while the container runs
+		var ports []string
+		if status == statusRunning {
+			for _, p := range s.Ports {
+				ports = append(ports, p.String())
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s ago\t%s\t%s\t%s\t%s\n", shortID(s.ID), truncate(strings.Join(s.Args, " "), 30),
+			humanDuration(time.Since(s.Created)), description, pid, strings.Join(ports, ", "), truncate(formatLabels(s.Labels), 40))
+	}
+	return tw.Flush()
+}
+
+// psFilter is what `ps --filter` asks for. Like in Docker a container must have every label, but
+// only one of the statuses, and one of the health statuses.
+type psFilter struct {
+	// labels maps a label to its value, nil when any value will do
+	labels   map[string]*string
+	statuses []string
+	// health are the health statuses, none for a container without a health check
+	health []string
+}
+
+// parsePsFilters parses the --filter entries of ps.
+func parsePsFilters(entries []string) (psFilter, error) {
+	f := psFilter{labels: map[string]*string{}}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || value == "" {
+			return f, fmt.Errorf("%q is not NAME=VALUE", entry)
+		}
+		switch name {
+		case "label":
+			if key, labelValue, hasValue := strings.Cut(value, "="); hasValue {
+				f.labels[key] = &labelValue
+			} else {
+				f.labels[key] = nil
+			}
+		case "status":
+			if !slices.Contains([]string{statusCreated, statusRunning, statusExited, statusRestarting, statusDead}, value) {
+				return f, fmt.Errorf("unknown status %q", value)
+			}
+			f.statuses = append(f.statuses, value)
+		case "health":
+			if !slices.Contains([]string{healthStarting, healthHealthy, healthUnhealthy, "none"}, value) {
+				return f, fmt.Errorf("unknown health %q, expected starting, healthy, unhealthy or none", value)
+			}
+			f.health = append(f.health, value)
+		default:
+			return f, fmt.Errorf("unknown filter %q, expected label, status or health", name)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether container s, whose current status is status, passes f.
+func (f psFilter) match(s *containerState, status string) bool {
+	for key, want := range f.labels {
+		value, ok := s.Labels[key]
+		if !ok || (want != nil && value != *want) {
+			return false
+		}
+	}
+	health := "none"
+	if s.Health != nil {
+		health = s.Health.Status
+	}
+	if len(f.health) > 0 && !slices.Contains(f.health, health) {
+		return false
+	}
+	return len(f.statuses) == 0 || slices.Contains(f.statuses, status)
+}
+
+// formatLabels prints labels the way Docker's `ps --format {{.Labels}}` does: KEY=VALUE,KEY=VALUE,
+// sorted so the order doesn't change from one ps to the next.
+func formatLabels(labels map[string]string) string {
+	var entries []string
+	for key, value := range labels {
+		entries = append(entries, key+"="+value)
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, ",")
+}
+
+// humanDuration formats d the way Docker does in `ps`: "5 seconds", "About a minute", "3 hours".
+func humanDuration(d time.Duration) string {
+	switch seconds := int(d.Seconds()); {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	switch minutes := int(d.Minutes()); {
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	switch hours := int(d.Round(time.Hour).Hours()); {
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	default:
+		return fmt.Sprintf("%d days", hours/24)
+	}
+}
+
+// truncate shortens s to at most n characters, marking the cut with "…"
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
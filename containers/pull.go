@@ -0,0 +1,328 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// `pull` fetches an image from a registry with the requests of registry.go, and puts it into the
+// image store like `import` does:
+//
+//  1. The manifest of the tag. If it's an index, a manifest per platform, the manifest for
+//     our platform (see platform.go), which the index names by its digest.
+//  2. The config blob. Its sha256 is the image ID, the same one `docker images` shows. If the
+//     store has that image, the tag was only moved back to it and we are done.
+//  3. Every layer blob the blob store doesn't have yet (see blobs.go), each unpacked into a
+//     directory of its own with extractTar. The container's root is their overlay (overlay.go):
+//     a layer adds its files on top of the ones below it. Several download at the same time, and
+//     an interrupted download resumes (see download.go).
+//
+// A layer that deletes a file of a layer below it says so with a "whiteout" entry, an empty file
+// .wh.NAME, which becomes a whiteout of overlayfs.
+//
+// Nothing the registry sends is trusted before its digest is checked, and a pull that gets other
+// bytes than a digest says fails, at the first one:
+//
+//	the manifest    the @sha256: digest of the pull, or the one the registry says the tag has
+//	                (registry.go), and in an index the digest of the platform's entry
+//	the config      the digest and size the manifest says, before anything reads it
+//	every layer     the digest and size the manifest says, while it is downloaded (blobs.go),
+//	                and the uncompressed tar the diff ID in the config's rootfs.diff_ids says,
+//	                while it is unpacked into a new directory, which only a match puts into the
+//	                store
+//
+// That is a chain: the digest of the manifest vouches for the config and the layers it names,
+// the config for the content of the layers. Who has the digest of the manifest knows what runs,
+// whatever server or proxy it came from. Whether the digest is the right one, the one those
+// who made the image published, is what signatures are for: pull --verify, see cosign.go.
+
+// pull implements `pull [--platform OS/ARCH] [--verify [--key FILE]] NAME`.
+func pull(args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s pull [OPTIONS] NAME[:TAG|@DIGEST]\n\nDownload an image from a registry, Docker Hub if NAME doesn't start with one.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	platformFlag := fs.String("platform", "", "pull the image of another platform, OS/ARCH[/VARIANT] like linux/arm64 (default "+hostPlatform().String()+")")
+	verify := fs.Bool("verify", false, "fail unless the image has a valid cosign signature (see cosign.go), of --key or keyless of --certificate-identity")
+	keyFile := fs.String("key", "", "with --verify, the public key `FILE` the signature must be of, like cosign.pub")
+	identity := fs.String("certificate-identity", "", "with --verify and no --key, the e-mail address or URI of the keyless signer")
+	issuer := fs.String("certificate-oidc-issuer", "", "with --verify and no --key, where the keyless signer logged in, like https://accounts.google.com")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected NAME")
+	}
+	var policy *signaturePolicy
+	if *verify {
+		var err error
+		if policy, err = newSignaturePolicy(*keyFile, *identity, *issuer); err != nil {
+			return err
+		}
+	} else if *keyFile != "" || *identity != "" || *issuer != "" {
+		return usageErrorf(fs, "--key and --certificate-* go with --verify")
+	}
+	ref, err := parseReference(fs.Arg(0))
+	if err != nil {
+		return usageErrorf(fs, "%v", err)
+	}
+	platform := hostPlatform()
+	if *platformFlag != "" {
+		if platform, err = parsePlatform(*platformFlag); err != nil {
+			return usageErrorf(fs, "%v", err)
+		}
+	}
+	id, err := pullImage(ref, platform, policy, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("sha256:" + id)
+	return nil
+}
+
+// pullImage downloads the image ref for platform into the store and returns its ID. Unless policy
+// is nil, the image must have a signature it accepts. The progress goes to out.
+func pullImage(ref imageReference, platform ociPlatform, policy *signaturePolicy, out io.Writer) (string, error) {
+	pulling := startSpan("pull", "image", ref.String())
+	id, err := downloadImage(ref, platform, policy, out)
+	pulling.end(err)
+	return id, err
+}
+
+// downloadImage does the work of pullImage.
+func downloadImage(ref imageReference, platform ociPlatform, policy *signaturePolicy, out io.Writer) (string, error) {
+	c := newRegistryClient(ref)
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	fmt.Fprintf(out, "Pulling %s from %s\n", ref, ref.Registry)
+	m, data, err := c.manifest(reference)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	fmt.Fprintf(out, "Digest: sha256:%s\n", hex.EncodeToString(digest[:]))
+	// What is signed is the digest of what the name points at, for most images the index
+	if policy != nil {
+		if err := verifySignatures(c, "sha256:"+hex.EncodeToString(digest[:]), policy, out); err != nil {
+			return "", err
+		}
+	}
+	if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList {
+		desc, err := selectPlatform(m, platform)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", ref, err)
+		}
+		// manifest checked the digest, the size is the index's too
+		if m, data, err = c.manifest(desc.Digest); err != nil {
+			return "", err
+		}
+		if err := verifyContent(data, *desc); err != nil {
+			return "", fmt.Errorf("%s: manifest %s: %w", ref, desc.Digest, err)
+		}
+	}
+	if m.MediaType != mediaTypeOCIManifest && m.MediaType != mediaTypeDockerManifest {
+		return "", fmt.Errorf("%s: unsupported manifest type %q", ref, m.MediaType)
+	}
+	// Layers are tar or tar+gzip, which openArchive tells apart by themselves. zstd needs a
+	// decompressor the standard library doesn't have.
+	for _, layer := range m.Layers {
+		if strings.HasSuffix(layer.MediaType, "+zstd") {
+			return "", fmt.Errorf("%s: layer %s is compressed with zstd, which is not supported", ref, layer.Digest)
+		}
+	}
+
+	blob, err := c.blob(m.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	configData, err := io.ReadAll(io.LimitReader(blob, 4<<20))
+	blob.Close()
+	if err == nil {
+		err = verifyContent(configData, m.Config)
+	}
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", m.Config.Digest, err)
+	}
+	// A manifest that isn't in an index says its platform in the config
+	var config imageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return "", fmt.Errorf("config %s: %w", m.Config.Digest, err)
+	}
+	if !platform.matches(config.platform()) {
+		return "", fmt.Errorf("%s is an image for %s, not %s", ref, config.platform(), platform)
+	}
+	if host := hostPlatform(); config.Architecture != host.Architecture {
+		fmt.Fprintf(out, "Warning: the image is for %s, this machine is %s: its programs need qemu-user and binfmt_misc to run\n", config.platform(), host)
+	}
+	if len(config.RootFS.DiffIDs) != len(m.Layers) {
+		return "", fmt.Errorf("%s: the manifest has %d layers, the config %d diff IDs", ref, len(m.Layers), len(config.RootFS.DiffIDs))
+	}
+	id := strings.TrimPrefix(m.Config.Digest, "sha256:")
+
+	// Until the image is in the store its blobs are referenced by nothing, and rmi would remove
+	// them
+	unlock, err := lockImages()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	repoDigest := "sha256:" + hex.EncodeToString(digest[:])
+	if _, err := os.Stat(imageDir(id)); err == nil {
+		fmt.Fprintf(out, "Image is up to date for %s\n", ref)
+		if err := addRepoDigest(id, ref.repository(), repoDigest); err != nil {
+			return "", err
+		}
+		return id, tagImage(ref.String(), id)
+	}
+
+	skipped, err := pullLayers(c, m.Layers, config.RootFS.DiffIDs, out)
+	if err != nil {
+		return "", err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(out, "Warning: skipped %d device nodes, creating them takes root (the container gets its own /dev)\n", skipped)
+	}
+	if id, err = addImage(ref.String(), configData, data); err != nil {
+		return "", err
+	}
+	if err := addRepoDigest(id, ref.repository(), repoDigest); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Downloaded newer image for %s\n", ref)
+	return id, nil
+}
+
+// selectPlatform returns the manifest of an index for platform.
+func selectPlatform(index *ociManifest, platform ociPlatform) (*ociDescriptor, error) {
+	var available []string
+	for i, desc := range index.Manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		if platform.matches(*desc.Platform) {
+			return &index.Manifests[i], nil
+		}
+		available = append(available, desc.Platform.String())
+	}
+	return nil, fmt.Errorf("no image for %s, only for %s", platform, strings.Join(available, ", "))
+}
+
+// verifyContent checks that data is the content desc describes, by its size and digest.
+func verifyContent(data []byte, desc ociDescriptor) error {
+	digest := sha256.Sum256(data)
+	if got := "sha256:" + hex.EncodeToString(digest[:]); got != desc.Digest {
+		return fmt.Errorf("the content has the digest %s, not %s", got, desc.Digest)
+	}
+	if int64(len(data)) != desc.Size {
+		return fmt.Errorf("the content has %d bytes, not %d", len(data), desc.Size)
+	}
+	return nil
+}
+
+// verifyDiffID checks that the uncompressed content of the layer in the blob store has the
+// diff ID diffID.
+func verifyDiffID(layer ociDescriptor, diffID string) error {
+	f, err := openBlob(layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archive, err := openArchive(f)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, archive); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != diffID {
+		return fmt.Errorf("the uncompressed content has the diff ID %s, the config says %s", got, diffID)
+	}
+	return nil
+}
+
+// unpackLayer unpacks the blob of a layer into its directory of the store. Unless diffID is
+// empty, the uncompressed tar must have it, or the layer doesn't go into the store. Unless
+// progress is nil, it's told how many bytes of the blob were read.
+func unpackLayer(layer ociDescriptor, diffID string, progress func(done int64)) (unpackResult, error) {
+	f, err := openBlob(layer.Digest)
+	if err != nil {
+		return unpackResult{}, err
+	}
+	defer f.Close()
+	var blob io.Reader = f
+	if progress != nil {
+		blob = &progressReader{r: f, report: progress}
+	}
+	archive, err := openArchive(blob)
+	if err != nil {
+		return unpackResult{}, err
+	}
+	dir, err := newLayerDir()
+	if err != nil {
+		return unpackResult{}, err
+	}
+	// The diff ID is of all of the tar, the padding after its end marker too, like in import
+	hash := sha256.New()
+	tee := io.TeeReader(archive, hash)
+	result, err := extractTar(tee, dir, true)
+	if err == nil {
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); err == nil && diffID != "" && got != diffID {
+		err = fmt.Errorf("the uncompressed content has the diff ID %s, the config says %s", got, diffID)
+	}
+	if err == nil {
+		err = commitLayer(dir, layer.Digest)
+	}
+	if err != nil {
+		removeTree(dir)
+	}
+	return result, err
+}
+
+// findOrPullImage returns the image called name from the store, and pulls it first if the store
+// doesn't have it, like `docker run` does. platform is that of --platform, or nil: then the image
+// in the store is used whatever its platform, and a pull gets the host's.
+func findOrPullImage(name string, platform *ociPlatform) (string, *imageConfig, error) {
+	id, config, err := findImage(name)
+	switch {
+	case err == nil && (platform == nil || platform.matches(config.platform())):
+		return id, config, nil
+	case err == nil:
+		fmt.Fprintf(os.Stderr, "The image %s is for %s, not %s\n", name, config.platform(), platform)
+	case errors.Is(err, errNoSuchImage):
+		fmt.Fprintf(os.Stderr, "Unable to find image %s locally\n", name)
+	default:
+		return "", nil, err
+	}
+	ref, err := parseReference(name)
+	if err != nil {
+		return "", nil, err
+	}
+	want := hostPlatform()
+	if platform != nil {
+		want = *platform
+	}
+	// The progress goes to stderr, stdout is the container's
+	if id, err = pullImage(ref, want, nil, os.Stderr); err != nil {
+		return "", nil, err
+	}
+	config, err = readImageConfig(id)
+	return id, config, err
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An image reference says where an image is and which one: "alpine" is short for
+//
+//	docker.io/library/alpine:latest
+//	└──┬────┘ └────┬──────┘ └─┬──┘
+//	registry   repository    tag    (or @sha256:..., a digest: exactly this content)
+//
+// A reference can have both, like alpine:3.19@sha256:..., which Kubernetes manifests and
+// Dockerfiles pin their images with: the digest says which image it is, the tag is for the reader
+// and isn't looked at. Pulled, it's the image alpine@sha256:..., like in Docker.
+//
+// The first component is a registry if it looks like a host name: it has a dot or a port, or
+// is "localhost". Otherwise the image is on Docker Hub, and a single component there is one of
+// the official images in "library/". Same rules as Docker's, so the same names work.
+
+// dockerHub is the registry of names without one, and dockerHubHost where its API is
+const (
+	dockerHub     = "docker.io"
+	dockerHubHost = "registry-1.docker.io"
+)
+
+// The grammar of the parts of a reference, from the distribution spec
+var (
+	referenceComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	referenceHost      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	referenceTag       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	referenceDigest    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// imageReference is a parsed image reference. Tag is "latest" if neither it nor Digest is given.
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseReference parses an image reference like alpine, alpine:3.19, ghcr.io/org/app@sha256:...,
+// localhost:5000/app:dev or alpine:3.19@sha256:...
+func parseReference(s string) (imageReference, error) {
+	var ref imageReference
+	invalid := func(why string) (imageReference, error) {
+		return imageReference{}, fmt.Errorf("invalid image reference %q: %s", s, why)
+	}
+	name, digest, hasDigest := strings.Cut(s, "@")
+	if hasDigest {
+		if !referenceDigest.MatchString(digest) {
+			return invalid("the digest must be sha256: and 64 hex digits")
+		}
+		ref.Digest = digest
+	}
+	// A colon after the last slash starts the tag, one before it is the registry's port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !referenceTag.MatchString(ref.Tag) {
+			return invalid("a tag has letters, digits, _ . and -, at most 128")
+		}
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		if !referenceHost.MatchString(first) {
+			return invalid("bad registry host")
+		}
+		ref.Registry, name = first, rest
+	} else {
+		ref.Registry = dockerHub
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if !referenceComponent.MatchString(component) {
+			return invalid("the name has lower-case letters, digits and . _ - between them, separated by /")
+		}
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// repository is the repository with its registry, the short way: Docker Hub's is left out, and
+// so is "library/" of its official images.
+func (r imageReference) repository() string {
+	if r.Registry != dockerHub {
+		return r.Registry + "/" + r.Repository
+	}
+	return strings.TrimPrefix(r.Repository, "library/")
+}
+
+// String is the reference the short way, the name of the image in our store: alpine:latest,
+// ghcr.io/org/app@sha256:... A digest goes before a tag.
+func (r imageReference) String() string {
+	if r.Digest != "" {
+		return r.repository() + "@" + r.Digest
+	}
+	return r.repository() + ":" + r.Tag
+}
+
+// normalizeImageName checks an image name and returns it the way the store knows it: alpine
+// and docker.io/library/alpine are both alpine:latest.
+func normalizeImageName(name string) (string, error) {
+	ref, err := parseReference(name)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
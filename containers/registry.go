@@ -0,0 +1,389 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A registry is a web server with the images in it, and the OCI distribution spec is its API.
+// Pulling an image takes three kinds of requests:
+//
+//	GET /v2/library/alpine/manifests/latest    the manifest: which config and layers make up the
+//	                                           image, each by its digest (or an index of manifests,
+//	                                           one per platform)
+//	GET /v2/library/alpine/blobs/sha256:...    the config, then every layer, a tar.gz
+//
+// Everything in a registry is content-addressed: a blob's name is the sha256 of its bytes, a
+// manifest names them that way, and a manifest itself can be fetched by its digest instead of
+// a tag. A tag is the only name that moves, to another manifest when the image is rebuilt.
+//
+// Docker Hub, like most registries, wants a token even for public images. The first request
+// is answered with 401 and a header that says where to get one:
+//
+//	WWW-Authenticate: Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+//
+// The token service hands out anonymous tokens for public repositories, good for a few minutes,
+// and for private ones to a user it knows: we ask with basic authentication, the user and
+// password of credentials.go. A few registries want those with every request instead, their
+// challenge is "Basic realm=...".
+//
+// A blob can also be asked for from an offset on, with the header "Range: bytes=OFFSET-" of HTTP:
+// a registry that can answers 206 Partial Content, which is how an interrupted download goes on
+// where it stopped (see download.go). One that can't sends all of it, with 200.
+//
+// Docker Hub limits how many manifests an IP address may pull, fewer anonymously than logged in:
+// it answers 429 Too Many Requests, and the RateLimit-Limit header says what the limit is,
+// "100;w=21600" is 100 per 6 hours.
+
+// The media types of manifests and indexes, OCI's and Docker's, which registries still serve for
+// many images
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestMediaTypes is what we accept for a manifest, in the order we prefer them
+var manifestMediaTypes = []string{mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest}
+
+// ociDescriptor points at content by its digest: a config, a layer, or one of the manifests of
+// an index.
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+	// Annotations are notes about it, like the name of an image in an image layout
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociPlatform is the platform of a manifest in an index.
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is a manifest, or an index of manifests, which has Manifests instead of Config and
+// Layers.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests,omitempty"`
+}
+
+// registryClient talks to the registry of one repository.
+type registryClient struct {
+	ref    imageReference
+	base   string
+	client *http.Client
+	// mu guards what follows: the layers are downloaded in parallel, and a token that expired
+	// is renewed by whichever download gets the 401
+	mu sync.Mutex
+	// token is the bearer token, once a 401 told us where to get one
+	token string
+	// basic is set when the registry wants the credentials with every request
+	basic bool
+	// user and password are the credentials, read at the first 401
+	user, password  string
+	credentialsRead bool
+}
+
+// newRegistryClient returns a client for the repository of ref. A registry on this machine is
+// spoken to over plain HTTP, like Docker does for 127.0.0.0/8: that's a `docker run registry:2`
+// for testing, without certificates.
+func newRegistryClient(ref imageReference) *registryClient {
+	host := ref.Registry
+	if host == dockerHub {
+		host = dockerHubHost
+	}
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return &registryClient{
+		ref:  ref,
+		base: scheme + "://" + host + "/v2/" + ref.Repository,
+		// No timeout for the whole request, a layer may take minutes. Only for the answer to start.
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 30 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+		}},
+	}
+}
+
+// get requests path below the repository, like "manifests/latest", with header, and gets a
+// token first if the registry wants one. Anything but 200 is an error, or 206 for a Range.
+func (c *registryClient) get(path string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, c.base+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		c.mu.Lock()
+		if c.basic {
+			req.SetBasicAuth(c.user, c.password)
+		} else if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		c.mu.Unlock()
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK || (resp.StatusCode == http.StatusPartialContent && header.Get("Range") != "") {
+			return resp, nil
+		}
+		err = registryError(resp)
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && attempt > 0 {
+			c.mu.Lock()
+			user := c.user
+			c.mu.Unlock()
+			// Docker Hub says so for a repository that doesn't exist, too
+			if user == "" {
+				return nil, fmt.Errorf("pull access denied for %s, the repository doesn't exist or needs a login (%s): %w", c.ref.repository(), dockerConfigPath(), err)
+			}
+			return nil, fmt.Errorf("pull access denied for %s to %s: %w", c.ref.repository(), user, err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || challenge == "" {
+			return nil, err
+		}
+		c.mu.Lock()
+		err = c.authenticate(challenge)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate answers the challenge of a 401: it gets a token from the token service the
+// challenge names, or sends the credentials from now on. c.mu must be held.
+func (c *registryClient) authenticate(challenge string) error {
+	if !c.credentialsRead {
+		var err error
+		if c.user, c.password, err = registryCredentials(c.ref.Registry); err != nil {
+			return fmt.Errorf("credentials for %s: %w", c.ref.Registry, err)
+		}
+		c.credentialsRead = true
+	}
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "Basic") {
+		if c.user == "" {
+			return fmt.Errorf("%s needs a login, we found none for it in %s", c.ref.Registry, dockerConfigPath())
+		}
+		c.basic = true
+		return nil
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("the registry wants %s authentication, we know Bearer and Basic", scheme)
+	}
+	values := parseChallenge(params)
+	if values["realm"] == "" {
+		return errors.New("the registry's token challenge has no realm")
+	}
+	u, err := url.Parse(values["realm"])
+	if err != nil {
+		return fmt.Errorf("token realm: %w", err)
+	}
+	query := u.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	// The scope of the challenge, or the one we need
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && c.user != "" {
+		return fmt.Errorf("login to %s as %s failed, check the credentials in %s: %w", c.ref.Registry, c.user, dockerConfigPath(), registryError(resp))
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get token: %w", registryError(resp))
+	}
+	// Docker's token service calls it token, OAuth2's access_token
+	var answer struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("get token: %w", err)
+	}
+	c.token = answer.Token
+	if c.token == "" {
+		c.token = answer.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("get token: the token service sent none")
+	}
+	return nil
+}
+
+// parseChallenge parses the key="value" pairs of a WWW-Authenticate header, separated by commas.
+func parseChallenge(s string) map[string]string {
+	values := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+		s = strings.TrimLeft(rest, ", ")
+	}
+	return values
+}
+
+// registryError turns an answer that isn't 200 into an error, with the message of the JSON
+// error document the spec defines, if there is one.
+func registryError(resp *http.Response) error {
+	var doc struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	message := resp.Status
+	if json.Unmarshal(body, &doc) == nil && len(doc.Errors) > 0 {
+		message = fmt.Sprintf("%s (%s)", doc.Errors[0].Message, doc.Errors[0].Code)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%s: the registry's rate limit is reached%s, log in for a higher one (%s): %s", resp.Request.URL.Host, rateLimit(resp.Header), dockerConfigPath(), message)
+	}
+	return fmt.Errorf("%s: %s", resp.Request.URL, message)
+}
+
+// rateLimit describes the RateLimit-Limit and Retry-After headers of a 429, like ", 100 pulls
+// per 6h0m0s".
+func rateLimit(header http.Header) string {
+	var s string
+	// "100;w=21600": 100 in a window of 21600 seconds
+	if limit, window, ok := strings.Cut(header.Get("RateLimit-Limit"), ";w="); ok {
+		if seconds, err := strconv.Atoi(window); err == nil {
+			s += fmt.Sprintf(", %s pulls per %s", limit, time.Duration(seconds)*time.Second)
+		}
+	}
+	// Seconds, or a date
+	if after := header.Get("Retry-After"); after != "" {
+		if _, err := strconv.Atoi(after); err == nil {
+			after += "s"
+		}
+		s += ", retry after " + after
+	}
+	return s
+}
+
+// manifest fetches the manifest reference points at, a tag or a digest, and returns it with its
+// raw bytes. Those have to be what the digest says: the one asked for, or for a tag the one the
+// registry says in its Docker-Content-Digest header, when it says one.
+func (c *registryClient) manifest(reference string) (*ociManifest, []byte, error) {
+	resp, err := c.get("manifests/"+reference, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	// Manifests are small, a large one isn't one
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	want := reference
+	if !strings.HasPrefix(want, "sha256:") {
+		want = resp.Header.Get("Docker-Content-Digest")
+	}
+	sum := sha256.Sum256(data)
+	if got := "sha256:" + hex.EncodeToString(sum[:]); strings.HasPrefix(want, "sha256:") && got != want {
+		return nil, nil, fmt.Errorf("manifest %s: the content has the digest %s, not %s", reference, got, want)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("manifest %s: %w", reference, err)
+	}
+	// Docker's manifests have the media type inside, OCI's may only have it in the header
+	if m.MediaType == "" {
+		m.MediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+	return &m, data, nil
+}
+
+// blob starts the download of the blob with digest. Close the body.
+func (c *registryClient) blob(digest string) (io.ReadCloser, error) {
+	resp, err := c.get("blobs/"+digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// blobFrom starts the download of the blob with digest from the byte offset on. If the registry
+// sends all of it instead, resumed is false. Close the body.
+func (c *registryClient) blobFrom(digest string, offset int64) (body io.ReadCloser, resumed bool, err error) {
+	if offset == 0 {
+		body, err := c.blob(digest)
+		return body, false, err
+	}
+	resp, err := c.get("blobs/"+digest, http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}})
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, false, nil
+	}
+	// Content-Range: bytes 1048576-4194303/4194304, the range has to be the one asked for
+	var start, end, size int64
+	if n, _ := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); n != 3 || start != offset {
+		resp.Body.Close()
+		return nil, false, fmt.Errorf("blob %s: asked for bytes %d-, the registry sent %q", digest, offset, resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, true, nil
+}
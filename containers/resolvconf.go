@@ -0,0 +1,144 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Programs find their DNS servers in /etc/resolv.conf, and the rootfs has the one of whoever
+// built it, or none. Docker writes one for every container, next to its state, and bind-mounts
+// it on /etc/resolv.conf: a copy of the host's, with the nameservers the container can't reach
+// taken out. Those are the ones on the host's loopback device, like systemd-resolved's stub
+// 127.0.0.53: in the container 127.0.0.53 is its own lo, where nobody answers. systemd-resolved
+// keeps the list of the real servers in another file, that one is used then.
+
+// The host's resolv.conf, and systemd-resolved's list of the servers behind its stub
+const (
+	hostResolvConf     = "/etc/resolv.conf"
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// defaultNameservers are Docker's, for when none of the host's is left
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// writeResolvConf writes the resolv.conf of the container into its state directory and sets
+// cfg.ResolvConf to it. It is written again at every start: the host's may have changed.
+func writeResolvConf(cfg *containerConfig) error {
+	host, err := readHostResolvConf(cfg.Network == networkHost, cfg.IPAddress6 != "")
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	nameservers := cfg.DNS
+	if cfg.EmbeddedDNS != "" {
+		nameservers = []string{cfg.EmbeddedDNS}
+	}
+	if len(nameservers) == 0 {
+		nameservers = cfg.Nameservers
+	}
+	if len(nameservers) == 0 {
+		nameservers = host.nameservers
+	}
+	if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	search := cfg.DNSSearch
+	if len(search) == 0 {
+		search = host.search
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	options := cfg.DNSOptions
+	if len(options) == 0 {
+		options = host.options
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(options, " "))
+	}
+
+	path := filepath.Join(stateDir(cfg.ID), "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write resolv.conf: %w", err)
+	}
+	cfg.ResolvConf = path
+	return nil
+}
+
+// resolvConf is what we take from a resolv.conf. The rest, like comments, stays behind.
+type resolvConf struct {
+	nameservers, search, options []string
+}
+
+// readHostResolvConf reads the host's resolv.conf, without the nameservers the container can't
+// reach, unless it shares the host's network and reaches them all: the loopback ones, and the
+// IPv6 ones unless it has an IPv6 address. A host without one has no servers to pass on, the
+// defaults then.
+func readHostResolvConf(hostNetwork, ipv6 bool) (resolvConf, error) {
+	conf, err := parseResolvConf(hostResolvConf)
+	if os.IsNotExist(err) {
+		return resolvConf{}, nil
+	} else if err != nil {
+		return conf, err
+	}
+	if hostNetwork {
+		return conf, nil
+	}
+	unreachable := func(ns string) bool {
+		ip := net.ParseIP(ns)
+		return ip.IsLoopback() || (ip.To4() == nil && !ipv6)
+	}
+	conf.nameservers = slices.DeleteFunc(conf.nameservers, unreachable)
+	if len(conf.nameservers) == 0 {
+		// Only the stub of systemd-resolved, or what else listens on lo
+		if resolved, err := parseResolvConf(resolvedResolvConf); err == nil {
+			conf.nameservers = slices.DeleteFunc(resolved.nameservers, unreachable)
+		}
+	}
+	return conf, nil
+}
+
+// parseResolvConf reads the nameserver, search and options lines of a resolv.conf. search
+// replaces the older domain, the last of them counts, like for the resolver.
+func parseResolvConf(path string) (resolvConf, error) {
+	var conf resolvConf
+	f, err := os.Open(path)
+	if err != nil {
+		return conf, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			// A link-local IPv6 address has the interface after a %, one of the host's, which
+			// the container doesn't have. ParseIP doesn't take those.
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				conf.nameservers = append(conf.nameservers, ip.String())
+			}
+		case "search", "domain":
+			conf.search = fields[1:]
+		case "options":
+			conf.options = append(conf.options, fields[1:]...)
+		}
+	}
+	return conf, scanner.Err()
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies, the names Docker uses for --restart
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// Between two restarts the monitor waits, like Docker: 100ms after the first exit, twice as long
+// after every further one, at most a minute. A container that ran for at least
+// restartResetAfter starts over at 100ms. Without the delay a command that exits right away would
+// keep a CPU busy restarting it.
+const (
+	restartDelayMin   = 100 * time.Millisecond
+	restartDelayMax   = time.Minute
+	restartResetAfter = 10 * time.Second
+)
+
+// stopRequestFile in the state directory tells the monitor that the container was stopped on
+// purpose (`stop`, `rm -f`), so its restart policy doesn't apply
+const stopRequestFile = "stop-requested"
+
+// restartPolicy says when the monitor starts the command of a container again after it exited.
+type restartPolicy struct {
+	Name string `json:"name"`
+	// MaximumRetryCount limits the restarts of "on-failure", 0 means no limit
+	MaximumRetryCount int `json:"maximumRetryCount,omitempty"`
+}
+
+// parseRestartPolicy parses --restart: no, on-failure, on-failure:MAX or always.
+func parseRestartPolicy(v string) (restartPolicy, error) {
+	name, value, hasMax := strings.Cut(v, ":")
+	p := restartPolicy{Name: name}
+	switch name {
+	case restartNo, restartAlways:
+		if hasMax {
+			return p, fmt.Errorf("only %s takes a maximum retry count", restartOnFailure)
+		}
+	case restartOnFailure:
+		if hasMax {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("invalid maximum retry count %q", value)
+			}
+			p.MaximumRetryCount = n
+		}
+	default:
+		return p, errors.New("expected no, on-failure[:MAX] or always")
+	}
+	return p, nil
+}
+
+// shouldRestart decides whether a container that exited with exitCode after restarts restarts is
+// started again.
+func (p restartPolicy) shouldRestart(exitCode, restarts int) bool {
+	switch p.Name {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return exitCode != 0 && (p.MaximumRetryCount == 0 || restarts < p.MaximumRetryCount)
+	}
+	return false
+}
+
+// superviseContainer runs the container like runContainer, and starts it again if its restart
+// policy says so. Every run is a new container init in new namespaces, only the ID, the cgroup,
+// the log and the state file carry over; the state counts the restarts.
+func superviseContainer(cfg *containerConfig, started func()) error {
+	// Registered for the whole time, so a `stop` that sends SIGTERM right after we decided to
+	// restart isn't missed: it is waiting in the channel when the delay begins
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	var prev *containerState
+	delay := restartDelayMin
+	for {
+		begin := time.Now()
+		err := runContainer(cfg, prev, started)
+		// A restart runs the command right away, `start` was only needed once
+		started, cfg.CreateOnly = nil, false
+		// runContainer forwarded those to the container already
+		select {
+		case <-signals:
+		default:
+		}
+
+		restart := false
+		// Under the lock: `stop` writes its request and sends its signal in one go, before or
+		// after the decision, never in the middle of it
+		updateErr := updateState(cfg.ID, func(s *containerState) error {
+			if s.Status == statusRestarting {
+				// The restart failed before the container ran
+				s.Status, s.Finished, s.ExitCode = statusExited, time.Now(), errorExitCode(err)
+				return nil
+			}
+			// Not exited: the container never got to run
+			if s.Status != statusExited || stopRequested(cfg.ID) || !cfg.Restart.shouldRestart(s.ExitCode, s.RestartCount) {
+				return errNoRestart
+			}
+			s.Status = statusRestarting
+			s.RestartCount++
+			restart, prev = true, s
+			return nil
+		})
+		if !restart {
+			// Also when the container never started, or rm removed it
+			return err
+		}
+		if updateErr != nil {
+			return updateErr
+		}
+
+		if time.Since(begin) >= restartResetAfter {
+			delay = restartDelayMin
+		}
+		if !sleepUnlessStopped(signals, delay) {
+			// `stop` during the delay: the container stays exited
+			updateState(cfg.ID, func(s *containerState) error {
+				s.Status, s.RestartCount = statusExited, s.RestartCount-1
+				return nil
+			})
+			return err
+		}
+		delay = min(2*delay, restartDelayMax)
+	}
+}
+
+// errNoRestart tells updateState to leave the state of a container that isn't restarted alone
+var errNoRestart = errors.New("no restart")
+
+// sleepUnlessStopped waits for d, and returns false if one of the signals that would have been
+// forwarded to the container arrives on signals first.
+func sleepUnlessStopped(signals <-chan os.Signal, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-signals:
+		return false
+	}
+}
+
+// requestStop marks container id as stopped on purpose, see stopRequestFile.
+func requestStop(id string) error {
+	err := os.WriteFile(filepath.Join(stateDir(id), stopRequestFile), nil, 0600)
+	// Without a state directory the container is gone already
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("stop %s: %w", shortID(id), err)
+	}
+	return nil
+}
+
+// stopRequested reports whether requestStop was called for container id.
+func stopRequested(id string) bool {
+	_, err := os.Stat(filepath.Join(stateDir(id), stopRequestFile))
+	return err == nil
+}
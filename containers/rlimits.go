@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// rlimits are the older, per-process way of limiting resources: every process has a soft and a
+// hard limit for each resource, setrlimit() changes them, children inherit them. The soft limit is
+// what the kernel enforces, a process may raise it up to the hard limit, and only lower the hard
+// one (raising it takes CAP_SYS_RESOURCE). Unlike a cgroup limit, which is shared by everything in
+// the container, an rlimit counts one process at a time: --ulimit nofile=64 lets every process
+// open 64 files, --memory limits all of them together. And some limits have no cgroup equivalent
+// at all, like the number of open files or the size of a core dump.
+
+// rlimit is one limit of the containerized process, in the OCI runtime spec's form.
+type rlimit struct {
+	// Type is the resource, e.g. "RLIMIT_NOFILE"
+	Type string `json:"type"`
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// rlimitInfinity is RLIM_INFINITY, "no limit"
+const rlimitInfinity = ^uint64(0)
+
+// rlimitResources are the resources setrlimit() knows, by the names of `--ulimit` (which are
+// those of bash's `ulimit` and /etc/security/limits.conf). The numbers from <asm/resource.h> are
+// the same on x86 and arm64, the syscall package only has some of them.
+var rlimitResources = map[string]int{
+	"cpu":        0,  // CPU time in seconds, then SIGXCPU
+	"fsize":      1,  // size of a file the process writes, then SIGXFSZ
+	"data":       2,  // size of the data segment (heap)
+	"stack":      3,  // size of the main thread's stack
+	"core":       4,  // size of a core dump, 0 means none
+	"rss":        5,  // resident memory, ignored since Linux 2.6
+	"nproc":      6,  // processes of the process's real user ID, wherever they run
+	"nofile":     7,  // file descriptors, the highest number plus one
+	"memlock":    8,  // memory locked with mlock()
+	"as":         9,  // size of the address space
+	"locks":      10, // file locks, ignored since Linux 2.4
+	"sigpending": 11, // queued signals
+	"msgqueue":   12, // bytes in POSIX message queues
+	"nice":       13, // how far the nice value may be raised, as 20 - nice
+	"rtprio":     14, // real-time priority
+	"rttime":     15, // CPU time in microseconds under a real-time policy without blocking
+}
+
+// parseUlimit parses a --ulimit value, Docker's syntax: NAME=SOFT[:HARD], e.g. nofile=1024:2048.
+// Without HARD both limits are SOFT, -1 or "unlimited" means no limit.
+func parseUlimit(v string) (rlimit, error) {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return rlimit{}, errors.New("expected NAME=SOFT[:HARD]")
+	}
+	if _, ok := rlimitResources[name]; !ok {
+		return rlimit{}, fmt.Errorf("unknown resource %q", name)
+	}
+	soft, hard, hasHard := strings.Cut(value, ":")
+	if !hasHard {
+		hard = soft
+	}
+	l := rlimit{Type: "RLIMIT_" + strings.ToUpper(name)}
+	var err error
+	if l.Soft, err = parseRlimitValue(soft); err != nil {
+		return l, err
+	}
+	if l.Hard, err = parseRlimitValue(hard); err != nil {
+		return l, err
+	}
+	if l.Soft > l.Hard {
+		return l, errors.New("the soft limit can't be above the hard limit")
+	}
+	return l, nil
+}
+
+// parseRlimitValue parses one limit of --ulimit.
+func parseRlimitValue(v string) (uint64, error) {
+	if v == "-1" || v == "unlimited" {
+		return rlimitInfinity, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q", v)
+	}
+	return n, nil
+}
+
+// rlimitResource returns the setrlimit() number of an rlimit type like "RLIMIT_NOFILE".
+func rlimitResource(typ string) (int, bool) {
+	name, ok := strings.CutPrefix(typ, "RLIMIT_")
+	if !ok {
+		return 0, false
+	}
+	resource, ok := rlimitResources[strings.ToLower(name)]
+	return resource, ok
+}
+
+// setRlimits sets the limits of process pid, 0 for ourselves. What the child sets before the exec
+// the command inherits, exec sets them on the command it started.
+//
+// Our own limits go through syscall.Setrlimit: Go raises its soft limit of open files at startup,
+// and puts the old one back in every process it starts, unless the program set one itself.
+func setRlimits(pid int, limits []rlimit) error {
+	for _, l := range limits {
+		resource, ok := rlimitResource(l.Type)
+		if !ok {
+			return fmt.Errorf("unknown rlimit %s", l.Type)
+		}
+		limit := syscall.Rlimit{Cur: l.Soft, Max: l.Hard}
+		var err error
+		if pid == 0 {
+			err = syscall.Setrlimit(resource, &limit)
+		} else if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0); errno != 0 {
+			err = errno
+		}
+		if err != nil {
+			// EPERM: raising a hard limit needs CAP_SYS_RESOURCE, which a rootless container lacks
+			return fmt.Errorf("set %s: %w", l.Type, err)
+		}
+	}
+	return nil
+}
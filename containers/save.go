@@ -0,0 +1,336 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An image leaves the store the way it came from the registry: as blobs named by their digest.
+// The OCI image layout is the registry's content in a directory, or a tar of one, and every tool
+// reads it (docker load, podman load, skopeo, containerd's ctr import):
+//
+//	oci-layout               {"imageLayoutVersion": "1.0.0"}, this is an image layout
+//	index.json               the manifests of the images, each with its name in an annotation
+//	blobs/sha256/<hex>       the manifests, configs and layers, as the store has them
+//	manifest.json            the same once more the way `docker save` wrote it before 25.0:
+//	                         [{"Config": "blobs/sha256/...", "RepoTags": [...], "Layers": [...]}]
+//
+// Docker 25 writes both, and so do we: older Dockers read manifest.json only. The blobs aren't
+// unpacked or packed again, so the digests stay the same and a registry that gets the image
+// pushed finds the layers it already has.
+
+// The names of an image in the index.json of an image layout: containerd's and Docker's whole
+// name, and the OCI spec's, which is the tag only
+const (
+	annotationImageName = "io.containerd.image.name"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+)
+
+// ociIndex is the index.json of an image layout, an index of the images' manifests.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// dockerSaveManifest is an entry of the manifest.json of `docker save`.
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// imageCommand implements the `image` commands.
+func imageCommand(args []string) error {
+	fs := flag.NewFlagSet("image", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s image COMMAND\n\nCommands:\n  load     Load images from a tar archive of an OCI image layout or docker save\n  ls       List the images of the store, like images\n  prune    Remove images without a name, and the blobs no image needs\n  save     Write images to a tar archive of an OCI image layout\n  sbom     List the packages of an image as an SPDX or CycloneDX SBOM\n  tag      Give an image another name, like tag\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing command")
+	}
+	switch fs.Arg(0) {
+	case "load":
+		return loadImages(fs.Args()[1:])
+	case "ls", "list":
+		return listImages(fs.Args()[1:])
+	case "prune":
+		return pruneImagesCommand(fs.Args()[1:])
+	case "save":
+		return saveImages(fs.Args()[1:])
+	case "sbom":
+		return sbomCommand(fs.Args()[1:])
+	case "tag":
+		return tagCommand(fs.Args()[1:])
+	}
+	return usageErrorf(fs, "unknown command %q", fs.Arg(0))
+}
+
+// saveImages implements `image save [-o FILE] IMAGE...`.
+func saveImages(args []string) error {
+	fs := flag.NewFlagSet("image save", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s image save [OPTIONS] IMAGE...\n\nWrite images, by name or ID, to a tar archive of an OCI image layout, which docker load and podman load read.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", "", "write the archive to `FILE`, not to the standard output")
+	fs.StringVar(output, "output", "", "same as -o")
+	// Like docker, the options may come after the images too: `image save alpine -o alpine.tar`.
+	// The flag package stops at the first image, so it parses again after each one.
+	var names []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return err
+			}
+			return errUsage
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		// After "--" everything is an image
+		if len(args) > len(rest) && args[len(args)-len(rest)-1] == "--" {
+			names = append(names, rest...)
+			break
+		}
+		names, args = append(names, rest[0]), rest[1:]
+	}
+	if len(names) == 0 {
+		return usageErrorf(fs, "missing IMAGE")
+	}
+	if *output == "" && isTerminal(os.Stdout) {
+		return usageErrorf(fs, "refusing to write an archive to a terminal, use -o FILE or redirect the output")
+	}
+
+	// rmi would remove the blobs while we copy them
+	unlock, err := lockImages()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Every image must be there before the first byte goes out, on the standard output half an
+	// archive can't be taken back
+	for _, name := range names {
+		if err := checkSavable(name); err != nil {
+			return err
+		}
+	}
+
+	if *output == "" {
+		return writeImageLayout(os.Stdout, names)
+	}
+	// Written next to FILE and renamed, so a failed save doesn't leave half an archive
+	f, err := os.CreateTemp(filepath.Dir(*output), "."+filepath.Base(*output)+"-*")
+	if err != nil {
+		return err
+	}
+	err = writeImageLayout(f, names)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// CreateTemp's file is ours only, an archive is for others too
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), *output)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// checkSavable tells whether image name is in the store with its blobs, as writeImageLayout
+// needs it.
+func checkSavable(name string) error {
+	id, _, err := findImage(name)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(imageDir(id), "manifest.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errNoBlobs(name)
+	}
+	return err
+}
+
+// errNoBlobs is the error of an image imported before images had their blobs in the store.
+func errNoBlobs(name string) error {
+	return fmt.Errorf("image %s has no blobs, it is from before the blob store: import or pull it again", name)
+}
+
+// writeImageLayout writes the tar of an OCI image layout with the images names to w. The lock of
+// the store must be taken.
+func writeImageLayout(w io.Writer, names []string) error {
+	repos, err := readRepositories()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	var dockerManifests []dockerSaveManifest
+	written := map[string]bool{}
+	for _, name := range names {
+		id, _, err := findImage(name)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(imageDir(id), "manifest.json"))
+		if errors.Is(err, os.ErrNotExist) {
+			return errNoBlobs(name)
+		} else if err != nil {
+			return err
+		}
+		var m ociManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("image %s: %w", shortID(id), err)
+		}
+
+		// The manifest is a blob in the layout, like in a registry
+		sum := sha256.Sum256(data)
+		desc := ociDescriptor{
+			MediaType: m.MediaType,
+			Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+			Size:      int64(len(data)),
+		}
+		if desc.MediaType == "" {
+			desc.MediaType = mediaTypeOCIManifest
+		}
+		if !written[desc.Digest] {
+			if err := writeTarFile(tw, blobName(desc.Digest), data); err != nil {
+				return err
+			}
+			written[desc.Digest] = true
+		}
+		for _, blob := range append([]ociDescriptor{m.Config}, m.Layers...) {
+			if written[blob.Digest] {
+				continue
+			}
+			if err := writeTarBlob(tw, blob.Digest); err != nil {
+				return fmt.Errorf("image %s: %w", name, err)
+			}
+			written[blob.Digest] = true
+		}
+
+		// By name the image has that one, by ID all of its
+		var tags []string
+		if normalized, err := normalizeImageName(name); err == nil && repos[normalized] == id {
+			tags = []string{normalized}
+		} else {
+			for other, otherID := range repos {
+				if otherID == id {
+					tags = append(tags, other)
+				}
+			}
+			slices.Sort(tags)
+		}
+		// An image saved under two names is one entry of manifest.json, with both
+		i := slices.IndexFunc(dockerManifests, func(d dockerSaveManifest) bool { return d.Config == blobName(m.Config.Digest) })
+		if i < 0 {
+			dockerManifest := dockerSaveManifest{Config: blobName(m.Config.Digest), RepoTags: []string{}, Layers: []string{}}
+			for _, layer := range m.Layers {
+				dockerManifest.Layers = append(dockerManifest.Layers, blobName(layer.Digest))
+			}
+			dockerManifests = append(dockerManifests, dockerManifest)
+			i = len(dockerManifests) - 1
+		}
+		named := false
+		for _, tag := range tags {
+			ref, err := parseReference(tag)
+			if err != nil || ref.Tag == "" {
+				// A name by digest has no tag for docker, and no name of its own in the layout
+				continue
+			}
+			d := desc
+			d.Annotations = map[string]string{
+				annotationImageName: ref.Registry + "/" + ref.Repository + ":" + ref.Tag,
+				annotationRefName:   ref.Tag,
+			}
+			index.Manifests = append(index.Manifests, d)
+			dockerManifests[i].RepoTags = append(dockerManifests[i].RepoTags, tag)
+			named = true
+		}
+		if !named {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": "1.0.0"})
+	indexData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestData, err := json.MarshalIndent(dockerManifests, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", append(indexData, '\n')},
+		{"manifest.json", append(manifestData, '\n')},
+	} {
+		if err := writeTarFile(tw, file.name, file.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// blobName is the path of the blob with digest in an image layout.
+func blobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// writeTarFile adds the file name with data to an archive. Every entry has the same time, so the
+// same images make the same archive.
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(0, 0)}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeTarBlob adds the blob with digest of the store to an archive.
+func writeTarBlob(tw *tar.Writer, digest string) error {
+	f, err := openBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: blobName(digest), Typeflag: tar.TypeReg, Mode: 0644, Size: fi.Size(), ModTime: time.Unix(0, 0)}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
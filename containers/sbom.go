@@ -0,0 +1,607 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An SBOM, a software bill of materials, lists what an image is made of: the packages of its
+// distribution and the modules compiled into its programs, each by a "package URL" that scanners
+// look up in vulnerability databases (Trivy, Grype, Dependency-Track), and that `docker sbom` and
+// BuildKit's attestations make too. `image sbom` reads them from the image's layers, like the
+// container would see them (see walkLayers), without running anything of the image:
+//
+//	var/lib/dpkg/status, status.d/*   Debian and Ubuntu, distroless: a stanza per package
+//	lib/apk/db/installed              Alpine: P:name, V:version, A:arch, L:license, per package
+//	var/lib/rpm, usr/lib/sysimage/rpm Fedora, RHEL: a database, read with the host's rpm
+//	every Go program                  the modules and the Go version it was built with, which
+//	                                  the linker puts into the binary (`go version -m`)
+//
+// What a Dockerfile's COPY or curl | sh added without a package manager isn't in any of them,
+// and neither in the SBOM. The output is one of the two standard formats, SPDX 2.3 (the Linux
+// Foundation's) or CycloneDX 1.5 (OWASP's), as JSON.
+
+// sbomPackage is a package of an image.
+type sbomPackage struct {
+	Name, Version string
+	// Type is the purl type: deb, apk, rpm or golang
+	Type    string
+	License string
+	PURL    string
+	// Locations are where it was found: its database, or the programs built with it
+	Locations []string
+}
+
+// sbomCommand implements `image sbom [--format FORMAT] [-o FILE] IMAGE`.
+func sbomCommand(args []string) error {
+	fs := flag.NewFlagSet("image sbom", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s image sbom [OPTIONS] IMAGE\n\nList the packages of an image as an SBOM: its dpkg, apk and rpm packages and the modules of its Go programs.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "spdx-json", "the format: spdx-json (SPDX 2.3) or cyclonedx-json (CycloneDX 1.5)")
+	output := fs.String("o", "", "write the SBOM to `FILE`, not to the standard output")
+	fs.StringVar(output, "output", "", "same as -o")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected IMAGE")
+	}
+	if *format != "spdx-json" && *format != "cyclonedx-json" {
+		return usageErrorf(fs, "unknown format %q, spdx-json or cyclonedx-json", *format)
+	}
+	id, _, err := findImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	layers, err := imageLayers(id)
+	if err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if normalized, err := normalizeImageName(name); err == nil && !strings.HasPrefix(id, name) {
+		name = normalized
+	}
+	packages, err := scanImage(layers)
+	if err != nil {
+		return err
+	}
+
+	var doc any
+	if *format == "spdx-json" {
+		doc = spdxDocumentOf(name, id, packages)
+	} else {
+		doc = cycloneDXDocumentOf(name, id, packages)
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	// A purl has & in it, which JSON needn't write as \u0026
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for _, p := range packages {
+		counts[p.Type]++
+	}
+	var kinds []string
+	for _, typ := range []string{"deb", "apk", "rpm", "golang"} {
+		if counts[typ] > 0 {
+			kinds = append(kinds, fmt.Sprintf("%d %s", counts[typ], typ))
+		}
+	}
+	// The SBOM may be on stdout
+	fmt.Fprintf(os.Stderr, "Found %d packages in %s", len(packages), name)
+	if len(kinds) > 0 {
+		fmt.Fprintf(os.Stderr, ": %s", strings.Join(kinds, ", "))
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+// scanImage finds the packages in the overlay of layers.
+func scanImage(layers []string) ([]sbomPackage, error) {
+	// The databases by their name in the image, and where they are in the layers
+	var dpkg, apk [][2]string
+	osRelease, rpmDir := "", ""
+	rpmFiles := map[string]string{}
+	var programs [][2]string
+	err := walkLayers(layers, func(name, p string, fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		switch dir := filepath.Dir(name); {
+		case name == "var/lib/dpkg/status", dir == "var/lib/dpkg/status.d" && !strings.HasSuffix(name, ".md5sums"):
+			dpkg = append(dpkg, [2]string{name, p})
+		case name == "lib/apk/db/installed":
+			apk = append(apk, [2]string{name, p})
+		case name == "etc/os-release", name == "usr/lib/os-release" && osRelease == "":
+			// /etc/os-release is often a symlink to the other, which walkLayers doesn't follow
+			osRelease = p
+		case dir == "var/lib/rpm" || dir == "usr/lib/sysimage/rpm":
+			if rpmDir == "" || rpmDir == dir {
+				rpmDir = dir
+				rpmFiles[filepath.Base(name)] = p
+			}
+		}
+		// Go programs are executables, which buildinfo tells apart by their sections
+		if fi.Mode()&0111 != 0 && fi.Size() > 0 {
+			programs = append(programs, [2]string{name, p})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	distro := readOSRelease(osRelease)
+
+	var packages []sbomPackage
+	for _, db := range dpkg {
+		found, err := readDpkgStatus(db[1], "/"+db[0], distro)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, found...)
+	}
+	for _, db := range apk {
+		found, err := readApkInstalled(db[1], "/"+db[0], distro)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, found...)
+	}
+	if rpmDir != "" {
+		found, err := readRpmDatabase(rpmFiles, "/"+rpmDir, distro)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: the rpm database /%s: %v\n", rpmDir, err)
+		}
+		packages = append(packages, found...)
+	}
+	return append(packages, readGoModules(programs)...), nil
+}
+
+// osRelease is what /etc/os-release says about the distribution, for the packages' purls.
+type osRelease struct {
+	ID, VersionID string
+}
+
+// readOSRelease reads the os-release file at p, if there is one.
+func readOSRelease(p string) osRelease {
+	var release osRelease
+	f, err := os.Open(p)
+	if err != nil {
+		return release
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			release.ID = value
+		case "VERSION_ID":
+			release.VersionID = value
+		}
+	}
+	return release
+}
+
+// qualifier is the distro qualifier of a purl, like debian-12.
+func (r osRelease) qualifier() string {
+	if r.ID == "" || r.VersionID == "" {
+		return ""
+	}
+	return r.ID + "-" + r.VersionID
+}
+
+// readDpkgStatus reads the packages of dpkg's status file at p, which is at location in the
+// image. A package that was removed keeps a stanza with another status than installed.
+func readDpkgStatus(p, location string, distro osRelease) ([]sbomPackage, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	namespace := distro.ID
+	if namespace == "" {
+		namespace = "debian"
+	}
+	var packages []sbomPackage
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		fields := map[string]string{}
+		for _, line := range strings.Split(stanza, "\n") {
+			// A line that starts with a space continues the field before, like Description's
+			if key, value, ok := strings.Cut(line, ": "); ok && !strings.HasPrefix(line, " ") {
+				fields[key] = value
+			}
+		}
+		if fields["Package"] == "" || (fields["Status"] != "" && !strings.HasSuffix(fields["Status"], " installed")) {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Name: fields["Package"], Version: fields["Version"], Type: "deb",
+			PURL:      purl("deb", namespace, fields["Package"], fields["Version"], "arch", fields["Architecture"], "distro", distro.qualifier()),
+			Locations: []string{location},
+		})
+	}
+	return packages, nil
+}
+
+// readApkInstalled reads the packages of apk's database at p, which is at location in the image.
+func readApkInstalled(p, location string, distro osRelease) ([]sbomPackage, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	namespace := distro.ID
+	if namespace == "" {
+		namespace = "alpine"
+	}
+	var packages []sbomPackage
+	var name, version, arch, license string
+	add := func() {
+		if name != "" {
+			packages = append(packages, sbomPackage{
+				Name: name, Version: version, Type: "apk", License: license,
+				PURL:      purl("apk", namespace, name, version, "arch", arch, "distro", distro.qualifier()),
+				Locations: []string{location},
+			})
+		}
+		name, version, arch, license = "", "", "", ""
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			add()
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		switch key {
+		case "P":
+			name = value
+		case "V":
+			version = value
+		case "A":
+			arch = value
+		case "L":
+			license = value
+		}
+	}
+	add()
+	return packages, scanner.Err()
+}
+
+// readRpmDatabase reads the packages of the rpm database made of files, by their names, which is
+// at location in the image. Its format is SQLite or Berkeley DB, which only rpm reads: we copy it
+// and ask the host's rpm, if it has one.
+func readRpmDatabase(files map[string]string, location string, distro osRelease) ([]sbomPackage, error) {
+	rpm, err := exec.LookPath("rpm")
+	if err != nil {
+		return nil, errors.New("reading it takes rpm on the host, its packages are missing")
+	}
+	tmp, err := os.MkdirTemp("", "rpmdb-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	for name, p := range files {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	out, err := exec.Command(rpm, "--dbpath", tmp, "-qa", "--qf", `%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\t%{EPOCH}\t%{LICENSE}\n`).Output()
+	if err != nil {
+		return nil, fmt.Errorf("rpm -qa: %w", err)
+	}
+	var packages []sbomPackage
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 5 || f[0] == "gpg-pubkey" {
+			// The keys rpm trusts are in the database as packages too
+			continue
+		}
+		epoch := f[3]
+		if epoch == "(none)" {
+			epoch = ""
+		}
+		packages = append(packages, sbomPackage{
+			Name: f[0], Version: f[1], Type: "rpm", License: f[4],
+			PURL:      purl("rpm", distro.ID, f[0], f[1], "arch", f[2], "epoch", epoch, "distro", distro.qualifier()),
+			Locations: []string{location},
+		})
+	}
+	return packages, nil
+}
+
+// readGoModules reads the modules of the Go programs among executables, each its name in the
+// image and where it is in the layers. A module many programs use is one package with all of them as
+// its locations. The standard library is a package too, "stdlib", with the version of Go.
+func readGoModules(executables [][2]string) []sbomPackage {
+	var packages []sbomPackage
+	index := map[string]int{}
+	add := func(module, version, location string) {
+		version = strings.TrimPrefix(version, "(devel)")
+		p := purl("golang", path.Dir(module), path.Base(module), version)
+		if path.Dir(module) == "." {
+			p = purl("golang", "", module, version)
+		}
+		if i, ok := index[p]; ok {
+			if !slices.Contains(packages[i].Locations, location) {
+				packages[i].Locations = append(packages[i].Locations, location)
+			}
+			return
+		}
+		index[p] = len(packages)
+		packages = append(packages, sbomPackage{Name: module, Version: version, Type: "golang", PURL: p, Locations: []string{location}})
+	}
+	for _, executable := range executables {
+		info, err := buildinfo.ReadFile(executable[1])
+		if err != nil {
+			// Not a Go program
+			continue
+		}
+		location := "/" + executable[0]
+		// "go1.22.1 X:loopvar" has experiments after the version
+		goVersion, _, _ := strings.Cut(strings.TrimPrefix(info.GoVersion, "go"), " ")
+		add("stdlib", goVersion, location)
+		if info.Main.Path != "" {
+			add(info.Main.Path, info.Main.Version, location)
+		}
+		for _, dep := range info.Deps {
+			// A replaced module is built from the replacement. One with a directory of the
+			// machine it was built on has no version.
+			if r := dep.Replace; r != nil && (strings.HasPrefix(r.Path, ".") || strings.HasPrefix(r.Path, "/")) {
+				add(dep.Path, "", location)
+				continue
+			} else if r != nil {
+				dep = r
+			}
+			add(dep.Path, dep.Version, location)
+		}
+	}
+	return packages
+}
+
+// purl returns the package URL pkg:TYPE/NAMESPACE/NAME@VERSION?QUALIFIERS of the purl spec, like
+// pkg:deb/debian/curl@7.88.1-10?arch=amd64&distro=debian-12. qualifiers are keys and values,
+// sorted by key, and the empty ones are left out.
+func purl(typ, namespace, name, version string, qualifiers ...string) string {
+	s := "pkg:" + typ + "/"
+	if namespace != "" {
+		// The / of a Go module path separate the namespace's segments
+		for _, segment := range strings.Split(namespace, "/") {
+			s += purlEscape(segment) + "/"
+		}
+	}
+	s += purlEscape(name)
+	if version != "" {
+		s += "@" + purlEscape(version)
+	}
+	var query []string
+	for i := 0; i+1 < len(qualifiers); i += 2 {
+		if qualifiers[i+1] != "" {
+			query = append(query, qualifiers[i]+"="+purlEscape(qualifiers[i+1]))
+		}
+	}
+	slices.Sort(query)
+	if len(query) > 0 {
+		s += "?" + strings.Join(query, "&")
+	}
+	return s
+}
+
+// purlEscape percent-encodes everything in s but letters, digits and .-_~, like the purl spec
+// wants: the epoch of a Debian version, 1:2.3, is 1%3A2.3.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(".-_~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// newUUID returns a random UUID, version 4, for the SBOM documents' names.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on Linux
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// imagePURL is the package URL of the image id called name, pkg:oci/NAME@sha256%3A...
+func imagePURL(name, id string) string {
+	repository, _, _ := strings.Cut(name, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	if strings.HasPrefix(id, repository) {
+		return purl("oci", "", shortID(id), "sha256:"+id)
+	}
+	// A name of the store only, not of a registry
+	if !strings.Contains(repository, "/") {
+		return purl("oci", "", repository, "sha256:"+id)
+	}
+	return purl("oci", "", path.Base(repository), "sha256:"+id, "repository_url", repository)
+}
+
+// The parts of SPDX 2.3 we write. NOASSERTION says we don't know, where SPDX wants a value.
+type (
+	spdxDocument struct {
+		SPDXVersion       string             `json:"spdxVersion"`
+		DataLicense       string             `json:"dataLicense"`
+		SPDXID            string             `json:"SPDXID"`
+		Name              string             `json:"name"`
+		DocumentNamespace string             `json:"documentNamespace"`
+		CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+		Packages          []spdxPackage      `json:"packages"`
+		Relationships     []spdxRelationship `json:"relationships"`
+	}
+	spdxCreationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	spdxPackage struct {
+		Name             string            `json:"name"`
+		SPDXID           string            `json:"SPDXID"`
+		VersionInfo      string            `json:"versionInfo,omitempty"`
+		Supplier         string            `json:"supplier"`
+		DownloadLocation string            `json:"downloadLocation"`
+		FilesAnalyzed    bool              `json:"filesAnalyzed"`
+		SourceInfo       string            `json:"sourceInfo,omitempty"`
+		LicenseConcluded string            `json:"licenseConcluded"`
+		LicenseDeclared  string            `json:"licenseDeclared"`
+		CopyrightText    string            `json:"copyrightText"`
+		PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+		ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+	}
+	spdxExternalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	spdxRelationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+)
+
+// spdxDocumentOf is the SPDX document of the packages of the image id called name: the image is
+// a package, which contains the others. The licenses are NOASSERTION: SPDX wants license
+// expressions, and what apk and rpm say isn't always one.
+func spdxDocumentOf(name, id string, packages []sbomPackage) spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        name,
+		// Has to be unique, every document its own
+		DocumentNamespace: "https://spdx.org/spdxdocs/mycontainer/" + shortID(id) + "-" + newUUID(),
+		CreationInfo:      spdxCreationInfo{Created: time.Now().UTC().Format(time.RFC3339), Creators: []string{"Tool: mycontainer"}},
+	}
+	noPackage := func(p spdxPackage) spdxPackage {
+		p.Supplier, p.DownloadLocation, p.LicenseConcluded, p.LicenseDeclared, p.CopyrightText = "NOASSERTION", "NOASSERTION", "NOASSERTION", "NOASSERTION", "NOASSERTION"
+		return p
+	}
+	doc.Packages = append(doc.Packages, noPackage(spdxPackage{
+		Name: name, SPDXID: "SPDXRef-Image", VersionInfo: "sha256:" + id, PrimaryPurpose: "CONTAINER",
+		ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", imagePURL(name, id)}},
+	}))
+	doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"})
+	for i, p := range packages {
+		spdxID := fmt.Sprintf("SPDXRef-Package-%s-%d", p.Type, i+1)
+		doc.Packages = append(doc.Packages, noPackage(spdxPackage{
+			Name: p.Name, SPDXID: spdxID, VersionInfo: p.Version,
+			SourceInfo:   "found in " + strings.Join(p.Locations, ", "),
+			ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", p.PURL}},
+		}))
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", spdxID})
+	}
+	return doc
+}
+
+// The parts of CycloneDX 1.5 we write.
+type (
+	cycloneDXDocument struct {
+		BOMFormat    string               `json:"bomFormat"`
+		SpecVersion  string               `json:"specVersion"`
+		SerialNumber string               `json:"serialNumber"`
+		Version      int                  `json:"version"`
+		Metadata     cycloneDXMetadata    `json:"metadata"`
+		Components   []cycloneDXComponent `json:"components"`
+	}
+	cycloneDXMetadata struct {
+		Timestamp string `json:"timestamp"`
+		Tools     struct {
+			Components []cycloneDXComponent `json:"components"`
+		} `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	}
+	cycloneDXComponent struct {
+		Type       string              `json:"type"`
+		BOMRef     string              `json:"bom-ref,omitempty"`
+		Name       string              `json:"name"`
+		Version    string              `json:"version,omitempty"`
+		PURL       string              `json:"purl,omitempty"`
+		Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+		Properties []cycloneDXProperty `json:"properties,omitempty"`
+	}
+	cycloneDXLicense struct {
+		License struct {
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+	cycloneDXProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+)
+
+// cycloneDXDocumentOf is the CycloneDX document of the packages of the image id called name.
+func cycloneDXDocumentOf(name, id string, packages []sbomPackage) cycloneDXDocument {
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Components:   []cycloneDXComponent{},
+	}
+	doc.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	doc.Metadata.Tools.Components = []cycloneDXComponent{{Type: "application", Name: "mycontainer"}}
+	doc.Metadata.Component = cycloneDXComponent{Type: "container", BOMRef: imagePURL(name, id), Name: name, Version: "sha256:" + id, PURL: imagePURL(name, id)}
+	for _, p := range packages {
+		c := cycloneDXComponent{Type: "library", BOMRef: p.PURL, Name: p.Name, Version: p.Version, PURL: p.PURL}
+		if p.License != "" {
+			var license cycloneDXLicense
+			license.License.Name = p.License
+			c.Licenses = []cycloneDXLicense{license}
+		}
+		for _, location := range p.Locations {
+			c.Properties = append(c.Properties, cycloneDXProperty{"mycontainer:location", location})
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return doc
+}
@@ -0,0 +1,380 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// seccompProfile is a seccomp profile in Docker's JSON format (the subset this demo understands),
+// so the profiles written for Docker, including its own default.json, can be loaded with
+// `--security-opt seccomp=profile.json`.
+type seccompProfile struct {
+	// DefaultAction applies to every syscall no rule matches, e.g. SCMP_ACT_ERRNO for an allow-list
+	DefaultAction   string        `json:"defaultAction"`
+	DefaultErrnoRet *uint32       `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []seccompRule `json:"syscalls"`
+}
+
+// seccompRule applies Action to the syscalls in Names. The first rule that matches wins.
+type seccompRule struct {
+	Names    []string     `json:"names,omitempty"`
+	Name     string       `json:"name,omitempty"` // older profiles list one syscall per rule
+	Action   string       `json:"action"`
+	ErrnoRet *uint32      `json:"errnoRet,omitempty"`
+	Args     []seccompArg `json:"args,omitempty"`
+	// Includes and Excludes make a rule conditional, e.g. "only without CAP_SYS_ADMIN"
+	Includes seccompCondition `json:"includes,omitempty"`
+	Excludes seccompCondition `json:"excludes,omitempty"`
+}
+
+// seccompArg compares one syscall argument. With SCMP_CMP_MASKED_EQ, Value is the mask and
+// ValueTwo the expected result of `arg & mask`.
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// seccompCondition matches when the container has all of Caps and runs on one of Arches (Go names)
+type seccompCondition struct {
+	Arches []string `json:"arches,omitempty"`
+	Caps   []string `json:"caps,omitempty"`
+}
+
+// Namespace flags of clone(), a container without CAP_SYS_ADMIN may not create namespaces
+const cloneNamespaceFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC |
+	syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | 0x02000000 /* CLONE_NEWCGROUP */
+
+// defaultSeccompProfile blocks the syscalls Docker's default profile blocks.
+//
+// Docker's profile is an allow-list of ~350 syscalls. We write the same result the other way
+// around, as a deny-list of the ones it leaves out, because that list is what's worth reading:
+// kernel keyrings and kernel modules are not namespaced, clock and reboot affect the whole host,
+// and most of the others had exploitable bugs. Many of them already need a capability we dropped;
+// seccomp is a second wall, and it also shrinks the kernel code a container can reach at all.
+// Like Docker, a syscall becomes available again when its capability is added with --cap-add.
+func defaultSeccompProfile() *seccompProfile {
+	deny := func(caps []string, names ...string) seccompRule {
+		return seccompRule{Names: names, Action: "SCMP_ACT_ERRNO", Excludes: seccompCondition{Caps: caps}}
+	}
+	// One rule per value: the conditions of a rule must all be true
+	allowArg0 := func(name string, values ...uint64) []seccompRule {
+		var rules []seccompRule
+		for _, v := range values {
+			rules = append(rules, seccompRule{Names: []string{name}, Action: "SCMP_ACT_ALLOW",
+				Args: []seccompArg{{Index: 0, Value: v, Op: "SCMP_CMP_EQ"}}})
+		}
+		return rules
+	}
+	// Never allowed: not namespaced, obsolete, or both
+	rules := []seccompRule{
+		deny(nil, "add_key", "keyctl", "request_key", "create_module", "get_kernel_syms",
+			"query_module", "nfsservctl", "uselib", "ustat", "sysfs", "_sysctl", "vm86", "vm86old",
+			"userfaultfd"),
+	}
+	// personality() only for the execution domains normal programs use (0xffffffff queries)
+	rules = append(rules, allowArg0("personality", 0x0, 0x8, 0x20000, 0x20008, 0xffffffff)...)
+	rules = append(rules, deny(nil, "personality"))
+
+	return &seccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: append(rules,
+			// clone() is fine as long as it doesn't create namespaces (fork and threads use it too)
+			seccompRule{Names: []string{"clone"}, Action: "SCMP_ACT_ALLOW",
+				Args: []seccompArg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}}},
+			deny([]string{"CAP_SYS_ADMIN"}, "clone"),
+			// clone3 passes its flags in a struct that seccomp can't look into. ENOSYS makes the C
+			// library fall back to clone(), where the rule above checks the flags.
+			seccompRule{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: ptr(uint32(syscall.ENOSYS)),
+				Excludes: seccompCondition{Caps: []string{"CAP_SYS_ADMIN"}}},
+			deny([]string{"CAP_SYS_ADMIN"}, "mount", "umount", "umount2", "pivot_root", "unshare",
+				"setns", "sethostname", "setdomainname", "bpf", "fanotify_init", "perf_event_open",
+				"lookup_dcookie", "quotactl", "swapon", "swapoff", "fsopen", "fsconfig", "fsmount",
+				"fspick", "open_tree", "move_mount", "mount_setattr"),
+			deny([]string{"CAP_DAC_READ_SEARCH"}, "name_to_handle_at", "open_by_handle_at"),
+			deny([]string{"CAP_SYS_BOOT"}, "reboot", "kexec_load", "kexec_file_load"),
+			deny([]string{"CAP_SYS_MODULE"}, "init_module", "finit_module", "delete_module"),
+			deny([]string{"CAP_SYS_PTRACE"}, "process_vm_readv", "process_vm_writev", "kcmp"),
+			deny([]string{"CAP_SYS_TIME"}, "settimeofday", "stime", "clock_settime", "clock_adjtime"),
+			deny([]string{"CAP_SYS_PACCT"}, "acct"),
+			deny([]string{"CAP_SYS_RAWIO"}, "iopl", "ioperm"),
+			deny([]string{"CAP_SYS_NICE"}, "get_mempolicy", "set_mempolicy", "mbind", "move_pages"),
+			deny([]string{"CAP_SYS_TTY_CONFIG"}, "vhangup"),
+			deny([]string{"CAP_SYSLOG"}, "syslog"),
+		),
+	}
+}
+
+// ptr returns a pointer to v, for the optional fields of the profile
+func ptr[T any](v T) *T { return &v }
+
+// loadSeccompProfile reads a profile file and checks that we can turn it into a filter.
+func loadSeccompProfile(path string, caps []string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile seccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := profile.compile(caps); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+// Constants from <linux/seccomp.h> and <linux/audit.h>
+const (
+	seccompSetModeFilter = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data, the input of the filter
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+
+	// x86-64 also accepts syscalls of the x32 ABI, which have this bit set in their number
+	x32SyscallBit = 0x40000000
+
+	bpfMaxInsns = 4096
+)
+
+// auditArch identifies the architecture in seccomp_data.arch
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e, // AUDIT_ARCH_X86_64
+	"arm64": 0xc00000b7, // AUDIT_ARCH_AARCH64
+}
+
+// installSeccomp compiles the profile and installs it on the calling thread (see startRestricted).
+//
+// seccomp (SECure COMPuting) runs a small classic BPF program on every syscall the thread and
+// its children make. The program sees the syscall number and arguments and returns a verdict:
+// allow, fail with an errno, or kill. The filter can't be removed again, and it is inherited
+// across fork and exec, so the containerized process and everything it starts are filtered.
+func installSeccomp(profile *seccompProfile, caps []string) error {
+	filter, err := profile.compile(caps)
+	if err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// Without no_new_privs only a thread with CAP_SYS_ADMIN may install a filter (it could
+	// otherwise trick a setuid program into misbehaving). We still have it on this thread, so this
+	// also works with `--security-opt no-new-privileges=false`.
+	if _, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, 0, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("install seccomp filter: %w", errno)
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
+
+// compile translates the profile into a classic BPF program for the architecture we run on.
+// The program is one long if/else chain:
+//
+//	if arch != x86_64            { kill }
+//	if nr == mount               { return EPERM }
+//	if nr == clone && args ok    { allow }
+//	...
+//	return defaultAction
+func (p *seccompProfile) compile(caps []string) ([]syscall.SockFilter, error) {
+	defaultAction, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet, nil)
+	if err != nil {
+		return nil, err
+	}
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	numbers := syscallTable[runtime.GOARCH]
+
+	// A process can also make syscalls with another ABI (e.g. 32-bit `int 0x80` on x86-64),
+	// where the numbers mean something else. Those would walk right past a deny-list, so they
+	// kill the process.
+	filter := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, arch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	}
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		)
+	}
+
+	for _, rule := range p.Syscalls {
+		if !rule.applies(caps) {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet, p.DefaultErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		args, err := compileArgs(rule.Args)
+		if err != nil {
+			return nil, err
+		}
+
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for _, name := range names {
+			nr, ok := numbers[name]
+			if !ok {
+				// Like Docker: profiles list syscalls of every architecture, skip the ones we don't have
+				continue
+			}
+			// A holds the syscall number here. The argument checks overwrite it, so a block with
+			// arguments ends by loading the number again for the next rule.
+			body := append(append([]syscall.SockFilter{}, args...), bpfStmt(syscall.BPF_RET|syscall.BPF_K, action))
+			if len(args) > 0 {
+				body = append(body, bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr))
+			}
+			filter = append(filter, bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, uint32(nr), 0, uint8(len(body))))
+			filter = append(filter, body...)
+		}
+	}
+	filter = append(filter, bpfStmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+
+	if len(filter) > bpfMaxInsns {
+		return nil, fmt.Errorf("seccomp profile too large: %d instructions, the kernel allows %d", len(filter), bpfMaxInsns)
+	}
+	return filter, nil
+}
+
+// applies checks the includes/excludes conditions of a rule against the container
+func (r *seccompRule) applies(caps []string) bool {
+	matches := func(c seccompCondition) bool {
+		if len(c.Arches) > 0 && !containsFold(c.Arches, runtime.GOARCH) {
+			return false
+		}
+		for _, name := range c.Caps {
+			if !containsFold(caps, name) {
+				return false
+			}
+		}
+		return true
+	}
+	if !matches(r.Includes) {
+		return false
+	}
+	excluded := len(r.Excludes.Arches) > 0 || len(r.Excludes.Caps) > 0
+	return !excluded || !matches(r.Excludes)
+}
+
+// compileArgs turns argument conditions into BPF. Every condition jumps to the instruction
+// after the final `ret` when it fails, which means "this rule doesn't match".
+//
+// Arguments are 64-bit but classic BPF only handles 32 bits at a time, so each one is checked
+// as two halves (little-endian: the low half comes first).
+func compileArgs(args []seccompArg) ([]syscall.SockFilter, error) {
+	type insn struct {
+		syscall.SockFilter
+		failTrue, failFalse bool // jump to the end instead of using Jt/Jf
+	}
+	var insns []insn
+	load := func(index uint, high bool) insn {
+		offset := seccompDataArgs + 8*uint32(index)
+		if high {
+			offset += 4
+		}
+		return insn{SockFilter: bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, offset)}
+	}
+	and := func(mask uint32) insn {
+		return insn{SockFilter: bpfStmt(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, mask)}
+	}
+	jeq := func(v uint32) syscall.SockFilter {
+		return bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, v, 0, 0)
+	}
+
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("syscall argument index %d out of range", arg.Index)
+		}
+		lo, hi := uint32(arg.Value), uint32(arg.Value>>32)
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			insns = append(insns, load(arg.Index, false), insn{jeq(lo), false, true},
+				load(arg.Index, true), insn{jeq(hi), false, true})
+		case "SCMP_CMP_MASKED_EQ":
+			want := arg.ValueTwo
+			insns = append(insns, load(arg.Index, false), and(lo), insn{jeq(uint32(want)), false, true},
+				load(arg.Index, true), and(hi), insn{jeq(uint32(want >> 32)), false, true})
+		case "SCMP_CMP_NE":
+			// Different if either half differs: a different low half skips the check of the high half
+			skipHigh := jeq(lo)
+			skipHigh.Jf = 2
+			insns = append(insns, load(arg.Index, false), insn{SockFilter: skipHigh},
+				load(arg.Index, true), insn{jeq(hi), true, false})
+		default:
+			return nil, fmt.Errorf("unsupported seccomp argument operator %q", arg.Op)
+		}
+	}
+
+	// The end is after the `ret` of the rule that the caller appends
+	end := len(insns) + 1
+	filter := make([]syscall.SockFilter, len(insns))
+	for i, in := range insns {
+		if in.failTrue {
+			in.Jt = uint8(end - (i + 1))
+		}
+		if in.failFalse {
+			in.Jf = uint8(end - (i + 1))
+		}
+		filter[i] = in.SockFilter
+	}
+	return filter, nil
+}
+
+// seccompAction translates a profile action into the value the BPF program returns
+func seccompAction(action string, errnoRet, defaultErrnoRet *uint32) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		} else if defaultErrnoRet != nil {
+			errno = *defaultErrnoRet
+		}
+		return seccompRetErrno | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	case "":
+		return 0, errors.New("seccomp action missing")
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// bpfStmt and bpfJump are the BPF_STMT and BPF_JUMP macros from <linux/filter.h>
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
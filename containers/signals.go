@@ -0,0 +1,146 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// forwardedSignals are the signals a user (or systemd, or `kill`) sends to ask a program to stop
+// or reload. They are meant for the program in the container, not for the tool that started it.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// initForwardedSignals are the signals the child passes on to the command. That's more than
+// forwardedSignals: `kill -s USR1 CONTAINER` sends its signal to the container's init, which
+// would ignore it otherwise. SIGKILL and SIGSTOP can't be caught, they hit the init itself.
+var initForwardedSignals = append([]os.Signal{syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH}, forwardedSignals...)
+
+// forwardSignals catches the given signals and passes them on to process. Call the returned
+// function to stop.
+//
+// It runs at both ends of the chain. The parent forwards to the child, so a Ctrl-C or `kill`
+// doesn't kill the parent while the container keeps running without anyone removing its cgroup.
+// The child forwards to the command: left alone it would exit on the signal, and when PID 1 of
+// a namespace exits the kernel SIGKILLs everything else in it. It's the command that should
+// decide what SIGTERM means.
+//
+// Without -t the command shares our process group, so a Ctrl-C typed in the terminal reaches it
+// directly as well as through us. Programs treat a second SIGINT like the first, so that's fine.
+func forwardSignals(process *os.Process, forwarded ...os.Signal) (stop func()) {
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, forwarded...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				// Fails only when the process is already gone, then there's nobody left to tell
+				process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// reapUntil waits for the command with the given PID like an init system does, and returns its
+// exit status.
+//
+// The child is PID 1 of the container, and PID 1 has a special job: when a process dies, its
+// children are re-parented to PID 1, and once they exit they stay around as zombies (an entry
+// in the process table holding the exit status) until PID 1 collects them with wait(). A shell or
+// web server that forks a lot would fill the process table with <defunct> entries if we only
+// waited for our own command. So, like tini and docker-init, we wake up on every SIGCHLD and reap
+// whatever has exited, until it's the command itself.
+func reapUntil(pid int) (syscall.WaitStatus, error) {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	defer signal.Stop(sigchld)
+
+	for {
+		// Several children may exit for one SIGCHLD (signals don't queue), so collect all of them.
+		// The first round also catches children that exited before Notify.
+		for {
+			var status syscall.WaitStatus
+			reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("wait: %w", err)
+			}
+			if reaped == pid {
+				return status, nil
+			}
+			if reaped == 0 {
+				// Nothing else has exited yet
+				break
+			}
+		}
+		<-sigchld
+	}
+}
+
+// exitStatus makes main exit with this code without printing anything. It carries the exit code
+// of the containerized command all the way out, so `container run ... && echo ok` behaves like
+// running the command directly.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// exitCode turns a wait status into a shell-style exit code: the code the process passed to
+// exit(), or 128 plus the signal number when a signal killed it (137 for SIGKILL, also what an
+// OOM kill looks like).
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// startError turns the error of starting a command into the exit code a shell would use: 127
+// when there's no such command, 126 when it can't be executed. Other errors are returned as is.
+func startError(err error) error {
+	var pathErr *os.PathError
+	if !errors.Is(err, exec.ErrNotFound) && !(errors.As(err, &pathErr) && pathErr.Op == "fork/exec") {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", progName(), err)
+	if errors.Is(err, os.ErrPermission) {
+		return exitStatus(126)
+	}
+	return exitStatus(127)
+}
+
+// errorExitCode is the exit code main ends up with for err
+func errorExitCode(err error) int {
+	var status exitStatus
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &status):
+		return int(status)
+	}
+	return 1
+}
+
+// waitExit is cmd.Wait() for the parent, with the child's exit code as an exitStatus.
+func waitExit(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(exitCode(exitErr.Sys().(syscall.WaitStatus)))
+	}
+	return err
+}
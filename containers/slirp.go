@@ -0,0 +1,126 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A rootless container can't have a veth pair: creating interfaces on the host takes root there.
+// But inside its own user and network namespace it may create a tap device, an interface whose
+// other end is a file descriptor instead of a cable: the frames the container sends can be read
+// from it, the frames written to it arrive at the container.
+//
+// slirp4netns, the network of rootless Podman and Docker, sits on the other end. It is a TCP/IP
+// stack in user mode, the one of QEMU's user networking: for every connection the container
+// opens it opens one of its own, an ordinary socket of an unprivileged host process, and copies
+// the data across. To the container it looks like a small network, the same for every container:
+//
+//	10.0.2.100   the container's eth0, the tap device       fd00::100 with --ipv6
+//	10.0.2.2     the gateway, slirp4netns                   fd00::2
+//	10.0.2.3     a DNS server, slirp4netns asking the host's servers   fd00::3
+//
+// We don't build a TCP/IP stack into the monitor. It runs slirp4netns for the container when it
+// is installed, the container stays without a network when it isn't.
+
+// slirpBinary is the helper, looked up in PATH
+const slirpBinary = "slirp4netns"
+
+// The network slirp4netns emulates (its defaults)
+const (
+	slirpAddress = "10.0.2.100/24"
+	slirpGateway = "10.0.2.2"
+	slirpDNS     = "10.0.2.3"
+
+	slirpAddress6 = "fd00::100/64"
+	slirpGateway6 = "fd00::2"
+	slirpDNS6     = "fd00::3"
+)
+
+// slirp is slirp4netns running for a container.
+type slirp struct {
+	cmd *exec.Cmd
+	// exit is our end of the pipe slirp4netns watches, it exits when it is closed
+	exit *os.File
+}
+
+// startSlirp starts slirp4netns for the container whose init is process pid, which creates eth0
+// in its network namespace. It returns when eth0 is there, and fills in the address for the
+// child to configure, like setupNetwork. stop it when the container exits.
+func startSlirp(cfg *containerConfig, path string, pid int) (*slirp, error) {
+	// slirp4netns writes "1" to the ready pipe when the tap device exists, and exits when the exit
+	// pipe is closed: by stop, or by the kernel if we die
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	exitReader, exitWriter, err := os.Pipe()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+
+	// The namespaces are the container's user namespace, which lets slirp4netns create devices
+	// in the network namespace it owns, and the network namespace itself
+	args := []string{"--ready-fd=3", "--exit-fd=4",
+		// Otherwise the gateway is the host's 127.0.0.1, and the container reaches everything
+		// that only listens there
+		"--disable-host-loopback",
+		"--netns-type=path", fmt.Sprintf("--userns-path=/proc/%d/ns/user", pid)}
+	if cfg.IPv6 {
+		args = append(args, "--enable-ipv6")
+	}
+	cmd := exec.Command(path, append(args, fmt.Sprintf("/proc/%d/ns/net", pid), "eth0")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{readyWriter, exitReader}
+	err = cmd.Start()
+	readyWriter.Close()
+	exitReader.Close()
+	if err != nil {
+		exitWriter.Close()
+		return nil, fmt.Errorf("start %s: %w", slirpBinary, err)
+	}
+	s := &slirp{cmd: cmd, exit: exitWriter}
+
+	// Without the "1" slirp4netns has exited, or hangs
+	readyReader.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(readyReader, make([]byte, 1)); err != nil {
+		s.stop()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		return nil, fmt.Errorf("%s: %w", slirpBinary, err)
+	}
+	cfg.IPAddress, cfg.Gateway, cfg.Slirp4netns = slirpAddress, slirpGateway, true
+	cfg.Nameservers = []string{slirpDNS}
+	if cfg.IPv6 {
+		cfg.IPAddress6, cfg.Gateway6 = slirpAddress6, slirpGateway6
+		cfg.Nameservers = append(cfg.Nameservers, slirpDNS6)
+	}
+	return s, nil
+}
+
+// stop ends slirp4netns and waits for it, a second at most.
+func (s *slirp) stop() {
+	s.exit.Close()
+	done := make(chan struct{})
+	go func() {
+		s.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.cmd.Process.Kill()
+		<-done
+	}
+}
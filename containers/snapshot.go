@@ -0,0 +1,350 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// The root of a container of an image is made from the image's layers by a snapshotter, the name
+// containerd gives the part (Docker says storage driver). There are two here, and --snapshotter
+// (env CONTAINER_SNAPSHOTTER) picks one for run and for the RUN steps of build:
+//
+//	overlayfs  the overlay of the layers and the container's upper/ (see overlay.go). Starting
+//	           copies nothing, and what the container changed is upper/. The default.
+//	vfs        a plain copy of the layers in merged/, like Docker's vfs driver. Any filesystem
+//	           can hold it, any kernel and any user namespace will do. But every container copies
+//	           the whole image, and what it changed is found by comparing the copy with the layers.
+//
+// Try it, the difference is what the storage layer is about:
+//
+//	time run --snapshotter vfs alpine true        against the default
+//	du -sh /var/lib/mycontainer/containers/*      a copy of the image each, or only the changes
+//
+// The steps, with dir the container's directory (see containerDataDir) and its root dir/merged:
+//
+//	prepare  before the child starts: the directories, or the copy. Once: a restart finds
+//	         them there, with the container's changes
+//	mounts   what the child mounts on merged/, in its mount namespace: nothing for vfs
+//	changes  what the container added, changed and deleted, for diff (see diff.go)
+//	commit   the changes as a layer tar, for commit and the RUN of build
+//	remove   the directory, for rm
+//
+// A container keeps its snapshotter, diff, commit and cp ask its config.
+type snapshotter interface {
+	prepare(dir string, layers []string) error
+	mounts(dir string, layers []string) []snapshotMount
+	changes(dir string, layers []string) ([]diffEntry, error)
+	commit(tw *tar.Writer, dir string, layers []string) error
+	remove(dir string) error
+}
+
+// snapshotMount is a filesystem a snapshotter mounts on the container's root.
+type snapshotMount struct {
+	fstype, source, options string
+}
+
+// snapshotters are the choices of --snapshotter
+var snapshotters = map[string]snapshotter{
+	"overlayfs": overlaySnapshotter{},
+	"vfs":       vfsSnapshotter{},
+}
+
+// defaultSnapshotter is the snapshotter unless --snapshotter or snapshotterEnv says otherwise
+const defaultSnapshotter = "overlayfs"
+
+// snapshotterEnv is the environment variable for the default of --snapshotter
+const snapshotterEnv = "CONTAINER_SNAPSHOTTER"
+
+// snapshotterNames lists the choices of --snapshotter, for the usage.
+func snapshotterNames() string {
+	var names []string
+	for name := range snapshotters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, " or ")
+}
+
+// snapshotterOf returns the snapshotter of the container cfg.
+func snapshotterOf(cfg *containerConfig) snapshotter {
+	if s, ok := snapshotters[cfg.Snapshotter]; ok {
+		return s
+	}
+	return snapshotters[defaultSnapshotter]
+}
+
+// mountSnapshot makes the root of the container of an image on cfg.Rootfs, and reports whether
+// it mounted something there. It's for the child, in its mount namespace, and for cp on the host.
+// The parent prepared it already, this finds it done.
+func mountSnapshot(cfg *containerConfig) (mounted bool, err error) {
+	s, dir := snapshotterOf(cfg), filepath.Dir(cfg.Rootfs)
+	if err := s.prepare(dir, cfg.Layers); err != nil {
+		return false, err
+	}
+	for _, m := range s.mounts(dir, cfg.Layers) {
+		slog.Debug("mount the snapshot", "fstype", m.fstype, "target", cfg.Rootfs)
+		if err := mountFS(m.source, cfg.Rootfs, m.fstype, 0, m.options); err != nil {
+			return mounted, fmt.Errorf("mount %s on %s: %w (without it, try --snapshotter vfs)", m.fstype, cfg.Rootfs, err)
+		}
+		mounted = true
+	}
+	// A layer needn't have the directories we mount /proc, /dev and /sys on
+	for _, d := range []string{"proc", "dev", "sys"} {
+		if err := os.MkdirAll(filepath.Join(cfg.Rootfs, d), 0755); err != nil {
+			return mounted, err
+		}
+	}
+	return mounted, nil
+}
+
+// vfsSnapshotter copies the layers into merged/, see above.
+type vfsSnapshotter struct{}
+
+// prepare copies the files of the layers, as the container would see their overlay, into
+// merged/. The copy is made next to it and renamed when it's complete: a merged/ is a copy.
+func (vfsSnapshotter) prepare(dir string, layers []string) error {
+	merged := filepath.Join(dir, "merged")
+	if _, err := os.Lstat(merged); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// What a child that died while copying left
+	tmp := merged + ".tmp"
+	if err := removeTree(tmp); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		return err
+	}
+	// Only the host's root can give files away, and has devices. A rootless container's layers are
+	// the user's, and have none (see extractTar).
+	root := os.Geteuid() == 0 && !inUserNamespace()
+	type inode struct{ dev, ino uint64 }
+	links := map[inode]string{}
+	type copiedDir struct {
+		name string
+		info os.FileInfo
+	}
+	var dirs []copiedDir
+	err := walkLayers(layers, func(name, p string, fi os.FileInfo) error {
+		target := filepath.Join(tmp, name)
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: no stat", p)
+		}
+		// A file with several names is one with several names in the copy too
+		if !fi.IsDir() && st.Nlink > 1 {
+			if first, ok := links[inode{st.Dev, st.Ino}]; ok {
+				return os.Link(first, target)
+			}
+			links[inode{st.Dev, st.Ino}] = target
+		}
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			// Its mode and times once its entries are in
+			dirs = append(dirs, copiedDir{name, fi})
+			return nil
+		case mode.IsRegular():
+			if err := copyRegular(p, target); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode&os.ModeNamedPipe != 0:
+			if err := syscall.Mkfifo(target, 0600); err != nil {
+				return err
+			}
+		case mode&os.ModeDevice != 0:
+			if !root {
+				return nil
+			}
+			kind := uint32(syscall.S_IFBLK)
+			if mode&os.ModeCharDevice != 0 {
+				kind = syscall.S_IFCHR
+			}
+			if err := syscall.Mknod(target, kind|0600, int(st.Rdev)); err != nil {
+				return fmt.Errorf("mknod %s: %w", target, err)
+			}
+		default:
+			// A socket is of a program that ran
+			return nil
+		}
+		return copyMetadata(target, fi, root)
+	})
+	if err != nil {
+		return err
+	}
+	// The deepest first, like extractTar: each entry changed its directory's mtime
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		if err := copyMetadata(filepath.Join(tmp, d.name), d.info, root); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, merged)
+}
+
+// copyRegular copies the content of the file src to the new file target, readable only by us
+// until copyMetadata sets the mode.
+func copyRegular(src, target string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeRegular(target, f)
+}
+
+// copyMetadata gives target the owner, the mode and the modification time of fi, like
+// applyHeader does for an entry of a tar.
+func copyMetadata(target string, fi os.FileInfo, root bool) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && root {
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// After chown, which clears the setuid and setgid bits
+	if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// vfs has nothing to mount, merged/ is the root.
+func (vfsSnapshotter) mounts(dir string, layers []string) []snapshotMount {
+	return nil
+}
+
+// changes compares merged/ with the layers it was copied from. Like rsync does by default, a
+// file changed if its size or its modification time did, its content isn't compared. A directory
+// is a change only if it's new or has another owner or mode, or if something in it changed, like
+// the ones overlayfs copies up. A file of the layers that merged/ hasn't got any more is deleted,
+// a whiteout in the layer.
+func (vfsSnapshotter) changes(dir string, layers []string) ([]diffEntry, error) {
+	lower := map[string]string{}
+	children := map[string][]string{}
+	err := walkLayers(layers, func(name, p string, fi os.FileInfo) error {
+		lower[name] = p
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		children[parent] = append(children[parent], path.Base(name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return compareTree(filepath.Join(dir, "merged"), "", lower, children)
+}
+
+// compareTree returns the changes in the directory rel of merged, each directory before its
+// entries. lower has where the layers have each path, children the names in their directories.
+func compareTree(merged, rel string, lower map[string]string, children map[string][]string) ([]diffEntry, error) {
+	entries, err := os.ReadDir(filepath.Join(merged, rel))
+	if err != nil {
+		return nil, err
+	}
+	names := children[rel]
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	var diff []diffEntry
+	for _, name := range names {
+		p := path.Join(rel, name)
+		if buildRuntimeFiles[p] {
+			continue
+		}
+		var below os.FileInfo
+		if lp, ok := lower[p]; ok {
+			if below, err = os.Lstat(lp); err != nil {
+				return nil, err
+			}
+		}
+		fi, err := os.Lstat(filepath.Join(merged, p))
+		if errors.Is(err, os.ErrNotExist) {
+			diff = append(diff, diffEntry{path: p, info: below, whiteout: true})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if below == nil || fileChanged(lower[p], filepath.Join(merged, p), below, fi) {
+				diff = append(diff, diffEntry{path: p, info: fi})
+			}
+			continue
+		}
+		// A directory that replaced a file has only new entries
+		var inside []diffEntry
+		if below != nil && below.IsDir() {
+			inside, err = compareTree(merged, p, lower, children)
+		} else {
+			inside, err = compareTree(merged, p, nil, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if below == nil || !below.IsDir() || len(inside) > 0 || !sameOwnerAndMode(below, fi) {
+			diff = append(diff, diffEntry{path: p, info: fi})
+			diff = append(diff, inside...)
+		}
+	}
+	return diff, nil
+}
+
+// fileChanged tells whether the file p of merged/ isn't the file lowerPath of the layers any more.
+func fileChanged(lowerPath, p string, lower, fi os.FileInfo) bool {
+	if !sameOwnerAndMode(lower, fi) {
+		return true
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		a, errA := os.Readlink(lowerPath)
+		b, errB := os.Readlink(p)
+		return errA != nil || errB != nil || a != b
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		return lower.Sys().(*syscall.Stat_t).Rdev != fi.Sys().(*syscall.Stat_t).Rdev
+	}
+	return lower.Size() != fi.Size() || !lower.ModTime().Equal(fi.ModTime())
+}
+
+// commit writes the changes of merged/ as a layer.
+func (s vfsSnapshotter) commit(tw *tar.Writer, dir string, layers []string) error {
+	entries, err := s.changes(dir, layers)
+	if err != nil {
+		return err
+	}
+	return writeChanges(tw, filepath.Join(dir, "merged"), entries)
+}
+
+// remove deletes the copy with the rest of dir.
+func (vfsSnapshotter) remove(dir string) error {
+	return removeTree(dir)
+}
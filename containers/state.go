@@ -0,0 +1,413 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A container that runs in the background (`run -d`) outlives the command that started it, so
+// the other commands need a way to find it later. Like runc (/run/runc) and containerd
+// (/run/containerd), every container gets a directory in a state directory with a state.json that
+// describes it. /run is a tmpfs: the state disappears on reboot, together with the containers.
+//
+//	/run/mycontainer/containers/<ID>/
+//	    state.json      containerState: PIDs, status, exit code
+//	    config.json     containerConfig, as the container was started
+//	    container.log   output of a detached container (see logFile), container.log.1 and
+//	                    so on before it
+//	    exec.fifo       only while a created container waits for `start` (see execFifo)
+//	    stop-requested  only once `stop` was called (see stopRequestFile)
+//	    lock            see lockContainer
+const stateFile = "state.json"
+
+// lockFile is the file in the state directory that commands flock(), see lockContainer
+const lockFile = "lock"
+
+// stateVersion is the version of this layout, state.json records it. A build that changes what
+// a file means bumps it, so an older build refuses a state it would misread (runc and containerd
+// have no such thing and break in odd ways after an upgrade with containers running). 0 is what
+// states written before there was a version say, they are the same as 1.
+const stateVersion = 1
+
+// configFile holds the config of the container, for commands like exec that need to know how it
+// was set up
+const configFile = "config.json"
+
+// Container status values, the same words Docker uses
+const (
+	// statusCreated is a container that waits for `start` (see create)
+	statusCreated = "created"
+	statusRunning = "running"
+	statusExited  = "exited"
+	// statusRestarting is a container that exited and waits to be started again (--restart)
+	statusRestarting = "restarting"
+	// statusDead is a container whose state says "running" while its process is gone, because
+	// the monitor was killed before it could record the exit (or the host crashed)
+	statusDead = "dead"
+)
+
+// containerState is what state.json holds.
+type containerState struct {
+	// Version is the stateVersion of the build that wrote the state
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	// Pid is the host PID of the container's init process (the child, PID 1 inside)
+	Pid int `json:"pid"`
+	// PidStartTime is when Pid started, in clock ticks after boot (see processStartTime)
+	PidStartTime uint64 `json:"pidStartTime"`
+	// MonitorPid is the process that waits for the container and cleans up after it: the `run`
+	// command itself, or with -d the monitor it left behind (see runDetached)
+	MonitorPid       int      `json:"monitorPid"`
+	MonitorStartTime uint64   `json:"monitorStartTime"`
+	Status           string   `json:"status"`
+	Args             []string `json:"args"`
+	Rootfs           string   `json:"rootfs"`
+	// Cgroup is the container's cgroup relative to the cgroup root, like /proc/PID/cgroup shows
+	// it. On v1 the same path exists below every controller.
+	Cgroup   string `json:"cgroup"`
+	Detached bool   `json:"detached,omitempty"`
+	// Created is when the container was created, Started when its init last started and Finished
+	// when it last exited
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+	// ExitCode is the exit code of the command, valid once Status is "exited" or "restarting"
+	ExitCode int `json:"exitCode"`
+	// RestartCount is how often the restart policy started the container again
+	RestartCount int `json:"restartCount"`
+	// Labels are the container's --label entries, here too so `ps` needn't read every config
+	Labels map[string]string `json:"labels,omitempty"`
+	// Hostname is the container's --hostname, one of its names for the DNS server (see dns.go)
+	Hostname string `json:"hostname,omitempty"`
+	// IPAddress is the container's address on the bridge or macvlan network, if it has one, and
+	// IPAddress6 its IPv6 address with --ipv6
+	IPAddress  string `json:"ipAddress,omitempty"`
+	IPAddress6 string `json:"ipAddress6,omitempty"`
+	// Ports are the published ports, for `ps` as well
+	Ports []portMapping `json:"ports,omitempty"`
+	// Health is the result of the container's health check, if it has one (see health.go)
+	Health *healthState `json:"health,omitempty"`
+}
+
+// stateRoot is the directory that holds one directory per container.
+func stateRoot() string {
+	if os.Geteuid() == 0 {
+		return "/run/mycontainer/containers"
+	}
+	// /run belongs to root. Rootless tools (runc, podman) use the per-user runtime directory
+	// that systemd-logind creates for every login instead.
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "mycontainer", "containers")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mycontainer-%d", os.Getuid()), "containers")
+}
+
+// stateDir is the directory of container id
+func stateDir(id string) string {
+	return filepath.Join(stateRoot(), id)
+}
+
+// writeState creates or replaces the state file of s.ID.
+func writeState(s *containerState) error {
+	// 0700: the state says which processes and cgroups belong to a container, other users
+	// shouldn't be able to read it, let alone change it
+	if err := os.MkdirAll(stateDir(s.ID), 0700); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+	s.Version = stateVersion
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(stateDir(s.ID), stateFile), append(data, '\n')); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with one that holds data, readable only by us.
+//
+// os.WriteFile truncates the file first and then writes it: `ps` reading the state in between
+// finds it empty or cut off. rename() replaces a file in one step instead, whoever opens path gets
+// either the old file or the new one. The new one has to be written in the same directory, rename
+// doesn't work across filesystems.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// lockContainer waits until no other command holds the lock of container id, takes it and
+// returns the function that releases it.
+//
+// Every change to a container is a read, a decision and a write: `start` checks the status is
+// "created" before it says "running", the monitor records the exit. Two commands doing that at
+// the same time can each undo what the other one did, so they take turns. flock() locks are
+// advisory (only those who ask for the lock wait for it) and belong to the open file: the lock
+// goes away when the command exits, however it exits, so it can't be left behind.
+//
+// The lock file lives in the state directory, it is gone with the container. Whoever waited for it
+// while `rm` removed the container then holds the lock of a deleted file, and finds no state when
+// it reads it again, which is why every caller reads the state after taking the lock.
+func lockContainer(id string) (unlock func(), err error) {
+	// O_CREATE creates the file, but not the directory: no lock for a container that is gone
+	unlock, err = lockPath(filepath.Join(stateDir(id), lockFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no such container: %s", shortID(id))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", shortID(id), err)
+	}
+	return unlock, nil
+}
+
+// lockPath takes an exclusive flock() on the file at path, which it creates if needed.
+func lockPath(path string) (unlock func(), err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		// A signal that arrives while we wait interrupts flock(), it didn't fail
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock. Closing it twice does no harm, so a caller can release
+	// the lock early and still defer unlock for its other ways out.
+	return func() { file.Close() }, nil
+}
+
+// updateState changes the state of container id under its lock: update gets the current state,
+// and what it leaves in there is written back. If update returns an error nothing is written.
+func updateState(id string, update func(s *containerState) error) error {
+	unlock, err := lockContainer(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := readState(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no such container: %s", shortID(id))
+	}
+	if err != nil {
+		return err
+	}
+	if err := update(s); err != nil {
+		return err
+	}
+	return writeState(s)
+}
+
+// readState loads the state file of container id.
+func readState(id string) (*containerState, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir(id), stateFile))
+	if err != nil {
+		return nil, err
+	}
+	var s containerState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("state of %s: %w", shortID(id), err)
+	}
+	if s.Version > stateVersion {
+		return nil, fmt.Errorf("state of %s has layout version %d, this build only knows %d: use the build that started it", shortID(id), s.Version, stateVersion)
+	}
+	return &s, nil
+}
+
+// writeConfig saves cfg next to the state of the container.
+func writeConfig(cfg *containerConfig) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(stateDir(cfg.ID), configFile), data); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// readConfig is the opposite of writeConfig.
+func readConfig(id string) (*containerConfig, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir(id), configFile))
+	if err != nil {
+		return nil, err
+	}
+	var cfg containerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config of %s: %w", shortID(id), err)
+	}
+	return &cfg, nil
+}
+
+// findContainer returns the state of the container whose ID starts with prefix. Every command
+// that takes a CONTAINER goes through it, so a unique prefix works everywhere.
+func findContainer(prefix string) (*containerState, error) {
+	if prefix == "" {
+		return nil, errors.New("empty container ID")
+	}
+	// The directory names are the IDs, no state needs to be read to match them
+	entries, _ := os.ReadDir(stateRoot())
+	var matches []string
+	for _, entry := range entries {
+		if entry.Name() == prefix {
+			// A full ID is never ambiguous
+			matches = []string{prefix}
+			break
+		}
+		if strings.HasPrefix(entry.Name(), prefix) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", prefix)
+	case 1:
+		s, err := readState(matches[0])
+		if errors.Is(err, os.ErrNotExist) {
+			// The directory without a state is a container that is just being created or removed
+			return nil, fmt.Errorf("no such container: %s", prefix)
+		}
+		return s, err
+	default:
+		return nil, fmt.Errorf("container ID %s is ambiguous, use more characters", prefix)
+	}
+}
+
+// listStates returns the states of all containers, newest first.
+func listStates() []*containerState {
+	entries, err := os.ReadDir(stateRoot())
+	if err != nil {
+		return nil
+	}
+	var states []*containerState
+	for _, entry := range entries {
+		if s, err := readState(entry.Name()); err == nil {
+			states = append(states, s)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Created.After(states[j].Created) })
+	return states
+}
+
+// currentStatus is s.Status, checked against the process table.
+func (s *containerState) currentStatus() string {
+	if ((s.Status == statusRunning || s.Status == statusCreated) && !s.alive()) || (s.Status == statusRestarting && !s.monitorAlive()) {
+		return statusDead
+	}
+	return s.Status
+}
+
+// stopped reports whether the monitor is done with container s: it recorded the final exit, or
+// it is gone itself. Until then it may still update the state, the cgroup and the log.
+func (s *containerState) stopped() bool {
+	return (s.Status != statusCreated && s.Status != statusRunning && s.Status != statusRestarting) || !s.monitorAlive()
+}
+
+// alive reports whether the container's init process still runs.
+//
+// kill() with signal 0 checks whether a PID exists without sending anything, but it also
+// succeeds for a zombie (a process that exited and hasn't been reaped yet). And PIDs are
+// recycled: once the container is gone, any new process may get its PID. So we look at
+// /proc/PID/stat instead: a process is only the same one if it also started at the same time.
+func (s *containerState) alive() bool {
+	return processAlive(s.Pid, s.PidStartTime)
+}
+
+// monitorAlive reports whether the monitor of the container still runs. Until it exits it may
+// still update the state and the cgroup.
+func (s *containerState) monitorAlive() bool {
+	return processAlive(s.MonitorPid, s.MonitorStartTime)
+}
+
+// processAlive reports whether process pid runs and started at startTime (see processStartTime).
+func processAlive(pid int, startTime uint64) bool {
+	fields, err := procStat(pid)
+	if err != nil {
+		return false
+	}
+	// Field 3 is the process state, Z for zombie, X for dead
+	if fields[0] == "Z" || fields[0] == "X" {
+		return false
+	}
+	started, err := strconv.ParseUint(fields[19], 10, 64)
+	return err == nil && started == startTime
+}
+
+// processStartTime returns when process pid started, in clock ticks after boot: field 22 of
+// /proc/PID/stat.
+func processStartTime(pid int) (uint64, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// procStat returns the fields of /proc/PID/stat from field 3 on (see proc(5)).
+func procStat(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// "PID (COMMAND) STATE PPID ...": the command may contain spaces and parentheses itself,
+	// so split what comes after the last ")"
+	var fields []string
+	if i := bytes.LastIndexByte(data, ')'); i >= 0 {
+		fields = strings.Fields(string(data[i+1:]))
+	}
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+// removeState deletes the directory of container id with everything in it.
+func removeState(id string) {
+	// While its config is there to say which image it was
+	recordEvent(id, eventRemove)
+	// Its address is free again once the container is gone, not when it merely exited: a restart
+	// or `start` gets the same one
+	releaseNetwork(id)
+	// Its snapshotter is in the config, which goes with the state
+	remove := removeTree
+	if cfg, err := readConfig(id); err == nil {
+		remove = snapshotterOf(cfg).remove
+	}
+	if err := os.RemoveAll(stateDir(id)); err != nil {
+		slog.Warn("could not remove the state", "id", shortID(id), "err", err)
+	}
+	// And what it changed in its rootfs
+	if err := remove(containerDataDir(id)); err != nil {
+		slog.Warn("could not remove the files", "id", shortID(id), "err", err)
+	}
+}
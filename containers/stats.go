@@ -0,0 +1,241 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// cgroupStats is a snapshot of the counters the kernel keeps for a container's cgroup.
+// Everything `docker stats` shows comes from these files.
+type cgroupStats struct {
+	CPUUsage    time.Duration // total CPU time used by all processes so far
+	Memory      int64         // current memory usage in bytes
+	MemoryLimit int64         // 0 means no limit
+	Pids        int64
+	PidsLimit   int64 // 0 means no limit
+	ReadBytes   int64
+	WriteBytes  int64
+	// The CFS quota of --cpus: how many of its periods there were, in how many the container
+	// used up its quota and had to wait, and how long it waited in all
+	Periods          int64
+	ThrottledPeriods int64
+	Throttled        time.Duration
+}
+
+// stats implements `stats [OPTIONS] [CONTAINER...]`
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stats [OPTIONS] [CONTAINER...]\n\nShow live resource usage of running containers (all of them if none is given).\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	interval := fs.Duration("interval", time.Second, "time between updates")
+	noStream := fs.Bool("no-stream", false, "print a single snapshot and exit")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if *interval <= 0 {
+		return usageErrorf(fs, "invalid --interval %v", *interval)
+	}
+
+	ids, err := resolveContainers(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	// CPU % is CPU time used per wall-clock time, so we need two samples
+	previous := map[string]cgroupStats{}
+	for _, id := range ids {
+		if s, err := readCgroupStats(id); err == nil {
+			previous[id] = s
+		}
+	}
+
+	for {
+		time.Sleep(*interval)
+
+		if !*noStream {
+			// Clear the screen and jump to the top left corner, like top does
+			fmt.Print("\033[2J\033[H")
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(tw, "CONTAINER ID\tCPU %\tMEM USAGE / LIMIT\tMEM %\tPIDS\tBLOCK I/O")
+
+		var running []string
+		for _, id := range ids {
+			current, err := readCgroupStats(id)
+			if err != nil {
+				// The cgroup is gone, the container exited
+				continue
+			}
+			running = append(running, id)
+
+			cpu := float64(current.CPUUsage-previous[id].CPUUsage) / float64(*interval) * 100
+			previous[id] = current
+
+			limit := current.MemoryLimit
+			if limit == 0 {
+				limit = hostMemory()
+			}
+			fmt.Fprintf(tw, "%s\t%.2f%%\t%s / %s\t%.2f%%\t%d\t%s / %s\n",
+				shortID(id), cpu,
+				formatBytes(current.Memory), formatBytes(limit), float64(current.Memory)/float64(limit)*100,
+				current.Pids,
+				formatBytes(current.ReadBytes), formatBytes(current.WriteBytes))
+		}
+		tw.Flush()
+
+		if *noStream {
+			return nil
+		}
+		if ids = running; len(ids) == 0 {
+			fmt.Println("No running containers left")
+			return nil
+		}
+	}
+}
+
+// resolveContainers turns (prefixes of) container IDs into the full IDs of containers with a
+// cgroup, the one thing stats, pause and unpause work with. No arguments means all running
+// containers.
+func resolveContainers(args []string) ([]string, error) {
+	var ids []string
+	if len(args) == 0 {
+		for _, s := range listStates() {
+			if s.currentStatus() == statusRunning && s.Cgroup != "" {
+				ids = append(ids, s.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("no running containers")
+		}
+		return ids, nil
+	}
+
+	for _, arg := range args {
+		s, err := findContainer(arg)
+		if err != nil {
+			return nil, err
+		}
+		if status := s.currentStatus(); status != statusRunning && status != statusCreated {
+			return nil, fmt.Errorf("container %s is %s", shortID(s.ID), status)
+		}
+		if s.Cgroup == "" {
+			return nil, fmt.Errorf("container %s has no cgroup: rootless containers don't get one", shortID(s.ID))
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// readCgroupStats collects the usage counters of container id.
+func readCgroupStats(id string) (cgroupStats, error) {
+	var s cgroupStats
+	// A cgroup without processes belongs to a container that is gone (or was never cleaned up)
+	if readCgroupFile(cgroupPath("memory", id), "cgroup.procs") == "" {
+		return s, fmt.Errorf("container %s is not running", shortID(id))
+	}
+	num := func(dir, file string) int64 {
+		n, _ := strconv.ParseInt(readCgroupFile(dir, file), 10, 64)
+		return n
+	}
+
+	if cgroupV2() {
+		dir := cgroupPath("", id)
+
+		// cpu.stat: "usage_usec 123456" plus user/system split and throttling counters
+		for _, line := range strings.Split(readCgroupFile(dir, "cpu.stat"), "\n") {
+			key, v, _ := strings.Cut(line, " ")
+			n, _ := strconv.ParseInt(v, 10, 64)
+			switch key {
+			case "usage_usec":
+				s.CPUUsage = time.Duration(n) * time.Microsecond
+			case "nr_periods":
+				s.Periods = n
+			case "nr_throttled":
+				s.ThrottledPeriods = n
+			case "throttled_usec":
+				s.Throttled = time.Duration(n) * time.Microsecond
+			}
+		}
+		s.Memory = num(dir, "memory.current")
+		s.MemoryLimit = num(dir, "memory.max") // "max" doesn't parse and stays 0: unlimited
+		s.Pids = num(dir, "pids.current")
+		s.PidsLimit = num(dir, "pids.max")
+
+		// io.stat: one line per device, "8:0 rbytes=1024 wbytes=4096 rios=1 wios=2 ..."
+		for _, line := range strings.Split(readCgroupFile(dir, "io.stat"), "\n") {
+			for _, field := range strings.Fields(line) {
+				key, value, _ := strings.Cut(field, "=")
+				n, _ := strconv.ParseInt(value, 10, 64)
+				switch key {
+				case "rbytes":
+					s.ReadBytes += n
+				case "wbytes":
+					s.WriteBytes += n
+				}
+			}
+		}
+		return s, nil
+	}
+
+	// cpuacct.usage is the total CPU time in nanoseconds
+	s.CPUUsage = time.Duration(num(cgroupPath("cpuacct", id), "cpuacct.usage"))
+	s.Memory = num(cgroupPath("memory", id), "memory.usage_in_bytes")
+	// v1 has no "max": an unlimited cgroup reports a huge number (LONG_MAX rounded to pages)
+	if limit := num(cgroupPath("memory", id), "memory.limit_in_bytes"); limit < 1<<62 {
+		s.MemoryLimit = limit
+	}
+	s.Pids = num(cgroupPath("pids", id), "pids.current")
+	s.PidsLimit = num(cgroupPath("pids", id), "pids.max")
+	// cpu.stat of v1 has the throttled time in nanoseconds
+	for _, line := range strings.Split(readCgroupFile(cgroupPath("cpu", id), "cpu.stat"), "\n") {
+		key, v, _ := strings.Cut(line, " ")
+		n, _ := strconv.ParseInt(v, 10, 64)
+		switch key {
+		case "nr_periods":
+			s.Periods = n
+		case "nr_throttled":
+			s.ThrottledPeriods = n
+		case "throttled_time":
+			s.Throttled = time.Duration(n)
+		}
+	}
+
+	// blkio.throttle.io_service_bytes: "8:0 Read 1024", "8:0 Write 4096", ... per device
+	for _, line := range strings.Split(readCgroupFile(cgroupPath("blkio", id), "blkio.throttle.io_service_bytes"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		n, _ := strconv.ParseInt(fields[2], 10, 64)
+		switch fields[1] {
+		case "Read":
+			s.ReadBytes += n
+		case "Write":
+			s.WriteBytes += n
+		}
+	}
+	return s, nil
+}
+
+// hostMemory is the total RAM of the host, the effective limit of a container without one
+func hostMemory() int64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return int64(info.Totalram) * int64(info.Unit)
+}
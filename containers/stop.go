@@ -0,0 +1,296 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signalNames lists the signals by number, the same on x86 and arm64 (see signal(7)).
+var signalNames = []string{
+	1: "HUP", "INT", "QUIT", "ILL", "TRAP", "ABRT", "BUS", "FPE", "KILL", "USR1", "SEGV", "USR2", "PIPE",
+	"ALRM", "TERM", "STKFLT", "CHLD", "CONT", "STOP", "TSTP", "TTIN", "TTOU", "URG", "XCPU", "XFSZ",
+	"VTALRM", "PROF", "WINCH", "IO", "PWR", "SYS",
+}
+
+// parseSignal accepts "TERM", "SIGTERM", "sigterm" or "15".
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= 64 {
+		// Numbers above 31 are the real-time signals, which have no names
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	for n, known := range signalNames {
+		if n > 0 && known == name {
+			return syscall.Signal(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// stop implements `stop [OPTIONS] CONTAINER...`, like `docker stop`.
+//
+// A graceful stop gives the container the chance to clean up: SIGTERM goes to the container's
+// init, which passes it on to the command. If the container is still running after the timeout, it
+// gets SIGKILL. SIGKILL can't be caught, not even by a PID 1, and when the init of a PID namespace
+// dies the kernel kills every other process in it, so nothing in the container survives that.
+func stop(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stop [OPTIONS] CONTAINER...\n\nStop running containers: SIGTERM, then SIGKILL after a timeout.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var timeout int
+	fs.IntVar(&timeout, "t", 10, "seconds to wait before killing the container")
+	fs.IntVar(&timeout, "time", 10, "same as -t")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+	if timeout < 0 {
+		return usageErrorf(fs, "invalid --time %d", timeout)
+	}
+
+	for _, arg := range fs.Args() {
+		if err := stopOne(arg, time.Duration(timeout)*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopOne stops one container for stop.
+func stopOne(prefix string, timeout time.Duration) error {
+	s, unlock, err := lockContainerState(prefix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Stopping a container that isn't running is not an error, it's stopped either way
+	switch s.currentStatus() {
+	case statusCreated, statusRunning:
+		// Its restart policy must not start it again
+		if err := requestStop(s.ID); err != nil {
+			return err
+		}
+		if err := syscall.Kill(s.Pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("stop %s: %w", shortID(s.ID), err)
+		}
+		// The monitor needs the lock to record the exit we are waiting for
+		unlock()
+		if !waitStopped(s, timeout) {
+			slog.Warn("container did not stop in time, killing it", "id", shortID(s.ID), "timeout", timeout)
+			if err := syscall.Kill(s.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return fmt.Errorf("kill %s: %w", shortID(s.ID), err)
+			}
+			waitStopped(s, 5*time.Second)
+		}
+		recordEvent(s.ID, eventStop)
+	case statusRestarting:
+		if err := stopRestart(s); err != nil {
+			return err
+		}
+		unlock()
+		waitStopped(s, 5*time.Second)
+		recordEvent(s.ID, eventStop)
+	}
+	fmt.Println(shortID(s.ID))
+	return nil
+}
+
+// kill implements `kill [OPTIONS] CONTAINER...`: send a signal (SIGKILL by default) to the
+// container's init, like `docker kill`.
+func kill(args []string) error {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s kill [OPTIONS] CONTAINER...\n\nSend a signal to running containers.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var name string
+	fs.StringVar(&name, "s", "KILL", "signal to send, e.g. TERM, SIGUSR1 or 15")
+	fs.StringVar(&name, "signal", "KILL", "same as -s")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+	sig, err := parseSignal(name)
+	if err != nil {
+		return usageErrorf(fs, "%v", err)
+	}
+
+	for _, arg := range fs.Args() {
+		s, unlock, err := lockContainerState(arg)
+		if err != nil {
+			return err
+		}
+		// Under the lock the monitor can't record the exit in between, so s.Pid is still the
+		// container's init, not a process that got its PID after it
+		if status := s.currentStatus(); status != statusRunning && status != statusCreated {
+			err = fmt.Errorf("container %s is not running", shortID(s.ID))
+		} else if err = syscall.Kill(s.Pid, sig); err != nil {
+			err = fmt.Errorf("kill %s: %w", shortID(s.ID), err)
+		} else {
+			recordEvent(s.ID, eventKill, "signal", strconv.Itoa(int(sig)))
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+		fmt.Println(shortID(s.ID))
+	}
+	return nil
+}
+
+// lockContainerState finds the container whose ID starts with prefix, takes its lock (see
+// lockContainer) and reads its state again, which may have changed while we waited.
+func lockContainerState(prefix string) (*containerState, func(), error) {
+	found, err := findContainer(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockContainer(found.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := readState(found.ID)
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("no such container: %s", prefix)
+	}
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return s, unlock, nil
+}
+
+// stopRestart stops container s while it waits to be restarted. Then only its monitor is left,
+// which gives up on the restart when it gets SIGTERM. Call it with the lock held, and wait for
+// the monitor after releasing it.
+func stopRestart(s *containerState) error {
+	if err := requestStop(s.ID); err != nil {
+		return err
+	}
+	if err := syscall.Kill(s.MonitorPid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("stop %s: %w", shortID(s.ID), err)
+	}
+	return nil
+}
+
+// waitStopped polls until container s has stopped, at most for timeout. We aren't the parent of
+// the container, so we can't wait() for it. It has stopped once its monitor recorded the exit (or
+// removed the state, for a container in the foreground), or when the monitor itself is gone.
+func waitStopped(s *containerState, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(50 * time.Millisecond) {
+		current, err := readState(s.ID)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && current.stopped()) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+}
+
+// rm implements `rm [OPTIONS] CONTAINER...`: delete what is left of stopped containers.
+func rm(args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rm [OPTIONS] CONTAINER...\n\nRemove stopped containers.\n\nOptions:\n", progName())
+		fs.PrintDefaults()
+	}
+	var force bool
+	fs.BoolVar(&force, "f", false, "kill running containers first")
+	fs.BoolVar(&force, "force", false, "same as -f")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+
+	for _, arg := range fs.Args() {
+		if err := removeOne(arg, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOne removes one container for rm.
+func removeOne(prefix string, force bool) error {
+	s, unlock, err := lockContainerState(prefix)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	switch status := s.currentStatus(); status {
+	case statusCreated, statusRunning, statusRestarting:
+		if !force {
+			return fmt.Errorf("container %s is %s: stop it first or use rm -f", shortID(s.ID), status)
+		}
+		if status == statusRestarting {
+			if err := stopRestart(s); err != nil {
+				return err
+			}
+			break
+		}
+		if err := requestStop(s.ID); err != nil {
+			return err
+		}
+		if err := syscall.Kill(s.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("kill %s: %w", shortID(s.ID), err)
+		}
+	}
+	if !s.stopped() {
+		// Let the monitor finish, or it writes the state again right after we removed it. It
+		// needs the lock for that, we take it again after.
+		unlock()
+		if !waitStopped(s, 5*time.Second) {
+			return fmt.Errorf("container %s did not stop", shortID(s.ID))
+		}
+		if s, unlock, err = lockContainerState(s.ID); err != nil {
+			return err
+		}
+		defer unlock()
+		if !s.stopped() {
+			// Another command started it again while we waited
+			return fmt.Errorf("container %s is %s again", shortID(s.ID), s.currentStatus())
+		}
+	}
+	removeContainer(s)
+	fmt.Println(shortID(s.ID))
+	return nil
+}
+
+// removeContainer deletes the cgroup and the state of a stopped container.
+//
+// The monitor removes the cgroup itself when the container exits, unless it was killed first.
+// Everything else a container had goes away with its last process: its mounts live in its own
+// mount namespace, and the network namespace takes its interfaces along.
+func removeContainer(s *containerState) {
+	if s.Cgroup != "" {
+		removeCgroups(s.ID)
+	}
+	removeState(s.ID)
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The time namespace (Linux 5.6) is the newest namespace, and the only one about a value rather
+// than a set of things: it shifts two clocks, CLOCK_MONOTONIC (time since some point at boot,
+// what timeouts are measured with) and CLOCK_BOOTTIME (the same, including suspend, what `uptime`
+// shows). The wall clock, CLOCK_REALTIME, stays shared: moving it is what NTP is for, and all
+// of the world agrees on it. CRIU needs the namespace to move a container to another host
+// without its clocks jumping back to that host's uptime.
+
+// timeOffsetsEnv passes the offsets from the monitor to the child, which needs them before it
+// reads its config (see enterTimeNamespace): the boottime and monotonic offsets in nanoseconds
+const timeOffsetsEnv = "_CONTAINER_TIME_OFFSETS"
+
+// timeOffsets are how far the clocks of a time namespace are ahead of the host's, behind when
+// negative.
+type timeOffsets struct {
+	Boottime  time.Duration `json:"boottime,omitempty"`
+	Monotonic time.Duration `json:"monotonic,omitempty"`
+}
+
+// parseTimeOffset parses --boottime-offset and --monotonic-offset: a Go duration like 90m or
+// -1h30m, or a number of days like 10d, which is what an uptime demo wants.
+func parseTimeOffset(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// encode is the value of timeOffsetsEnv for o.
+func (o timeOffsets) encode() string {
+	return fmt.Sprintf("%d %d", o.Boottime, o.Monotonic)
+}
+
+// enterTimeNamespace runs first thing in the child when timeOffsetsEnv is set: it creates a time
+// namespace with the offsets and executes the child again, inside it. On success it doesn't return.
+//
+// A time namespace is odd in two ways. unshare(CLONE_NEWTIME) doesn't move the caller, the new
+// namespace is only for what it starts later (/proc/<pid>/ns/time_for_children), or for itself
+// after its next execve(). And the offsets can only be set as long as no process is in it yet, in
+// /proc/<pid>/timens_offsets, which only exists per process, not per thread: it is the namespace
+// of the main thread. So the main thread has to do all of it, including the execve() (main locks
+// the child's main goroutine to it). runc does the same in C, before the Go runtime even starts.
+func enterTimeNamespace(encoded string) error {
+	var offsets timeOffsets
+	if _, err := fmt.Sscanf(encoded, "%d %d", &offsets.Boottime, &offsets.Monotonic); err != nil {
+		return fmt.Errorf("invalid %s %q", timeOffsetsEnv, encoded)
+	}
+	explainBefore("unshare(CLONE_NEWTIME)", "Creates a time namespace, whose CLOCK_BOOTTIME and CLOCK_MONOTONIC may be "+
+		"ahead or behind the host's. Only the processes the next execve() starts are in it.")
+	err := syscall.Unshare(syscall.CLONE_NEWTIME)
+	explainAfter(err, "")
+	if err != nil {
+		return fmt.Errorf("unshare time namespace: %w", err)
+	}
+	var lines strings.Builder
+	for _, clock := range []struct {
+		name   string
+		offset time.Duration
+	}{{"monotonic", offsets.Monotonic}, {"boottime", offsets.Boottime}} {
+		// Seconds and nanoseconds, the nanoseconds always positive: -1.5s is -2s + 500000000ns
+		secs, nsecs := int64(clock.offset/time.Second), int64(clock.offset%time.Second)
+		if nsecs < 0 {
+			secs, nsecs = secs-1, nsecs+int64(time.Second)
+		}
+		fmt.Fprintf(&lines, "%s %d %d\n", clock.name, secs, nsecs)
+	}
+	// One write() for both, the kernel applies it all or nothing
+	if err := os.WriteFile("/proc/self/timens_offsets", []byte(lines.String()), 0); err != nil {
+		// ERANGE: the clock would be negative, e.g. a boottime offset of -10d after a day of uptime
+		return fmt.Errorf("set time offsets: %w", err)
+	}
+
+	// The config pipe and the other file descriptors stay open across execve(), the second child
+	// reads the config the monitor sends like any child
+	os.Unsetenv(timeOffsetsEnv)
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
@@ -0,0 +1,198 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// `top CONTAINER` lists the processes of a container, like `docker top`:
+//
+//	PID   HOST PID   PPID   UID   %CPU   RSS      TIME       COMMAND
+//	1     4711       0      0     0.0    1.2MiB   00:00:00   /bin/sh -c while true; do ...
+//	9     4790       1      0     0.0    896.0KiB 00:00:00   sleep 1
+//
+// A process has a PID in every PID namespace it is in: 1 in the container, 4711 on the host.
+// The host's /proc has them all, in the NSpid line of /proc/PID/status, innermost last. Which
+// processes are the container's says /proc/PID/cgroup: the container's cgroup, or one below it.
+// A rootless container has no cgroup of its own, there it's the processes in its PID namespace.
+//
+// UID is the user on the host, which a user namespace maps to root in a rootless container. %CPU
+// is what ps shows: the CPU time of the process over the time it has been running, not over the
+// last second like stats. RSS is the memory it has in RAM.
+
+// userHZ is the unit of the times in /proc/PID/stat, in ticks per second. It's fixed at 100 for
+// userspace, whatever the kernel's own HZ is.
+const userHZ = 100
+
+// topProcess is a line of top
+type topProcess struct {
+	pid, hostPid, ppid, uid int
+	cpu                     time.Duration
+	started                 time.Duration // after boot
+	rss                     int64
+	command                 string
+}
+
+// top implements `top CONTAINER`.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s top CONTAINER\n\nList the processes of a running container, with their PIDs in the container and on the host.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf(fs, "expected one CONTAINER")
+	}
+	s, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if s.currentStatus() != statusRunning {
+		return fmt.Errorf("container %s is not running", shortID(s.ID))
+	}
+
+	inContainer, err := containerProcessFilter(s)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	var processes []topProcess
+	for _, entry := range entries {
+		hostPid, err := strconv.Atoi(entry.Name())
+		if err != nil || !inContainer(hostPid) {
+			continue
+		}
+		// A process that exits while we read it just isn't in the list
+		if p, err := readTopProcess(hostPid); err == nil {
+			processes = append(processes, p)
+		}
+	}
+	if len(processes) == 0 {
+		return fmt.Errorf("container %s has no processes", shortID(s.ID))
+	}
+	slices.SortFunc(processes, func(a, b topProcess) int { return a.pid - b.pid })
+
+	// The PPID in the container: the parent of init is on the host, and 0 like the kernel shows it there
+	inside := map[int]int{}
+	for _, p := range processes {
+		inside[p.hostPid] = p.pid
+	}
+	uptime := systemUptime()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "PID\tHOST PID\tPPID\tUID\t%CPU\tRSS\tTIME\tCOMMAND")
+	for _, p := range processes {
+		var percent float64
+		if running := uptime - p.started; running > 0 {
+			percent = 100 * p.cpu.Seconds() / running.Seconds()
+		}
+		seconds := int(p.cpu.Seconds())
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.1f\t%s\t%02d:%02d:%02d\t%s\n", p.pid, p.hostPid, inside[p.ppid], p.uid,
+			percent, formatBytes(p.rss), seconds/3600, seconds/60%60, seconds%60, truncate(p.command, 60))
+	}
+	return tw.Flush()
+}
+
+// containerProcessFilter returns what tells whether a host PID is a process of the container of
+// s: by its cgroup, or without one by its PID namespace.
+func containerProcessFilter(s *containerState) (func(pid int) bool, error) {
+	if s.Cgroup != "" {
+		return func(pid int) bool {
+			data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+			if err != nil {
+				return false
+			}
+			// "0::/mycontainer/ID" on v2, a line like "4:memory:/mycontainer/ID" per hierarchy on v1
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if parts := strings.SplitN(line, ":", 3); len(parts) == 3 &&
+					(parts[2] == s.Cgroup || strings.HasPrefix(parts[2], s.Cgroup+"/")) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	var pidns syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/ns/pid", s.Pid), &pidns); err != nil {
+		return nil, fmt.Errorf("the PID namespace of %s: %w", shortID(s.ID), err)
+	}
+	return func(pid int) bool {
+		var st syscall.Stat_t
+		return syscall.Stat(fmt.Sprintf("/proc/%d/ns/pid", pid), &st) == nil && st.Dev == pidns.Dev && st.Ino == pidns.Ino
+	}, nil
+}
+
+// readTopProcess reads what top shows of the process with host PID hostPid from /proc.
+func readTopProcess(hostPid int) (topProcess, error) {
+	p := topProcess{hostPid: hostPid, pid: hostPid}
+	fields, err := procStat(hostPid)
+	if err != nil {
+		return p, err
+	}
+	// From field 3 on: PPID is field 4, utime and stime 14 and 15, starttime 22
+	p.ppid, _ = strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	p.cpu = time.Duration(utime+stime) * time.Second / userHZ
+	started, _ := strconv.ParseInt(fields[19], 10, 64)
+	p.started = time.Duration(started) * time.Second / userHZ
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", hostPid))
+	if err != nil {
+		return p, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		values := strings.Fields(value)
+		if len(values) == 0 {
+			continue
+		}
+		switch key {
+		case "NSpid":
+			p.pid, _ = strconv.Atoi(values[len(values)-1])
+		case "Uid":
+			p.uid, _ = strconv.Atoi(values[0])
+		case "VmRSS":
+			// "VmRSS:	    1234 kB", kernel threads have none
+			kib, _ := strconv.ParseInt(values[0], 10, 64)
+			p.rss = kib * 1024
+		}
+	}
+
+	// The arguments are NUL-separated, and empty for a zombie: then its name, in brackets like ps
+	cmdline, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", hostPid))
+	p.command = strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ")
+	if p.command == "" {
+		if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", hostPid)); err == nil {
+			p.command = "[" + strings.TrimSpace(string(comm)) + "]"
+		}
+	}
+	return p, nil
+}
+
+// systemUptime is how long the host has been up, the first number of /proc/uptime.
+func systemUptime() time.Duration {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	seconds, _ := strconv.ParseFloat(strings.Fields(string(data))[0], 64)
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,468 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// `run --trace` shows what the command asks the kernel for, the way strace does: every system
+// call of the command and of the processes it starts, with its arguments and what it returned.
+//
+//	[1] openat(AT_FDCWD, "/etc/passwd", 0x80000) = 3
+//	[1] read(3, "root:x:0:0:root:/root:/bin/sh\n"..., 4096) = 1203
+//	[1] write(1, "root\n", 5) = 5
+//	[1] exit_group(0) = ?
+//	[1] +++ exited with 0 +++
+//
+// The tracer is ptrace(2), the same one debuggers use. The container's init starts the command
+// with PTRACE_TRACEME, which stops it right after its execve(), and then runs it from one stop to
+// the next with PTRACE_SYSCALL: the kernel stops the tracee when it enters a system call and
+// again when it leaves it, and in between we read its registers, the number of the call, its
+// arguments and the result. Strings and buffers are in the tracee's memory, PTRACE_PEEKDATA reads
+// them a word at a time. The options make the kernel trace the processes it forks as well.
+//
+// A tracer must be the thread that started the tracee, so it is the locked thread of
+// startRestricted, with the capabilities the command has and under its seccomp filter: tracing a
+// child of the same user needs no privilege. It is also the one that waits for every process in
+// the container now, as the init does without --trace, since wait4 would take the stops of the
+// tracees from anyone else. The PIDs are the ones in the container, and the lines go to the
+// container's stderr, next to what the command writes there. Every call stops the tracee twice,
+// so a traced program is a lot slower.
+
+// traceRegisters says where the syscall registers are in the NT_PRSTATUS register set of an
+// architecture: user_regs_struct of amd64, user_pt_regs of arm64 (x0 has the first argument on
+// entry and the result on exit).
+var traceRegisters = map[string]struct {
+	number, result int
+	args           [6]int
+	count          int
+}{
+	"amd64": {number: 15 /* orig_rax */, result: 10 /* rax */, args: [6]int{14, 13, 12, 7, 9, 8} /* rdi rsi rdx r10 r8 r9 */, count: 27},
+	"arm64": {number: 8, result: 0, args: [6]int{0, 1, 2, 3, 4, 5}, count: 34},
+}
+
+// Constants from <linux/ptrace.h> and <linux/elf.h> the syscall package doesn't have
+const (
+	ptraceOExitKill = 0x100000
+	ntPrstatus      = 1
+)
+
+// The longest string and buffer a trace line shows, and the most entries of an argv
+const (
+	traceStringLimit = 32
+	traceArgvLimit   = 8
+)
+
+// traceSignatures says how to print the arguments of a system call, a letter each:
+//
+//	d  an int       u  a size            l  an offset, a long     f  a file descriptor, AT_FDCWD for -100
+//	x  flags, hex   o  a mode, octal     p  a pointer, NULL for 0
+//	s  a string     S  the string the call writes, like getcwd    v  an array of strings, like argv
+//	b  the buffer the call reads from, the next argument is its length
+//	r  the buffer the call writes into, as long as the result
+//
+// A call that isn't here gets its first three arguments in hex.
+var traceSignatures = map[string]string{
+	"read": "fru", "write": "fbu", "pread64": "frul", "pwrite64": "fbul", "readv": "fpd", "writev": "fpd",
+	"open": "sxo", "openat": "fsxo", "creat": "so", "close": "f", "lseek": "fld",
+	"stat": "sp", "lstat": "sp", "fstat": "fp", "newfstatat": "fspx", "statx": "fsxxp",
+	"access": "so", "faccessat": "fso", "faccessat2": "fsox", "readlink": "sru", "readlinkat": "fsru",
+	"getdents64": "fpu", "getcwd": "Su", "chdir": "s", "fchdir": "f", "mkdir": "so", "mkdirat": "fso",
+	"rmdir": "s", "unlink": "s", "unlinkat": "fsx", "rename": "ss", "renameat": "fsfs", "renameat2": "fsfsx",
+	"chmod": "so", "fchmod": "fo", "fchmodat": "fso", "chown": "sdd", "fchownat": "fsddx", "symlink": "ss",
+	"symlinkat": "sfs", "link": "ss", "linkat": "fsfsx", "truncate": "sl", "ftruncate": "fl",
+	"dup": "f", "dup2": "ff", "dup3": "ffx", "pipe": "p", "pipe2": "px", "fcntl": "fdx", "ioctl": "fxp",
+	"execve": "svp", "execveat": "fsvpx", "clone": "xp", "clone3": "pu", "fork": "", "vfork": "",
+	"wait4": "dpxp", "exit": "d", "exit_group": "d", "kill": "dd", "tgkill": "ddd",
+	"getpid": "", "getppid": "", "gettid": "", "getuid": "", "geteuid": "", "getgid": "", "getegid": "",
+	"setuid": "d", "setgid": "d", "uname": "p", "sethostname": "su", "umask": "o",
+	"mmap": "puxxfl", "munmap": "pu", "mprotect": "pux", "brk": "p", "madvise": "pud",
+	"rt_sigaction": "dpp", "rt_sigprocmask": "dppu", "rt_sigreturn": "", "sigaltstack": "pp",
+	"nanosleep": "pp", "clock_nanosleep": "dxpp", "clock_gettime": "dp", "poll": "pud", "ppoll": "pupp",
+	"socket": "ddd", "connect": "fpu", "bind": "fpu", "listen": "fd", "accept": "fpp", "accept4": "fppx",
+	"sendto": "fbuxpu", "recvfrom": "fruxpp", "shutdown": "fd", "setsockopt": "fddpu", "getsockopt": "fddpp",
+	"getrandom": "rux", "set_tid_address": "p", "set_robust_list": "pu", "arch_prctl": "xp", "prctl": "dxxxx",
+	"prlimit64": "ddpp", "futex": "pxdp", "sysinfo": "p", "sched_getaffinity": "dup", "rseq": "puxx",
+}
+
+// traceErrnos names the errors a trace shows most, like strace: the name, then the message
+var traceErrnos = map[syscall.Errno]string{
+	syscall.EPERM: "EPERM", syscall.ENOENT: "ENOENT", syscall.ESRCH: "ESRCH", syscall.EINTR: "EINTR",
+	syscall.EIO: "EIO", syscall.EBADF: "EBADF", syscall.ECHILD: "ECHILD", syscall.EAGAIN: "EAGAIN",
+	syscall.ENOMEM: "ENOMEM", syscall.EACCES: "EACCES", syscall.EFAULT: "EFAULT", syscall.EEXIST: "EEXIST",
+	syscall.ENOTDIR: "ENOTDIR", syscall.EISDIR: "EISDIR", syscall.EINVAL: "EINVAL", syscall.ENOTTY: "ENOTTY",
+	syscall.ENOSPC: "ENOSPC", syscall.ESPIPE: "ESPIPE", syscall.EROFS: "EROFS", syscall.EPIPE: "EPIPE",
+	syscall.ERANGE: "ERANGE", syscall.ENOSYS: "ENOSYS", syscall.ENOTEMPTY: "ENOTEMPTY", syscall.ELOOP: "ELOOP",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG", syscall.ENOTSOCK: "ENOTSOCK", syscall.EAFNOSUPPORT: "EAFNOSUPPORT",
+	syscall.EADDRINUSE: "EADDRINUSE", syscall.ENETUNREACH: "ENETUNREACH", syscall.ECONNREFUSED: "ECONNREFUSED",
+	syscall.ETIMEDOUT: "ETIMEDOUT", syscall.EINPROGRESS: "EINPROGRESS", syscall.ENOTCONN: "ENOTCONN",
+}
+
+// tracePointerResults are the calls whose result is an address
+var tracePointerResults = map[string]bool{"mmap": true, "brk": true, "mremap": true, "shmat": true}
+
+// checkTrace tells whether --trace works on this architecture.
+func checkTrace() error {
+	if _, ok := traceRegisters[runtime.GOARCH]; !ok {
+		return fmt.Errorf("--trace knows the registers of amd64 and arm64, not of %s", runtime.GOARCH)
+	}
+	return nil
+}
+
+// tracedCall is a system call a tracee entered and hasn't left yet.
+type tracedCall struct {
+	name string
+	args [6]uint64
+	// shown are the arguments as printed, on entry: after an execve the strings are gone
+	shown []string
+}
+
+// tracer follows the system calls of the command and of the processes it starts.
+type tracer struct {
+	// calls are the calls the tracees are in, by PID
+	calls map[int]*tracedCall
+	// traced are the tracees, the processes that aren't there yet stop with SIGSTOP first
+	traced map[int]bool
+}
+
+// startTraced starts cmd like startRestricted, traced, and follows it and what it starts until it
+// has exited. It reaps the other processes of the container like reapUntil, and returns the exit
+// status of the command.
+func startTraced(cmd *exec.Cmd, restrict func() error, started func(pid int)) (syscall.WaitStatus, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+	type result struct {
+		status syscall.WaitStatus
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// Never unlocked: the thread has the restrictions of the command, and it's the tracer
+		runtime.LockOSThread()
+		if err := restrict(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		started(cmd.Process.Pid)
+		t := &tracer{calls: map[int]*tracedCall{}, traced: map[int]bool{}}
+		status, err := t.run(cmd)
+		done <- result{status, err}
+	}()
+	r := <-done
+	return r.status, r.err
+}
+
+// run follows the command, stopped after its execve, until it exits.
+func (t *tracer) run(cmd *exec.Cmd) (syscall.WaitStatus, error) {
+	pid := cmd.Process.Pid
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, syscall.WALL, nil); err != nil {
+		return 0, fmt.Errorf("trace: wait: %w", err)
+	}
+	if !status.Stopped() {
+		return status, nil
+	}
+	options := syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK |
+		syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACEEXEC | ptraceOExitKill
+	if err := syscall.PtraceSetOptions(pid, options); err != nil {
+		return 0, fmt.Errorf("trace: %w", err)
+	}
+	t.traced[pid] = true
+	// The execve that started it is over, it stopped on its way back
+	t.print(pid, fmt.Sprintf("execve(%s, [%s], ...) = 0", strconv.Quote(cmd.Path), quoteArgs(cmd.Args)))
+	if err := syscall.PtraceSyscall(pid, 0); err != nil {
+		return 0, fmt.Errorf("trace: %w", err)
+	}
+
+	for {
+		stopped, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("trace: wait: %w", err)
+		}
+		if status.Exited() || status.Signaled() {
+			if !t.traced[stopped] {
+				// An orphan the init reaps, it wasn't ours to trace
+				continue
+			}
+			t.exited(stopped, status)
+			if stopped == pid {
+				return status, nil
+			}
+			continue
+		}
+		if !status.Stopped() {
+			continue
+		}
+		t.stopped(stopped, status)
+	}
+}
+
+// stopped handles a stop of tracee pid and lets it go on to the next.
+func (t *tracer) stopped(pid int, status syscall.WaitStatus) {
+	var signal syscall.Signal
+	switch sig := status.StopSignal(); {
+	case sig == syscall.SIGTRAP|0x80:
+		// TRACESYSGOOD: a system call, on its way in or out
+		t.syscallStop(pid)
+	case !t.traced[pid] && sig == syscall.SIGSTOP:
+		// The first stop of a process a tracee forked
+		t.traced[pid] = true
+	case sig == syscall.SIGTRAP && status.TrapCause() > 0:
+		// A fork, clone or exec, the next stops tell what it did
+	case t.groupStop(pid):
+		// Stopped by SIGSTOP or SIGTSTP, the tracee goes on right away as without --trace
+	default:
+		// A signal on its way to the tracee, which gets it when it goes on
+		signal = sig
+		t.print(pid, fmt.Sprintf("--- %s ---", signalName(sig)))
+	}
+	syscall.PtraceSyscall(pid, int(signal))
+}
+
+// groupStop tells whether the stop of pid is the group-stop of a stop signal, rather than a
+// signal to pass on: a group stop has no siginfo (see ptrace(2)).
+func (t *tracer) groupStop(pid int) bool {
+	var siginfo [128]byte
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETSIGINFO, uintptr(pid), 0, uintptr(unsafe.Pointer(&siginfo[0])), 0, 0)
+	return errno == syscall.EINVAL
+}
+
+// syscallStop reads the system call pid enters or leaves, and prints the call when it's over.
+func (t *tracer) syscallStop(pid int) {
+	regs, err := t.registers(pid)
+	if err != nil {
+		return
+	}
+	layout := traceRegisters[runtime.GOARCH]
+	call, inside := t.calls[pid]
+	if !inside {
+		call = &tracedCall{name: syscallName(int(regs[layout.number]))}
+		if call.name == "" {
+			call.name = fmt.Sprintf("syscall_%d", regs[layout.number])
+		}
+		for i, r := range layout.args {
+			call.args[i] = regs[r]
+		}
+		call.shown = t.formatArgs(pid, call, nil)
+		t.calls[pid] = call
+		return
+	}
+	delete(t.calls, pid)
+	result := int64(regs[layout.result])
+	t.print(pid, fmt.Sprintf("%s(%s) = %s", call.name, strings.Join(t.formatArgs(pid, call, &result), ", "), formatResult(call.name, result)))
+}
+
+// exited prints that tracee pid is gone, and the call it was in if any: exit_group and execve of
+// another thread don't come back.
+func (t *tracer) exited(pid int, status syscall.WaitStatus) {
+	if call, ok := t.calls[pid]; ok {
+		t.print(pid, fmt.Sprintf("%s(%s) = ?", call.name, strings.Join(call.shown, ", ")))
+		delete(t.calls, pid)
+	}
+	delete(t.traced, pid)
+	if status.Signaled() {
+		t.print(pid, fmt.Sprintf("+++ killed by %s +++", signalName(status.Signal())))
+	} else {
+		t.print(pid, fmt.Sprintf("+++ exited with %d +++", status.ExitStatus()))
+	}
+}
+
+// print writes a line of the trace of pid.
+func (t *tracer) print(pid int, line string) {
+	fmt.Fprintf(os.Stderr, "[%d] %s\n", pid, line)
+}
+
+// registers reads the general purpose registers of the stopped tracee pid. PTRACE_GETREGSET
+// works the same on every architecture, unlike PTRACE_GETREGS and the fields of PtraceRegs.
+func (t *tracer) registers(pid int) ([]uint64, error) {
+	regs := make([]uint64, traceRegisters[runtime.GOARCH].count)
+	iov := syscall.Iovec{Base: (*byte)(unsafe.Pointer(&regs[0]))}
+	iov.SetLen(len(regs) * 8)
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETREGSET, uintptr(pid), ntPrstatus, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return regs, nil
+}
+
+// formatArgs prints the arguments of call. On entry result is nil and the buffers the call fills
+// are left empty, on exit they are read and the rest is what was shown on entry.
+func (t *tracer) formatArgs(pid int, call *tracedCall, result *int64) []string {
+	signature, known := traceSignatures[call.name]
+	if !known {
+		signature = "xxx"
+	}
+	shown := make([]string, len(signature))
+	for i, kind := range signature {
+		if result != nil && kind != 'r' && kind != 'S' {
+			shown[i] = call.shown[i]
+			continue
+		}
+		arg := call.args[i]
+		switch kind {
+		case 'd':
+			// An int is the lower half of the register
+			shown[i] = strconv.Itoa(int(int32(arg)))
+		case 'u':
+			shown[i] = strconv.FormatUint(arg, 10)
+		case 'l':
+			shown[i] = strconv.FormatInt(int64(arg), 10)
+		case 'f':
+			if int32(arg) == -100 {
+				shown[i] = "AT_FDCWD"
+			} else {
+				shown[i] = strconv.Itoa(int(int32(arg)))
+			}
+		case 'x':
+			shown[i] = "0"
+			if arg != 0 {
+				shown[i] = fmt.Sprintf("%#x", arg)
+			}
+		case 'o':
+			shown[i] = fmt.Sprintf("%#o", arg)
+		case 'p':
+			shown[i] = formatPointer(arg)
+		case 's':
+			shown[i] = t.readString(pid, arg)
+		case 'b':
+			if i+1 < len(call.args) {
+				shown[i] = t.readBuffer(pid, arg, int64(call.args[i+1]))
+			}
+		case 'r', 'S':
+			if result == nil {
+				continue
+			}
+			switch {
+			case *result < 0:
+				shown[i] = formatPointer(arg)
+			case kind == 'S':
+				shown[i] = t.readString(pid, arg)
+			default:
+				shown[i] = t.readBuffer(pid, arg, *result)
+			}
+		case 'v':
+			shown[i] = t.readArgv(pid, arg)
+		}
+	}
+	return shown
+}
+
+// formatPointer prints an address like strace
+func formatPointer(addr uint64) string {
+	if addr == 0 {
+		return "NULL"
+	}
+	return fmt.Sprintf("%#x", addr)
+}
+
+// formatResult prints what a call returned: -1 and the error for -4095 to -1, like the C
+// library turns it into errno.
+func formatResult(name string, result int64) string {
+	if result < 0 && result > -4096 {
+		errno := syscall.Errno(-result)
+		if known, ok := traceErrnos[errno]; ok {
+			return fmt.Sprintf("-1 %s (%s)", known, errno.Error())
+		}
+		return fmt.Sprintf("-1 errno %d (%s)", -result, errno.Error())
+	}
+	if tracePointerResults[name] {
+		return formatPointer(uint64(result))
+	}
+	return strconv.FormatInt(result, 10)
+}
+
+// peek reads up to len(buf) bytes at addr from the memory of tracee pid, and returns how many it
+// got: the end of a mapping stops it.
+func (t *tracer) peek(pid int, addr uint64, buf []byte) int {
+	n, _ := syscall.PtracePeekData(pid, uintptr(addr), buf)
+	return n
+}
+
+// readString reads the C string at addr, quoted and at most traceStringLimit bytes of it.
+func (t *tracer) readString(pid int, addr uint64) string {
+	if addr == 0 {
+		return "NULL"
+	}
+	var s []byte
+	buf := make([]byte, 8)
+	for len(s) <= traceStringLimit {
+		n := t.peek(pid, addr+uint64(len(s)), buf)
+		if n == 0 {
+			break
+		}
+		if end := strings.IndexByte(string(buf[:n]), 0); end >= 0 {
+			return strconv.Quote(string(append(s, buf[:end]...)))
+		}
+		s = append(s, buf[:n]...)
+	}
+	if len(s) == 0 {
+		return formatPointer(addr)
+	}
+	return strconv.Quote(string(s[:min(len(s), traceStringLimit)])) + "..."
+}
+
+// readBuffer reads the n bytes at addr, quoted and at most traceStringLimit of them.
+func (t *tracer) readBuffer(pid int, addr uint64, n int64) string {
+	if n <= 0 {
+		return `""`
+	}
+	buf := make([]byte, min(n, traceStringLimit))
+	got := t.peek(pid, addr, buf)
+	if got == 0 {
+		return formatPointer(addr)
+	}
+	shown := strconv.Quote(string(buf[:got]))
+	if int64(got) < n {
+		shown += "..."
+	}
+	return shown
+}
+
+// readArgv reads the NULL-terminated array of strings at addr, at most traceArgvLimit of them.
+func (t *tracer) readArgv(pid int, addr uint64) string {
+	if addr == 0 {
+		return "NULL"
+	}
+	var entries []string
+	word := make([]byte, 8)
+	for i := 0; ; i++ {
+		if i == traceArgvLimit {
+			entries = append(entries, "...")
+			break
+		}
+		if t.peek(pid, addr+uint64(i)*8, word) < 8 {
+			break
+		}
+		pointer := *(*uint64)(unsafe.Pointer(&word[0]))
+		if pointer == 0 {
+			break
+		}
+		entries = append(entries, t.readString(pid, pointer))
+	}
+	return "[" + strings.Join(entries, ", ") + "]"
+}
+
+// signalName is SIGTERM for 15, and the number for signals without a name
+func signalName(sig syscall.Signal) string {
+	if int(sig) > 0 && int(sig) < len(signalNames) {
+		return "SIG" + signalNames[sig]
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
@@ -0,0 +1,207 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// consoleSocketFd is where the child finds its end of the console socket (0-2 are stdio, 3 is
+// the config pipe). It only exists with -t.
+const consoleSocketFd = 4
+
+// A pseudo terminal (PTY) is a pair of file descriptors. The *slave* side behaves like a real
+// terminal: the shell reads and writes it, and the kernel's terminal layer handles line editing,
+// echo and Ctrl-C (turning it into SIGINT for the foreground process). The *master* side is what a
+// terminal emulator, sshd or `docker run -t` holds: bytes written to it are "typed", bytes read
+// from it are what the program printed.
+//
+// Like runc, the child creates the PTY from the container's own /dev/ptmx, so the slave is
+// /dev/pts/0 *inside* the container, and hands the master to the parent over a unix socket. That
+// is the "console socket" of the OCI runtime spec.
+
+// newConsoleSocket creates the socket pair the child sends the PTY master over.
+func newConsoleSocket() (parentEnd, childEnd *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create console socket: %w", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "console-socket"), os.NewFile(uintptr(fds[1]), "console-socket"), nil
+}
+
+// setupConsole runs in the child after pivot_root. It creates a PTY, sends the master to the
+// parent and returns the slave, which becomes stdin, stdout, stderr and the controlling terminal
+// of the containerized process.
+func setupConsole() (*os.File, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer master.Close()
+
+	// File descriptors can be passed between processes as SCM_RIGHTS ancillary data on a unix
+	// socket; the receiver gets a new descriptor for the same open file
+	socket := os.NewFile(consoleSocketFd, "console-socket")
+	defer socket.Close()
+	rights := syscall.UnixRights(int(master.Fd()))
+	if err := syscall.Sendmsg(int(socket.Fd()), []byte{0}, rights, nil, 0); err != nil {
+		slave.Close()
+		return nil, fmt.Errorf("send pty to parent: %w", err)
+	}
+	return slave, nil
+}
+
+// openPTY creates a new PTY from /dev/ptmx, the one of the calling thread's mount namespace.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /dev/ptmx: %w", err)
+	}
+
+	// unlockpt() and ptsname() from libc: a new slave starts locked, and its number tells us
+	// which /dev/pts entry it is
+	unlock := int32(0)
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlock pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("get pty number: %w", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// receiveConsole is the parent side of setupConsole.
+func receiveConsole(socket *os.File) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(socket.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receive pty: %w", err)
+	}
+	if oobn == 0 {
+		// The child exited (and closed the socket) before it got that far
+		return nil, errors.New("container exited before creating its terminal")
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, fmt.Errorf("receive pty: bad control message: %v", err)
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("receive pty: %v", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "pty-master"), nil
+}
+
+// proxyConsole copies our stdin to the PTY and its output to our stdout. The returned channel is
+// closed once all output has been copied: reading the master fails with EIO when the last
+// process in the container closed the slave.
+func proxyConsole(master *os.File) <-chan struct{} {
+	go io.Copy(master, os.Stdin)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(os.Stdout, master)
+	}()
+	return done
+}
+
+// isTerminal tells whether f is a terminal: a terminal answers TCGETS, other files don't.
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// makeRaw puts our terminal into raw mode, cfmakeraw() from libc, and returns a function that
+// restores the old settings. It fails when f isn't a terminal.
+//
+// A terminal normally works in "cooked" mode: it collects a line until Enter, echoes what you type
+// and turns Ctrl-C into SIGINT for *our* process. With -t the container has a terminal of its own
+// that does all of that, so ours has to step aside and pass every key through unchanged.
+// Otherwise everything is echoed twice, vim only sees keystrokes after Enter, and Ctrl-C kills
+// the demo instead of the program in the container.
+func makeRaw(f *os.File) (restore func(), err error) {
+	var old syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	// read() returns as soon as one byte is there
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&old))) }, nil
+}
+
+// forwardWindowSize keeps the size of the container's terminal in sync with ours.
+//
+// Full-screen programs like vim and top ask their terminal for its size (TIOCGWINSZ) and redraw
+// on SIGWINCH. The kernel sends us SIGWINCH when our terminal window is resized; we copy the new
+// size to the PTY master with TIOCSWINSZ, and the kernel then sends SIGWINCH to the program in the
+// container. Call the returned function to stop.
+func forwardWindowSize(master *os.File) (stop func()) {
+	resize := func() {
+		var size struct{ rows, cols, xpixel, ypixel uint16 }
+		if ioctl(os.Stdin.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))) == nil {
+			ioctl(master.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+		}
+	}
+	// Start with the right size, a new PTY is 0x0
+	resize()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-winch:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(winch)
+		close(done)
+	}
+}
+
+// terminalWidth returns the number of columns of the terminal f, 80 if it doesn't say.
+func terminalWidth(f *os.File) int {
+	var size struct{ rows, cols, xpixel, ypixel uint16 }
+	if ioctl(f.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))) != nil || size.cols == 0 {
+		return 80
+	}
+	return int(size.cols)
+}
+
+// ioctl is a plain ioctl(2) with a pointer (or integer) argument
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
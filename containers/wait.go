@@ -0,0 +1,94 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// waitContainers implements `wait CONTAINER...`: block until the containers exit and print their
+// exit codes, like `docker wait`.
+func waitContainers(args []string) error {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s wait CONTAINER...\n\nWait until containers stop, then print their exit codes.\n", progName())
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf(fs, "missing CONTAINER")
+	}
+
+	for _, arg := range fs.Args() {
+		s, err := findContainer(arg)
+		if err != nil {
+			return err
+		}
+		// The exit code is final once the monitor has recorded it and exited
+		waitForExit(s.MonitorPid, s.MonitorStartTime)
+		current, err := readState(s.ID)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("container %s ran in the foreground, its exit code wasn't kept", shortID(s.ID))
+		case err != nil:
+			return err
+		case current.Status != statusExited:
+			return fmt.Errorf("the monitor of container %s died, its exit code is unknown", shortID(s.ID))
+		}
+		fmt.Println(current.ExitCode)
+	}
+	return nil
+}
+
+// waitForExit blocks until process pid, which started at startTime, has exited.
+//
+// Only the parent of a process can wait() for it. Since Linux 5.3 anybody else can get a *pidfd*
+// with pidfd_open(): a file descriptor that refers to the process and becomes readable when it
+// exits. Unlike a PID it can't suddenly mean another process. On older kernels we poll.
+func waitForExit(pid int, startTime uint64) {
+	if fd, _, errno := syscall.RawSyscall(sysPidfdOpen, uintptr(pid), 0, 0); errno == 0 {
+		defer syscall.Close(int(fd))
+		// The PID might have been reused before we opened it, check that it is still our process
+		if !processAlive(pid, startTime) {
+			return
+		}
+		if waitReadable(int(fd)) == nil {
+			return
+		}
+	}
+	for processAlive(pid, startTime) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitReadable blocks until fd is readable.
+func waitReadable(fd int) error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return err
+	}
+	events := make([]syscall.EpollEvent, 1)
+	for {
+		n, err := syscall.EpollWait(epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n > 0 {
+			return err
+		}
+	}
+}